@@ -1,15 +1,20 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"net"
 	"net/url"
 	"os"
@@ -17,23 +22,25 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"git.sr.ht/~elektito/gemplex/pkg/config"
+	"git.sr.ht/~elektito/gemplex/pkg/db"
 	"git.sr.ht/~elektito/gemplex/pkg/gcrawler"
 	"git.sr.ht/~elektito/gemplex/pkg/gparse"
+	"git.sr.ht/~elektito/gemplex/pkg/logging"
 	"git.sr.ht/~elektito/gemplex/pkg/utils"
 	"github.com/a-h/gemini"
+	"github.com/lib/pq"
 )
 
 const (
-	permanentErrorRetry          = "1 month"
-	tempErrorMinRetry            = "1 day"
-	revisitTimeIncrementNoChange = "2 days"
-	revisitTimeAfterChange       = "2 days"
-	maxRevisitTime               = "1 month"
-	maxRedirects                 = 5
-	crawlerUserAgent             = "elektito/gemplex"
-	robotsTxtValidity            = "1 day"
+	maxRedirects           = 5
+	spartanDefaultPort     = "300"
+	spartanTimeout         = 30 * time.Second
+	spartanMaxHeaderLength = 1024
 )
 
 type VisitResult struct {
@@ -47,6 +54,10 @@ type VisitResult struct {
 	visitTime   time.Time
 	banned      bool
 
+	// the time it took to fetch the url, including redirects; zero if the
+	// url was not fetched.
+	fetchDuration time.Duration
+
 	// set when this was a host-level visit (like robots.txt) and urls table
 	// should not be updated.
 	isHostVisit bool
@@ -68,25 +79,136 @@ func errGeminiSlowdown(meta string) *GeminiSlowdownError {
 
 var _ error = (*GeminiSlowdownError)(nil)
 
+// returned by readGemini when a successful response has a content type we do
+// not process. the body is not downloaded in this case.
+type NonTextContentError struct {
+	ContentType string
+}
+
+func (e *NonTextContentError) Error() string {
+	return fmt.Sprintf("Non-text doc: %s", e.ContentType)
+}
+
+var _ error = (*NonTextContentError)(nil)
+
+// returned by readGemini when a host presents a certificate different from
+// the one pinned for it (only if Crawl.TofuPin is set).
+type CertMismatchError struct {
+	Host        string
+	Pinned      string
+	Fingerprint string
+}
+
+func (e *CertMismatchError) Error() string {
+	return fmt.Sprintf(
+		"Certificate mismatch for %s: pinned=%s got=%s (use \"gpctl repin\" to accept the new certificate)",
+		e.Host, e.Pinned, e.Fingerprint)
+}
+
+var _ error = (*CertMismatchError)(nil)
+
 var ErrRobotsBackoff = fmt.Errorf("Backing off from fetching robots.txt")
 
+// return a context for a single gemini request, bounded by the configured
+// request timeout (if any).
+func withRequestTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if Config.Crawl.RequestTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, time.Duration(Config.Crawl.RequestTimeout)*time.Second)
+}
+
+// stores the certificates pinned for each host, if Crawl.TofuPin is set.
+type certPinStore interface {
+	// return the fingerprint pinned for the given host, or an empty string
+	// if there's none.
+	Get(host string) (fingerprint string, err error)
+
+	// pin the given fingerprint for the host, unless it's already pinned.
+	Set(host string, fingerprint string) error
+}
+
+// certificates pinned in the hosts table
+type dbCertPins struct{}
+
+func (dbCertPins) Get(host string) (fingerprint string, err error) {
+	var pin sql.NullString
+	err = Db.QueryRow(`select cert_pin from hosts where hostname = $1`, host).Scan(&pin)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+
+	fingerprint = pin.String
+	return
+}
+
+func (dbCertPins) Set(host string, fingerprint string) (err error) {
+	_, err = Db.Exec(
+		`insert into hosts (hostname, cert_pin) values ($1, $2)
+         on conflict (hostname) do update set cert_pin = $2
+         where hosts.cert_pin is null`,
+		host, fingerprint)
+	return
+}
+
+var certPins certPinStore = dbCertPins{}
+
+// return the fingerprint of a certificate as reported by the gemini client.
+// the client actually reports (a base64 encoding of) the whole certificate, so
+// we hash it again to get something short enough to store and display.
+func certFingerprint(cert string) string {
+	sum := sha256.Sum256([]byte(cert))
+	return hex.EncodeToString(sum[:])
+}
+
+// check the given certificate (as reported by the gemini client) against the
+// one pinned for the host, pinning it if there's none yet.
+func checkCertPin(host string, cert string) (err error) {
+	host = strings.ToLower(host)
+	fingerprint := certFingerprint(cert)
+
+	pinned, err := certPins.Get(host)
+	if err != nil {
+		return
+	}
+
+	if pinned == "" {
+		return certPins.Set(host, fingerprint)
+	}
+
+	if pinned != fingerprint {
+		err = &CertMismatchError{
+			Host:        host,
+			Pinned:      pinned,
+			Fingerprint: fingerprint,
+		}
+	}
+
+	return
+}
+
 func readGemini(ctx context.Context, client *gemini.Client, u *url.URL, visitorId string) (body []byte, code int, meta string, finalUrl *url.URL, err error) {
 	redirs := 0
 	finalUrl = u
 redirect:
-	resp, certs, auth, ok, err := client.RequestURL(ctx, u)
+	// the body is read while the request context is still alive; the
+	// deferred cancels all run after that.
+	reqCtx, cancel := withRequestTimeout(ctx)
+	defer cancel()
+
+	resp, certs, auth, ok, err := client.RequestURL(reqCtx, u)
 	if err != nil {
-		log.Printf(
-			"[crawl][%s] Request error for %s: ok=%t auth=%t certs=%d err=%s\n",
+		logging.Debugf(
+			"[crawl][%s] Request error for %s: ok=%t auth=%t certs=%d err=%s",
 			visitorId, u, ok, auth, len(certs), err)
 		return
 	}
 
 	if ok {
-		body, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return
-		}
+		// we'll be making the request again below, so there's no point in
+		// downloading the body here (which could well be a large binary file).
+		resp.Body.Close()
 	}
 
 	if len(certs) == 0 {
@@ -94,13 +216,20 @@ redirect:
 		return
 	}
 
+	if Config.Crawl.TofuPin {
+		err = checkCertPin(u.Host, certs[0])
+		if err != nil {
+			return
+		}
+	}
+
 	// Add certificate (trust on first use) and retry
 	client.AddServerCertificate(u.Host, certs[0])
 
-	resp, certs, auth, ok, err = client.RequestURL(ctx, u)
+	resp, certs, auth, ok, err = client.RequestURL(reqCtx, u)
 	if err != nil {
-		log.Printf(
-			"[crawl][%s] Request error for %s: ok=%t auth=%t certs=%d err=%s\n",
+		logging.Debugf(
+			"[crawl][%s] Request error for %s: ok=%t auth=%t certs=%d err=%s",
 			visitorId, u, ok, auth, len(certs), err)
 		return
 	}
@@ -113,9 +242,14 @@ redirect:
 			return
 		}
 
+		// this includes 21 (success, end of client certificate session) from
+		// older versions of the spec, which carries a body just like 20.
 		if code/10 == 2 { // SUCCESS response
-			if !strings.HasPrefix(resp.Header.Meta, "text/") {
-				err = fmt.Errorf("Non-text doc: %s", resp.Header.Meta)
+			// the content type is sent before the body, so we can avoid
+			// downloading content we're not going to use at all.
+			if !isAcceptedContentType(resp.Header.Meta) {
+				resp.Body.Close()
+				err = &NonTextContentError{ContentType: resp.Header.Meta}
 				return
 			}
 
@@ -139,8 +273,8 @@ redirect:
 				err = fmt.Errorf("Too many redirects")
 				return
 			}
-			log.Printf(
-				"[crawl][%s] Redirecting to: %s (from %s)\n",
+			logging.Debugf(
+				"[crawl][%s] Redirecting to: %s (from %s)",
 				visitorId, target.String(), u.String())
 			u = target
 			finalUrl, err = gparse.NormalizeUrl(target)
@@ -157,6 +291,148 @@ redirect:
 	return
 }
 
+// readSpartan fetches the given spartan url. Spartan status codes are mapped
+// to their gemini equivalents (2 => 20, 3 => 30, 4 => 59, 5 => 40), so the
+// results can be processed the same as gemini responses.
+func readSpartan(ctx context.Context, u *url.URL, visitorId string) (body []byte, code int, meta string, finalUrl *url.URL, err error) {
+	redirs := 0
+	finalUrl = u
+redirect:
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), spartanDefaultPort)
+	}
+
+	dialer := net.Dialer{Timeout: spartanTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		logging.Debugf("[crawl][%s] Request error for %s: err=%s", visitorId, u, err)
+		return
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(spartanTimeout))
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		// spartan sends input as the request body rather than the query
+		// string, which means we can't follow these links meaningfully.
+		err = fmt.Errorf("Spartan url with query string")
+		return
+	}
+
+	_, err = fmt.Fprintf(conn, "%s %s 0\r\n", u.Hostname(), path)
+	if err != nil {
+		return
+	}
+
+	reader := bufio.NewReader(io.LimitReader(conn, spartanMaxHeaderLength))
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		err = fmt.Errorf("Error reading spartan response header: %w", err)
+		return
+	}
+
+	header = strings.TrimRight(header, "\r\n")
+	status, meta, _ := strings.Cut(header, " ")
+	switch status {
+	case "2":
+		code = 20
+	case "3":
+		code = 30
+	case "4":
+		code = 59
+	case "5":
+		code = 40
+	default:
+		err = fmt.Errorf("Invalid response code: %s", status)
+		return
+	}
+
+	if code == 20 {
+		if !isAcceptedContentType(meta) {
+			err = &NonTextContentError{ContentType: meta}
+			return
+		}
+
+		// whatever was buffered after the header is part of the body
+		buffered, _ := reader.Peek(reader.Buffered())
+		var rest []byte
+		rest, err = ioutil.ReadAll(conn)
+		if err != nil {
+			return
+		}
+		body = append(buffered, rest...)
+		return
+	}
+
+	if code == 30 {
+		// spartan redirects are always to a path on the same host
+		var target *url.URL
+		target, err = url.Parse(meta)
+		if err != nil {
+			err = fmt.Errorf("Invalid redirect url '%s': %w", meta, err)
+			return
+		}
+		target = u.ResolveReference(target)
+
+		redirs++
+		if redirs == maxRedirects {
+			err = fmt.Errorf("Too many redirects")
+			return
+		}
+		logging.Debugf(
+			"[crawl][%s] Redirecting to: %s (from %s)",
+			visitorId, target.String(), u.String())
+		conn.Close()
+		u = target
+		finalUrl, err = gparse.NormalizeUrl(target)
+		if err != nil {
+			finalUrl = u
+		}
+		goto redirect
+	}
+
+	return
+}
+
+// readPage fetches the given url using the protocol matching its scheme.
+func readPage(ctx context.Context, client *gemini.Client, u *url.URL, visitorId string) (body []byte, code int, meta string, finalUrl *url.URL, err error) {
+	switch u.Scheme {
+	case "gemini":
+		return readGemini(ctx, client, u, visitorId)
+	case "spartan":
+		if !Config.Crawl.EnableSpartan {
+			err = fmt.Errorf("Spartan crawling is not enabled")
+			return
+		}
+		return readSpartan(ctx, u, visitorId)
+	default:
+		err = fmt.Errorf("Unsupported url scheme: %s", u.Scheme)
+		return
+	}
+}
+
+// return true if the crawler is configured to fetch urls with the given
+// scheme.
+func isCrawlableScheme(scheme string) bool {
+	switch scheme {
+	case "gemini":
+		return true
+	case "spartan":
+		return Config.Crawl.EnableSpartan
+	default:
+		return false
+	}
+}
+
+func isAcceptedContentType(meta string) bool {
+	return strings.HasPrefix(meta, "text/")
+}
+
 func visitor(visitorId string, urls <-chan gcrawler.PreparedUrl, results chan<- VisitResult, done <-chan bool) {
 	client := gemini.NewClient()
 	ctx, cancelFunc := context.WithCancel(context.Background())
@@ -167,72 +443,101 @@ func visitor(visitorId string, urls <-chan gcrawler.PreparedUrl, results chan<-
 	}()
 
 	for u := range urls {
-		log.Printf("[crawl][%s] Processing: %s\n", visitorId, u)
+		logging.Debugf("[crawl][%s] Processing: %s", visitorId, u)
 
-		body, code, meta, finalUrl, err := readGemini(ctx, client, u.Parsed, visitorId)
+		fetchStart := time.Now()
+		body, code, meta, finalUrl, err := readPage(ctx, client, u.Parsed, visitorId)
+		fetchDuration := time.Since(fetchStart)
 		if errors.Is(err, context.Canceled) {
 			break
 		}
-		if err != nil {
-			log.Printf("[crawl][%s] Error: %s url=%s\n", visitorId, err, u)
-			results <- VisitResult{
-				url:         u,
-				error:       err,
-				statusCode:  -1,
-				meta:        meta,
-				page:        gparse.Page{},
-				contents:    []byte{},
-				contentType: "",
-				visitTime:   time.Time{},
-				banned:      false,
-				isHostVisit: false,
-			}
-			continue
+		results <- makeVisitResult(u, body, code, meta, finalUrl, err, fetchDuration, visitorId)
+
+		time.Sleep(1 * time.Second)
+	}
+
+	log.Printf("[crawl][%s] Exited.\n", visitorId)
+}
+
+// build the result of visiting the given url from the outcome of fetching it.
+// every fetch attempt produces exactly one result (success, error or a
+// non-success status code like a redirect), so that the flusher always updates
+// the url, and it won't be re-crawled over and over.
+func makeVisitResult(u gcrawler.PreparedUrl, body []byte, code int, meta string, finalUrl *url.URL, err error, fetchDuration time.Duration, visitorId string) (r VisitResult) {
+	var nonTextErr *NonTextContentError
+	if errors.As(err, &nonTextErr) {
+		logging.Debugf("[crawl][%s] Skipped non-text content (%s): %s", visitorId, nonTextErr.ContentType, u)
+		r = VisitResult{
+			url:           u,
+			error:         err,
+			statusCode:    code,
+			meta:          meta,
+			visitTime:     time.Now(),
+			fetchDuration: fetchDuration,
 		}
+		return
+	}
+	if err != nil {
+		logging.Debugf("[crawl][%s] Error: %s url=%s", visitorId, err, u)
+		r = VisitResult{
+			url:           u,
+			error:         err,
+			statusCode:    -1,
+			meta:          meta,
+			page:          gparse.Page{},
+			contents:      []byte{},
+			contentType:   "",
+			visitTime:     time.Time{},
+			fetchDuration: fetchDuration,
+			banned:        false,
+			isHostVisit:   false,
+		}
+		return
+	}
 
-		if code/10 == 2 { // SUCCESS
-			contentType := meta
-			page, err := gparse.ParsePage(body, finalUrl, contentType)
-			if err != nil {
-				log.Printf("[crawl][%s]Error parsing page: %s\n", visitorId, err)
-				results <- VisitResult{
-					url:         u,
-					statusCode:  code,
-					meta:        meta,
-					contentType: contentType,
-					visitTime:   time.Now(),
-					error:       err,
-				}
-			} else {
-				results <- VisitResult{
-					url:         u,
-					statusCode:  code,
-					meta:        meta,
-					page:        page,
-					contents:    body,
-					contentType: contentType,
-					visitTime:   time.Now(),
-				}
+	if code/10 == 2 { // SUCCESS
+		contentType := meta
+		page, err := gparse.ParsePage(body, finalUrl, contentType)
+		if err != nil {
+			logging.Warnf("[crawl][%s]Error parsing page: %s", visitorId, err)
+			r = VisitResult{
+				url:           u,
+				statusCode:    code,
+				meta:          meta,
+				contentType:   contentType,
+				visitTime:     time.Now(),
+				fetchDuration: fetchDuration,
+				error:         err,
 			}
 		} else {
-			results <- VisitResult{
-				url:         u,
-				error:       fmt.Errorf("STATUS: %d META: %s", code, meta),
-				statusCode:  code,
-				meta:        meta,
-				page:        gparse.Page{},
-				contents:    []byte{},
-				contentType: "",
-				visitTime:   time.Time{},
-				banned:      false,
-				isHostVisit: false,
+			r = VisitResult{
+				url:           u,
+				statusCode:    code,
+				meta:          meta,
+				page:          page,
+				contents:      body,
+				contentType:   contentType,
+				visitTime:     time.Now(),
+				fetchDuration: fetchDuration,
 			}
 		}
-
-		time.Sleep(1 * time.Second)
+	} else {
+		r = VisitResult{
+			url:           u,
+			error:         fmt.Errorf("STATUS: %d META: %s", code, meta),
+			statusCode:    code,
+			meta:          meta,
+			page:          gparse.Page{},
+			contents:      []byte{},
+			contentType:   "",
+			visitTime:     time.Time{},
+			fetchDuration: fetchDuration,
+			banned:        false,
+			isHostVisit:   false,
+		}
 	}
 
-	log.Printf("[crawl][%s] Exited.\n", visitorId)
+	return
 }
 
 func parseContentType(ct string) (contentType string, args string) {
@@ -259,15 +564,167 @@ where url = $2
 	utils.PanicOnErr(err)
 }
 
-func updateDbSuccessfulVisit(r VisitResult) {
-	tx, err := Db.Begin()
+// the text of all the given headings, one per line, for storing in the
+// database.
+func headingsText(headings []gparse.Heading) string {
+	texts := make([]string, len(headings))
+	for i, h := range headings {
+		texts[i] = h.Text
+	}
+	return strings.Join(texts, "\n")
+}
+
+// return the depth of urls linked from a page with the given depth. pages with
+// unknown depth (crawled before we started tracking depths) produce links with
+// unknown depth too.
+func childDepth(parentDepth sql.NullInt64) (depth sql.NullInt64) {
+	if !parentDepth.Valid {
+		return
+	}
+
+	depth.Int64 = parentDepth.Int64 + 1
+	depth.Valid = true
+	return
+}
+
+// the number of urls rejected for exceeding url limits so far. only a sample
+// of rejections are logged, since trap capsules can produce many of them.
+var urlLimitRejections atomic.Int64
+
+const urlLimitLogInterval = 1000
+
+// return true if the url exceeds the configured url limits, logging a sample of
+// rejections.
+func exceedsUrlLimits(u gcrawler.PreparedUrl) bool {
+	err := gcrawler.CheckUrlLimits(u)
+	if err == nil {
+		return false
+	}
+
+	n := urlLimitRejections.Add(1)
+	if n%urlLimitLogInterval == 1 {
+		logging.Infof("[crawl] Rejected %d urls exceeding url limits so far; latest: %s (%s)", n, u, err)
+	}
+
+	return true
+}
+
+// remove blacklisted (and unparsable) links from the given list, so that they
+// never make it to the database.
+func filterBlacklistedLinks(links []gparse.Link) (result []gparse.Link) {
+	for _, link := range links {
+		u, err := gcrawler.NewPreparedUrl(link.Url)
+		if err != nil || gcrawler.IsBlacklisted(u) || exceedsUrlLimits(u) || gcrawler.IsSkippedQueryUrl(u) || gcrawler.IsDisallowedPort(u) {
+			continue
+		}
+
+		result = append(result, link)
+	}
+
+	return
+}
+
+// return a hash of the set of urls in the given links, regardless of their
+// order and link texts.
+func calcLinkSetHash(links []gparse.Link) string {
+	urls := make([]string, 0, len(links))
+	for _, link := range links {
+		urls = append(urls, link.Url)
+	}
+	sort.Strings(urls)
+	return calcContentHash([]byte(strings.Join(urls, "\n")))
+}
+
+// a url is volatile if its contents have changed on each of the last n visits,
+// while its set of links has changed at most maxLinkChanges times. these are
+// pages like feeds that wrap around, or show a different random selection each
+// time, which we'd otherwise keep re-crawling and re-indexing forever. the
+// given hashes are ordered from oldest to newest.
+func isVolatile(contentHashes []string, linkHashes []string, n int, maxLinkChanges int) bool {
+	if n < 2 || len(contentHashes) < n || len(linkHashes) < n {
+		return false
+	}
+
+	contentHashes = contentHashes[len(contentHashes)-n:]
+	linkHashes = linkHashes[len(linkHashes)-n:]
+
+	linkChanges := 0
+	for i := 1; i < n; i++ {
+		if contentHashes[i] == contentHashes[i-1] {
+			return false
+		}
+		if linkHashes[i] != linkHashes[i-1] {
+			linkChanges++
+		}
+	}
+
+	return linkChanges <= maxLinkChanges
+}
+
+// the change rate assumed for urls we haven't seen change (or not change) yet.
+const initialChangeRate = 0.5
+
+// the revisit intervals of urls, as configured.
+type revisitSchedule struct {
+	increment   time.Duration
+	afterChange time.Duration
+	max         time.Duration
+
+	// how quickly the change rate of a url follows its latest visits
+	smoothing float64
+}
+
+func revisitScheduleFromConfig() (s revisitSchedule) {
+	var err error
+
+	// these are already validated when loading the config
+	s.increment, err = config.ParseInterval(Config.Crawl.Retry.RevisitIncrement)
 	utils.PanicOnErr(err)
-	defer tx.Rollback()
+	s.afterChange, err = config.ParseInterval(Config.Crawl.Retry.RevisitAfterChange)
+	utils.PanicOnErr(err)
+	s.max, err = config.ParseInterval(Config.Crawl.Retry.MaxRevisit)
+	utils.PanicOnErr(err)
+
+	s.smoothing = Config.Crawl.Retry.ChangeRateSmoothing
+	return
+}
+
+// return the revisit interval of a url after a visit, given its previous
+// interval and change rate, and whether its contents changed since the last
+// visit. the change rate (an exponentially smoothed average of changes per
+// visit) is updated and returned too. the interval is reset after a change,
+// and grows after each visit without one; both are scaled up (to 2x) for urls
+// that rarely change, and down (to 0.5x) for those that often do.
+func nextRevisit(s revisitSchedule, prev time.Duration, changeRate float64, changed bool) (next time.Duration, newChangeRate float64) {
+	smoothing := math.Max(0, math.Min(1, s.smoothing))
+
+	observed := 0.0
+	if changed {
+		observed = 1.0
+	}
+	newChangeRate = changeRate + smoothing*(observed-changeRate)
+
+	// 2x for a change rate of 0, 1x for 0.5, and 0.5x for 1
+	scale := math.Pow(2, 1-2*newChangeRate)
+
+	if changed || prev <= 0 {
+		next = time.Duration(float64(s.afterChange) * scale)
+	} else {
+		next = prev + time.Duration(float64(s.increment)*scale)
+	}
+
+	if next > s.max {
+		next = s.max
+	}
+
+	return
+}
 
+// insert the contents (and images) of a successful visit into the database,
+// unless they're already there, and return the content id.
+func insertContents(tx *sql.Tx, r VisitResult, contentHash string) (contentId int64) {
 	ct, ctArgs := parseContentType(r.contentType)
-	contentHash := calcContentHash(r.contents)
 
-	var contentId int64
 	var lang sql.NullString
 	if r.page.Lang != "" {
 		lang.String = r.page.Lang
@@ -282,18 +739,18 @@ func updateDbSuccessfulVisit(r VisitResult) {
 
 	// insert contents with a dummy update on conflict so that we can
 	// get the id even in case of already existing data.
-	err = tx.QueryRow(
+	err := tx.QueryRow(
 		`insert into contents
-			    (hash, content, content_text, lang, kind, content_type, content_type_args, title, fetch_time)
-                values ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			    (hash, content, content_text, lang, kind, content_type, content_type_args, title, headings, code_langs, fetch_time, summary, script)
+                values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, nullif($12, ''), nullif($13, ''))
                 on conflict (hash)
                 do update set hash = excluded.hash
                 returning id
                 `,
-		contentHash, r.contents, r.page.Text, r.page.Lang, kind, ct, ctArgs, r.page.Title, r.visitTime,
+		contentHash, r.contents, r.page.Text, r.page.Lang, kind, ct, ctArgs, r.page.Title, headingsText(r.page.Headings), pq.Array(r.page.CodeLangs), r.visitTime, r.page.Summary, r.page.Script,
 	).Scan(&contentId)
 	if err != nil {
-		log.Println("[crawl] Database error when inserting contents for url:", r.url.String())
+		logging.Errorf("[crawl] Database error when inserting contents for url: %s", r.url.String())
 		panic(err)
 	}
 
@@ -308,48 +765,168 @@ do nothing
 		utils.PanicOnErr(err)
 	}
 
+	return
+}
+
+// return true if the contents fetched in a visit (with the given hash) are the
+// same as the ones already stored for the url.
+func isUnchangedContent(prevContentHash sql.NullString, contentHash string) bool {
+	return prevContentHash.Valid && prevContentHash.String == contentHash
+}
+
+func updateDbSuccessfulVisit(r VisitResult) {
+	tx, err := Db.Begin()
+	utils.PanicOnErr(err)
+	defer tx.Rollback()
+
+	contentHash := calcContentHash(r.contents)
+
+	var prevContentId sql.NullInt64
+	var prevContentHash sql.NullString
+	var prevRetrySeconds sql.NullFloat64
+	var prevChangeRate sql.NullFloat64
+	err = tx.QueryRow(
+		`select u.content_id, c.hash, extract(epoch from u.retry_time), u.change_rate
+                 from urls u
+                 left join contents c on c.id = u.content_id
+                 where u.url = $1
+                 for update of u`,
+		r.url.String(),
+	).Scan(&prevContentId, &prevContentHash, &prevRetrySeconds, &prevChangeRate)
+	if err == sql.ErrNoRows {
+		logging.Warnf("[crawl] URL not in the database, even though it should be; this is a bug! (%s)", r.url.String())
+		return
+	}
+	if err != nil {
+		logging.Errorf("[crawl] Database error when reading url info: %s", r.url.String())
+		panic(err)
+	}
+
+	// if the contents haven't changed, everything we'd get from them (text,
+	// images, links) is already stored.
+	unchanged := isUnchangedContent(prevContentHash, contentHash)
+
+	var contentId int64
+	if unchanged {
+		contentId = prevContentId.Int64
+	} else {
+		contentId = insertContents(tx, r, contentHash)
+	}
+
+	links := filterBlacklistedLinks(r.page.Links)
+	historySize := Config.Crawl.VolatileVisits
+	if historySize < 0 {
+		historySize = 0
+	}
+
+	changeRate := initialChangeRate
+	if prevChangeRate.Valid {
+		changeRate = prevChangeRate.Float64
+	}
+
+	schedule := revisitScheduleFromConfig()
+	retryTime := schedule.afterChange
+	if prevContentId.Valid {
+		// not the first successful visit, so we know whether the contents
+		// have changed since the last one.
+		prevRetryTime := time.Duration(prevRetrySeconds.Float64 * float64(time.Second))
+		retryTime, changeRate = nextRevisit(schedule, prevRetryTime, changeRate, !unchanged)
+	}
+
 	var urlId int64
+	var depth sql.NullInt64
+	var recentHashes []string
+	var recentLinkHashes []string
 	err = tx.QueryRow(
 		`update urls set
                  last_visited = now(),
+                 content_time = case when content_id is distinct from $1 then now() else content_time end,
                  content_id = $1,
                  error = null,
+                 input_prompt = null,
                  status_code = $2,
-                 retry_time = case when content_id = $1 then least(retry_time + $3, $4) else $5 end
-                 where url = $6
-                 returning id`,
-		contentId, r.statusCode, revisitTimeIncrementNoChange, maxRevisitTime, revisitTimeAfterChange, r.url.String(),
-	).Scan(&urlId)
+                 retry_time = make_interval(secs => $3),
+                 retry_jitter = null,
+                 change_rate = $4,
+                 recent_hashes = (array_append(coalesce(recent_hashes, '{}'), $6::text))
+                     [greatest(coalesce(cardinality(recent_hashes), 0) + 2 - $8, 1):],
+                 recent_link_hashes = (array_append(coalesce(recent_link_hashes, '{}'), $7::text))
+                     [greatest(coalesce(cardinality(recent_link_hashes), 0) + 2 - $8, 1):],
+                 volatile = false,
+                 priority = $9,
+                 last_fetch_ms = coalesce($10, last_fetch_ms)
+                 where url = $5
+                 returning id, depth, recent_hashes, recent_link_hashes`,
+		contentId, r.statusCode, retryTime.Seconds(), changeRate, r.url.String(),
+		contentHash, calcLinkSetHash(links), historySize, db.DefaultPriority, fetchMillis(r),
+	).Scan(&urlId, &depth, pq.Array(&recentHashes), pq.Array(&recentLinkHashes))
 	if err == sql.ErrNoRows {
-		log.Printf("[crawl] WARNING: URL not in the database, even though it should be; this is a bug! (%s)\n", r.url.String())
+		logging.Warnf("[crawl] URL not in the database, even though it should be; this is a bug! (%s)", r.url.String())
 		return
 	}
 	if err != nil {
-		log.Println("[crawl] Database error when updating url info:", r.url.String())
+		logging.Errorf("[crawl] Database error when updating url info: %s", r.url.String())
+		panic(err)
+	}
+
+	if isVolatile(recentHashes, recentLinkHashes, Config.Crawl.VolatileVisits, Config.Crawl.VolatileMaxLinkChanges) {
+		logging.Infof("[crawl] Marking url as volatile: %s", r.url.String())
+		_, err = tx.Exec(
+			`update urls set volatile = true, retry_time = $1 where id = $2`,
+			Config.Crawl.Retry.PermanentError, urlId)
+		utils.PanicOnErr(err)
+	}
+
+	if unchanged {
+		// the links haven't changed either, so we're done.
+		err = tx.Commit()
+		utils.PanicOnErr(err)
+		return
+	}
+
+	// take the existing links of this url out of the host links table, before
+	// removing them. they are added back (along with any new ones) below.
+	_, err = tx.Exec(`
+with old as
+    (select d.hostname dst_host, count(*) n
+     from links l
+     join urls d on d.id = l.dst_url_id
+     where l.src_url_id = $1
+     group by d.hostname)
+update host_links h
+set weight = h.weight - old.n
+from old
+where h.src_host = (select hostname from urls where id = $1) and h.dst_host = old.dst_host
+`, urlId)
+	if err != nil {
+		logging.Errorf("[crawl] Database error when updating host links for url: %s", r.url.String())
 		panic(err)
 	}
 
 	// remove all existing links for this url
 	_, err = tx.Exec(`delete from links where src_url_id = $1`, urlId)
 	if err != nil {
-		log.Println("[crawl] Database error when deleting existing links for url:", r.url.String())
+		logging.Errorf("[crawl] Database error when deleting existing links for url: %s", r.url.String())
 		panic(err)
 	}
 
-	for _, link := range r.page.Links {
+	linkDepth := childDepth(depth)
+	for _, link := range links {
 		u, err := url.Parse(link.Url)
 		if err != nil {
 			continue
 		}
 		var destUrlId int64
 		err = tx.QueryRow(
-			`insert into urls (url, hostname, first_added) values ($1, $2, now())
-                     on conflict (url) do update set url = excluded.url
+			`insert into urls (url, hostname, first_added, depth, priority)
+                     values ($1, $2, now(), $3,
+                             case when exists (select 1 from urls where hostname = $2) then $4 else $5 end)
+                     on conflict (url) do update set url = excluded.url, depth = least(urls.depth, excluded.depth)
                      returning id`,
-			link.Url, u.Host,
+			link.Url, u.Host, linkDepth, db.DefaultPriority, db.NewHostPriority,
 		).Scan(&destUrlId)
 		if err != nil {
-			log.Println("[crawl] DB error inserting link url:", link.Url)
+			logging.Errorf("[crawl] DB error inserting link url: %s", link.Url)
 		}
 		utils.PanicOnErr(err)
 
@@ -360,10 +937,52 @@ do nothing
 		utils.PanicOnErr(err)
 	}
 
+	_, err = tx.Exec(`
+insert into host_links (src_host, dst_host, weight)
+select s.hostname, d.hostname, count(*)
+from links l
+join urls s on s.id = l.src_url_id
+join urls d on d.id = l.dst_url_id
+where l.src_url_id = $1
+group by s.hostname, d.hostname
+on conflict (src_host, dst_host) do update
+set weight = host_links.weight + excluded.weight
+`, urlId)
+	if err != nil {
+		logging.Errorf("[crawl] Database error when updating host links for url: %s", r.url.String())
+		panic(err)
+	}
+
+	_, err = tx.Exec(
+		`delete from host_links where src_host = (select hostname from urls where id = $1) and weight <= 0`,
+		urlId)
+	utils.PanicOnErr(err)
+
 	err = tx.Commit()
 	utils.PanicOnErr(err)
 }
 
+// parse the number of seconds in the meta field of a 44 (slow down) response
+// and clamp it to the [min, max] range. if the meta is not a valid integer,
+// the given default value is used instead.
+func parseSlowdownSeconds(meta string, min int, max int, def int) (seconds int) {
+	seconds, err := strconv.Atoi(strings.TrimSpace(meta))
+	if err != nil {
+		logging.Debugf("[crawl] Invalid slow down meta '%s'; using the default (%d seconds).", meta, def)
+		seconds = def
+	}
+
+	if seconds < min {
+		seconds = min
+	}
+
+	if max > 0 && seconds > max {
+		seconds = max
+	}
+
+	return
+}
+
 func updateDbSlowDownError(r VisitResult) {
 	// if it's not a host-level visit (like robots.txt which is for an entire
 	// host, not just a single url)...
@@ -372,17 +991,20 @@ func updateDbSlowDownError(r VisitResult) {
 		updateDbTempError(r)
 	}
 
-	intervalSeconds, err := strconv.Atoi(r.meta)
-	if err != nil {
-		return
-	}
+	intervalSeconds := parseSlowdownSeconds(
+		r.meta,
+		Config.Crawl.MinSlowdownSeconds,
+		Config.Crawl.MaxSlowdownSeconds,
+		Config.Crawl.DefaultSlowdownSeconds)
+
+	jitteredSeconds := jitterSlowdown(intervalSeconds, Config.Crawl.MaxSlowdownSeconds, Config.Crawl.Retry.Jitter)
 
 	q := `
 update hosts
 set slowdown_until = now() + make_interval(secs => $1)
 where hostname = $2
 `
-	_, err = Db.Exec(q, intervalSeconds, r.url.Parsed.Host)
+	_, err := Db.Exec(q, jitteredSeconds, r.url.Parsed.Host)
 	utils.PanicOnErr(err)
 }
 
@@ -392,26 +1014,154 @@ func updateDbPermanentError(r VisitResult) {
                  last_visited = now(),
                  error = $1,
                  status_code = $2,
-                 retry_time = $3
+                 retry_time = $3,
+                 retry_jitter = null,
+                 priority = $5,
+                 last_fetch_ms = coalesce($6, last_fetch_ms)
                  where url = $4`,
-		r.error.Error(), r.statusCode, permanentErrorRetry, r.url.String())
+		r.error.Error(), r.statusCode, Config.Crawl.Retry.PermanentError, r.url.String(), db.DefaultPriority, fetchMillis(r))
 	utils.PanicOnErr(err)
 }
 
-func updateDbTempError(r VisitResult) {
-	// exponential retry
+// input endpoints (like search boxes) are not content, so we record the prompt
+// and treat them like permanent errors, retrying them a long time later.
+func updateDbInputRequired(r VisitResult) {
 	_, err := Db.Exec(
 		`update urls set
                  last_visited = now(),
                  error = $1,
                  status_code = $2,
-                 retry_time = case when retry_time is null then $3 else least(retry_time * 2, $4) end
+                 retry_time = $3,
+                 retry_jitter = null,
+                 input_prompt = $4,
+                 priority = $6,
+                 last_fetch_ms = coalesce($7, last_fetch_ms)
                  where url = $5`,
-		r.error.Error(), r.statusCode, tempErrorMinRetry, maxRevisitTime, r.url.String())
+		r.error.Error(), r.statusCode, Config.Crawl.Retry.PermanentError, strings.ToValidUTF8(r.meta, ""), r.url.String(), db.DefaultPriority, fetchMillis(r))
+	utils.PanicOnErr(err)
+}
+
+// return a random factor in the (1-jitter, 1] range for scaling retry
+// intervals, so that urls failing at the same time (like during a host outage)
+// don't all come due at the same moment. jitter is clamped to [0, 1].
+func retryJitterFactor(jitter float64) float64 {
+	if jitter <= 0 {
+		return 1
+	}
+	if jitter > 1 {
+		jitter = 1
+	}
+
+	return 1 - rand.Float64()*jitter
+}
+
+// return the given slow down interval, randomly extended by up to the given
+// jitter fraction. the server asked for at least this long, so jitter only
+// ever extends the interval, but never beyond the maximum (if positive).
+func jitterSlowdown(seconds int, max int, jitter float64) float64 {
+	jittered := float64(seconds) * (2 - retryJitterFactor(jitter))
+	if max > 0 && jittered > float64(max) {
+		jittered = float64(max)
+	}
+
+	return jittered
+}
+
+func updateDbTempError(r VisitResult) {
+	// exponential retry. the url comes due a random amount sooner, so that the
+	// interval never exceeds the maximum, but the stored retry time is kept
+	// as is; it's what the next retry interval is based on, and what the
+	// cleaner uses to tell urls that keep failing.
+	_, err := Db.Exec(
+		`update urls set
+                 last_visited = now(),
+                 error = $1,
+                 status_code = $2,
+                 retry_time = case when retry_time is null then $3 else least(retry_time * 2, $4) end,
+                 retry_jitter = $5,
+                 priority = $7,
+                 last_fetch_ms = coalesce($8, last_fetch_ms)
+                 where url = $6`,
+		r.error.Error(), r.statusCode, Config.Crawl.Retry.TempErrorMin, Config.Crawl.Retry.MaxRevisit,
+		retryJitterFactor(Config.Crawl.Retry.Jitter), r.url.String(), db.DefaultPriority, fetchMillis(r))
+	utils.PanicOnErr(err)
+}
+
+// the fetch duration of a visit in milliseconds, for storing in the database
+// along with the rest of the visit result. it's null (keeping the previous
+// value) if the visit did not involve a fetch.
+func fetchMillis(r VisitResult) sql.NullInt64 {
+	if r.fetchDuration <= 0 {
+		return sql.NullInt64{}
+	}
+
+	return sql.NullInt64{Int64: r.fetchDuration.Milliseconds(), Valid: true}
+}
+
+// stores the recent visits of each url, if Crawl.VisitHistorySize is set.
+type visitHistoryStore interface {
+	// append a visit to the history of the given url, and return the url's
+	// id. the id is zero if the url is not in the database.
+	Add(urlStr string, statusCode int, errMsg sql.NullString) (urlId int64, err error)
+
+	// delete all but the latest n visits of the given url.
+	Prune(urlId int64, n int) error
+}
+
+// visit history in the url_visits table
+type dbVisitHistory struct{}
+
+func (dbVisitHistory) Add(urlStr string, statusCode int, errMsg sql.NullString) (urlId int64, err error) {
+	err = Db.QueryRow(
+		`insert into url_visits (url_id, status_code, error)
+                 select id, $1, $2 from urls where url = $3
+                 returning url_id`,
+		statusCode, errMsg, urlStr).Scan(&urlId)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+
+	return
+}
+
+func (dbVisitHistory) Prune(urlId int64, n int) (err error) {
+	// this only looks at the visits of one url, using the (url_id,
+	// visit_time) index.
+	_, err = Db.Exec(
+		`delete from url_visits
+         where ctid in (
+             select ctid from url_visits
+             where url_id = $1
+             order by visit_time desc
+             offset $2)`,
+		urlId, n)
+	return
+}
+
+var visitHistory visitHistoryStore = dbVisitHistory{}
+
+// append the visit to the url's visit history, and trim the history to the
+// latest Config.Crawl.VisitHistorySize visits.
+func recordVisit(r VisitResult) {
+	var errMsg sql.NullString
+	if r.error != nil {
+		errMsg.Valid = true
+		errMsg.String = strings.ToValidUTF8(r.error.Error(), "")
+	}
+
+	urlId, err := visitHistory.Add(r.url.String(), r.statusCode, errMsg)
+	utils.PanicOnErr(err)
+	if urlId == 0 {
+		return
+	}
+
+	err = visitHistory.Prune(urlId, Config.Crawl.VisitHistorySize)
 	utils.PanicOnErr(err)
 }
 
-func flusher(c <-chan VisitResult, done chan bool, wg *sync.WaitGroup) {
+// write visit results to the database. pending is marked done for each result
+// written.
+func flusher(c <-chan VisitResult, done chan bool, wg *sync.WaitGroup, pending *sync.WaitGroup) {
 	defer wg.Done()
 
 loop:
@@ -423,19 +1173,27 @@ loop:
 			// parsing/encoding error after the page was successfully fetched.
 			case r.statusCode/10 == 2 && r.error == nil:
 				updateDbSuccessfulVisit(r)
+			case r.statusCode/10 == 2 && errors.As(r.error, new(*NonTextContentError)):
+				// the content type is unlikely to change, so there's no
+				// point in retrying soon.
+				updateDbPermanentError(r)
 			case r.statusCode == 44: // SLOW DOWN
 				updateDbSlowDownError(r)
-			case r.statusCode/10 == 5: // TEMPORARY ERROR
-				fallthrough
-			case r.statusCode/10 == 1: // REQUIRES INPUT
-				// for our purposes we'll consider requiring input the same as
-				// permanent errors. we'll retry it, but a long time later.
+			case r.statusCode/10 == 5: // PERMANENT ERROR
 				updateDbPermanentError(r)
+			case r.statusCode/10 == 1: // REQUIRES INPUT
+				updateDbInputRequired(r)
 			case r.banned:
 				updateDbBanned(r)
 			default:
 				updateDbTempError(r)
 			}
+
+			if !r.banned && Config.Crawl.VisitHistorySize > 0 {
+				recordVisit(r)
+			}
+
+			pending.Done()
 		case <-done:
 			break loop
 		}
@@ -451,19 +1209,23 @@ func hashString(input string) uint64 {
 }
 
 func isBanned(u gcrawler.PreparedUrl, robotsPrefixes []string) bool {
-	for _, prefix := range robotsPrefixes {
-		if strings.HasPrefix(u.Parsed.Path, prefix) {
-			return true
-		}
-	}
-
-	return false
+	_, banned := gcrawler.RobotsBannedPrefix(u, robotsPrefixes)
+	return banned
 }
 
-func coordinator(nprocs int, visitorInputs []chan gcrawler.PreparedUrl, urlChan <-chan gcrawler.PreparedUrl, done chan bool, wg *sync.WaitGroup) {
+// distribute urls between visitors, so that each host is always visited by
+// the same visitor. pending is marked done for urls that are dropped. if once is
+// set (i.e. the seeder only makes a single pass), urls are never dropped because
+// a visitor is busy, since they wouldn't be sent again.
+func coordinator(nprocs int, visitorInputs []chan gcrawler.PreparedUrl, urlChan <-chan gcrawler.PreparedUrl, done chan bool, wg *sync.WaitGroup, pending *sync.WaitGroup, once bool) {
 	defer wg.Done()
 
-	host2ip := map[string]string{}
+	resolver := newHostResolver(
+		time.Duration(Config.Crawl.HostResolveTTL)*time.Second,
+		time.Duration(Config.Crawl.HostResolveFailureTTL)*time.Second,
+		Config.Crawl.PreferIPv4,
+		Config.Crawl.PreferIPv6,
+	)
 	seen := map[string]bool{}
 
 loop:
@@ -471,31 +1233,33 @@ loop:
 		select {
 		case u := <-urlChan:
 			if _, ok := seen[u.String()]; ok {
+				pending.Done()
 				continue
 			}
 
-			seen[u.String()] = true
-
 			host := u.Parsed.Hostname()
-			ip, ok := host2ip[host]
-			if !ok {
-				ips, err := net.LookupIP(host)
-				if err != nil {
-					log.Printf("[crawl][coord] Error resolving host %s: %s\n", host, err)
-					host2ip[host] = ""
-					continue
-				}
-				if len(ips) == 0 {
-					log.Printf("[crawl][coord] Error resolving host %s: empty response\n", host)
-					host2ip[host] = ""
-					continue
-				}
-				ip = ips[0].String()
-				host2ip[host] = ip
+			ip, err := resolver.Resolve(host)
+			if err != nil {
+				// the url is not marked as seen, so that it's picked up again
+				// once the failure has expired.
+				logging.Debugf("[crawl][coord] Error resolving host %s: %s", host, err)
+				pending.Done()
+				continue
 			}
 
+			seen[u.String()] = true
+
 			n := int(hashString(ip) % uint64(nprocs))
 
+			if once {
+				select {
+				case visitorInputs[n] <- u:
+				case <-done:
+					break loop
+				}
+				continue
+			}
+
 			select {
 			case visitorInputs[n] <- u:
 			case <-done:
@@ -503,6 +1267,7 @@ loop:
 			default:
 				// channel buffer is full. we won't do anything for now. the url
 				// will be picked up again by the seeder later.
+				pending.Done()
 			}
 		case <-done:
 			break loop
@@ -512,15 +1277,41 @@ loop:
 	log.Println("[crawl][coord] Exited.")
 }
 
+// where the seeder gets the urls due for crawling, and the robots.txt rules
+// already known for their hosts.
+type seedStore interface {
+	// send the urls due for crawling to the given channel, and close it.
+	DueUrls(ctx context.Context, c chan<- gcrawler.PreparedUrl)
+
+	// return the robots.txt prefixes stored for the host of the given url;
+	// see getRobotsPrefixesFromDb.
+	RobotsPrefixes(u gcrawler.PreparedUrl) (prefixes []string, validUntil time.Time, err error)
+}
+
+// seed urls and robots.txt rules in the database
+type dbSeedStore struct{}
+
+func (dbSeedStore) DueUrls(ctx context.Context, c chan<- gcrawler.PreparedUrl) {
+	getDueUrls(ctx, c)
+}
+
+func (dbSeedStore) RobotsPrefixes(u gcrawler.PreparedUrl) ([]string, time.Time, error) {
+	return getRobotsPrefixesFromDb(u)
+}
+
+var seeds seedStore = dbSeedStore{}
+
 func getDueUrls(ctx context.Context, c chan<- gcrawler.PreparedUrl) {
 	rows, err := Db.QueryContext(ctx, `
 select url from urls u
 left join hosts h on u.hostname = h.hostname
 where not banned and (h.slowdown_until is null or h.slowdown_until < now()) and
+   ($1 <= 0 or u.depth is null or u.depth <= $1) and
    (last_visited is null or
-    (status_code / 10 = 4 and last_visited + retry_time < now()) or
-    (last_visited is not null and last_visited + retry_time < now()))
-`)
+    (status_code / 10 = 4 and last_visited + retry_time * coalesce(retry_jitter, 1) < now()) or
+    (last_visited is not null and last_visited + retry_time * coalesce(retry_jitter, 1) < now()))
+order by priority desc, last_visited nulls first
+`, Config.Crawl.MaxDepth)
 	utils.PanicOnErr(err)
 	defer rows.Close()
 
@@ -535,7 +1326,7 @@ loop:
 
 		uparsed, err := url.Parse(ustr)
 		if err != nil {
-			log.Println("Read invalid url from db:", ustr)
+			logging.Warnf("Read invalid url from db: %s", ustr)
 			continue
 		}
 
@@ -548,15 +1339,15 @@ loop:
 	close(c)
 }
 
-func fetchRobotsRules(ctx context.Context, u gcrawler.PreparedUrl, client *gemini.Client, visitorId string) (prefixes []string, err error) {
+func fetchRobotsRules(ctx context.Context, u gcrawler.PreparedUrl, client *gemini.Client, visitorId string) (prefixes []string, sitemap string, err error) {
 	prefixes = make([]string, 0)
 
-	robotsUrl, err := url.Parse("gemini://" + u.Parsed.Host + "/robots.txt")
+	robotsUrl, err := url.Parse(u.Parsed.Scheme + "://" + u.Parsed.Host + "/robots.txt")
 	if err != nil {
 		return
 	}
 
-	body, code, meta, finalUrl, err := readGemini(ctx, client, robotsUrl, visitorId)
+	body, code, meta, finalUrl, err := readPage(ctx, client, robotsUrl, visitorId)
 	if err != nil {
 		return
 	}
@@ -572,16 +1363,46 @@ func fetchRobotsRules(ctx context.Context, u gcrawler.PreparedUrl, client *gemin
 	} else if code/10 != 2 {
 		// we'll still treat it as an empty list, but we'll log something about
 		// it
-		log.Printf("Cannot read robots.txt for hostname %s: got code %d. Treating it as no robots.txt.", u.Parsed.Host, code)
+		logging.Debugf("Cannot read robots.txt for hostname %s: got code %d. Treating it as no robots.txt.", u.Parsed.Host, code)
 		return
 	} else if finalUrl.String() != robotsUrl.String() {
-		log.Printf("robots.txt redirected from %s to %s; treating it as no robots.txt.", robotsUrl.String(), finalUrl.String())
+		logging.Debugf("robots.txt redirected from %s to %s; treating it as no robots.txt.", robotsUrl.String(), finalUrl.String())
 		return
 	}
 
-	log.Println("[crawl] Found robots.txt for:", u.String())
+	logging.Debugf("[crawl] Found robots.txt for: %s", u.String())
+
+	agents := append([]string{Config.Crawl.UserAgent}, Config.Crawl.RobotsAgents...)
+	prefixes, sitemaps := parseRobotsTxt(string(body), agents)
+
+	// we only use the first sitemap that is on the same host
+	for _, sm := range sitemaps {
+		smUrl, err := url.Parse(sm)
+		if err != nil {
+			continue
+		}
+		smUrl = robotsUrl.ResolveReference(smUrl)
+		if smUrl.Scheme != robotsUrl.Scheme || smUrl.Host != robotsUrl.Host {
+			continue
+		}
+		smUrl, err = gparse.NormalizeUrl(smUrl)
+		if err != nil {
+			continue
+		}
+
+		sitemap = smUrl.String()
+		break
+	}
+
+	return
+}
+
+// parse the given robots.txt contents, and return the list of disallowed path
+// prefixes for the given user-agent tokens, along with the urls in any
+// "sitemap" directives. user-agents are matched case insensitively.
+func parseRobotsTxt(text string, agents []string) (prefixes []string, sitemaps []string) {
+	prefixes = make([]string, 0)
 
-	text := string(body)
 	lines := strings.Split(text, "\n")
 	curUserAgents := []string{"*"}
 	readingUserAgents := true
@@ -600,6 +1421,16 @@ func fetchRobotsRules(ctx context.Context, u gcrawler.PreparedUrl, client *gemin
 			continue
 		}
 
+		// sitemap directives are not tied to user-agents
+		directive = "sitemap:"
+		if len(line) > len(directive) && strings.ToLower(line[:len(directive)]) == directive {
+			sitemap := strings.TrimSpace(line[len(directive):])
+			if sitemap != "" {
+				sitemaps = append(sitemaps, sitemap)
+			}
+			continue
+		}
+
 		directive = "disallow:"
 		if len(line) > len(directive) && strings.ToLower(line[:len(directive)]) == directive {
 			readingUserAgents = false
@@ -607,22 +1438,15 @@ func fetchRobotsRules(ctx context.Context, u gcrawler.PreparedUrl, client *gemin
 
 		uaLoop:
 			for _, ua := range curUserAgents {
-				switch ua {
-				case "*":
-					fallthrough
-				case crawlerUserAgent:
-					fallthrough
-				case "crawler":
-					fallthrough
-				case "indexer":
-					fallthrough
-				case "researcher":
-					// an empty disallow (i.e "Disallow:"), means everything is
-					// allowed.
-					if prefix != "" {
-						prefixes = append(prefixes, prefix)
+				for _, agent := range agents {
+					if strings.EqualFold(ua, agent) {
+						// an empty disallow (i.e "Disallow:"), means everything
+						// is allowed.
+						if prefix != "" {
+							prefixes = append(prefixes, prefix)
+						}
+						break uaLoop
 					}
-					break uaLoop
 				}
 			}
 		}
@@ -677,7 +1501,7 @@ set robots_prefixes = null,
     robots_last_visited = now(),
     robots_retry_time = $2,
     slowdown_until = now() + $2`
-		_, err = Db.Exec(q, u.Parsed.Host, permanentErrorRetry)
+		_, err = Db.Exec(q, u.Parsed.Host, Config.Crawl.Retry.PermanentError)
 	} else {
 		q := `
 insert into hosts
@@ -693,47 +1517,58 @@ set robots_prefixes = null,
     slowdown_until = now() + (case when excluded.robots_retry_time is null
                               then $2
                               else least(excluded.robots_retry_time * 2, $3) end)`
-		_, err = Db.Exec(q, u.Parsed.Host, tempErrorMinRetry, maxRevisitTime)
+		_, err = Db.Exec(q, u.Parsed.Host, Config.Crawl.Retry.TempErrorMin, Config.Crawl.Retry.MaxRevisit)
 	}
 
 	utils.PanicOnErr(err)
 }
 
-func updateRobotsRulesInDbWithSuccess(u gcrawler.PreparedUrl, prefixes []string) {
+func updateRobotsRulesInDbWithSuccess(u gcrawler.PreparedUrl, prefixes []string, sitemap string) {
 	prefixesStr := strings.Join(prefixes, "\n")
+	sitemapNullable := sql.NullString{String: sitemap, Valid: sitemap != ""}
 	q := `
 insert into hosts
-    (hostname, robots_prefixes, robots_valid_until, robots_last_visited, robots_retry_time)
+    (hostname, robots_prefixes, robots_valid_until, robots_last_visited, robots_retry_time, sitemap_url)
 values
-    ($3, $1, now() + $2, now(), null)
+    ($3, $1, now() + $2, now(), null, $4)
 on conflict (hostname) do update set
     robots_prefixes = $1,
     robots_valid_until = now() + $2,
     robots_last_visited = now(),
-    robots_retry_time = null
+    robots_retry_time = null,
+    sitemap_url = $4
 `
-	_, err := Db.Exec(q, prefixesStr, robotsTxtValidity, u.Parsed.Host)
+	_, err := Db.Exec(q, prefixesStr, Config.Crawl.Retry.RobotsTxtValidity, u.Parsed.Host, sitemapNullable)
 	utils.PanicOnErr(err)
 }
 
-func isPermanentNetworkError(err error) bool {
-	var opErr *net.OpError
-	if !errors.As(err, &opErr) {
-		return false
-	}
-
-	if strings.Contains(err.Error(), "no such host") {
-		return true
-	}
+// add the sitemap url of a host to the urls table (if not already there), so
+// that it can be visited out of turn. it gets the same depth as the shallowest
+// known url on the host, since it's effectively an entry point to the host.
+func addSitemapToDb(sitemap gcrawler.PreparedUrl) {
+	_, err := Db.Exec(
+		`insert into urls (url, hostname, first_added, depth)
+         values ($1, $2, now(), (select min(depth) from urls where hostname = $2))
+         on conflict (url) do nothing`,
+		sitemap.String(), sitemap.Parsed.Host)
+	utils.PanicOnErr(err)
+}
 
-	if strings.Contains(err.Error(), "no route to host") {
-		return true
+// return true if the error means the host cannot be reached, and is not likely
+// to be reachable soon: either it doesn't exist, or there's no route to it.
+func isPermanentNetworkError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsNotFound
 	}
 
-	return false
+	return errors.Is(err, syscall.EHOSTUNREACH)
 }
 
-func seeder(output chan<- gcrawler.PreparedUrl, visitResults chan VisitResult, done chan bool, wg *sync.WaitGroup) {
+// send the urls due for crawling to the coordinator, over and over. pending is
+// incremented for every url sent. if exhausted is not nil, only a single pass
+// over the due urls is made, after which exhausted is closed.
+func seeder(output chan<- gcrawler.PreparedUrl, visitResults chan VisitResult, done chan bool, wg *sync.WaitGroup, pending *sync.WaitGroup, exhausted chan<- struct{}) {
 	defer wg.Done()
 
 	client := gemini.NewClient()
@@ -743,6 +1578,10 @@ func seeder(output chan<- gcrawler.PreparedUrl, visitResults chan VisitResult, d
 		err        error
 	}
 	robotsCache := map[string]RobotsRecord{}
+
+	// sitemaps found in robots.txt files, which are sent to the visitors
+	// before any other urls.
+	var sitemaps []gcrawler.PreparedUrl
 	getOrFetchRobotsPrefixes := func(ctx context.Context, u gcrawler.PreparedUrl) (results []string, err error) {
 		hit, ok := robotsCache[u.Parsed.Host]
 		if ok && hit.validUntil.Before(time.Now()) {
@@ -753,7 +1592,7 @@ func seeder(output chan<- gcrawler.PreparedUrl, visitResults chan VisitResult, d
 			delete(robotsCache, u.Parsed.Host)
 		}
 
-		results, validUntil, err := getRobotsPrefixesFromDb(u)
+		results, validUntil, err := seeds.RobotsPrefixes(u)
 		if err == nil {
 			robotsCache[u.Parsed.Host] = RobotsRecord{
 				prefixes:   results,
@@ -765,7 +1604,8 @@ func seeder(output chan<- gcrawler.PreparedUrl, visitResults chan VisitResult, d
 		}
 		err = nil
 
-		results, err = fetchRobotsRules(ctx, u, client, "seeder")
+		var sitemap string
+		results, sitemap, err = fetchRobotsRules(ctx, u, client, "seeder")
 		var slowdownErr *GeminiSlowdownError
 		if errors.Is(err, context.Canceled) {
 			return
@@ -784,7 +1624,17 @@ func seeder(output chan<- gcrawler.PreparedUrl, visitResults chan VisitResult, d
 			return
 		}
 
-		updateRobotsRulesInDbWithSuccess(u, results)
+		updateRobotsRulesInDbWithSuccess(u, results, sitemap)
+
+		if sitemap != "" && Config.Crawl.FollowSitemaps {
+			smUrl, err := gcrawler.NewPreparedUrl(sitemap)
+			if err == nil && !gcrawler.IsBlacklisted(smUrl) && !isBanned(smUrl, results) {
+				logging.Debugf("[crawl][seeder] Found sitemap for host %s: %s", u.Parsed.Host, sitemap)
+				addSitemapToDb(smUrl)
+				sitemaps = append(sitemaps, smUrl)
+			}
+		}
+
 		return
 	}
 
@@ -797,9 +1647,15 @@ func seeder(output chan<- gcrawler.PreparedUrl, visitResults chan VisitResult, d
 loop:
 	for {
 		c := make(chan gcrawler.PreparedUrl)
-		go getDueUrls(ctx, c)
+		go seeds.DueUrls(ctx, c)
 		for u := range c {
-			if gcrawler.IsBlacklisted(u) {
+			if gcrawler.IsBlacklisted(u) || exceedsUrlLimits(u) || gcrawler.IsSkippedQueryUrl(u) || gcrawler.IsDisallowedPort(u) {
+				continue
+			}
+
+			// this could happen if spartan crawling was enabled before, and
+			// is now disabled.
+			if !isCrawlableScheme(u.Parsed.Scheme) {
 				continue
 			}
 
@@ -811,11 +1667,23 @@ loop:
 				if err == ErrRobotsBackoff {
 					// don't report these so logs aren't spammed
 				} else {
-					log.Printf("[crawl][seeder] Cannot read robots.txt for url %s: %s\n", u.String(), err)
+					logging.Debugf("[crawl][seeder] Cannot read robots.txt for url %s: %s", u.String(), err)
 				}
 				continue
 			}
+			for _, sm := range sitemaps {
+				pending.Add(1)
+				select {
+				case output <- sm:
+				case <-ctx.Done():
+					pending.Done()
+					break loop
+				}
+			}
+			sitemaps = sitemaps[:0]
+
 			if isBanned(u, robotsPrefixes) {
+				pending.Add(1)
 				visitResults <- VisitResult{
 					url:    u,
 					banned: true,
@@ -823,13 +1691,21 @@ loop:
 				continue
 			}
 
+			pending.Add(1)
 			select {
 			case output <- u:
 			case <-ctx.Done():
+				pending.Done()
 				break loop
 			}
 		}
 
+		if exhausted != nil {
+			log.Println("[crawl][seeder] Finished a single pass over due urls.")
+			close(exhausted)
+			break loop
+		}
+
 		// since we just exhausted all urls, we'll wait a bit to allow for more
 		// urls to be added to the database.
 		select {
@@ -851,17 +1727,46 @@ func deleteDanglingUrls(ctx context.Context) (err error) {
 	}
 	defer tx.Rollback()
 
+	_, err = tx.ExecContext(ctx, `create temp table ids (id bigint) on commit drop`)
+	if err != nil {
+		return
+	}
+
 	_, err = tx.ExecContext(ctx, `
-create temp table ids on commit drop as
+insert into ids
     select id from urls
     where not exists (select 1 from links where dst_url_id = urls.id) and
           error is not null and
-          retry_time >= '1 month'
+          retry_time >= $1
+`, Config.Crawl.Retry.PermanentError)
+	if err != nil {
+		return
+	}
+
+	// dangling urls have no inbound links, so only the host links of their
+	// outbound links need to be taken out.
+	_, err = tx.ExecContext(ctx, `
+with old as
+    (select s.hostname src_host, d.hostname dst_host, count(*) n
+     from links l
+     join urls s on s.id = l.src_url_id
+     join urls d on d.id = l.dst_url_id
+     where l.src_url_id in (select id from ids)
+     group by s.hostname, d.hostname)
+update host_links h
+set weight = h.weight - old.n
+from old
+where h.src_host = old.src_host and h.dst_host = old.dst_host
 `)
 	if err != nil {
 		return
 	}
 
+	_, err = tx.ExecContext(ctx, `delete from host_links where weight <= 0`)
+	if err != nil {
+		return
+	}
+
 	result, err := tx.ExecContext(ctx, `delete from links where src_url_id in (select id from ids)`)
 	if err != nil {
 		return
@@ -982,9 +1887,33 @@ func dumpCrawlerState(filename string, nprocs int, urls [][]gcrawler.PreparedUrl
 	log.Println("[crawl] Dumped state to:", filename)
 }
 
+// return a channel which is closed once the seeder's single pass is over (i.e.
+// exhausted is closed), and all the urls it sent are done.
+func singlePassDone(exhausted <-chan struct{}, pending *sync.WaitGroup) <-chan struct{} {
+	finished := make(chan struct{})
+	go func() {
+		<-exhausted
+		pending.Wait()
+		close(finished)
+	}()
+
+	return finished
+}
+
 func crawl(done chan bool, wg *sync.WaitGroup) {
 	defer wg.Done()
 
+	if Config.Crawl.EnableSpartan {
+		gparse.AddLinkScheme("spartan")
+	}
+	gparse.SetListingLinkRatio(Config.Crawl.ListingLinkRatio)
+	for prefix, parser := range Config.Crawl.ContentTypeParsers {
+		err := gparse.AddContentTypeParser(prefix, parser)
+		utils.PanicOnErr(err)
+	}
+
+	logging.Infof("[crawl] Crawling as: %s (contact: %s)", Config.Crawl.UserAgent, Config.Crawl.Contact)
+
 	nprocs := 500
 
 	// create an array of channel, which will each serve as the input to each
@@ -1008,9 +1937,23 @@ func crawl(done chan bool, wg *sync.WaitGroup) {
 	flushDone := make(chan bool, 1)
 	cleanDone := make(chan bool, 1)
 	subWg := &sync.WaitGroup{}
-	go coordinator(nprocs, inputUrls, urlChan, coordDone, subWg)
-	go seeder(urlChan, visitResults, seedDone, subWg)
-	go flusher(visitResults, flushDone, subWg)
+
+	// urls sent by the seeder, which have not been visited and flushed to the
+	// database yet.
+	pending := &sync.WaitGroup{}
+
+	// when crawling once, this is closed after the seeder's single pass is
+	// done, and all the urls it sent are flushed.
+	var finished <-chan struct{}
+	var seedExhausted chan struct{}
+	if CrawlOnce {
+		seedExhausted = make(chan struct{})
+		finished = singlePassDone(seedExhausted, pending)
+	}
+
+	go coordinator(nprocs, inputUrls, urlChan, coordDone, subWg, pending, CrawlOnce)
+	go seeder(urlChan, visitResults, seedDone, subWg, pending, seedExhausted)
+	go flusher(visitResults, flushDone, subWg, pending)
 	go cleaner(cleanDone, subWg)
 	subWg.Add(4)
 
@@ -1041,6 +1984,9 @@ loop:
 		select {
 		case <-done:
 			break loop
+		case <-finished:
+			log.Println("[crawl] All due urls visited.")
+			break loop
 		case <-time.After(logPeriod):
 		}
 	}
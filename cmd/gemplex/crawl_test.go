@@ -0,0 +1,1024 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"git.sr.ht/~elektito/gemplex/pkg/config"
+	"git.sr.ht/~elektito/gemplex/pkg/gcrawler"
+	"git.sr.ht/~elektito/gemplex/pkg/gparse"
+	"github.com/a-h/gemini"
+	"golang.org/x/exp/slices"
+)
+
+func TestParseSlowdownSeconds(t *testing.T) {
+	cases := []struct {
+		meta     string
+		expected int
+	}{
+		{"30", 30},
+		{" 30 ", 30},
+		{"0", 5},
+		{"-10", 5},
+		{"100000000", 3600},
+		{"", 60},
+		{"soon", 60},
+		{"1.5", 60},
+	}
+
+	for _, c := range cases {
+		result := parseSlowdownSeconds(c.meta, 5, 3600, 60)
+		if result != c.expected {
+			t.Fatalf("parseSlowdownSeconds(%q): expected %d; got %d", c.meta, c.expected, result)
+		}
+	}
+}
+
+func TestParseSlowdownSecondsDefaultIsClamped(t *testing.T) {
+	// a misconfigured default should still respect the bounds
+	result := parseSlowdownSeconds("foo", 5, 3600, 100000)
+	if result != 3600 {
+		t.Fatalf("Expected the default to be clamped to 3600; got %d", result)
+	}
+}
+
+func TestChildDepth(t *testing.T) {
+	seed := sql.NullInt64{Int64: 0, Valid: true}
+	d := childDepth(seed)
+	if !d.Valid || d.Int64 != 1 {
+		t.Fatalf("Expected links from a seed to have depth 1; got %v", d)
+	}
+
+	d = childDepth(d)
+	if !d.Valid || d.Int64 != 2 {
+		t.Fatalf("Expected depth 2; got %v", d)
+	}
+
+	d = childDepth(sql.NullInt64{})
+	if d.Valid {
+		t.Fatalf("Expected links from a page with unknown depth to have unknown depth; got %v", d)
+	}
+}
+
+func TestFilterBlacklistedLinks(t *testing.T) {
+	oldConfig := Config
+	defer func() { Config = oldConfig }()
+	Config = &config.Config{}
+
+	gcrawler.AddDomainToBlacklist("blacklisted.example.org")
+	gcrawler.AddPrefixToBlacklist("gemini://example.org/cgi-bin/")
+
+	links := []gparse.Link{
+		{Url: "gemini://example.org/", Text: "ok"},
+		{Url: "gemini://blacklisted.example.org/foo", Text: "bad domain"},
+		{Url: "gemini://example.org/cgi-bin/search?foo", Text: "bad prefix"},
+		{Url: "gemini://example.org/cgi-bin", Text: "also ok"},
+	}
+
+	result := filterBlacklistedLinks(links)
+	if len(result) != 2 {
+		t.Fatalf("Expected 2 links after filtering; got %d: %v", len(result), result)
+	}
+
+	if result[0] != links[0] || result[1] != links[3] {
+		t.Fatalf("Unexpected links after filtering: %v", result)
+	}
+}
+
+func TestFilterBlacklistedLinksSkipsQueryUrls(t *testing.T) {
+	gcrawler.SetQueryUrlPolicy(true, nil)
+	defer gcrawler.SetQueryUrlPolicy(false, nil)
+
+	links := []gparse.Link{
+		{Url: "gemini://example.org/", Text: "ok"},
+		{Url: "gemini://example.org/calendar?2023-01", Text: "query"},
+	}
+
+	result := filterBlacklistedLinks(links)
+	if len(result) != 1 || result[0] != links[0] {
+		t.Fatalf("Expected only the link without a query; got %v", result)
+	}
+}
+
+func TestReadSpartan(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	requests := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			requests <- line
+			if line == "127.0.0.1 /old 0\r\n" {
+				conn.Write([]byte("3 /new\r\n"))
+			} else {
+				conn.Write([]byte("2 text/gemini\r\n# Hello\n=> /foo Foo\n"))
+			}
+			conn.Close()
+		}
+	}()
+
+	u, _ := url.Parse("spartan://" + ln.Addr().String() + "/old")
+	body, code, meta, finalUrl, err := readSpartan(context.Background(), u, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := <-requests; r != "127.0.0.1 /old 0\r\n" {
+		t.Fatalf("Unexpected first request line: %q", r)
+	}
+	if r := <-requests; r != "127.0.0.1 /new 0\r\n" {
+		t.Fatalf("Unexpected second request line: %q", r)
+	}
+
+	if code != 20 || meta != "text/gemini" {
+		t.Fatalf("Expected code 20 and meta text/gemini; got %d %q", code, meta)
+	}
+	if string(body) != "# Hello\n=> /foo Foo\n" {
+		t.Fatalf("Unexpected body: %q", body)
+	}
+	if finalUrl.Path != "/new" {
+		t.Fatalf("Expected final url to be the redirect target; got %s", finalUrl)
+	}
+}
+
+func TestParseRobotsTxt(t *testing.T) {
+	text := `# comment
+User-agent: *
+Disallow: /private/
+
+User-agent: researcher
+Disallow: /research/
+
+User-agent: MyBot
+User-agent: otherbot
+Disallow: /mybot/
+Disallow:
+
+User-agent: gpt
+Disallow: /
+
+Sitemap: /sitemap.gmi
+`
+
+	cases := []struct {
+		agents   []string
+		expected []string
+	}{
+		{[]string{"elektito/gemplex", "*", "crawler", "indexer", "researcher"}, []string{"/private/", "/research/"}},
+		{[]string{"mybot"}, []string{"/mybot/"}},
+		{[]string{"mybot", "*"}, []string{"/private/", "/mybot/"}},
+		{[]string{"nobody"}, []string{}},
+	}
+
+	for _, c := range cases {
+		prefixes, sitemaps := parseRobotsTxt(text, c.agents)
+		if strings.Join(prefixes, ",") != strings.Join(c.expected, ",") {
+			t.Errorf("agents=%v: expected %v; got %v", c.agents, c.expected, prefixes)
+		}
+		if len(sitemaps) != 1 || sitemaps[0] != "/sitemap.gmi" {
+			t.Errorf("agents=%v: expected sitemap /sitemap.gmi; got %v", c.agents, sitemaps)
+		}
+	}
+}
+
+func TestIsVolatile(t *testing.T) {
+	cases := []struct {
+		name     string
+		content  []string
+		links    []string
+		expected bool
+	}{
+		{"always changing", []string{"a", "b", "c", "d"}, []string{"x", "x", "x", "x"}, true},
+		{"one link change", []string{"a", "b", "c", "d"}, []string{"x", "x", "y", "y"}, true},
+		{"links change too", []string{"a", "b", "c", "d"}, []string{"x", "y", "z", "x"}, false},
+		{"content repeats", []string{"a", "b", "b", "c"}, []string{"x", "x", "x", "x"}, false},
+		{"not enough visits", []string{"a", "b", "c"}, []string{"x", "x", "x"}, false},
+		{"only recent visits count", []string{"a", "a", "b", "c", "d", "e"}, []string{"x", "y", "x", "x", "x", "x"}, true},
+	}
+
+	for _, c := range cases {
+		if got := isVolatile(c.content, c.links, 4, 1); got != c.expected {
+			t.Errorf("%s: expected %t; got %t", c.name, c.expected, got)
+		}
+	}
+
+	if isVolatile([]string{"a", "b", "c", "d"}, []string{"x", "x", "x", "x"}, 0, 1) {
+		t.Error("Expected detection to be disabled with n=0")
+	}
+}
+
+func TestCalcLinkSetHash(t *testing.T) {
+	a := []gparse.Link{{Url: "gemini://a/", Text: "A"}, {Url: "gemini://b/", Text: "B"}}
+	b := []gparse.Link{{Url: "gemini://b/", Text: "other"}, {Url: "gemini://a/"}}
+	if calcLinkSetHash(a) != calcLinkSetHash(b) {
+		t.Fatal("Expected link set hash to ignore order and link text")
+	}
+}
+
+func TestMakeVisitResult(t *testing.T) {
+	u, err := gcrawler.NewPreparedUrl("gemini://example.org/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name      string
+		body      []byte
+		code      int
+		meta      string
+		err       error
+		expectErr bool
+	}{
+		{"success", []byte("# Hello\n"), 20, "text/gemini", nil, false},
+		{"end of cert session", []byte("# Hello\n"), 21, "text/gemini", nil, false},
+		{"parse error", []byte("foo"), 20, "text/unknown-type", nil, true},
+		{"redirect", nil, 31, "gemini://example.org/bar", nil, true},
+		{"not found", nil, 51, "Not found", nil, true},
+		{"fetch error", nil, 0, "", errors.New("connection refused"), true},
+		{"non-text", nil, 20, "image/png", &NonTextContentError{ContentType: "image/png"}, true},
+	}
+
+	for _, c := range cases {
+		r := makeVisitResult(u, c.body, c.code, c.meta, u.Parsed, c.err, time.Second, "test")
+		if r.url != u {
+			t.Fatalf("%s: expected result for %s; got %s", c.name, u, r.url)
+		}
+		if (r.error != nil) != c.expectErr {
+			t.Fatalf("%s: unexpected error value: %v", c.name, r.error)
+		}
+		if r.fetchDuration != time.Second {
+			t.Fatalf("%s: expected fetch duration to be set; got %s", c.name, r.fetchDuration)
+		}
+	}
+}
+
+func TestVisitorEmitsResultPerUrl(t *testing.T) {
+	urls := make(chan gcrawler.PreparedUrl, 2)
+	results := make(chan VisitResult, 2)
+	for _, s := range []string{"ftp://example.org/a", "ftp://example.org/b"} {
+		u, err := gcrawler.NewPreparedUrl(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls <- u
+	}
+	close(urls)
+
+	visitor("test", urls, results, make(chan bool))
+	close(results)
+
+	n := 0
+	for r := range results {
+		if r.error == nil {
+			t.Fatalf("Expected an error for unsupported scheme: %s", r.url)
+		}
+		n++
+	}
+	if n != 2 {
+		t.Fatalf("Expected 2 visit results; got %d", n)
+	}
+}
+
+func TestReadGeminiTimeout(t *testing.T) {
+	oldConfig := Config
+	defer func() { Config = oldConfig }()
+	Config = &config.Config{}
+	Config.Crawl.RequestTimeout = 1
+
+	// accept connections, but never respond
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				break
+			}
+			conns = append(conns, conn)
+		}
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+
+	u, err := url.Parse("gemini://" + listener.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, _, _, _, err = readGemini(context.Background(), gemini.NewClient(), u, "test")
+	if err == nil {
+		t.Fatal("Expected an error from non-responding server")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("Request took too long to time out: %s", elapsed)
+	}
+
+	r := makeVisitResult(gcrawler.PreparedUrl{Parsed: u, NonParsed: u.String()}, nil, 0, "", u, err, time.Second, "test")
+	if r.statusCode/10 == 2 || r.statusCode/10 == 5 || r.banned {
+		t.Fatalf("Expected timed out fetch to be a temporary error; got: %+v", r)
+	}
+}
+
+func TestRetryJitterFactor(t *testing.T) {
+	if f := retryJitterFactor(0); f != 1 {
+		t.Fatalf("Expected no jitter with a zero fraction; got %f", f)
+	}
+
+	// a batch of urls failing together should not all be retried together
+	seen := map[float64]bool{}
+	for i := 0; i < 100; i++ {
+		f := retryJitterFactor(0.2)
+		if f <= 0.8 || f > 1 {
+			t.Fatalf("Expected jitter factor in (0.8, 1]; got %f", f)
+		}
+		seen[f] = true
+	}
+	if len(seen) < 2 {
+		t.Fatal("Expected retry intervals in a batch to be spread out")
+	}
+
+	for i := 0; i < 100; i++ {
+		f := retryJitterFactor(5)
+		if f < 0 || f > 1 {
+			t.Fatalf("Expected jitter factor in [0, 1] for a clamped fraction; got %f", f)
+		}
+	}
+}
+
+func TestJitterSlowdown(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		s := jitterSlowdown(100, 0, 0.2)
+		if s < 100 || s >= 120 {
+			t.Fatalf("Expected jittered slow down in [100, 120); got %f", s)
+		}
+	}
+
+	// jitter never pushes the interval past the maximum
+	for i := 0; i < 100; i++ {
+		s := jitterSlowdown(100, 110, 0.5)
+		if s < 100 || s > 110 {
+			t.Fatalf("Expected jittered slow down in [100, 110]; got %f", s)
+		}
+	}
+
+	if s := jitterSlowdown(100, 100, 0.2); s != 100 {
+		t.Fatalf("Expected slow down at the maximum to stay there; got %f", s)
+	}
+}
+
+func TestNextRevisit(t *testing.T) {
+	day := 24 * time.Hour
+	s := revisitSchedule{
+		increment:   2 * day,
+		afterChange: 2 * day,
+		max:         30 * day,
+		smoothing:   0.3,
+	}
+
+	// alternating change/no-change keeps the change rate (and so the
+	// intervals) around the neutral point.
+	interval := s.afterChange
+	rate := initialChangeRate
+	for i := 0; i < 20; i++ {
+		changed := i%2 == 0
+		interval, rate = nextRevisit(s, interval, rate, changed)
+		if rate < 0.3 || rate > 0.7 {
+			t.Fatalf("Visit %d: expected change rate to stay around 0.5; got %f", i, rate)
+		}
+		if changed && (interval < day || interval > 3*day) {
+			t.Fatalf("Visit %d: expected interval after change around 2 days; got %s", i, interval)
+		}
+		if !changed && (interval < 2*day || interval > 6*day) {
+			t.Fatalf("Visit %d: expected interval without change around 4 days; got %s", i, interval)
+		}
+	}
+
+	// a page that keeps changing is revisited more often than the default
+	rate = initialChangeRate
+	for i := 0; i < 20; i++ {
+		interval, rate = nextRevisit(s, interval, rate, true)
+	}
+	if interval >= s.afterChange || interval < s.afterChange/2 {
+		t.Fatalf("Expected a shorter interval for an often changing page; got %s", interval)
+	}
+
+	// a stable page grows its interval faster than the default increment,
+	// up to the maximum.
+	rate = initialChangeRate
+	interval = s.afterChange
+	prev := interval
+	for i := 0; i < 5; i++ {
+		interval, rate = nextRevisit(s, interval, rate, false)
+		if interval-prev <= s.increment {
+			t.Fatalf("Visit %d: expected the interval to grow by more than the increment; got %s -> %s", i, prev, interval)
+		}
+		prev = interval
+	}
+	for i := 0; i < 20; i++ {
+		interval, rate = nextRevisit(s, interval, rate, false)
+	}
+	if interval != s.max {
+		t.Fatalf("Expected the interval to reach the maximum; got %s", interval)
+	}
+
+	// a change after a long stable period resets the interval
+	interval, _ = nextRevisit(s, interval, rate, true)
+	if interval > 2*s.afterChange {
+		t.Fatalf("Expected the interval to be reset after a change; got %s", interval)
+	}
+}
+
+func TestNextRevisitWithoutSmoothing(t *testing.T) {
+	day := 24 * time.Hour
+	s := revisitSchedule{
+		increment:   2 * day,
+		afterChange: 3 * day,
+		max:         30 * day,
+	}
+
+	// without smoothing, all pages follow the fixed schedule
+	interval, rate := nextRevisit(s, 10*day, initialChangeRate, false)
+	if interval != 12*day || rate != initialChangeRate {
+		t.Fatalf("Expected 12 days with an unchanged rate; got %s (rate: %f)", interval, rate)
+	}
+
+	interval, _ = nextRevisit(s, 10*day, initialChangeRate, true)
+	if interval != 3*day {
+		t.Fatalf("Expected 3 days after a change; got %s", interval)
+	}
+}
+
+func TestIsUnchangedContent(t *testing.T) {
+	hash := calcContentHash([]byte("# Hello\n"))
+	otherHash := calcContentHash([]byte("# Hello, world\n"))
+
+	cases := []struct {
+		prev     sql.NullString
+		expected bool
+	}{
+		{sql.NullString{}, false},
+		{sql.NullString{String: hash, Valid: false}, false},
+		{sql.NullString{String: otherHash, Valid: true}, false},
+		{sql.NullString{String: hash, Valid: true}, true},
+	}
+
+	for _, c := range cases {
+		got := isUnchangedContent(c.prev, hash)
+		if got != c.expected {
+			t.Errorf("Expected %v for previous hash %+v; got %v", c.expected, c.prev, got)
+		}
+	}
+}
+
+func TestReadGeminiFollowsRedirect(t *testing.T) {
+	oldConfig := Config
+	defer func() { Config = oldConfig }()
+	Config = &config.Config{}
+	Config.Crawl.RequestTimeout = 5
+
+	s := newTestGeminiServer(t, map[string]testGeminiResponse{
+		"/new": {code: 20, meta: "text/gemini", body: "# New\n"},
+	})
+	s.handle("/old", testGeminiResponse{code: 31, meta: s.url("/new").String()})
+
+	body, code, meta, finalUrl, err := readGemini(context.Background(), gemini.NewClient(), s.url("/old"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 20 || meta != "text/gemini" || string(body) != "# New\n" {
+		t.Fatalf("Unexpected response: code=%d meta=%q body=%q", code, meta, body)
+	}
+	if finalUrl.String() != s.url("/new").String() {
+		t.Fatalf("Expected the final url to be the redirect target; got: %s", finalUrl)
+	}
+}
+
+func TestReadGeminiEndOfCertSession(t *testing.T) {
+	oldConfig := Config
+	defer func() { Config = oldConfig }()
+	Config = &config.Config{}
+	Config.Crawl.RequestTimeout = 5
+
+	s := newTestGeminiServer(t, map[string]testGeminiResponse{
+		"/": {code: 21, meta: "text/gemini", body: "# Bye\n=> /foo Foo\n"},
+	})
+
+	body, code, meta, finalUrl, err := readGemini(context.Background(), gemini.NewClient(), s.url("/"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 21 || string(body) != "# Bye\n=> /foo Foo\n" {
+		t.Fatalf("Unexpected response: code=%d meta=%q body=%q", code, meta, body)
+	}
+
+	u, err := gcrawler.NewPreparedUrl(s.url("/").String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := makeVisitResult(u, body, code, meta, finalUrl, nil, time.Second, "test")
+	if r.error != nil || r.page.Title != "Bye" || len(r.page.Links) != 1 {
+		t.Fatalf("Expected the body of a 21 response to be processed; got: %+v", r)
+	}
+}
+
+func TestReadGeminiSlowdown(t *testing.T) {
+	oldConfig := Config
+	defer func() { Config = oldConfig }()
+	Config = &config.Config{}
+	Config.Crawl.RequestTimeout = 5
+
+	s := newTestGeminiServer(t, map[string]testGeminiResponse{
+		"/": {code: 44, meta: "30"},
+	})
+
+	body, code, meta, _, err := readGemini(context.Background(), gemini.NewClient(), s.url("/"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 44 || meta != "30" || len(body) != 0 {
+		t.Fatalf("Unexpected response: code=%d meta=%q body=%q", code, meta, body)
+	}
+}
+
+func TestFetchRobotsRulesDisallow(t *testing.T) {
+	oldConfig := Config
+	defer func() { Config = oldConfig }()
+	Config = &config.Config{}
+	Config.Crawl.RequestTimeout = 5
+	Config.Crawl.UserAgent = "elektito/gemplex"
+
+	s := newTestGeminiServer(t, map[string]testGeminiResponse{
+		"/robots.txt": {
+			code: 20,
+			meta: "text/plain",
+			body: "User-agent: elektito/gemplex\nDisallow: /private/\n\nUser-agent: other\nDisallow: /\n",
+		},
+	})
+
+	u, err := gcrawler.NewPreparedUrl(s.url("/").String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefixes, _, err := fetchRobotsRules(context.Background(), u, gemini.NewClient(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, banned := range map[string]bool{
+		"/private/diary.gmi": true,
+		"/public/index.gmi":  false,
+	} {
+		pu, err := gcrawler.NewPreparedUrl(s.url(path).String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isBanned(pu, prefixes) != banned {
+			t.Errorf("Expected banned=%v for %s (prefixes: %v)", banned, path, prefixes)
+		}
+	}
+
+	if requested := s.requested(); len(requested) == 0 || requested[len(requested)-1] != "/robots.txt" {
+		t.Fatalf("Expected robots.txt to be requested; got: %v", requested)
+	}
+}
+
+func TestIsPermanentNetworkError(t *testing.T) {
+	notFound := &net.OpError{
+		Op:  "dial",
+		Net: "tcp",
+		Err: &net.DNSError{Err: "no such host", Name: "nowhere.example.org", IsNotFound: true},
+	}
+	dnsTimeout := &net.OpError{
+		Op:  "dial",
+		Net: "tcp",
+		Err: &net.DNSError{Err: "i/o timeout", Name: "example.org", IsTimeout: true},
+	}
+	unreachable := &net.OpError{
+		Op:  "dial",
+		Net: "tcp",
+		Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH),
+	}
+	refused := &net.OpError{
+		Op:  "dial",
+		Net: "tcp",
+		Err: os.NewSyscallError("connect", syscall.ECONNREFUSED),
+	}
+
+	cases := []struct {
+		name      string
+		err       error
+		permanent bool
+	}{
+		{"host not found", notFound, true},
+		{"wrapped host not found", fmt.Errorf("request failed: %w", notFound), true},
+		{"lookup not found", &net.DNSError{Err: "no such host", IsNotFound: true}, true},
+		{"dns timeout", dnsTimeout, false},
+		{"no route to host", unreachable, true},
+		{"wrapped no route to host", fmt.Errorf("request failed: %w", unreachable), true},
+		{"connection refused", refused, false},
+		{"unrelated error mentioning no such host", errors.New("no such host"), false},
+		{"nil", nil, false},
+	}
+
+	for _, c := range cases {
+		if isPermanentNetworkError(c.err) != c.permanent {
+			t.Errorf("%s: expected permanent=%v for: %v", c.name, c.permanent, c.err)
+		}
+	}
+}
+
+func TestFilterBlacklistedLinksSkipsDisallowedPorts(t *testing.T) {
+	gcrawler.SetAllowedPorts([]int{1965})
+	defer gcrawler.SetAllowedPorts(nil)
+
+	links := []gparse.Link{
+		{Url: "gemini://example.org/", Text: "ok"},
+		{Url: "gemini://example.org:6379/", Text: "other port"},
+	}
+
+	result := filterBlacklistedLinks(links)
+	if len(result) != 1 || result[0] != links[0] {
+		t.Fatalf("Expected only the link on the default port; got %v", result)
+	}
+}
+
+// an in-memory certPinStore for tests
+type memCertPins map[string]string
+
+func (m memCertPins) Get(host string) (string, error) {
+	return m[host], nil
+}
+
+func (m memCertPins) Set(host string, fingerprint string) error {
+	if m[host] == "" {
+		m[host] = fingerprint
+	}
+	return nil
+}
+
+// an in-memory visitHistoryStore for tests
+type memVisitHistory struct {
+	ids    map[string]int64
+	visits map[int64][]int // status codes, oldest first
+}
+
+func (m *memVisitHistory) Add(urlStr string, statusCode int, errMsg sql.NullString) (int64, error) {
+	id := m.ids[urlStr]
+	if id != 0 {
+		m.visits[id] = append(m.visits[id], statusCode)
+	}
+	return id, nil
+}
+
+func (m *memVisitHistory) Prune(urlId int64, n int) error {
+	if visits := m.visits[urlId]; len(visits) > n {
+		m.visits[urlId] = visits[len(visits)-n:]
+	}
+	return nil
+}
+
+func TestRecordVisitRetention(t *testing.T) {
+	oldConfig := Config
+	defer func() { Config = oldConfig }()
+	Config = &config.Config{}
+	Config.Crawl.VisitHistorySize = 3
+
+	oldVisitHistory := visitHistory
+	defer func() { visitHistory = oldVisitHistory }()
+	history := &memVisitHistory{
+		ids:    map[string]int64{"gemini://example.org/": 1},
+		visits: map[int64][]int{},
+	}
+	visitHistory = history
+
+	known, err := gcrawler.NewPreparedUrl("gemini://example.org/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := gcrawler.NewPreparedUrl("gemini://example.org/unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, code := range []int{20, 51, 40, 31, 20} {
+		recordVisit(VisitResult{url: known, statusCode: code})
+	}
+	recordVisit(VisitResult{url: unknown, statusCode: 20, error: errors.New("failed")})
+
+	expected := []int{40, 31, 20}
+	if !slices.Equal(history.visits[1], expected) {
+		t.Fatalf("Expected the latest visits %v to be kept; got %v", expected, history.visits[1])
+	}
+	if len(history.visits) != 1 {
+		t.Fatalf("Expected no visits recorded for an unknown url; got %v", history.visits)
+	}
+}
+
+func TestReadGeminiCertPin(t *testing.T) {
+	oldConfig := Config
+	defer func() { Config = oldConfig }()
+	Config = &config.Config{}
+	Config.Crawl.RequestTimeout = 5
+	Config.Crawl.TofuPin = true
+
+	oldCertPins := certPins
+	defer func() { certPins = oldCertPins }()
+	pins := memCertPins{}
+	certPins = pins
+
+	s := newTestGeminiServer(t, map[string]testGeminiResponse{
+		"/": {code: 20, meta: "text/gemini", body: "# Hello\n"},
+	})
+	host := s.url("/").Host
+
+	// first visit pins the certificate
+	_, code, _, _, err := readGemini(context.Background(), gemini.NewClient(), s.url("/"), "test")
+	if err != nil || code != 20 {
+		t.Fatalf("Expected first visit to succeed; got code=%d err=%v", code, err)
+	}
+	pinned := pins[host]
+	if pinned == "" {
+		t.Fatal("Expected certificate to be pinned on first visit")
+	}
+
+	// the same certificate is accepted again (by a fresh client, so that it's
+	// checked against the pin again)
+	_, code, _, _, err = readGemini(context.Background(), gemini.NewClient(), s.url("/"), "test")
+	if err != nil || code != 20 {
+		t.Fatalf("Expected pinned certificate to be accepted; got code=%d err=%v", code, err)
+	}
+	if pins[host] != pinned {
+		t.Fatalf("Expected pin not to change; got %s", pins[host])
+	}
+
+	// a different certificate is refused
+	pins[host] = "some-other-certificate"
+	_, _, _, _, err = readGemini(context.Background(), gemini.NewClient(), s.url("/"), "test")
+	var mismatchErr *CertMismatchError
+	if !errors.As(err, &mismatchErr) {
+		t.Fatalf("Expected a certificate mismatch error; got: %v", err)
+	}
+	if mismatchErr.Pinned != "some-other-certificate" || mismatchErr.Fingerprint != pinned {
+		t.Fatalf("Unexpected mismatch error: %+v", mismatchErr)
+	}
+	if pins[host] != "some-other-certificate" {
+		t.Fatalf("Expected pin not to be replaced on mismatch; got %s", pins[host])
+	}
+
+	// the mismatch is recorded as an error on the url
+	r := makeVisitResult(gcrawler.PreparedUrl{Parsed: s.url("/"), NonParsed: s.url("/").String()}, nil, 0, "", s.url("/"), err, time.Second, "test")
+	if !errors.As(r.error, &mismatchErr) || r.statusCode/10 == 2 {
+		t.Fatalf("Expected mismatch to be recorded as an error; got: %+v", r)
+	}
+
+	// re-pinning (forgetting the pin) accepts the certificate again
+	delete(pins, host)
+	_, code, _, _, err = readGemini(context.Background(), gemini.NewClient(), s.url("/"), "test")
+	if err != nil || code != 20 || pins[host] != pinned {
+		t.Fatalf("Expected certificate to be re-pinned; got code=%d err=%v pin=%s", code, err, pins[host])
+	}
+}
+
+func TestReadGeminiNoCertPin(t *testing.T) {
+	oldConfig := Config
+	defer func() { Config = oldConfig }()
+	Config = &config.Config{}
+	Config.Crawl.RequestTimeout = 5
+
+	oldCertPins := certPins
+	defer func() { certPins = oldCertPins }()
+	pins := memCertPins{}
+	certPins = pins
+
+	s := newTestGeminiServer(t, map[string]testGeminiResponse{
+		"/": {code: 20, meta: "text/gemini", body: "# Hello\n"},
+	})
+
+	// without pinning, any certificate is accepted, and nothing is stored
+	pins[s.url("/").Host] = "some-other-certificate"
+	_, code, _, _, err := readGemini(context.Background(), gemini.NewClient(), s.url("/"), "test")
+	if err != nil || code != 20 {
+		t.Fatalf("Expected any certificate to be accepted; got code=%d err=%v", code, err)
+	}
+	if pins[s.url("/").Host] != "some-other-certificate" {
+		t.Fatal("Expected pins not to be touched when pinning is disabled")
+	}
+}
+
+func TestCrawlSinglePass(t *testing.T) {
+	oldConfig := Config
+	defer func() { Config = oldConfig }()
+	Config = &config.Config{}
+	Config.Crawl.RequestTimeout = 5
+
+	s := newTestGeminiServer(t, map[string]testGeminiResponse{
+		"/a": {code: 20, meta: "text/gemini", body: "# A\n"},
+		"/b": {code: 51, meta: "Not found"},
+	})
+
+	nprocs := 2
+	visitResults := make(chan VisitResult, 10)
+	inputUrls := make([]chan gcrawler.PreparedUrl, nprocs)
+	for i := range inputUrls {
+		inputUrls[i] = make(chan gcrawler.PreparedUrl, 10)
+		go visitor(strconv.Itoa(i), inputUrls[i], visitResults, make(chan bool))
+	}
+	defer func() {
+		for _, c := range inputUrls {
+			close(c)
+		}
+	}()
+
+	urlChan := make(chan gcrawler.PreparedUrl, 10)
+	coordDone := make(chan bool, 1)
+	wg := &sync.WaitGroup{}
+	pending := &sync.WaitGroup{}
+	wg.Add(1)
+	go coordinator(nprocs, inputUrls, urlChan, coordDone, wg, pending, true)
+	defer func() {
+		coordDone <- true
+		wg.Wait()
+	}()
+
+	// stands in for the flusher, which needs a database
+	flushed := make(chan VisitResult, 10)
+	go func() {
+		for r := range visitResults {
+			flushed <- r
+			pending.Done()
+		}
+	}()
+
+	// stands in for the seeder; the duplicate url should be dropped by the
+	// coordinator.
+	exhausted := make(chan struct{})
+	finished := singlePassDone(exhausted, pending)
+	for _, path := range []string{"/a", "/b", "/a"} {
+		u := s.url(path)
+		pending.Add(1)
+		urlChan <- gcrawler.PreparedUrl{Parsed: u, NonParsed: u.String()}
+	}
+	close(exhausted)
+
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Single pass did not finish after all urls were visited")
+	}
+
+	n := 0
+	codes := map[string]int{}
+	for len(flushed) > 0 {
+		r := <-flushed
+		codes[r.url.Parsed.Path] = r.statusCode
+		n++
+	}
+	if n != 2 || codes["/a"] != 20 || codes["/b"] != 51 {
+		t.Fatalf("Expected both urls to be visited and flushed once; got: %v", codes)
+	}
+}
+
+// a seedStore with a fixed list of due urls, and the same robots.txt rules for
+// every host.
+type memSeeds struct {
+	urls           []gcrawler.PreparedUrl
+	robotsPrefixes []string
+}
+
+func (m memSeeds) DueUrls(ctx context.Context, c chan<- gcrawler.PreparedUrl) {
+	defer close(c)
+	for _, u := range m.urls {
+		select {
+		case c <- u:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m memSeeds) RobotsPrefixes(u gcrawler.PreparedUrl) ([]string, time.Time, error) {
+	return m.robotsPrefixes, time.Now().Add(time.Hour), nil
+}
+
+func TestSeederSinglePass(t *testing.T) {
+	oldConfig := Config
+	defer func() { Config = oldConfig }()
+	Config = &config.Config{}
+	Config.Crawl.RequestTimeout = 5
+
+	// 127.0.0.1 is blacklisted, so the seeder would skip urls on it
+	listener, err := listenTestGemini(t, "127.0.0.2:0")
+	if err != nil {
+		t.Skip("Cannot listen on 127.0.0.2:", err)
+	}
+	s := serveTestGemini(t, listener, map[string]testGeminiResponse{
+		"/a": {code: 20, meta: "text/gemini", body: "# A\n"},
+		"/b": {code: 20, meta: "text/gemini", body: "# B\n"},
+	})
+
+	oldSeeds := seeds
+	defer func() { seeds = oldSeeds }()
+	var urls []gcrawler.PreparedUrl
+	for _, path := range []string{"/a", "/b", "/c", "/private/d"} {
+		u := s.url(path)
+		urls = append(urls, gcrawler.PreparedUrl{Parsed: u, NonParsed: u.String()})
+	}
+	seeds = memSeeds{urls: urls, robotsPrefixes: []string{"/private/"}}
+
+	// a single visitor with room for a single url, so that the coordinator
+	// has to wait for it, instead of dropping urls.
+	visitResults := make(chan VisitResult, 10)
+	inputUrls := []chan gcrawler.PreparedUrl{make(chan gcrawler.PreparedUrl, 1)}
+	go visitor("0", inputUrls[0], visitResults, make(chan bool))
+	defer close(inputUrls[0])
+
+	urlChan := make(chan gcrawler.PreparedUrl, 10)
+	coordDone := make(chan bool, 1)
+	coordWg := &sync.WaitGroup{}
+	pending := &sync.WaitGroup{}
+	coordWg.Add(1)
+	go coordinator(1, inputUrls, urlChan, coordDone, coordWg, pending, true)
+	defer func() {
+		coordDone <- true
+		coordWg.Wait()
+	}()
+
+	// stands in for the flusher, which needs a database
+	flushed := make(chan VisitResult, 10)
+	go func() {
+		for r := range visitResults {
+			flushed <- r
+			pending.Done()
+		}
+	}()
+
+	seedDone := make(chan bool, 1)
+	seedWg := &sync.WaitGroup{}
+	exhausted := make(chan struct{})
+	finished := singlePassDone(exhausted, pending)
+	seedWg.Add(1)
+	go seeder(urlChan, visitResults, seedDone, seedWg, pending, exhausted)
+	defer func() { seedDone <- true }()
+
+	select {
+	case <-finished:
+	case <-time.After(20 * time.Second):
+		t.Fatal("Single pass did not finish after all urls were visited")
+	}
+
+	// the seeder exits by itself after a single pass
+	seederExited := make(chan struct{})
+	go func() {
+		seedWg.Wait()
+		close(seederExited)
+	}()
+	select {
+	case <-seederExited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Seeder did not exit after a single pass")
+	}
+
+	results := map[string]VisitResult{}
+	for len(flushed) > 0 {
+		r := <-flushed
+		results[r.url.Parsed.Path] = r
+	}
+	if len(results) != 4 {
+		t.Fatalf("Expected all urls to be flushed once; got: %v", results)
+	}
+	if results["/a"].statusCode != 20 || results["/b"].statusCode != 20 || results["/c"].statusCode != 51 {
+		t.Fatalf("Expected all allowed urls to be visited; got: %v", results)
+	}
+	if !results["/private/d"].banned {
+		t.Fatal("Expected the url disallowed by robots.txt to be flushed as banned")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a canned response served by testGeminiServer.
+type testGeminiResponse struct {
+	code int
+	meta string
+
+	// only sent for success (2x) responses
+	body string
+}
+
+// an in-process gemini server for tests, serving canned responses by path.
+// requests for any other path get a 51 (not found) response.
+type testGeminiServer struct {
+	listener  net.Listener
+	responses map[string]testGeminiResponse
+
+	mu       sync.Mutex
+	requests []string
+}
+
+// start a gemini server with a throw-away self-signed certificate on a random
+// local port. the server is stopped when the test finishes.
+func newTestGeminiServer(t *testing.T, responses map[string]testGeminiResponse) *testGeminiServer {
+	t.Helper()
+
+	listener, err := listenTestGemini(t, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return serveTestGemini(t, listener, responses)
+}
+
+// listen for gemini (tls) connections on the given address, with a throw-away
+// self-signed certificate.
+func listenTestGemini(t *testing.T, addr string) (net.Listener, error) {
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{generateTestCert(t)},
+	}
+	return tls.Listen("tcp", addr, tlsCfg)
+}
+
+// serve canned responses on the given listener, until the test finishes.
+func serveTestGemini(t *testing.T, listener net.Listener, responses map[string]testGeminiResponse) *testGeminiServer {
+	s := &testGeminiServer{
+		listener:  listener,
+		responses: responses,
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleConn(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *testGeminiServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	u, err := url.Parse(strings.TrimRight(line, "\r\n"))
+	if err != nil {
+		fmt.Fprintf(conn, "59 Bad request\r\n")
+		return
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, u.Path)
+	resp, ok := s.responses[u.Path]
+	s.mu.Unlock()
+
+	if !ok {
+		fmt.Fprintf(conn, "51 Not found\r\n")
+		return
+	}
+
+	fmt.Fprintf(conn, "%d %s\r\n", resp.code, resp.meta)
+	if resp.code/10 == 2 {
+		conn.Write([]byte(resp.body))
+	}
+}
+
+// set the response served for the given path. this is useful when the
+// response refers to the server's own address (like a redirect).
+func (s *testGeminiServer) handle(path string, resp testGeminiResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses[path] = resp
+}
+
+// return the url of the given path on the server.
+func (s *testGeminiServer) url(path string) *url.URL {
+	return &url.URL{
+		Scheme: "gemini",
+		Host:   s.listener.Addr().String(),
+		Path:   path,
+	}
+}
+
+// return the paths requested from the server so far, in order.
+func (s *testGeminiServer) requested() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+func generateTestCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	templ := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &templ, &templ, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  priv,
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	"git.sr.ht/~elektito/gemplex/pkg/gsearch"
+)
+
+const healthCheckTimeout = 5 * time.Second
+
+type healthResponse struct {
+	DocCount uint64 `json:"docs"`
+	Err      string `json:"err,omitempty"`
+}
+
+// run all health checks, print the results, and return true if everything is
+// fine.
+func healthcheck() bool {
+	ok := true
+	report := func(name string, err error) {
+		if err != nil {
+			fmt.Printf("%s: FAILED (%s)\n", name, err)
+			ok = false
+		} else {
+			fmt.Printf("%s: ok\n", name)
+		}
+	}
+
+	report("database", checkDb())
+
+	// if the search daemon is running, it has the index open (and locked), so
+	// we ask the daemon about it. otherwise, we open it ourselves.
+	docs, err := checkSearchDaemon()
+	report("search socket", err)
+	if err == nil {
+		fmt.Printf("index: ok (%d documents)\n", docs)
+	} else {
+		docs, err = checkIndex()
+		if err == nil {
+			fmt.Printf("index: ok (%d documents)\n", docs)
+		} else {
+			report("index", err)
+		}
+	}
+
+	return ok
+}
+
+func checkDb() (err error) {
+	db, err := sql.Open("postgres", Config.GetDbConnStr())
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	return db.Ping()
+}
+
+func checkIndex() (docs uint64, err error) {
+	err = fmt.Errorf("no index found in: %s", Config.Index.Path)
+	for _, name := range []string{"ping", "pong"} {
+		filename := path.Join(Config.Index.Path, name+".idx")
+		if _, statErr := os.Stat(filename); statErr != nil {
+			continue
+		}
+
+		index, openErr := gsearch.OpenIndexReadOnly(filename, name, healthCheckTimeout)
+		if openErr != nil {
+			err = fmt.Errorf("cannot open %s: %w", filename, openErr)
+			continue
+		}
+
+		docs, err = index.DocCount()
+		index.Close()
+		if err == nil {
+			return
+		}
+	}
+
+	return
+}
+
+func checkSearchDaemon() (docs uint64, err error) {
+	conn, err := net.DialTimeout("unix", Config.Search.UnixSocketPath, healthCheckTimeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(healthCheckTimeout))
+
+	err = json.NewEncoder(conn).Encode(TypedRequest{Type: "health"})
+	if err != nil {
+		return
+	}
+
+	var resp healthResponse
+	err = json.NewDecoder(conn).Decode(&resp)
+	if err != nil {
+		return
+	}
+
+	if resp.Err != "" {
+		err = fmt.Errorf("%s", resp.Err)
+		return
+	}
+
+	docs = resp.DocCount
+	return
+}
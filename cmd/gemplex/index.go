@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"path"
@@ -18,6 +21,19 @@ import (
 // daemons, is run only once.
 var loadIndexOnce sync.Once
 
+// closed once loadInitialIndex has successfully made an index available through
+// idx. idx should not be used before this is closed.
+var idxReadyChan = make(chan struct{})
+
+func indexReady() bool {
+	select {
+	case <-idxReadyChan:
+		return true
+	default:
+		return false
+	}
+}
+
 // this is an index alias which is used for searching (if the search daemon is
 // running). the actual index in use will be swapped transprently be the index
 // daemon periodically.
@@ -27,6 +43,64 @@ var idx bleve.IndexAlias
 // daemon.
 var curIdx bleve.Index
 
+// the number of rebuilt indices refused in a row by acceptRebuiltIndex. this is
+// only used by the index daemon.
+var refusedRebuilds int
+
+// metadata of the index currently in use, read from (or written to) the
+// sidecar file next to it. this is reported by the search daemon.
+var curIdxMeta gsearch.IndexMeta
+var curIdxMetaLock sync.RWMutex
+
+func getIndexMeta() gsearch.IndexMeta {
+	curIdxMetaLock.RLock()
+	defer curIdxMetaLock.RUnlock()
+	return curIdxMeta
+}
+
+func setIndexMeta(meta gsearch.IndexMeta) {
+	curIdxMetaLock.Lock()
+	defer curIdxMetaLock.Unlock()
+	curIdxMeta = meta
+}
+
+// read the metadata sidecar file of the given index file, and make it the
+// current index metadata. a missing or broken sidecar file is not an error; the
+// metadata is simply unknown in that case.
+func loadIndexMeta(indexFile string) {
+	meta, err := gsearch.ReadIndexMeta(indexFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Println("[index] No metadata file for index:", indexFile)
+	} else if err != nil {
+		log.Printf("[index] Cannot read metadata for index %s: %s\n", indexFile, err)
+	}
+
+	setIndexMeta(meta)
+}
+
+// index the database into the given (empty) index, and write the metadata
+// sidecar file for it.
+func buildIndex(ctx context.Context, index bleve.Index, indexFile string) (meta gsearch.IndexMeta, err error) {
+	meta.BuildStart = time.Now()
+	meta.SourceRows, err = gsearch.IndexDb(ctx, index, Config)
+	if err != nil {
+		return
+	}
+	meta.BuildFinish = time.Now()
+
+	// anything added while building might or might not have made it into the
+	// index; the next incremental update will (re)index it.
+	meta.Watermark = meta.BuildStart.Add(-gsearch.WatermarkMargin)
+
+	meta.DocCount, err = index.DocCount()
+	if err != nil {
+		return
+	}
+
+	err = gsearch.WriteIndexMeta(indexFile, meta)
+	return
+}
+
 func index(done chan bool, wg *sync.WaitGroup) {
 	defer wg.Done()
 
@@ -40,12 +114,46 @@ func index(done chan bool, wg *sync.WaitGroup) {
 		loopDone <- true
 	}()
 
+	fullInterval := time.Duration(Config.Index.FullRebuildInterval) * time.Minute
+	incInterval := time.Duration(Config.Index.IncrementalInterval) * time.Minute
+	compactInterval := time.Duration(Config.Index.CompactInterval) * time.Minute
+	pruneInterval := time.Duration(Config.Index.PruneInterval) * time.Minute
+	nextFull := time.Now()
+	nextCompact := time.Now().Add(compactInterval)
+	nextPrune := time.Now().Add(pruneInterval)
+
 loop:
 	for {
-		indexDb(ctx)
+		if !time.Now().Before(nextFull) {
+			indexDb(ctx)
+			nextFull = time.Now().Add(fullInterval)
+		} else {
+			indexDbIncremental(ctx)
+		}
+
+		if compactInterval > 0 && !time.Now().Before(nextCompact) {
+			compactIndex(ctx, curIdx)
+			nextCompact = time.Now().Add(compactInterval)
+		}
+
+		if pruneInterval > 0 && !time.Now().Before(nextPrune) {
+			pruneIndex(ctx, curIdx)
+			nextPrune = time.Now().Add(pruneInterval)
+		}
+
+		wait := time.Until(nextFull)
+		if incInterval > 0 && incInterval < wait {
+			wait = incInterval
+		}
+		if compactInterval > 0 && time.Until(nextCompact) < wait {
+			wait = time.Until(nextCompact)
+		}
+		if pruneInterval > 0 && time.Until(nextPrune) < wait {
+			wait = time.Until(nextPrune)
+		}
 
 		select {
-		case <-time.After(1 * time.Hour):
+		case <-time.After(wait):
 		case <-loopDone:
 			break loop
 		}
@@ -55,6 +163,14 @@ loop:
 }
 
 func loadInitialIndex(ctx context.Context) {
+	if loadIndex(ctx) {
+		close(idxReadyChan)
+	}
+}
+
+// open (or build, if none exists) the index to use and add it to idx. returns
+// false if loading was canceled before an index was available.
+func loadIndex(ctx context.Context) bool {
 	pingFile := path.Join(Config.Index.Path, "ping.idx")
 	pongFile := path.Join(Config.Index.Path, "pong.idx")
 
@@ -76,12 +192,14 @@ func loadInitialIndex(ctx context.Context) {
 			log.Println("[index] Going with ping because there was an error opening pong.")
 			curIdx = pingIdx
 			idx.Add(pingIdx)
-			return
+			loadIndexMeta(pingFile)
+			return true
 		} else if pongErr == nil && pingErr != nil {
 			log.Println("[index] Going with pong because there was an error opening ping.")
 			curIdx = pongIdx
 			idx.Add(pongIdx)
-			return
+			loadIndexMeta(pongFile)
+			return true
 		} else if pingErr != nil && pongErr != nil {
 			err = fmt.Errorf("Could not open either index file:\nping: %v\npong: %v", pingErr, pongErr)
 			panic(err)
@@ -93,12 +211,14 @@ func loadInitialIndex(ctx context.Context) {
 			log.Println("[index] Going with ping because there was an error reading pong.")
 			curIdx = pingIdx
 			idx.Add(pingIdx)
-			return
+			loadIndexMeta(pingFile)
+			return true
 		} else if pongErr == nil && pingErr != nil {
 			log.Println("[index] Going with pong because there was an error reading ping.")
 			curIdx = pongIdx
 			idx.Add(pongIdx)
-			return
+			loadIndexMeta(pongFile)
+			return true
 		} else if pingErr != nil && pongErr != nil {
 			err = fmt.Errorf("[index] Could not read either index file:\nping: %v\npong: %v", pingErr, pongErr)
 			panic(err)
@@ -110,37 +230,45 @@ func loadInitialIndex(ctx context.Context) {
 				pingCount, pongCount)
 			curIdx = pingIdx
 			idx.Add(pingIdx)
+			loadIndexMeta(pingFile)
 		} else {
 			log.Printf(
 				"[index] Choosing pong index since it has more documents (%d) than ping (%d).\n",
 				pongCount, pingCount)
 			curIdx = pongIdx
 			idx.Add(pongIdx)
+			loadIndexMeta(pongFile)
 		}
 	} else if pingExists {
 		curIdx, err = gsearch.OpenIndex(pingFile, "ping")
 		utils.PanicOnErr(err)
 		idx.Add(curIdx)
+		loadIndexMeta(pingFile)
 		log.Println("[index] Opened ping index.")
 	} else if pongExists {
 		curIdx, err = gsearch.OpenIndex(pongFile, "pong")
 		utils.PanicOnErr(err)
 		idx.Add(curIdx)
+		loadIndexMeta(pongFile)
 		log.Println("[index] Opened pong index.")
 	} else {
 		log.Println("[index] No index available. Creating ping index...")
 
-		curIdx, err = gsearch.NewIndex(pingFile, "ping")
+		curIdx, err = gsearch.NewShardedIndex(pingFile, "ping", Config.Index.Shards)
 		utils.PanicOnErr(err)
 
-		err = gsearch.IndexDb(ctx, curIdx, Config)
+		var meta gsearch.IndexMeta
+		meta, err = buildIndex(ctx, curIdx, pingFile)
 		if ctx.Err() == context.Canceled {
-			return
+			return false
 		}
 		utils.PanicOnErr(err)
 
 		idx.Add(curIdx)
+		setIndexMeta(meta)
 	}
+
+	return true
 }
 
 func indexDb(ctx context.Context) {
@@ -160,19 +288,145 @@ func indexDb(ctx context.Context) {
 
 	err := os.RemoveAll(newIdxFile)
 	utils.PanicOnErr(err)
+	err = gsearch.RemoveIndexMeta(newIdxFile)
+	utils.PanicOnErr(err)
 
 	log.Println("Creating new index:", newIdxFile)
-	newIdx, err := gsearch.NewIndex(newIdxFile, newIdxName)
+	newIdx, err := gsearch.NewShardedIndex(newIdxFile, newIdxName, Config.Index.Shards)
 	utils.PanicOnErr(err)
 
-	err = gsearch.IndexDb(ctx, newIdx, Config)
+	meta, err := buildIndex(ctx, newIdx, newIdxFile)
 	if ctx.Err() == context.Canceled {
 		return
 	}
+	if err != nil {
+		log.Printf("[index] ERROR: Building index %s failed: %s. Keeping the current index.\n", newIdxFile, err)
+		newIdx.Close()
+		return
+	}
+
+	curCount, err := curIdx.DocCount()
 	utils.PanicOnErr(err)
+	if !acceptRebuiltIndex(curCount, meta.DocCount, Config.Index.MinDocRatio, refusedRebuilds, Config.Index.MaxRefusedRebuilds) {
+		refusedRebuilds++
+		log.Printf(
+			"[index] WARNING: Not swapping in new index %s: it has %d documents, compared to %d in the current one, which is below Index.MinDocRatio (%g). Keeping the current index (refused %d time(s) in a row).\n",
+			newIdxFile, meta.DocCount, curCount, Config.Index.MinDocRatio, refusedRebuilds)
+		newIdx.Close()
+		return
+	}
+
+	if refusedRebuilds > 0 {
+		log.Printf(
+			"[index] Accepting new index %s with %d documents (compared to %d in the current one), after %d refused rebuild(s).\n",
+			newIdxFile, meta.DocCount, curCount, refusedRebuilds)
+	}
+	refusedRebuilds = 0
+
+	// compacting the new index while it's not live yet is cheaper than doing
+	// it later, when it's being searched.
+	if Config.Index.CompactInterval > 0 {
+		compactIndex(ctx, newIdx)
+	}
 
 	idx.Swap([]bleve.Index{newIdx}, []bleve.Index{curIdx})
+	setIndexMeta(meta)
+
+	// cached results from the old index would be stale now
+	searchCache.Clear()
 	log.Println("Swapped in new index:", newIdxFile)
 
 	curIdx = newIdx
 }
+
+// return true if a rebuilt index with newCount documents can replace the current
+// one with curCount documents, i.e. it doesn't have fewer than minRatio times
+// as many documents. since a large drop can also be legitimate (like after
+// removing lots of pages), the index is accepted anyway if the previous
+// maxRefused rebuilt indices were refused (refused is the number of those). a
+// zero maxRefused disables this.
+func acceptRebuiltIndex(curCount uint64, newCount uint64, minRatio float64, refused int, maxRefused int) bool {
+	if minRatio <= 0 || curCount == 0 {
+		return true
+	}
+
+	if maxRefused > 0 && refused >= maxRefused {
+		return true
+	}
+
+	return float64(newCount) >= minRatio*float64(curCount)
+}
+
+// merge the segments of the given index, logging the number of segments before
+// and after. failures are only logged, since the index is still usable.
+func compactIndex(ctx context.Context, index bleve.Index) {
+	start := time.Now()
+	before, after, err := gsearch.CompactIndex(ctx, index)
+	if err != nil {
+		log.Printf("[index] Error compacting index %s: %s\n", index.Name(), err)
+		return
+	}
+
+	log.Printf("[index] Compacted index %s from %d to %d segment(s) in %s.\n",
+		index.Name(), before, after, time.Since(start))
+}
+
+// delete the pages that no longer have any content in the database (for
+// example, because their host was deleted) from the given index. failures are
+// only logged, since the next full rebuild drops those pages anyway.
+func pruneIndex(ctx context.Context, index bleve.Index) {
+	db, err := sql.Open("postgres", Config.GetDbConnStr())
+	if err != nil {
+		log.Println("[index] Cannot connect to database for pruning:", err)
+		return
+	}
+	defer db.Close()
+
+	exist := func(ctx context.Context, urls []string) (map[string]bool, error) {
+		return gsearch.PagesWithContent(ctx, db, urls)
+	}
+
+	start := time.Now()
+	pruned, err := gsearch.PruneIndex(ctx, index, exist)
+	if pruned > 0 {
+		// cached results might still contain the deleted pages
+		searchCache.Clear()
+	}
+	if err != nil {
+		log.Printf("[index] Error pruning index %s (%d page(s) pruned): %s\n", index.Name(), pruned, err)
+		return
+	}
+
+	log.Printf("[index] Pruned %d page(s) from index %s in %s.\n", pruned, index.Name(), time.Since(start))
+}
+
+// add the pages fetched since the last (full or incremental) update to the
+// current index.
+func indexDbIncremental(ctx context.Context) {
+	meta := getIndexMeta()
+	if meta.Watermark.IsZero() {
+		log.Println("[index] No watermark for current index; skipping incremental update.")
+		return
+	}
+
+	start := time.Now()
+	n, err := gsearch.IndexPagesSince(ctx, curIdx, Config, meta.Watermark)
+	if ctx.Err() == context.Canceled {
+		return
+	}
+	utils.PanicOnErr(err)
+
+	meta.Watermark = start.Add(-gsearch.WatermarkMargin)
+	meta.DocCount, err = curIdx.DocCount()
+	utils.PanicOnErr(err)
+
+	curIdxFile := path.Join(Config.Index.Path, curIdx.Name()+".idx")
+	err = gsearch.WriteIndexMeta(curIdxFile, meta)
+	utils.PanicOnErr(err)
+	setIndexMeta(meta)
+
+	if n > 0 {
+		searchCache.Clear()
+	}
+	log.Printf("[index] Incremental update done: %d pages indexed.\n", n)
+}
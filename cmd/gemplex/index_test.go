@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestAcceptRebuiltIndex(t *testing.T) {
+	cases := []struct {
+		curCount   uint64
+		newCount   uint64
+		minRatio   float64
+		refused    int
+		maxRefused int
+		expected   bool
+	}{
+		{1000, 1200, 0.5, 0, 3, true},
+		{1000, 500, 0.5, 0, 3, true},
+		{1000, 499, 0.5, 0, 3, false},
+		{1000, 0, 0.5, 0, 3, false},
+		{1000, 0, 0, 0, 3, true},
+		{0, 0, 0.5, 0, 3, true},
+		{0, 10, 0.5, 0, 3, true},
+		{1000, 899, 0.9, 0, 3, false},
+		{1000, 100, 0.5, 2, 3, false},
+		{1000, 100, 0.5, 3, 3, true},
+		{1000, 100, 0.5, 10, 0, false},
+	}
+
+	for _, c := range cases {
+		accepted := acceptRebuiltIndex(c.curCount, c.newCount, c.minRatio, c.refused, c.maxRefused)
+		if accepted != c.expected {
+			t.Errorf("Expected %v for %d -> %d documents (min ratio %g, refused %d/%d); got %v",
+				c.expected, c.curCount, c.newCount, c.minRatio, c.refused, c.maxRefused, accepted)
+		}
+	}
+}
@@ -8,17 +8,24 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime/pprof"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"git.sr.ht/~elektito/gemplex/pkg/config"
 	"git.sr.ht/~elektito/gemplex/pkg/gcrawler"
+	"git.sr.ht/~elektito/gemplex/pkg/gparse"
+	"git.sr.ht/~elektito/gemplex/pkg/logging"
 	"git.sr.ht/~elektito/gemplex/pkg/utils"
 )
 
 var Config *config.Config
 var CrawlerStateFile *string
+
+// set by "crawl -once", to make a single crawling pass and exit.
+var CrawlOnce bool
 var Db *sql.DB
 
 func main() {
@@ -28,13 +35,33 @@ func main() {
 		"",
 		"Dump crawler state on shutdown to the given filename (by default state will not be dumped).",
 	)
+	verbose := flag.Bool("verbose", false, "Enable debug logs (overrides Log.Level in the config file).")
 	flag.Usage = usage
 	flag.Parse()
 
 	Config = config.LoadConfig(*configFile)
 
+	logLevel, err := logging.ParseLevel(Config.Log.Level)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *verbose {
+		logLevel = logging.LevelDebug
+	}
+	logging.SetLevel(logLevel)
+
+	for alias, canonical := range Config.Crawl.HostAliases {
+		gparse.AddHostAlias(alias, canonical)
+	}
+
+	if flag.Arg(0) == "healthcheck" {
+		if !healthcheck() {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// open (and check) database for all workers to use
-	var err error
 	Db, err = sql.Open("postgres", Config.GetDbConnStr())
 	utils.PanicOnErr(err)
 	err = Db.Ping()
@@ -59,7 +86,17 @@ func main() {
 
 	seen := map[string]bool{}
 	funcs := []func(chan bool, *sync.WaitGroup){}
+	names := []string{}
 	for _, cmd := range cmds {
+		if cmd == "-once" {
+			if len(names) == 0 || names[len(names)-1] != "crawl" {
+				fmt.Println("The -once flag can only be passed to the crawl command.")
+				os.Exit(1)
+			}
+			CrawlOnce = true
+			continue
+		}
+
 		if _, ok := seen[cmd]; ok {
 			fmt.Println("Duplicate command:", cmd)
 			os.Exit(1)
@@ -78,6 +115,8 @@ func main() {
 			fmt.Println("Unrecognized command:", cmd)
 			os.Exit(1)
 		}
+
+		names = append(names, cmd)
 	}
 
 	// setup signal handling
@@ -94,11 +133,40 @@ func main() {
 
 	wg.Add(len(funcs))
 
+	// keep track of which daemons are still running, so we can report them if
+	// shutdown takes too long.
+	var runningMu sync.Mutex
+	running := map[string]bool{}
 	for i, f := range funcs {
-		go f(done[i], &wg)
+		running[names[i]] = true
+		go func(name string, f func(chan bool, *sync.WaitGroup), done chan bool) {
+			var daemonWg sync.WaitGroup
+			daemonWg.Add(1)
+			f(done, &daemonWg)
+			daemonWg.Wait()
+
+			runningMu.Lock()
+			delete(running, name)
+			runningMu.Unlock()
+
+			wg.Done()
+		}(names[i], f, done[i])
 	}
 
-	<-sigs
+	// daemons normally run until we're signaled, but some (like "crawl
+	// -once") can finish on their own.
+	allStopped := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(allStopped)
+	}()
+
+	select {
+	case <-sigs:
+	case <-allStopped:
+		log.Println("[gemplex] All daemons finished.")
+		return
+	}
 
 	// stop receiving signals, so user can stop the program by sending another
 	// signal (in case the finalization process is taking too long).
@@ -111,7 +179,30 @@ func main() {
 	}
 
 	log.Println("[gemplex] Waiting for daemons to stop...")
-	wg.Wait()
+
+	var timeout <-chan time.Time
+	if Config.ShutdownTimeout > 0 {
+		timeout = time.After(time.Duration(Config.ShutdownTimeout) * time.Second)
+	}
+
+	select {
+	case <-allStopped:
+	case <-timeout:
+		runningMu.Lock()
+		stuck := make([]string, 0, len(running))
+		for name := range running {
+			stuck = append(stuck, name)
+		}
+		runningMu.Unlock()
+
+		log.Printf(
+			"[gemplex] Daemons did not stop in %d seconds: %s\n",
+			Config.ShutdownTimeout, strings.Join(stuck, ", "))
+		log.Println("[gemplex] Dumping goroutines:")
+		pprof.Lookup("goroutine").WriteTo(log.Writer(), 1)
+		log.Println("[gemplex] Exiting anyway.")
+		os.Exit(1)
+	}
 
 	log.Println("[gemplex] Done.")
 }
@@ -119,7 +210,7 @@ func main() {
 func usage() {
 	fmt.Printf(`Gemplex Search Engine
 
-usage: %s [flags] { all | <commands> }
+usage: %s [flags] { all | healthcheck | <commands> }
 
 The following flags are available:
 
@@ -134,11 +225,22 @@ The following flags are available:
     Dump crawler state to a file with the given name. Could be useful for
     debugging. By default, state will not be dumped.
 
+-verbose
+
+    Enable debug logs, like per-url crawler logs. This overrides the log level
+    set in the config file.
+
+If "healthcheck" is used, the database, the index and the search daemon are
+checked, and the program exits with a non-zero exit code if any of them is not
+usable.
+
 <commands> can be one or more of these commands, separated by spaces. If "all"
 is used, all daemons are launched.
 
  - crawl: Start the crawler daemon. The crawler routinely crawls the geminispace
-   and stores the results in the database.
+   and stores the results in the database. If followed by -once (like
+   "crawl -once"), the crawler makes a single pass over the urls currently due
+   for crawling, and exits once they are all visited and stored.
 
  - rank: Start the periodic pagerank calculator damon.
 
@@ -152,11 +254,8 @@ is used, all daemons are launched.
 }
 
 func updateBlacklist() {
-	for _, domain := range Config.Blacklist.Domains {
-		gcrawler.AddDomainToBlacklist(domain)
-	}
-
-	for _, prefix := range Config.Blacklist.Prefixes {
-		gcrawler.AddPrefixToBlacklist(prefix)
+	err := gcrawler.ConfigureBlacklist(Config)
+	if err != nil {
+		log.Fatal(err)
 	}
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"git.sr.ht/~elektito/gemplex/pkg/db"
+	"git.sr.ht/~elektito/gemplex/pkg/logging"
+)
+
+// the maximum number of popular queries returned
+const maxPopularQueries = 100
+
+// normalize the given query for counting, so that trivially different versions
+// of a query are counted together. ok is false if the query should not be
+// counted at all.
+func normalizePopularQuery(query string, maxLength int) (normalized string, ok bool) {
+	normalized = strings.Join(strings.Fields(strings.ToLower(query)), " ")
+	if normalized == "" || utf8.RuneCountInString(normalized) > maxLength {
+		return "", false
+	}
+
+	ok = true
+	return
+}
+
+// return the HMAC of the given (normalized) query, keyed with the given key, as
+// a hex string.
+func hashPopularQuery(query string, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(query))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// count the given query, if popular queries are enabled.
+func recordPopularQuery(query string) {
+	if !Config.Search.PopularQueriesEnabled {
+		return
+	}
+
+	query, ok := normalizePopularQuery(query, Config.Search.PopularQueryMaxLength)
+	if !ok {
+		return
+	}
+
+	if Config.Search.PopularQueryHashKey != "" {
+		query = hashPopularQuery(query, Config.Search.PopularQueryHashKey)
+	}
+
+	err := db.RecordQuery(Db, query, time.Now())
+	if err != nil {
+		logging.Warnf("[search] Error recording popular query: %s", err)
+	}
+}
+
+func handleTopQueriesRequest(reqLine []byte) []byte {
+	var req struct {
+		Count int `json:"n"`
+	}
+
+	var resp struct {
+		Days    int             `json:"days"`
+		Queries []db.QueryCount `json:"queries"`
+	}
+
+	err := json.Unmarshal(reqLine, &req)
+	if err != nil {
+		return errorResponse("bad request")
+	}
+
+	if req.Count <= 0 || req.Count > maxPopularQueries {
+		req.Count = maxPopularQueries
+	}
+
+	resp.Days = Config.Search.PopularQueryDays
+	resp.Queries = []db.QueryCount{}
+	// hashed queries are meaningless to users, so they are never listed.
+	if Config.Search.PopularQueriesEnabled && Config.Search.PopularQueryHashKey == "" {
+		since := time.Now().AddDate(0, 0, -resp.Days)
+		resp.Queries, err = db.TopQueries(Db, since, Config.Search.PopularQueryMinCount, req.Count)
+		if err != nil {
+			return errorResponse(fmt.Sprintf("Database error: %s", err))
+		}
+	}
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Error marshalling results: %s", err))
+	}
+
+	return jsonResp
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestNormalizePopularQuery(t *testing.T) {
+	cases := []struct {
+		query      string
+		normalized string
+		ok         bool
+	}{
+		{"gemini", "gemini", true},
+		{"  Gemini   Protocol ", "gemini protocol", true},
+		{"", "", false},
+		{"   ", "", false},
+		{"ünïcödé", "ünïcödé", true},
+		{"this query is far too long to be counted", "", false},
+	}
+
+	for _, c := range cases {
+		normalized, ok := normalizePopularQuery(c.query, 20)
+		if normalized != c.normalized || ok != c.ok {
+			t.Fatalf("normalizePopularQuery(%q): expected (%q, %t); got (%q, %t)",
+				c.query, c.normalized, c.ok, normalized, ok)
+		}
+	}
+}
+
+func TestHashPopularQuery(t *testing.T) {
+	h1 := hashPopularQuery("gemini", "key")
+	h2 := hashPopularQuery("gemini", "key")
+	if h1 != h2 {
+		t.Fatalf("Expected the same hash for the same query; got %q and %q", h1, h2)
+	}
+
+	if len(h1) != 64 {
+		t.Fatalf("Expected a hex encoded sha256 hmac; got: %q", h1)
+	}
+
+	if h1 == hashPopularQuery("gemini", "other-key") {
+		t.Fatal("Expected a different hash with a different key")
+	}
+
+	if h1 == hashPopularQuery("gopher", "key") {
+		t.Fatal("Expected a different hash for a different query")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+type QueryLogEntry struct {
+	Time     time.Time     `json:"time"`
+	Type     string        `json:"t"`
+	Query    string        `json:"q"`
+	Page     int           `json:"page"`
+	Results  uint64        `json:"n"`
+	Duration time.Duration `json:"duration"`
+	Err      string        `json:"err,omitempty"`
+}
+
+// a json lines query log, rotated based on size.
+type QueryLog struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// this is nil if query logging is disabled.
+var queryLog *QueryLog
+
+func OpenQueryLog(path string, maxSize int64, maxFiles int) (ql *QueryLog, err error) {
+	ql = &QueryLog{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+
+	err = ql.open()
+	return
+}
+
+func (ql *QueryLog) open() (err error) {
+	ql.f, err = os.OpenFile(ql.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+
+	info, err := ql.f.Stat()
+	if err != nil {
+		ql.f.Close()
+		return
+	}
+
+	ql.size = info.Size()
+	return
+}
+
+// rename the current log file to <path>.1 (shifting older files up, and
+// removing the oldest one), and start a new log file.
+func (ql *QueryLog) rotate() (err error) {
+	ql.f.Close()
+
+	if ql.maxFiles > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", ql.path, ql.maxFiles))
+		for i := ql.maxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", ql.path, i), fmt.Sprintf("%s.%d", ql.path, i+1))
+		}
+		err = os.Rename(ql.path, ql.path+".1")
+	} else {
+		err = os.Remove(ql.path)
+	}
+	if err != nil {
+		return
+	}
+
+	return ql.open()
+}
+
+func (ql *QueryLog) Log(entry QueryLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Println("[search] Error marshalling query log entry:", err)
+		return
+	}
+	line = append(line, '\n')
+
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+
+	if ql.maxSize > 0 && ql.size > 0 && ql.size+int64(len(line)) > ql.maxSize {
+		err = ql.rotate()
+		if err != nil {
+			log.Println("[search] Error rotating query log:", err)
+			return
+		}
+	}
+
+	n, err := ql.f.Write(line)
+	ql.size += int64(n)
+	if err != nil {
+		log.Println("[search] Error writing to query log:", err)
+	}
+}
+
+func (ql *QueryLog) Close() error {
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+
+	return ql.f.Close()
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestQueryLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	logPath := path.Join(dir, "queries.log")
+
+	ql, err := OpenQueryLog(logPath, 100, 2)
+	if err != nil {
+		t.Fatal("Cannot open query log:", err)
+	}
+	defer ql.Close()
+
+	for i := 0; i < 10; i++ {
+		ql.Log(QueryLogEntry{Type: "search", Query: "foobar"})
+	}
+
+	for _, name := range []string{"queries.log", "queries.log.1", "queries.log.2"} {
+		info, err := os.Stat(path.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Expected log file %s to exist: %s", name, err)
+		}
+
+		if info.Size() > 100 {
+			t.Fatalf("Log file %s is larger than the maximum size: %d", name, info.Size())
+		}
+	}
+
+	if _, err := os.Stat(path.Join(dir, "queries.log.3")); err == nil {
+		t.Fatal("Expected at most 2 old log files to be kept")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// hostResolver caches the address chosen for each host. Successful resolutions
+// are kept for ttl, and failures for negativeTTL, after which the host is
+// resolved again. It is only used by the coordinator, so it is not safe for
+// concurrent use.
+type hostResolver struct {
+	ttl         time.Duration
+	negativeTTL time.Duration
+	preferIPv4  bool
+	preferIPv6  bool
+
+	// used for testing; default to time.Now and net.LookupIP
+	now    func() time.Time
+	lookup func(host string) ([]net.IP, error)
+
+	entries map[string]resolvedHost
+}
+
+type resolvedHost struct {
+	ip      string // empty if resolution failed
+	err     error
+	expires time.Time
+}
+
+func newHostResolver(ttl, negativeTTL time.Duration, preferIPv4, preferIPv6 bool) *hostResolver {
+	return &hostResolver{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		preferIPv4:  preferIPv4,
+		preferIPv6:  preferIPv6,
+		now:         time.Now,
+		lookup:      net.LookupIP,
+		entries:     map[string]resolvedHost{},
+	}
+}
+
+// Resolve returns the address chosen for the given host, resolving it if there
+// is no unexpired entry for it. A cached failure is returned as an error until
+// it expires.
+func (r *hostResolver) Resolve(host string) (ip string, err error) {
+	entry, ok := r.entries[host]
+	if ok && r.now().Before(entry.expires) {
+		ip, err = entry.ip, entry.err
+		return
+	}
+
+	ips, err := r.lookup(host)
+	if err == nil && len(ips) == 0 {
+		err = fmt.Errorf("empty response")
+	}
+	if err != nil {
+		r.entries[host] = resolvedHost{
+			err:     err,
+			expires: r.now().Add(r.negativeTTL),
+		}
+		return
+	}
+
+	ip = selectIP(ips, r.preferIPv4, r.preferIPv6).String()
+	r.entries[host] = resolvedHost{
+		ip:      ip,
+		expires: r.now().Add(r.ttl),
+	}
+	return
+}
+
+// select an address from the given list, preferring the given address family
+// (if any), and falling back to the first address otherwise.
+func selectIP(ips []net.IP, preferIPv4, preferIPv6 bool) net.IP {
+	if len(ips) == 0 {
+		return nil
+	}
+
+	if preferIPv4 || preferIPv6 {
+		for _, ip := range ips {
+			isIPv4 := ip.To4() != nil
+			if isIPv4 == preferIPv4 {
+				return ip
+			}
+		}
+	}
+
+	return ips[0]
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSelectIP(t *testing.T) {
+	v4 := net.ParseIP("192.0.2.1")
+	v6 := net.ParseIP("2001:db8::1")
+
+	cases := []struct {
+		ips        []net.IP
+		preferIPv4 bool
+		preferIPv6 bool
+		expected   net.IP
+	}{
+		{[]net.IP{v6, v4}, false, false, v6},
+		{[]net.IP{v4, v6}, false, false, v4},
+		{[]net.IP{v6, v4}, true, false, v4},
+		{[]net.IP{v4, v6}, false, true, v6},
+		{[]net.IP{v6}, true, false, v6},
+		{[]net.IP{v4}, false, true, v4},
+		{[]net.IP{v6, v4}, true, true, v4},
+		{nil, true, false, nil},
+	}
+
+	for _, c := range cases {
+		result := selectIP(c.ips, c.preferIPv4, c.preferIPv6)
+		if !result.Equal(c.expected) {
+			t.Errorf("For %v (v4=%t v6=%t): expected %v; got %v",
+				c.ips, c.preferIPv4, c.preferIPv6, c.expected, result)
+		}
+	}
+}
+
+type fakeLookup struct {
+	ips   []net.IP
+	err   error
+	calls int
+}
+
+func (f *fakeLookup) lookup(host string) ([]net.IP, error) {
+	f.calls++
+	return f.ips, f.err
+}
+
+func newTestResolver(now *time.Time, f *fakeLookup) *hostResolver {
+	r := newHostResolver(time.Hour, time.Minute, false, false)
+	r.now = func() time.Time { return *now }
+	r.lookup = f.lookup
+	return r
+}
+
+func TestHostResolverPositiveExpiry(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := &fakeLookup{ips: []net.IP{net.ParseIP("192.0.2.1")}}
+	r := newTestResolver(&now, f)
+
+	ip, err := r.Resolve("example.org")
+	if err != nil || ip != "192.0.2.1" {
+		t.Fatalf("Unexpected result: ip=%q err=%v", ip, err)
+	}
+
+	f.ips = []net.IP{net.ParseIP("192.0.2.2")}
+	now = now.Add(59 * time.Minute)
+	ip, _ = r.Resolve("example.org")
+	if ip != "192.0.2.1" || f.calls != 1 {
+		t.Fatalf("Expected cached address; got %q after %d lookups", ip, f.calls)
+	}
+
+	now = now.Add(2 * time.Minute)
+	ip, _ = r.Resolve("example.org")
+	if ip != "192.0.2.2" || f.calls != 2 {
+		t.Fatalf("Expected a new lookup; got %q after %d lookups", ip, f.calls)
+	}
+}
+
+func TestHostResolverNegativeExpiry(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := &fakeLookup{err: errors.New("no such host")}
+	r := newTestResolver(&now, f)
+
+	_, err := r.Resolve("example.org")
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	f.ips = []net.IP{net.ParseIP("192.0.2.1")}
+	f.err = nil
+	now = now.Add(30 * time.Second)
+	_, err = r.Resolve("example.org")
+	if err == nil || f.calls != 1 {
+		t.Fatalf("Expected cached failure; got err=%v after %d lookups", err, f.calls)
+	}
+
+	now = now.Add(time.Minute)
+	ip, err := r.Resolve("example.org")
+	if err != nil || ip != "192.0.2.1" || f.calls != 2 {
+		t.Fatalf("Expected recovery; got ip=%q err=%v after %d lookups", ip, err, f.calls)
+	}
+}
+
+func TestHostResolverEmptyResponse(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := &fakeLookup{}
+	r := newTestResolver(&now, f)
+
+	_, err := r.Resolve("example.org")
+	if err == nil {
+		t.Fatal("Expected an error for an empty response")
+	}
+}
@@ -3,16 +3,21 @@ package main
 import (
 	"bufio"
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"sync"
 	"time"
 
+	"git.sr.ht/~elektito/gemplex/pkg/db"
+	"git.sr.ht/~elektito/gemplex/pkg/gparse"
 	"git.sr.ht/~elektito/gemplex/pkg/gsearch"
 	"git.sr.ht/~elektito/gemplex/pkg/utils"
+	"golang.org/x/exp/slices"
 )
 
 type TypedRequest struct {
@@ -22,8 +27,36 @@ type TypedRequest struct {
 func search(done chan bool, wg *sync.WaitGroup) {
 	defer wg.Done()
 
+	// this needs to be set before the first search is performed
+	gsearch.SetSnippetSize(Config.Search.SnippetSize)
+
+	gsearch.SetTitleBoost(Config.Search.TitleBoost)
+	gsearch.SetLinksBoost(Config.Search.LinksBoost)
+	gsearch.SetHeadingsBoost(Config.Search.HeadingsBoost)
+	gsearch.SetLangBoost(Config.Search.LangBoost)
+	gsearch.SetMaxReportedResults(Config.Search.MaxReportedResults)
+	gsearch.SetSynonyms(Config.Search.Synonyms)
+	gsearch.SetSynonymBoost(Config.Search.SynonymBoost)
+
+	searchCache.Configure(
+		Config.Search.CacheSize,
+		time.Duration(Config.Search.CacheTTL)*time.Second)
+
+	// load the index in the background, so that we can start answering
+	// requests (with an "index not ready" error) while it is being built.
 	ctx, cancelFunc := context.WithCancel(context.Background())
-	loadIndexOnce.Do(func() { loadInitialIndex(ctx) })
+	go loadIndexOnce.Do(func() { loadInitialIndex(ctx) })
+
+	if Config.Search.QueryLogEnabled {
+		ql, err := OpenQueryLog(
+			Config.Search.QueryLogPath,
+			Config.Search.QueryLogMaxSize,
+			Config.Search.QueryLogMaxFiles)
+		utils.PanicOnErr(err)
+		defer ql.Close()
+		queryLog = ql
+		log.Println("[search] Logging queries to:", Config.Search.QueryLogPath)
+	}
 
 	cleanupUnixSocket()
 	listener, err := net.Listen("unix", Config.Search.UnixSocketPath)
@@ -84,10 +117,26 @@ func handleConn(conn net.Conn) {
 		resp = handleSearchRequest(reqLine)
 	case "randimg":
 		resp = handleRandImgRequest(reqLine)
+	case "randpage":
+		resp = handleRandPageRequest(reqLine)
 	case "getimg":
 		resp = handleGetImgRequest(reqLine)
 	case "searchimg":
 		resp = handleSearchImgRequest(reqLine)
+	case "suggest":
+		resp = handleSuggestRequest(reqLine)
+	case "health":
+		resp = handleHealthRequest(reqLine)
+	case "stats":
+		resp = handleStatsRequest(reqLine)
+	case "backlinks":
+		resp = handleBacklinksRequest(reqLine)
+	case "topqueries":
+		resp = handleTopQueriesRequest(reqLine)
+	case "urlinfo":
+		resp = handleUrlInfoRequest(reqLine)
+	case "hosts":
+		resp = handleHostsRequest(reqLine)
 	default:
 		resp = errorResponse("unknown request type")
 		return
@@ -109,11 +158,29 @@ func handleSearchRequest(reqLine []byte) []byte {
 		return errorResponse("no query")
 	}
 
-	resp, err := gsearch.SearchPages(req, idx)
+	if !indexReady() {
+		return errorResponse(gsearch.ErrIndexNotReady.Error())
+	}
+
+	resp, ok := searchCache.Get(req)
+	if !ok {
+		resp, err = gsearch.SearchPages(req, idx)
+		if err == nil {
+			searchCache.Put(req, resp)
+		}
+	}
+	logQuery("search", req.Query, req.Page, resp.TotalResults, resp.Duration, err)
 	if err != nil {
 		return errorResponse(err.Error())
 	}
 
+	// only count a query once, not for every page of results viewed
+	if req.Page == 1 {
+		go recordPopularQuery(req.Query)
+	}
+
+	resp.IndexBuilt = getIndexMeta().BuildFinish
+
 	jsonResp, err := json.Marshal(resp)
 	if err != nil {
 		return errorResponse(fmt.Sprintf("Error marshalling results: %s", err))
@@ -122,7 +189,53 @@ func handleSearchRequest(reqLine []byte) []byte {
 	return jsonResp
 }
 
+// the maximum number of images a random image request can exclude.
+const maxRandImgExclusions = 100
+
+// return the hashes of the images a random image request asks to exclude (like
+// the ones recently shown to the user). the result is never nil, since a null
+// array would not match any images in the query.
+func randImgExclusions(reqLine []byte) (exclude []string, err error) {
+	var req struct {
+		Exclude []string `json:"exclude"`
+	}
+
+	err = json.Unmarshal(reqLine, &req)
+	if err != nil {
+		return
+	}
+
+	if len(req.Exclude) > maxRandImgExclusions {
+		err = fmt.Errorf("too many excluded images: %d", len(req.Exclude))
+		return
+	}
+
+	exclude = req.Exclude
+	if exclude == nil {
+		exclude = []string{}
+	}
+
+	return
+}
+
+// return the first of the given (randomly sampled) image hashes that is not
+// excluded, or false if they are all excluded.
+func pickRandImg(sample []string, exclude []string) (hash string, ok bool) {
+	for _, h := range sample {
+		if !slices.Contains(exclude, h) {
+			return h, true
+		}
+	}
+
+	return "", false
+}
+
 func handleRandImgRequest(reqLine []byte) []byte {
+	exclude, err := randImgExclusions(reqLine)
+	if err != nil {
+		return errorResponse("bad request")
+	}
+
 	var resp struct {
 		Url       string    `json:"url"`
 		Alt       string    `json:"alt"`
@@ -131,12 +244,65 @@ func handleRandImgRequest(reqLine []byte) []byte {
 		ImageId   string    `json:"image_id"`
 	}
 
+	// sample one more image than the excluded ones, so that at least one of
+	// them is not excluded (unless there are too few images to begin with).
+	rows, err := Db.Query(`
+select * from
+	(select image_hash from images tablesample bernoulli(1)) s
+order by random() limit $1;
+`, len(exclude)+1)
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Database error: %s", err))
+	}
+	defer rows.Close()
+
+	var sample []string
+	for rows.Next() {
+		var hash string
+		err = rows.Scan(&hash)
+		if err != nil {
+			return errorResponse(fmt.Sprintf("Database error: %s", err))
+		}
+		sample = append(sample, hash)
+	}
+	if err = rows.Err(); err != nil {
+		return errorResponse(fmt.Sprintf("Database error: %s", err))
+	}
+
+	hash, ok := pickRandImg(sample, exclude)
+	if !ok {
+		return errorResponse("no images found")
+	}
+
+	row := Db.QueryRow(`
+select url, alt, image_hash, image, fetch_time from images where image_hash = $1
+`, hash)
+	err = row.Scan(&resp.Url, &resp.Alt, &resp.ImageId, &resp.Image, &resp.FetchTime)
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Database error: %s", err))
+	}
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Error marshalling results: %s", err))
+	}
+
+	return jsonResp
+}
+
+func handleRandPageRequest(reqLine []byte) []byte {
+	var resp struct {
+		Url string `json:"url"`
+	}
+
 	row := Db.QueryRow(`
 select * from
-	(select url, alt, image_hash, image, fetch_time from images tablesample bernoulli(1)) s
+	(select url from urls tablesample bernoulli(1)
+	 where content_id is not null and not banned
+	       and hostname not in (select hostname from hosts where search_hidden)) s
 order by random() limit 1;
 `)
-	err := row.Scan(&resp.Url, &resp.Alt, &resp.ImageId, &resp.Image, &resp.FetchTime)
+	err := row.Scan(&resp.Url)
 	if err != nil {
 		return errorResponse(fmt.Sprintf("Database error: %s", err))
 	}
@@ -149,6 +315,122 @@ order by random() limit 1;
 	return jsonResp
 }
 
+func handleBacklinksRequest(reqLine []byte) []byte {
+	var req struct {
+		Url  string `json:"url"`
+		Page int    `json:"page"`
+	}
+
+	var resp struct {
+		Url       string        `json:"url"`
+		Total     int           `json:"n"`
+		Backlinks []gparse.Link `json:"backlinks"`
+	}
+
+	req.Page = 1
+	err := json.Unmarshal(reqLine, &req)
+	if err != nil || req.Page < 1 {
+		return errorResponse("bad request")
+	}
+
+	u, err := url.Parse(req.Url)
+	if err != nil {
+		return errorResponse("bad url")
+	}
+	u, err = gparse.NormalizeUrl(u)
+	if err != nil {
+		return errorResponse("bad url")
+	}
+
+	resp.Url = u.String()
+	resp.Backlinks, resp.Total, err = db.QueryBacklinks(Db, resp.Url, (req.Page-1)*gsearch.PageSize, gsearch.PageSize)
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Database error: %s", err))
+	}
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Error marshalling results: %s", err))
+	}
+
+	return jsonResp
+}
+
+func handleHostsRequest(reqLine []byte) []byte {
+	var req struct {
+		Page int `json:"page"`
+	}
+
+	var resp struct {
+		Total int           `json:"n"`
+		Hosts []db.HostInfo `json:"hosts"`
+	}
+
+	req.Page = 1
+	err := json.Unmarshal(reqLine, &req)
+	if err != nil || req.Page < 1 {
+		return errorResponse("bad request")
+	}
+
+	resp.Hosts, resp.Total, err = db.QueryHosts(Db, (req.Page-1)*gsearch.PageSize, gsearch.PageSize)
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Database error: %s", err))
+	}
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Error marshalling results: %s", err))
+	}
+
+	return jsonResp
+}
+
+func handleUrlInfoRequest(reqLine []byte) []byte {
+	var req struct {
+		Url string `json:"url"`
+	}
+
+	var resp struct {
+		Found bool       `json:"found"`
+		Info  db.UrlInfo `json:"info"`
+	}
+
+	err := json.Unmarshal(reqLine, &req)
+	if err != nil {
+		return errorResponse("bad request")
+	}
+
+	u, err := url.Parse(req.Url)
+	if err != nil {
+		return errorResponse("bad url")
+	}
+	u, err = gparse.NormalizeUrl(u)
+	if err != nil {
+		return errorResponse("bad url")
+	}
+
+	resp.Info, err = db.QueryUrl(Db, u.String(), false)
+	if err == sql.ErrNoRows {
+		resp.Info = db.UrlInfo{Url: u.String()}
+	} else if err != nil {
+		return errorResponse(fmt.Sprintf("Database error: %s", err))
+	} else {
+		resp.Found = true
+	}
+
+	// the url info is shown on a public page, so only the lengths of the
+	// contents are sent, and not the contents themselves.
+	resp.Info.Contents = nil
+	resp.Info.ContentsText = ""
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Error marshalling results: %s", err))
+	}
+
+	return jsonResp
+}
+
 func handleGetImgRequest(reqLine []byte) []byte {
 	var req struct {
 		Id string `json:"id"`
@@ -193,7 +475,36 @@ func handleSearchImgRequest(reqLine []byte) []byte {
 		return errorResponse("no query")
 	}
 
+	if !indexReady() {
+		return errorResponse(gsearch.ErrIndexNotReady.Error())
+	}
+
 	resp, err := gsearch.SearchImages(req, idx)
+	logQuery("searchimg", req.Query, req.Page, resp.TotalResults, resp.Duration, err)
+	if err != nil {
+		return errorResponse(err.Error())
+	}
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Error marshalling results: %s", err))
+	}
+
+	return jsonResp
+}
+
+func handleSuggestRequest(reqLine []byte) []byte {
+	var req gsearch.SuggestRequest
+	err := json.Unmarshal(reqLine, &req)
+	if err != nil {
+		return errorResponse("bad request")
+	}
+
+	if !indexReady() {
+		return errorResponse(gsearch.ErrIndexNotReady.Error())
+	}
+
+	resp, err := gsearch.Suggest(req, idx)
 	if err != nil {
 		return errorResponse(err.Error())
 	}
@@ -206,6 +517,73 @@ func handleSearchImgRequest(reqLine []byte) []byte {
 	return jsonResp
 }
 
+func handleHealthRequest(reqLine []byte) []byte {
+	var resp healthResponse
+
+	if !indexReady() {
+		return errorResponse(gsearch.ErrIndexNotReady.Error())
+	}
+
+	docs, err := idx.DocCount()
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Index error: %s", err))
+	}
+	resp.DocCount = docs
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Error marshalling results: %s", err))
+	}
+
+	return jsonResp
+}
+
+func handleStatsRequest(reqLine []byte) []byte {
+	if !indexReady() {
+		return errorResponse(gsearch.ErrIndexNotReady.Error())
+	}
+
+	var resp gsearch.IndexStatsResponse
+	resp.IndexMeta = getIndexMeta()
+
+	// the metadata might be unknown (no sidecar file), but we can always report
+	// the number of documents.
+	if resp.DocCount == 0 {
+		docs, err := idx.DocCount()
+		if err != nil {
+			return errorResponse(fmt.Sprintf("Index error: %s", err))
+		}
+		resp.DocCount = docs
+	}
+
+	jsonResp, err := json.Marshal(resp)
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Error marshalling results: %s", err))
+	}
+
+	return jsonResp
+}
+
+func logQuery(reqType string, query string, page int, n uint64, duration time.Duration, err error) {
+	if queryLog == nil {
+		return
+	}
+
+	entry := QueryLogEntry{
+		Time:     time.Now(),
+		Type:     reqType,
+		Query:    query,
+		Page:     page,
+		Results:  n,
+		Duration: duration,
+	}
+	if err != nil {
+		entry.Err = err.Error()
+	}
+
+	queryLog.Log(entry)
+}
+
 func errorResponse(msg string) (resp []byte) {
 	type errorJson struct {
 		Err string `json:"err"`
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+func TestRandImgExclusions(t *testing.T) {
+	exclude, err := randImgExclusions([]byte(`{"t": "randimg"}`))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if exclude == nil || len(exclude) != 0 {
+		t.Fatalf("Expected an empty (non-nil) list of exclusions; got: %#v", exclude)
+	}
+
+	exclude, err = randImgExclusions([]byte(`{"t": "randimg", "exclude": ["aaa", "bbb"]}`))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if !slices.Equal(exclude, []string{"aaa", "bbb"}) {
+		t.Fatalf("Unexpected exclusions: %#v", exclude)
+	}
+
+	hashes := make([]string, maxRandImgExclusions+1)
+	for i := range hashes {
+		hashes[i] = fmt.Sprintf(`"%032x"`, i)
+	}
+	reqLine := fmt.Sprintf(`{"t": "randimg", "exclude": [%s]}`, strings.Join(hashes, ","))
+	_, err = randImgExclusions([]byte(reqLine))
+	if err == nil {
+		t.Fatal("Expected an error for too many exclusions")
+	}
+
+	_, err = randImgExclusions([]byte(`{"t": "randimg", "exclude": "aaa"}`))
+	if err == nil {
+		t.Fatal("Expected an error for a malformed request")
+	}
+}
+
+func TestPickRandImg(t *testing.T) {
+	sample := []string{"aaa", "bbb", "ccc"}
+
+	hash, ok := pickRandImg(sample, []string{})
+	if !ok || hash != "aaa" {
+		t.Fatalf("Expected the first sampled image with no exclusions; got %q (%v)", hash, ok)
+	}
+
+	hash, ok = pickRandImg(sample, []string{"aaa", "bbb"})
+	if !ok || hash != "ccc" {
+		t.Fatalf("Expected the only image not excluded; got %q (%v)", hash, ok)
+	}
+
+	hash, ok = pickRandImg(sample, []string{"ccc", "aaa", "bbb"})
+	if ok {
+		t.Fatalf("Expected no image when all are excluded; got %q", hash)
+	}
+
+	_, ok = pickRandImg(nil, []string{})
+	if ok {
+		t.Fatal("Expected no image from an empty sample")
+	}
+}
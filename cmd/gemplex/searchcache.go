@@ -0,0 +1,134 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"git.sr.ht/~elektito/gemplex/pkg/gsearch"
+)
+
+// SearchCache is an in-memory LRU cache of search responses, with entries
+// expiring after a fixed time. A cache with a size of zero is disabled.
+type SearchCache struct {
+	maxSize int
+	ttl     time.Duration
+
+	// used for testing; defaults to time.Now
+	now func() time.Time
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // most recently used first
+}
+
+type searchCacheEntry struct {
+	key     string
+	resp    gsearch.PageSearchResponse
+	expires time.Time
+}
+
+// the cache used by the search daemon. it's cleared by the index daemon every
+// time a new index is swapped in.
+var searchCache = NewSearchCache(0, 0)
+
+func NewSearchCache(maxSize int, ttl time.Duration) *SearchCache {
+	return &SearchCache{
+		maxSize: maxSize,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// Configure changes the size and ttl of the cache, and clears it.
+func (c *SearchCache) Configure(maxSize int, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.maxSize = maxSize
+	c.ttl = ttl
+	c.clear()
+}
+
+func (c *SearchCache) Get(req gsearch.PageSearchRequest) (resp gsearch.PageSearchResponse, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.entries[searchCacheKey(req)]
+	if !ok {
+		return
+	}
+
+	entry := elem.Value.(*searchCacheEntry)
+	if c.now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, entry.key)
+		ok = false
+		return
+	}
+
+	c.order.MoveToFront(elem)
+	resp = entry.resp
+	return
+}
+
+func (c *SearchCache) Put(req gsearch.PageSearchRequest, resp gsearch.PageSearchResponse) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.maxSize <= 0 {
+		return
+	}
+
+	key := searchCacheKey(req)
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+
+	elem := c.order.PushFront(&searchCacheEntry{
+		key:     key,
+		resp:    resp,
+		expires: c.now().Add(c.ttl),
+	})
+	c.entries[key] = elem
+
+	for c.order.Len() > c.maxSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*searchCacheEntry).key)
+	}
+}
+
+// Clear removes all entries from the cache.
+func (c *SearchCache) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.clear()
+}
+
+func (c *SearchCache) clear() {
+	c.entries = map[string]*list.Element{}
+	c.order.Init()
+}
+
+func (c *SearchCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.order.Len()
+}
+
+// only the fields sent to the search daemon are used in the key; the rest are
+// only used by the cgi.
+func searchCacheKey(req gsearch.PageSearchRequest) string {
+	collapse := "0"
+	if req.Collapse {
+		collapse = "1"
+	}
+	return fmt.Sprintf("%d:%s:%q:%q:%s", req.Page, collapse, req.HighlightBefore, req.HighlightAfter, req.Query)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"git.sr.ht/~elektito/gemplex/pkg/gsearch"
+)
+
+func TestSearchCacheEviction(t *testing.T) {
+	c := NewSearchCache(2, time.Minute)
+
+	reqA := gsearch.PageSearchRequest{Query: "a", Page: 1}
+	reqB := gsearch.PageSearchRequest{Query: "b", Page: 1}
+	reqC := gsearch.PageSearchRequest{Query: "c", Page: 1}
+
+	c.Put(reqA, gsearch.PageSearchResponse{TotalResults: 1})
+	c.Put(reqB, gsearch.PageSearchResponse{TotalResults: 2})
+
+	// make a the most recently used, so b is evicted next
+	if _, ok := c.Get(reqA); !ok {
+		t.Fatal("Expected a to be cached")
+	}
+
+	c.Put(reqC, gsearch.PageSearchResponse{TotalResults: 3})
+	if _, ok := c.Get(reqB); ok {
+		t.Fatal("Expected b to be evicted")
+	}
+
+	resp, ok := c.Get(reqA)
+	if !ok || resp.TotalResults != 1 {
+		t.Fatalf("Expected a to be cached with 1 result; got ok=%t n=%d", ok, resp.TotalResults)
+	}
+
+	if _, ok := c.Get(gsearch.PageSearchRequest{Query: "a", Page: 2}); ok {
+		t.Fatal("Expected a different page not to be a cache hit")
+	}
+}
+
+func TestSearchCacheExpiryAndClear(t *testing.T) {
+	now := time.Now()
+	c := NewSearchCache(10, time.Minute)
+	c.now = func() time.Time { return now }
+
+	req := gsearch.PageSearchRequest{Query: "a", Page: 1}
+	c.Put(req, gsearch.PageSearchResponse{})
+
+	now = now.Add(2 * time.Minute)
+	if _, ok := c.Get(req); ok {
+		t.Fatal("Expected entry to be expired")
+	}
+	if c.Len() != 0 {
+		t.Fatalf("Expected expired entry to be removed; got %d entries", c.Len())
+	}
+
+	c.Put(req, gsearch.PageSearchResponse{})
+	c.Clear()
+	if _, ok := c.Get(req); ok {
+		t.Fatal("Expected cache to be empty after clearing")
+	}
+}
+
+func TestSearchCacheDisabled(t *testing.T) {
+	c := NewSearchCache(0, time.Minute)
+
+	req := gsearch.PageSearchRequest{Query: "a", Page: 1}
+	c.Put(req, gsearch.PageSearchResponse{})
+	if _, ok := c.Get(req); ok {
+		t.Fatal("Expected a zero-sized cache to be disabled")
+	}
+}
+
+func TestSearchCacheKeyHighlightDelimiters(t *testing.T) {
+	c := NewSearchCache(10, time.Minute)
+
+	req := gsearch.PageSearchRequest{Query: "a", Page: 1}
+	c.Put(req, gsearch.PageSearchResponse{TotalResults: 1})
+
+	custom := gsearch.PageSearchRequest{Query: "a", Page: 1, HighlightBefore: "*", HighlightAfter: "*"}
+	if _, ok := c.Get(custom); ok {
+		t.Fatal("Expected requests with different highlight delimiters to be cached separately")
+	}
+}
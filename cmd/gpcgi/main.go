@@ -17,8 +17,11 @@ import (
 	"strings"
 	"text/template"
 	"time"
+	"unicode/utf8"
 
 	"git.sr.ht/~elektito/gemplex/pkg/config"
+	"git.sr.ht/~elektito/gemplex/pkg/db"
+	"git.sr.ht/~elektito/gemplex/pkg/gparse"
 	"git.sr.ht/~elektito/gemplex/pkg/gsearch"
 	"git.sr.ht/~elektito/gemplex/pkg/utils"
 	"github.com/dustin/go-humanize"
@@ -27,83 +30,896 @@ import (
 type Params struct {
 	SearchDaemonSocket string
 	ServerName         string
+	MaxInlineImageSize int
+	CrawlerName        string
+	CrawlerContact     string
+	CollapseResults    bool
+	PopularDisabled    bool
 }
 
+// the maximum length (in bytes) of a gemini request url, per the spec.
+const maxRequestLength = 1024
+
 var (
-	ErrPageNotFound = errors.New("Not found")
-	ErrBadUrl       = errors.New("Bad URL")
+	ErrPageNotFound   = errors.New("Not found")
+	ErrBadUrl         = errors.New("Bad URL")
+	ErrRequestTooLong = errors.New("Request too long")
+	ErrRequestNotUtf8 = errors.New("Request is not valid UTF-8")
+	ErrNoRequestLine  = errors.New("No request line")
 )
 
-func usage() {
-	fmt.Printf(`Usage: %s [-config config-file] [-serve]
+func usage() {
+	fmt.Printf(`Usage: %s [-config config-file] [-serve]
+
+If you pass -serve, the program will run a test gemini server,
+instead of running as a CGI script. This can be useful for
+testing purposes.`, os.Args[0])
+}
+
+func main() {
+	configFile := flag.String("config", "", "config file")
+	serve := flag.Bool("serve", false, "start testing gemini sesrver, instead of running as a cgi script.")
+	flag.Usage = usage
+	flag.Parse()
+
+	cfg := config.LoadConfig(*configFile)
+
+	if *serve {
+		// run as a gemini server. useful for debugging and testing.
+		testServe(cfg)
+		return
+	}
+
+	params := Params{
+		SearchDaemonSocket: cfg.Search.UnixSocketPath,
+		MaxInlineImageSize: cfg.Search.MaxInlineImageSize,
+		CrawlerName:        cfg.Crawl.UserAgent,
+		CrawlerContact:     cfg.Crawl.Contact,
+		CollapseResults:    cfg.Search.CollapseResults,
+		PopularDisabled:    cfg.Search.PopularQueryHashKey != "",
+		ServerName:         os.Getenv("SERVER_NAME"),
+	}
+	cgi(os.Stdin, os.Stdout, params)
+}
+
+// read the request line (the url, terminated by CRLF) from the given reader.
+// no more than maxRequestLength bytes (plus the CRLF) are read, so that overlong
+// (or binary) input is rejected early.
+func readRequestLine(r io.Reader) (line string, err error) {
+	br := bufio.NewReader(io.LimitReader(r, maxRequestLength+2))
+	line, err = br.ReadString('\n')
+	if err == io.EOF {
+		// a missing line terminator is tolerated, unless we stopped reading
+		// because of the length limit.
+		err = nil
+		if line == "" {
+			err = ErrNoRequestLine
+			return
+		}
+	} else if err != nil {
+		return
+	}
+
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+	if len(line) > maxRequestLength {
+		err = ErrRequestTooLong
+		return
+	}
+
+	if !utf8.ValidString(line) {
+		err = ErrRequestNotUtf8
+		return
+	}
+
+	return
+}
+
+func cgi(r io.Reader, w io.Writer, params Params) {
+	urlStr, err := readRequestLine(r)
+	if err == ErrRequestTooLong || err == ErrRequestNotUtf8 {
+		geminiHeader(w, 59, err.Error())
+		return
+	} else if err != nil {
+		log.Println("Could not read request line:", err)
+		return
+	}
+
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		geminiHeader(w, 59, "Bad URL")
+		return
+	}
+
+	if u.Hostname() != params.ServerName {
+		geminiHeader(w, 53, "Unknown hostname in URL")
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(u.Path, "/search"):
+		fallthrough
+	case strings.HasPrefix(u.Path, "/v/search"):
+		handleSearch(u, r, w, params)
+	case u.Path == "/random":
+		handleRandomPage(u, r, w, params)
+	case strings.HasPrefix(u.Path, "/image/random"):
+		handleRandomImage(u, r, w, params)
+	case strings.HasPrefix(u.Path, "/image/perm/"):
+		handleImagePermalink(u, r, w, params)
+	case strings.HasPrefix(u.Path, "/image/search"):
+		handleImageSearch(u, r, w, params)
+	case strings.HasPrefix(u.Path, "/suggest"):
+		handleSuggest(u, r, w, params)
+	case u.Path == "/help":
+		handleHelp(u, r, w, params)
+	case u.Path == "/stats":
+		handleStats(u, r, w, params)
+	case u.Path == "/popular":
+		handlePopular(u, r, w, params)
+	case strings.HasPrefix(u.Path, "/backlinks"):
+		handleBacklinks(u, r, w, params)
+	case u.Path == "/info":
+		handleUrlInfo(u, r, w, params)
+	case strings.HasPrefix(u.Path, "/hosts"):
+		handleHosts(u, r, w, params)
+	default:
+		geminiHeader(w, 51, "Not found")
+	}
+}
+
+func handleSuggest(u *url.URL, r io.Reader, w io.Writer, params Params) {
+	if u.RawQuery == "" {
+		geminiHeader(w, 10, "Partial search query")
+		return
+	}
+
+	query, err := url.QueryUnescape(u.RawQuery)
+	if err != nil {
+		geminiHeader(w, 59, "Bad URL")
+		return
+	}
+
+	conn, err := net.Dial("unix", params.SearchDaemonSocket)
+	if err != nil {
+		log.Println("Cannot connect to search backend:", err)
+		cgiErr(w, "Cannot connect to search backend")
+		return
+	}
+
+	req := gsearch.SuggestRequest{
+		Type:  "suggest",
+		Query: query,
+		Count: 10,
+	}
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		log.Println("Error encoding suggest request:", err)
+		cgiErr(w, "Internal error")
+		return
+	}
+
+	var resp gsearch.SuggestResponse
+	err = json.NewDecoder(conn).Decode(&resp)
+	if err != nil {
+		log.Println("Internal error:", err)
+		cgiErr(w, "Internal error")
+		return
+	}
+
+	if resp.Err != "" {
+		log.Println("Error from search daemon:", resp.Err)
+		searchDaemonErr(w, resp.Err)
+		return
+	}
+
+	t := `# Gemplex - Suggestions
+
+Suggestions for: {{ .Query }}
+{{ range .Suggestions }}
+=> /search?{{ escape . }} {{ . }}
+{{- else }}
+No suggestions.
+{{- end }}
+
+=> /suggest Try something else
+=> / 🏠 Gemplex Home
+`
+	funcMap := template.FuncMap{
+		"escape": func(s string) string { return url.QueryEscape(s) },
+	}
+	tmpl := template.Must(template.New("root").Funcs(funcMap).Parse(t))
+
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, resp)
+	utils.PanicOnErr(err)
+
+	geminiHeader(w, 20, "text/gemini")
+	w.Write(out.Bytes())
+}
+
+func handleHelp(u *url.URL, r io.Reader, w io.Writer, params Params) {
+	t := `# Gemplex - Search Help
+
+Type your search terms, and Gemplex finds pages containing them. Pages whose titles contain the terms are ranked higher.
+
+## Filtering by kind
+
+Some kinds of documents are excluded from search results by default. You can search them explicitly by adding a "kind:" filter to your query. For example:
+
+XXX
+kind:rfc congestion control
+XXX
+
+Available kinds:
+{{ range .Kinds }}
+* {{ . }}
+{{- end }}
+
+## Filtering by content type
+
+You can limit results to a single content type by adding a "type:" filter to your query. For example:
+
+XXX
+type:text/gemini gardening
+XXX
+
+## Filtering by programming language
+
+You can find pages containing code in a certain programming language by adding a "code:" filter to your query. The language is taken from the alt text of preformatted blocks (as in "XXXgo"). For example:
+
+XXX
+code:go http server
+XXX
+
+## The crawler
+
+Gemplex finds pages using its own crawler, which obeys robots.txt rules for the "{{ .CrawlerName }}" user-agent. Gemini requests do not identify their sender, so that is the only name the crawler goes by. To keep it out of your capsule, add this to your robots.txt:
+
+XXX
+User-agent: {{ .CrawlerName }}
+Disallow: /
+XXX
+{{- if .CrawlerContact }}
+
+=> {{ .CrawlerContact }} About the crawler and its operator
+{{- end }}
+
+=> /search 🔍 Search
+=> / 🏠 Gemplex Home
+`
+	t = strings.Replace(t, "XXX", "```", -1)
+	tmpl := template.Must(template.New("root").Parse(t))
+
+	var out bytes.Buffer
+	err := tmpl.Execute(&out, struct {
+		Kinds          []string
+		CrawlerName    string
+		CrawlerContact string
+	}{
+		Kinds:          gsearch.DefaultExcludedKinds,
+		CrawlerName:    params.CrawlerName,
+		CrawlerContact: contactLink(params.CrawlerContact),
+	})
+	utils.PanicOnErr(err)
+
+	geminiHeader(w, 20, "text/gemini")
+	w.Write(out.Bytes())
+}
+
+// return a link for the given crawler contact, which is either a url, or a bare
+// email address that is turned into a mailto link.
+func contactLink(contact string) string {
+	if contact == "" {
+		return ""
+	}
+
+	u, err := url.Parse(contact)
+	if err == nil && u.Scheme != "" {
+		return contact
+	}
+
+	return "mailto:" + contact
+}
+
+// return the url passed in the query string of a request like /backlinks?<url>
+// (or /backlinks?url=<url>), adding the gemini scheme if it's left out.
+func parseUrlQuery(rawQuery string) (urlStr string, err error) {
+	urlStr, err = url.QueryUnescape(strings.TrimPrefix(rawQuery, "url="))
+	if err != nil {
+		return
+	}
+
+	// allow leaving out the scheme
+	if !strings.Contains(urlStr, "://") {
+		urlStr = "gemini://" + urlStr
+	}
+
+	return
+}
+
+func handleUrlInfo(u *url.URL, r io.Reader, w io.Writer, params Params) {
+	// url format: /info?<url> (the url can also be passed as "url=<url>")
+	if u.RawQuery == "" {
+		geminiHeader(w, 10, "URL to show info for")
+		return
+	}
+
+	var req struct {
+		Type string `json:"t"`
+		Url  string `json:"url"`
+	}
+
+	var resp struct {
+		Found bool       `json:"found"`
+		Info  db.UrlInfo `json:"info"`
+		Err   string     `json:"err"`
+	}
+
+	var err error
+	req.Type = "urlinfo"
+	req.Url, err = parseUrlQuery(u.RawQuery)
+	if err != nil {
+		geminiHeader(w, 59, "Bad URL")
+		return
+	}
+
+	conn, err := net.Dial("unix", params.SearchDaemonSocket)
+	if err != nil {
+		log.Println("Cannot connect to search backend:", err)
+		cgiErr(w, "Cannot connect to search backend")
+		return
+	}
+
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		log.Println("Error encoding url info request:", err)
+		cgiErr(w, "Internal error")
+		return
+	}
+
+	err = json.NewDecoder(conn).Decode(&resp)
+	if err != nil {
+		log.Println("Internal error:", err)
+		cgiErr(w, "Internal error")
+		return
+	}
+
+	if resp.Err != "" {
+		log.Println("Error from search daemon:", resp.Err)
+		searchDaemonErr(w, resp.Err)
+		return
+	}
+
+	if !resp.Found {
+		geminiHeader(w, 51, "Not found")
+		return
+	}
+
+	geminiHeader(w, 20, "text/gemini")
+	w.Write(renderUrlInfo(resp.Info))
+}
+
+func renderUrlInfo(info db.UrlInfo) []byte {
+	t := `
+{{- define "Links" }}
+{{- range . }}
+=> {{ .Url }} {{ if .Text }}{{ .Text }}{{ else }}{{ .Url }}{{ end }}
+{{- end }}
+{{- end -}}
+
+# Gemplex - Page Info
+
+=> {{ .Url }} {{ .Url }}
+
+* URL id: {{ .UrlId }}
+* URL rank: {{ printf "%f" .UrlRank }}
+* Host rank: {{ printf "%f" .HostRank }}
+{{- if ge .LastFetchMs 0 }}
+* Last fetch took: {{ .LastFetchMs }}ms
+{{- end }}
+{{- if .IsInput }}
+* This is an input endpoint; prompt: {{ .InputPrompt }}
+{{- end }}
+
+## Content
+{{ if ge .ContentId 0 }}
+* Content id: {{ .ContentId }}
+* Title: {{ .ContentTitle }}
+{{- if .ContentSummary }}
+* Summary: {{ .ContentSummary }}
+{{- end }}
+* Content type: {{ .ContentType }}{{ if .ContentTypeArgs }} ({{ .ContentTypeArgs }}){{ end }}
+* Language: {{ or .ContentLang "unknown" }}
+* Script: {{ or .ContentScript "unknown" }}
+* Kind: {{ or .ContentKind "none" }}
+* Content length: {{ .ContentsLength }}
+* Text length: {{ .TextLength }}
+{{- else }}
+No content.
+{{- end }}
+
+## Links
+
+{{ .OutboundLinks }} outbound link(s).
+
+### {{ len .InternalLinks }} internal link(s)
+{{- template "Links" .InternalLinks }}
+
+### {{ len .ExternalLinks }} external link(s)
+{{- template "Links" .ExternalLinks }}
+
+## Backlinks
+
+### {{ len .InternalBacklinks }} internal backlink(s)
+{{- template "Links" .InternalBacklinks }}
+
+### {{ len .ExternalBacklinks }} external backlink(s)
+{{- template "Links" .ExternalBacklinks }}
+
+=> /info Show info for another url
+=> / 🏠 Gemplex Home
+`
+	tmpl := template.Must(template.New("root").Parse(t))
+
+	var out bytes.Buffer
+	err := tmpl.Execute(&out, info)
+	utils.PanicOnErr(err)
+
+	return out.Bytes()
+}
+
+func handleHosts(u *url.URL, r io.Reader, w io.Writer, params Params) {
+	// url format: /hosts[/page]
+	re := regexp.MustCompile(`^/hosts(?:/(\d+))?$`)
+	m := re.FindStringSubmatch(u.Path)
+	if m == nil {
+		geminiHeader(w, 51, "Not found")
+		return
+	}
+
+	var req struct {
+		Type string `json:"t"`
+		Page int    `json:"page"`
+	}
+
+	var resp struct {
+		Total int           `json:"n"`
+		Hosts []db.HostInfo `json:"hosts"`
+		Err   string        `json:"err"`
+	}
+
+	var err error
+	req.Type = "hosts"
+	req.Page = 1
+	if m[1] != "" {
+		req.Page, err = strconv.Atoi(m[1])
+		if err != nil || req.Page < 1 {
+			geminiHeader(w, 59, "Bad URL")
+			return
+		}
+	}
+
+	conn, err := net.Dial("unix", params.SearchDaemonSocket)
+	if err != nil {
+		log.Println("Cannot connect to search backend:", err)
+		cgiErr(w, "Cannot connect to search backend")
+		return
+	}
+
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		log.Println("Error encoding hosts request:", err)
+		cgiErr(w, "Internal error")
+		return
+	}
+
+	err = json.NewDecoder(conn).Decode(&resp)
+	if err != nil {
+		log.Println("Internal error:", err)
+		cgiErr(w, "Internal error")
+		return
+	}
+
+	if resp.Err != "" {
+		log.Println("Error from search daemon:", resp.Err)
+		searchDaemonErr(w, resp.Err)
+		return
+	}
+
+	geminiHeader(w, 20, "text/gemini")
+	w.Write(renderHosts(resp.Hosts, resp.Total, req.Page))
+}
+
+// render a page of the list of known hosts.
+func renderHosts(hosts []db.HostInfo, total int, page int) []byte {
+	npages := total / gsearch.PageSize
+	if total%gsearch.PageSize != 0 {
+		npages += 1
+	}
+
+	t := `# Gemplex - Known Capsules
+
+{{ .Total }} capsule(s), ordered by rank. Each link leads to the highest ranked page of the capsule.
+{{ range .Hosts }}
+=> {{ .TopUrl }} {{ .Hostname }} ({{ .Pages }} page(s), rank {{ printf "%.4g" .Rank }})
+{{- end }}
+{{ if gt .Page 1 }}
+=> /hosts/{{ dec .Page }} Prev Page ({{ dec .Page }} of {{ .PageCount }} pages)
+{{- end }}
+{{- if lt .Page .PageCount }}
+=> /hosts/{{ inc .Page }} Next Page ({{ inc .Page }} of {{ .PageCount }} pages)
+{{- end }}
+
+=> / 🏠 Gemplex Home
+`
+	funcMap := template.FuncMap{
+		"inc": func(n int) int { return n + 1 },
+		"dec": func(n int) int { return n - 1 },
+	}
+	tmpl := template.Must(template.New("root").Funcs(funcMap).Parse(t))
+
+	data := struct {
+		Total     int
+		Hosts     []db.HostInfo
+		Page      int
+		PageCount int
+	}{
+		Total:     total,
+		Hosts:     hosts,
+		Page:      page,
+		PageCount: npages,
+	}
+
+	var out bytes.Buffer
+	err := tmpl.Execute(&out, data)
+	utils.PanicOnErr(err)
+
+	return out.Bytes()
+}
+
+func handleBacklinks(u *url.URL, r io.Reader, w io.Writer, params Params) {
+	// url format: /backlinks[/page]?<url> (the url can also be passed as
+	// "url=<url>")
+	re := regexp.MustCompile(`^/backlinks(?:/(\d+))?$`)
+	m := re.FindStringSubmatch(u.Path)
+	if m == nil {
+		geminiHeader(w, 51, "Not found")
+		return
+	}
+
+	if u.RawQuery == "" {
+		geminiHeader(w, 10, "URL to find backlinks for")
+		return
+	}
+
+	var req struct {
+		Type string `json:"t"`
+		Url  string `json:"url"`
+		Page int    `json:"page"`
+	}
+
+	var resp struct {
+		Url       string        `json:"url"`
+		Total     int           `json:"n"`
+		Backlinks []gparse.Link `json:"backlinks"`
+		Err       string        `json:"err"`
+	}
+
+	var err error
+	req.Type = "backlinks"
+	req.Page = 1
+	if m[1] != "" {
+		req.Page, err = strconv.Atoi(m[1])
+		if err != nil || req.Page < 1 {
+			geminiHeader(w, 59, "Bad URL")
+			return
+		}
+	}
+
+	req.Url, err = parseUrlQuery(u.RawQuery)
+	if err != nil {
+		geminiHeader(w, 59, "Bad URL")
+		return
+	}
+
+	conn, err := net.Dial("unix", params.SearchDaemonSocket)
+	if err != nil {
+		log.Println("Cannot connect to search backend:", err)
+		cgiErr(w, "Cannot connect to search backend")
+		return
+	}
+
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		log.Println("Error encoding backlinks request:", err)
+		cgiErr(w, "Internal error")
+		return
+	}
+
+	err = json.NewDecoder(conn).Decode(&resp)
+	if err != nil {
+		log.Println("Internal error:", err)
+		cgiErr(w, "Internal error")
+		return
+	}
+
+	if resp.Err != "" {
+		log.Println("Error from search daemon:", resp.Err)
+		searchDaemonErr(w, resp.Err)
+		return
+	}
+
+	npages := resp.Total / gsearch.PageSize
+	if resp.Total%gsearch.PageSize != 0 {
+		npages += 1
+	}
+
+	t := `# Gemplex - Backlinks
+
+=> {{ .Url }} Backlinks for: {{ .Url }}
+Found {{ .Total }} backlink(s).
+{{ range .Backlinks }}
+=> {{ .Url }} {{ if .Text }}{{ .Text }}{{ else }}{{ .Url }}{{ end }}
+{{- end }}
+{{ if gt .Page 1 }}
+=> /backlinks/{{ dec .Page }}?{{ .UrlEscaped }} Prev Page ({{ dec .Page }} of {{ .PageCount }} pages)
+{{- end }}
+{{- if lt .Page .PageCount }}
+=> /backlinks/{{ inc .Page }}?{{ .UrlEscaped }} Next Page ({{ inc .Page }} of {{ .PageCount }} pages)
+{{- end }}
+
+=> /info?{{ .UrlEscaped }} Page info
+=> /backlinks Find backlinks for another url
+=> / 🏠 Gemplex Home
+`
+	funcMap := template.FuncMap{
+		"inc": func(n int) int { return n + 1 },
+		"dec": func(n int) int { return n - 1 },
+	}
+	tmpl := template.Must(template.New("root").Funcs(funcMap).Parse(t))
+
+	data := struct {
+		Url        string
+		UrlEscaped string
+		Total      int
+		Backlinks  []gparse.Link
+		Page       int
+		PageCount  int
+	}{
+		Url:        resp.Url,
+		UrlEscaped: url.QueryEscape(resp.Url),
+		Total:      resp.Total,
+		Backlinks:  resp.Backlinks,
+		Page:       req.Page,
+		PageCount:  npages,
+	}
 
-If you pass -serve, the program will run a test gemini server,
-instead of running as a CGI script. This can be useful for
-testing purposes.`, os.Args[0])
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, data)
+	utils.PanicOnErr(err)
+
+	geminiHeader(w, 20, "text/gemini")
+	w.Write(out.Bytes())
 }
 
-func main() {
-	configFile := flag.String("config", "", "config file")
-	serve := flag.Bool("serve", false, "start testing gemini sesrver, instead of running as a cgi script.")
-	flag.Usage = usage
-	flag.Parse()
+func handleStats(u *url.URL, r io.Reader, w io.Writer, params Params) {
+	var req struct {
+		Type string `json:"t"`
+	}
 
-	cfg := config.LoadConfig(*configFile)
+	conn, err := net.Dial("unix", params.SearchDaemonSocket)
+	if err != nil {
+		log.Println("Cannot connect to search backend:", err)
+		cgiErr(w, "Cannot connect to search backend")
+		return
+	}
 
-	if *serve {
-		// run as a gemini server. useful for debugging and testing.
-		testServe(cfg)
+	req.Type = "stats"
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		log.Println("Error encoding stats request:", err)
+		cgiErr(w, "Internal error")
 		return
 	}
 
-	params := Params{
-		SearchDaemonSocket: cfg.Search.UnixSocketPath,
-		ServerName:         os.Getenv("SERVER_NAME"),
+	var resp gsearch.IndexStatsResponse
+	err = json.NewDecoder(conn).Decode(&resp)
+	if err != nil {
+		log.Println("Internal error:", err)
+		cgiErr(w, "Internal error")
+		return
 	}
-	cgi(os.Stdin, os.Stdout, params)
+
+	if resp.Err != "" {
+		log.Println("Error from search daemon:", resp.Err)
+		searchDaemonErr(w, resp.Err)
+		return
+	}
+
+	t := `# Gemplex - Index Statistics
+
+Documents in index: {{ .DocCount }}
+{{- if .BuildFinish.IsZero }}
+Index build time is not known.
+{{- else }}
+Index built: {{ .BuildFinish.UTC.Format "2006-01-02 15:04 MST" }} ({{ ago .BuildFinish }})
+Build duration: {{ duration .BuildStart .BuildFinish }}
+Database rows indexed: {{ .SourceRows }}
+{{- end }}
+
+=> /search 🔍 Search
+=> / 🏠 Gemplex Home
+`
+	funcMap := template.FuncMap{
+		"ago":      func(t time.Time) string { return humanize.Time(t) },
+		"duration": func(start, end time.Time) time.Duration { return end.Sub(start).Round(time.Second) },
+	}
+	tmpl := template.Must(template.New("root").Funcs(funcMap).Parse(t))
+
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, resp)
+	utils.PanicOnErr(err)
+
+	geminiHeader(w, 20, "text/gemini")
+	w.Write(out.Bytes())
 }
 
-func cgi(r io.Reader, w io.Writer, params Params) {
-	scanner := bufio.NewScanner(r)
-	ok := scanner.Scan()
-	if !ok {
-		log.Println("Could not read request line:", scanner.Err())
+func handlePopular(u *url.URL, r io.Reader, w io.Writer, params Params) {
+	if params.PopularDisabled {
+		// popular queries are hashed, so there's nothing to show
+		geminiHeader(w, 51, "Not found")
 		return
 	}
 
-	urlStr := scanner.Text()
-	u, err := url.Parse(urlStr)
+	var req struct {
+		Type  string `json:"t"`
+		Count int    `json:"n"`
+	}
+
+	var resp struct {
+		Days    int             `json:"days"`
+		Queries []db.QueryCount `json:"queries"`
+		Err     string          `json:"err"`
+	}
+
+	conn, err := net.Dial("unix", params.SearchDaemonSocket)
 	if err != nil {
-		geminiHeader(w, 59, "Bad URL")
+		log.Println("Cannot connect to search backend:", err)
+		cgiErr(w, "Cannot connect to search backend")
 		return
 	}
 
-	if u.Hostname() != params.ServerName {
-		geminiHeader(w, 53, "Unknown hostname in URL")
+	req.Type = "topqueries"
+	req.Count = 30
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		log.Println("Error encoding topqueries request:", err)
+		cgiErr(w, "Internal error")
 		return
 	}
 
-	switch {
-	case strings.HasPrefix(u.Path, "/search"):
-		fallthrough
-	case strings.HasPrefix(u.Path, "/v/search"):
-		handleSearch(u, r, w, params)
-	case strings.HasPrefix(u.Path, "/image/random"):
-		handleRandomImage(u, r, w, params)
-	case strings.HasPrefix(u.Path, "/image/perm/"):
-		handleImagePermalink(u, r, w, params)
-	case strings.HasPrefix(u.Path, "/image/search"):
-		handleImageSearch(u, r, w, params)
-	default:
-		geminiHeader(w, 51, "Not found")
+	err = json.NewDecoder(conn).Decode(&resp)
+	if err != nil {
+		log.Println("Internal error:", err)
+		cgiErr(w, "Internal error")
+		return
+	}
+
+	if resp.Err != "" {
+		log.Println("Error from search daemon:", resp.Err)
+		searchDaemonErr(w, resp.Err)
+		return
+	}
+
+	t := `# Gemplex - Popular Searches
+
+{{ if .Queries -}}
+The most common searches in the last {{ .Days }} day(s):
+{{ range .Queries }}
+=> /search?{{ escape .Query }} {{ .Query }} ({{ .Count }})
+{{- end }}
+{{- else -}}
+No popular searches yet.
+{{- end }}
+
+=> /search 🔍 Search
+=> / 🏠 Gemplex Home
+`
+	funcMap := template.FuncMap{
+		"escape": url.QueryEscape,
 	}
+	tmpl := template.Must(template.New("root").Funcs(funcMap).Parse(t))
+
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, resp)
+	utils.PanicOnErr(err)
+
+	geminiHeader(w, 20, "text/gemini")
+	w.Write(out.Bytes())
 }
 
-func handleRandomImage(u *url.URL, r io.Reader, w io.Writer, params Params) {
+func handleRandomPage(u *url.URL, r io.Reader, w io.Writer, params Params) {
 	var req struct {
 		Type string `json:"t"`
 	}
 
+	var resp struct {
+		Url string `json:"url"`
+		Err string `json:"err"`
+	}
+
+	conn, err := net.Dial("unix", params.SearchDaemonSocket)
+	if err != nil {
+		log.Println("Cannot connect to search backend:", err)
+		cgiErr(w, "Cannot connect to search backend")
+		return
+	}
+
+	req.Type = "randpage"
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		log.Println("Error encoding search request:", err)
+		cgiErr(w, "Internal error")
+		return
+	}
+
+	err = json.NewDecoder(conn).Decode(&resp)
+	if err != nil {
+		log.Println("Internal error:", err)
+		cgiErr(w, "Internal error")
+		return
+	}
+
+	if resp.Err != "" || resp.Url == "" {
+		log.Println("Error from search daemon:", resp.Err)
+		searchDaemonErr(w, resp.Err)
+		return
+	}
+
+	geminiHeader(w, 30, resp.Url)
+}
+
+// the number of recently shown images the random image page avoids showing
+// again. they're passed along in the query string of the "another image" link,
+// so that no state needs to be kept.
+const recentImagesCount = 10
+
+var imageIdRe = regexp.MustCompile("^[0-9a-f]{32}$")
+
+// parse the list of recently shown image ids from the query string of a random
+// image request. invalid ids are ignored.
+func parseRecentImages(rawQuery string) (ids []string) {
+	for _, id := range strings.Split(rawQuery, ",") {
+		if imageIdRe.MatchString(id) {
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) > recentImagesCount {
+		ids = ids[len(ids)-recentImagesCount:]
+	}
+
+	return
+}
+
+// return the query string for the next random image request, after the image
+// with the given id has been shown.
+func nextRecentImages(recent []string, current string) string {
+	ids := append(append([]string{}, recent...), current)
+	if len(ids) > recentImagesCount {
+		ids = ids[len(ids)-recentImagesCount:]
+	}
+
+	return strings.Join(ids, ",")
+}
+
+func handleRandomImage(u *url.URL, r io.Reader, w io.Writer, params Params) {
+	var req struct {
+		Type    string   `json:"t"`
+		Exclude []string `json:"exclude,omitempty"`
+	}
+
 	var resp struct {
 		Url       string    `json:"url"`
 		Alt       string    `json:"alt"`
@@ -120,6 +936,7 @@ func handleRandomImage(u *url.URL, r io.Reader, w io.Writer, params Params) {
 	}
 
 	req.Type = "randimg"
+	req.Exclude = parseRecentImages(u.RawQuery)
 	err = json.NewEncoder(conn).Encode(req)
 	if err != nil {
 		log.Println("Error encoding search request:", err)
@@ -133,11 +950,19 @@ func handleRandomImage(u *url.URL, r io.Reader, w io.Writer, params Params) {
 		return
 	}
 
+	resp.Image = inlineImage(resp.Image, params.MaxInlineImageSize)
+	next := nextRecentImages(req.Exclude, resp.ImageId)
+
 	t := `# 🖼️ Gemplex - Random Gemini Image
 
+{{ if .Image -}}
 XXX {{ .Alt }}
 {{ .Image }}
 XXX
+{{- else -}}
+This image is too large to be shown here.
+=> /image/perm/{{ .ImageId }} View image
+{{- end }}
 
 {{ if .Alt }}Alt: {{ .Alt }}{{ else }}No alt text.{{ end }}
 
@@ -145,13 +970,23 @@ Fetched on {{ .FetchTime.Format "2006-01-02" }} from:
 => {{ .Url }} Source
 
 => /image/perm/{{ .ImageId }} ♾️ Permalink
+=> /image/random?{{ .Next }} 🔀 Another Random Image
 => / 🏠 Gemplex Home
 `
 	t = strings.Replace(t, "XXX", "```", 2)
 	tmpl := template.Must(template.New("root").Parse(t))
 
+	data := struct {
+		Url       string
+		Alt       string
+		Image     string
+		FetchTime time.Time
+		ImageId   string
+		Next      string
+	}{resp.Url, resp.Alt, resp.Image, resp.FetchTime, resp.ImageId, next}
+
 	var out bytes.Buffer
-	err = tmpl.Execute(&out, resp)
+	err = tmpl.Execute(&out, data)
 	utils.PanicOnErr(err)
 
 	geminiHeader(w, 20, "text/gemini")
@@ -200,11 +1035,19 @@ func handleImagePermalink(u *url.URL, r io.Reader, w io.Writer, params Params) {
 		return
 	}
 
+	// this is where oversized images are linked to, so there's no size limit
+	// here.
+	resp.Image = inlineImage(resp.Image, 0)
+
 	t := `# 🖼️ Gemplex - Random Gemini Image
 
+{{ if .Image -}}
 XXX {{ .Alt }}
 {{ .Image }}
 XXX
+{{- else -}}
+This image cannot be displayed.
+{{- end }}
 
 {{ if .Alt }}Alt: {{ .Alt }}{{ else }}No alt text.{{ end }}
 
@@ -243,6 +1086,7 @@ func handleSearch(u *url.URL, r io.Reader, w io.Writer, params Params) {
 		cgiErr(w, "Internal error")
 		return
 	}
+	req.Collapse = params.CollapseResults
 
 	conn, err := net.Dial("unix", params.SearchDaemonSocket)
 	if err != nil {
@@ -268,14 +1112,53 @@ func handleSearch(u *url.URL, r io.Reader, w io.Writer, params Params) {
 
 	if resp.Err != "" {
 		log.Println("Error from search daemon:", resp.Err)
-		cgiErr(w, "Internal error")
+		searchDaemonErr(w, resp.Err)
 		return
 	}
 
-	geminiHeader(w, 20, "text/gemini")
+	if req.Format == "plain" {
+		geminiHeader(w, 20, "text/plain; charset=utf-8")
+	} else {
+		geminiHeader(w, 20, "text/gemini")
+	}
 	w.Write(renderSearchResults(resp, req))
 }
 
+type ContentTypeFilter struct {
+	Term         string
+	Count        int
+	QueryEscaped string
+}
+
+// short labels shown for pages of certain kinds, or (if the kind has no label)
+// content types, in search results.
+var kindLabels = map[string]string{
+	"email":   "📧 email",
+	"rfc":     "📜 rfc",
+	"irc":     "💬 irc log",
+	"listing": "🗂️ listing",
+}
+
+var contentTypeLabels = map[string]string{
+	"text/gemini":   "📄 gemtext",
+	"text/plain":    "📝 plain text",
+	"text/markdown": "📝 markdown",
+}
+
+// return the label shown for a search result of the given kind and content
+// type; the content type itself if there's no label for either.
+func typeLabel(kind string, contentType string) string {
+	if label, ok := kindLabels[kind]; ok {
+		return label
+	}
+
+	if label, ok := contentTypeLabels[contentType]; ok {
+		return label
+	}
+
+	return contentType
+}
+
 func renderSearchResults(resp gsearch.PageSearchResponse, req gsearch.PageSearchRequest) []byte {
 	type Page struct {
 		Query        string
@@ -284,22 +1167,29 @@ func renderSearchResults(resp gsearch.PageSearchResponse, req gsearch.PageSearch
 		Title        string
 		Results      []gsearch.PageSearchResult
 		TotalResults uint64
+		TotalCapped  bool
 		Verbose      bool
 		Page         int
 		PageCount    uint64
 		BaseUrl      string
+		IndexBuilt   time.Time
+		ContentTypes []ContentTypeFilter
 	}
 
 	t := `
 {{- define "SingleResult" }}
-=> {{ .Url }} {{ if .Title }} {{- .Title }} {{- else }} [Untitled] {{- end }}
-* {{ .Hostname }} - {{ .ContentType }} - {{ human .ContentSize }}
+=> {{ .Url }} {{ if .HighlightedTitle }} {{- .HighlightedTitle }} {{- else if .Title }} {{- .Title }} {{- else }} [Untitled] {{- end }}
+* {{ .Hostname }} - {{ typeLabel .Kind .ContentType }} - {{ human .ContentSize }}{{ if .Lang }} - {{ .Lang }}{{ end }}
 {{- if verbose }}
+* content type: {{ .ContentType }}
 * hrank: {{ .HostRank }}
 * urank: {{ .UrlRank }}
 * relevance: {{ .Relevance }}
 {{- end }}
 > {{ .Snippet -}}
+{{- if .Collapsed }}
+* +{{ .Collapsed }} more from this host
+{{- end }}
 {{ end }}
 
 {{- define "Results" }}
@@ -312,9 +1202,17 @@ func renderSearchResults(resp gsearch.PageSearchResponse, req gsearch.PageSearch
 # {{ .Title }}
 
 => {{ .BaseUrl }}/search search
+=> /help help
 
 Searching for: {{ .Query }}
-Found {{ .TotalResults }} result(s) in {{ .Duration }}.
+Found {{ .TotalResults }}{{ if .TotalCapped }}+{{ end }} result(s) in {{ .Duration }}.
+{{- if gt (len .ContentTypes) 1 }}
+
+Filter by content type:
+{{- range .ContentTypes }}
+=> {{ $.BaseUrl }}/search?{{ .QueryEscaped }} {{ .Term }} ({{ .Count }})
+{{- end }}
+{{- end }}
 
 {{- template "Results" .Results }}
 {{- if gt .Page 1 }}
@@ -323,17 +1221,51 @@ Found {{ .TotalResults }} result(s) in {{ .Duration }}.
 {{- if lt .Page .PageCount }}
 => {{ .BaseUrl }}/search/{{ inc .Page }}?{{ .QueryEscaped }} Next Page ({{ inc .Page }} of {{ .PageCount }} pages)
 {{ end }}
+{{- if not .IndexBuilt.IsZero }}
+Index updated {{ ago .IndexBuilt }}.
+{{ end }}
 => / Home
 {{ end -}}
 
 {{- template "Page" . }}
 `
 
+	if req.Format == "plain" {
+		// links are written inline, for clients that can't (or prefer not to)
+		// render gemtext.
+		t = `{{ .Title }}
+
+Searching for: {{ .Query }}
+Found {{ .TotalResults }}{{ if .TotalCapped }}+{{ end }} result(s) in {{ .Duration }}.
+{{ range .Results }}
+{{ if .HighlightedTitle }} {{- .HighlightedTitle }} {{- else if .Title }} {{- .Title }} {{- else }} [Untitled] {{- end }}
+  {{ .Url }}
+  {{ .Hostname }} - {{ typeLabel .Kind .ContentType }} - {{ human .ContentSize }}{{ if .Lang }} - {{ .Lang }}{{ end }}
+{{- if verbose }}
+  content type: {{ .ContentType }}
+  hrank: {{ .HostRank }}  urank: {{ .UrlRank }}  relevance: {{ .Relevance }}
+{{- end }}
+  {{ .Snippet }}
+{{- if .Collapsed }}
+  +{{ .Collapsed }} more from this host
+{{- end }}
+{{ end }}
+{{- if gt .Page 1 }}
+Prev page ({{ dec .Page }} of {{ .PageCount }}): {{ .BaseUrl }}/search/{{ dec .Page }}?{{ .QueryEscaped }}
+{{- end }}
+{{- if lt .Page .PageCount }}
+Next page ({{ inc .Page }} of {{ .PageCount }}): {{ .BaseUrl }}/search/{{ inc .Page }}?{{ .QueryEscaped }}
+{{- end }}
+`
+	}
+
 	funcMap := template.FuncMap{
-		"inc":     func(n int) int { return n + 1 },
-		"dec":     func(n int) int { return n - 1 },
-		"verbose": func() bool { return req.Verbose },
-		"human":   func(n uint64) string { return humanize.Bytes(n) },
+		"inc":       func(n int) int { return n + 1 },
+		"dec":       func(n int) int { return n - 1 },
+		"verbose":   func() bool { return req.Verbose },
+		"human":     func(n uint64) string { return humanize.Bytes(n) },
+		"ago":       func(t time.Time) string { return humanize.Time(t) },
+		"typeLabel": typeLabel,
 	}
 
 	baseUrl := ""
@@ -341,10 +1273,9 @@ Found {{ .TotalResults }} result(s) in {{ .Duration }}.
 		baseUrl = "/v"
 	}
 
-	npages := resp.TotalResults / gsearch.PageSize
-	if resp.TotalResults%gsearch.PageSize != 0 {
-		npages += 1
-	}
+	// this is based on the capped total, if there are too many results, so
+	// we won't link to pages that cannot be viewed.
+	npages := gsearch.PageCount(resp.TotalResults)
 
 	// fill in the Hostname field, since this is not ordinarily set by the
 	// Search function (because we can always parse the url for reading the
@@ -356,18 +1287,35 @@ Found {{ .TotalResults }} result(s) in {{ .Duration }}.
 		}
 	}
 
+	queryEscaped := searchQueryString(req)
+
+	// links for narrowing down the results to a single content type
+	var contentTypes []ContentTypeFilter
+	for _, ct := range resp.ContentTypes {
+		filtered := req
+		filtered.Query = req.Query + " type:" + ct.Term
+		contentTypes = append(contentTypes, ContentTypeFilter{
+			Term:         ct.Term,
+			Count:        ct.Count,
+			QueryEscaped: searchQueryString(filtered),
+		})
+	}
+
 	tmpl := template.Must(template.New("root").Funcs(funcMap).Parse(t))
 	data := Page{
 		Query:        req.Query,
-		QueryEscaped: url.QueryEscape(req.Query),
+		QueryEscaped: queryEscaped,
 		Duration:     resp.Duration.Round(time.Millisecond / 10),
 		Title:        "Gemplex Gemini Search",
 		Results:      resp.Results,
 		TotalResults: resp.TotalResults,
+		TotalCapped:  resp.TotalCapped,
 		Page:         req.Page,
 		PageCount:    npages,
 		BaseUrl:      baseUrl,
 		Verbose:      req.Verbose,
+		IndexBuilt:   resp.IndexBuilt,
+		ContentTypes: contentTypes,
 	}
 	var w bytes.Buffer
 	err := tmpl.Execute(&w, data)
@@ -419,15 +1367,36 @@ func handleImageSearch(u *url.URL, r io.Reader, w io.Writer, params Params) {
 
 	if resp.Err != "" {
 		log.Println("Error from search daemon:", resp.Err)
-		cgiErr(w, "Internal error")
+		searchDaemonErr(w, resp.Err)
 		return
 	}
 
 	geminiHeader(w, 20, "text/gemini")
-	w.Write(renderImageSearchResults(resp, req))
+	w.Write(renderImageSearchResults(resp, req, params.MaxInlineImageSize))
+}
+
+// return the given image (ascii art) ready to be shown inside a preformatted
+// block, or an empty string if it's larger than maxSize bytes (when maxSize is
+// positive) or malformed, in which case it should be linked to instead.
+func inlineImage(image string, maxSize int) string {
+	if maxSize > 0 && len(image) > maxSize {
+		return ""
+	}
+
+	image = strings.ToValidUTF8(image, "")
+
+	// a line starting with a toggle would end the preformatted block early,
+	// and the rest of the image would be rendered as gemtext.
+	for _, line := range strings.Split(image, "\n") {
+		if strings.HasPrefix(line, "```") {
+			return ""
+		}
+	}
+
+	return strings.TrimRight(image, "\n")
 }
 
-func renderImageSearchResults(resp gsearch.ImageSearchResponse, req gsearch.ImageSearchRequest) []byte {
+func renderImageSearchResults(resp gsearch.ImageSearchResponse, req gsearch.ImageSearchRequest, maxInlineImageSize int) []byte {
 	type Page struct {
 		Query        string
 		QueryEscaped string
@@ -445,9 +1414,13 @@ func renderImageSearchResults(resp gsearch.ImageSearchResponse, req gsearch.Imag
 {{- define "SingleResult" }}
 => {{ permalink .ImageHash }} {{ .AltText }}
 * Fetched: {{ .FetchTime.Format "2006-01-02" }} - {{ urlhost .SourceUrl }}
+{{- if .Image }}
 XXX {{ .AltText }}
 {{ .Image }}
 XXX
+{{- else }}
+* Too large to be shown here; follow the link above to view it.
+{{- end }}
 {{ end }}
 
 {{- define "Results" }}
@@ -492,6 +1465,12 @@ Found {{ .TotalResults }} result(s) in {{ .Duration }}.
 		"permalink": func(ih string) string { return "/image/perm/" + ih },
 	}
 
+	results := make([]gsearch.ImageSearchResult, len(resp.Results))
+	for i, r := range resp.Results {
+		r.Image = inlineImage(r.Image, maxInlineImageSize)
+		results[i] = r
+	}
+
 	baseUrl := ""
 	npages := resp.TotalResults / gsearch.PageSize
 	if resp.TotalResults%gsearch.PageSize != 0 {
@@ -504,7 +1483,7 @@ Found {{ .TotalResults }} result(s) in {{ .Duration }}.
 		QueryEscaped: url.QueryEscape(req.Query),
 		Duration:     resp.Duration.Round(time.Millisecond / 10),
 		Title:        "Gemplex Gemini Image Search",
-		Results:      resp.Results,
+		Results:      results,
 		TotalResults: resp.TotalResults,
 		Page:         req.Page,
 		PageCount:    npages,
@@ -527,6 +1506,50 @@ func cgiErr(w io.Writer, msg string) {
 	geminiHeader(w, 42, msg)
 }
 
+// report an error returned by the search daemon. an index that is not ready yet
+// (e.g. still being built) is a temporary condition, so the user is asked to
+// retry instead of getting a generic error. pages past the reported results
+// simply don't exist.
+func searchDaemonErr(w io.Writer, daemonErr string) {
+	if daemonErr == gsearch.ErrIndexNotReady.Error() {
+		geminiHeader(w, 41, "The search index is not ready yet; please try again in a few minutes")
+		return
+	}
+
+	if daemonErr == gsearch.ErrPageBeyondLimit.Error() {
+		geminiHeader(w, 51, "Only the first pages of results can be viewed")
+		return
+	}
+
+	cgiErr(w, "Internal error")
+}
+
+// return the query string for a search url (the reverse of parseSearchRequest),
+// so that links to other pages of the results keep everything the user asked
+// for. filters (like lang: or type:) are part of the query itself; other
+// options are passed as separate parameters. the page number and verbose mode
+// are part of the path.
+func searchQueryString(req gsearch.PageSearchRequest) string {
+	if req.Format == "" {
+		return url.QueryEscape(req.Query)
+	}
+
+	// "fmt" must always be present, since that's how we detect this form of
+	// the query string.
+	return "q=" + url.QueryEscape(req.Query) + "&fmt=" + url.QueryEscape(req.Format)
+}
+
+// isFormattedQuery reports whether the given query string values are in the
+// "q=<query>&fmt=<format>" form, as generated by searchQueryString.
+func isFormattedQuery(values url.Values) bool {
+	if len(values) != 2 || len(values["q"]) != 1 || len(values["fmt"]) != 1 {
+		return false
+	}
+
+	format := values.Get("fmt")
+	return format == "plain" || format == "gemini"
+}
+
 func parseSearchRequest(u *url.URL) (req gsearch.PageSearchRequest, err error) {
 	// url format: [/v]/search[/page]
 	re := regexp.MustCompile(`(?P<verbose>/v)?/search(?:/(?P<page>\d+))?`)
@@ -558,6 +1581,20 @@ func parseSearchRequest(u *url.URL) (req gsearch.PageSearchRequest, err error) {
 		}
 	}
 
+	// the query can also be passed as "q=<query>&fmt=<format>", which allows
+	// choosing the output format. since a plain query could look just like
+	// that, this form is only accepted when it contains nothing but a "q" and
+	// a valid "fmt" parameter; anything else is taken as a plain query.
+	if values, perr := url.ParseQuery(u.RawQuery); perr == nil && isFormattedQuery(values) {
+		req.Query = values.Get("q")
+		req.Format = values.Get("fmt")
+		if req.Format == "gemini" {
+			req.Format = ""
+		}
+
+		return
+	}
+
 	req.Query, err = url.QueryUnescape(u.RawQuery)
 	if err != nil {
 		err = ErrBadUrl
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~elektito/gemplex/pkg/db"
+	"git.sr.ht/~elektito/gemplex/pkg/gparse"
+	"git.sr.ht/~elektito/gemplex/pkg/gsearch"
+	"golang.org/x/exp/slices"
+)
+
+func TestInlineImage(t *testing.T) {
+	cases := []struct {
+		image    string
+		maxSize  int
+		expected string
+	}{
+		{" /\\_/\\\n( o.o )\n", 100, " /\\_/\\\n( o.o )"},
+		{"0123456789", 5, ""},
+		{"0123456789", 0, "0123456789"},
+		{"top\n```\nbottom", 100, ""},
+		{"bad \xff utf-8", 100, "bad  utf-8"},
+	}
+
+	for _, c := range cases {
+		result := inlineImage(c.image, c.maxSize)
+		if result != c.expected {
+			t.Fatalf("inlineImage(%q, %d): expected %q; got %q", c.image, c.maxSize, c.expected, result)
+		}
+	}
+}
+
+func TestRenderImageSearchResultsOversized(t *testing.T) {
+	small := "(=^.^=)"
+	large := strings.Repeat("#", 100)
+
+	resp := gsearch.ImageSearchResponse{
+		TotalResults: 2,
+		Results: []gsearch.ImageSearchResult{
+			{ImageHash: "small", AltText: "cat", Image: small, SourceUrl: "gemini://example.org/"},
+			{ImageHash: "large", AltText: "wall", Image: large, SourceUrl: "gemini://example.org/"},
+		},
+	}
+	req := gsearch.ImageSearchRequest{Query: "cat", Page: 1}
+
+	out := string(renderImageSearchResults(resp, req, 50))
+
+	if !strings.Contains(out, small) {
+		t.Fatalf("Expected the small image to be inlined; got:\n%s", out)
+	}
+	if strings.Contains(out, large) {
+		t.Fatalf("Expected the large image not to be inlined; got:\n%s", out)
+	}
+	if !strings.Contains(out, "=> /image/perm/large wall") {
+		t.Fatalf("Expected a permalink to the large image; got:\n%s", out)
+	}
+	if strings.Count(out, "```") != 2 {
+		t.Fatalf("Expected a single preformatted block; got:\n%s", out)
+	}
+
+	// the response itself is left untouched
+	if resp.Results[1].Image != large {
+		t.Fatal("Expected the search response not to be modified")
+	}
+}
+
+func TestParseUrlQuery(t *testing.T) {
+	cases := []struct {
+		query    string
+		expected string
+	}{
+		{"example.org/foo", "gemini://example.org/foo"},
+		{"url=gemini%3A%2F%2Fexample.org%2F", "gemini://example.org/"},
+		{"gemini://example.org/a%20b", "gemini://example.org/a b"},
+	}
+
+	for _, c := range cases {
+		result, err := parseUrlQuery(c.query)
+		if err != nil || result != c.expected {
+			t.Fatalf("parseUrlQuery(%q): expected %q; got %q (err: %v)", c.query, c.expected, result, err)
+		}
+	}
+}
+
+func TestRenderUrlInfo(t *testing.T) {
+	info := db.UrlInfo{
+		Url:            "gemini://example.org/",
+		UrlId:          42,
+		ContentId:      7,
+		ContentTitle:   "Example",
+		ContentType:    "text/gemini",
+		ContentsLength: 10,
+		LastFetchMs:    -1,
+		InternalLinks: []gparse.Link{
+			{Url: "gemini://example.org/about", Text: "About"},
+		},
+		ExternalBacklinks: []gparse.Link{
+			{Url: "gemini://other.org/links"},
+		},
+		OutboundLinks: 1,
+	}
+
+	out := string(renderUrlInfo(info))
+
+	expected := []string{
+		"* URL id: 42",
+		"* Title: Example",
+		"* Content length: 10",
+		"### 1 internal link(s)\n=> gemini://example.org/about About\n",
+		"### 0 external link(s)\n\n## Backlinks",
+		"### 1 external backlink(s)\n=> gemini://other.org/links gemini://other.org/links\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Fatalf("Expected %q in the rendered page; got:\n%s", e, out)
+		}
+	}
+
+	if strings.Contains(out, "Last fetch took") {
+		t.Fatalf("Expected no fetch time for an unknown one; got:\n%s", out)
+	}
+}
+
+func TestHelpCrawlerIdentity(t *testing.T) {
+	params := Params{
+		CrawlerName:    "example-bot",
+		CrawlerContact: "gemini://example.org/bot.gmi",
+	}
+
+	var out strings.Builder
+	handleHelp(nil, nil, &out, params)
+
+	expected := []string{
+		"User-agent: example-bot\nDisallow: /\n",
+		"=> gemini://example.org/bot.gmi ",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out.String(), e) {
+			t.Fatalf("Expected %q in the help page; got:\n%s", e, out.String())
+		}
+	}
+
+	out.Reset()
+	handleHelp(nil, nil, &out, Params{CrawlerName: "example-bot", CrawlerContact: "bot@example.org"})
+	if !strings.Contains(out.String(), "=> mailto:bot@example.org ") {
+		t.Fatalf("Expected a mailto link for an email contact; got:\n%s", out.String())
+	}
+
+	out.Reset()
+	handleHelp(nil, nil, &out, Params{CrawlerName: "example-bot"})
+	if strings.Contains(out.String(), "About the crawler") {
+		t.Fatalf("Expected no contact link without a contact; got:\n%s", out.String())
+	}
+}
+
+func TestRenderHosts(t *testing.T) {
+	hosts := []db.HostInfo{
+		{Hostname: "example.org", Rank: 0.5, Pages: 12, TopUrl: "gemini://example.org/"},
+		{Hostname: "other.org:1966", Rank: 0.25, Pages: 1, TopUrl: "gemini://other.org:1966/about.gmi"},
+	}
+
+	out := string(renderHosts(hosts, gsearch.PageSize+2, 2))
+
+	expected := []string{
+		"=> gemini://example.org/ example.org (12 page(s), rank 0.5)\n",
+		"=> gemini://other.org:1966/about.gmi other.org:1966 (1 page(s), rank 0.25)\n",
+		"=> /hosts/1 Prev Page (1 of 2 pages)",
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Fatalf("Expected %q in the rendered page; got:\n%s", e, out)
+		}
+	}
+
+	if strings.Contains(out, "Next Page") {
+		t.Fatalf("Expected no next page link on the last page; got:\n%s", out)
+	}
+}
+
+func TestTypeLabel(t *testing.T) {
+	cases := []struct {
+		kind        string
+		contentType string
+		expected    string
+	}{
+		{"", "text/gemini", "📄 gemtext"},
+		{"", "text/plain", "📝 plain text"},
+		{"rfc", "text/plain", "📜 rfc"},
+		{"email", "text/plain", "📧 email"},
+		{"listing", "text/gemini", "🗂️ listing"},
+		{"", "text/x-unknown", "text/x-unknown"},
+		{"unknown-kind", "text/csv", "text/csv"},
+	}
+
+	for _, c := range cases {
+		label := typeLabel(c.kind, c.contentType)
+		if label != c.expected {
+			t.Errorf("Expected %q for kind=%q and content type %q; got %q", c.expected, c.kind, c.contentType, label)
+		}
+	}
+}
+
+func TestRenderSearchResultsTypeLabel(t *testing.T) {
+	resp := gsearch.PageSearchResponse{
+		TotalResults: 1,
+		Results: []gsearch.PageSearchResult{
+			{Url: "gemini://example.org/rfc1.txt", Title: "RFC 1", ContentType: "text/plain", Kind: "rfc"},
+		},
+	}
+
+	out := string(renderSearchResults(resp, gsearch.PageSearchRequest{Query: "rfc", Page: 1}))
+	if !strings.Contains(out, " - 📜 rfc - ") || strings.Contains(out, "content type: text/plain") {
+		t.Fatalf("Expected the type label (and not the raw type) in the results; got:\n%s", out)
+	}
+
+	out = string(renderSearchResults(resp, gsearch.PageSearchRequest{Query: "rfc", Page: 1, Verbose: true}))
+	if !strings.Contains(out, "* content type: text/plain") {
+		t.Fatalf("Expected the raw content type in verbose results; got:\n%s", out)
+	}
+}
+
+func TestRecentImages(t *testing.T) {
+	ids := make([]string, recentImagesCount+2)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%032x", i)
+	}
+
+	// invalid ids are dropped, and only the latest ones are kept
+	rawQuery := "foo," + strings.Join(ids, ",") + ",<script>"
+	recent := parseRecentImages(rawQuery)
+	if !slices.Equal(recent, ids[2:]) {
+		t.Fatalf("Unexpected recent images: %v", recent)
+	}
+
+	// the current image is added to the list, dropping the oldest
+	current := fmt.Sprintf("%032x", 100)
+	next := parseRecentImages(nextRecentImages(recent, current))
+	if len(next) != recentImagesCount || next[len(next)-1] != current || slices.Contains(next, ids[2]) {
+		t.Fatalf("Unexpected next recent images: %v", next)
+	}
+
+	if parseRecentImages("") != nil {
+		t.Fatal("Expected no recent images for an empty query")
+	}
+}
+
+func TestCgiRequestLine(t *testing.T) {
+	params := Params{ServerName: "example.org"}
+
+	cases := []struct {
+		name     string
+		request  string
+		expected string
+	}{
+		{"over-length", "gemini://example.org/search?" + strings.Repeat("a", maxRequestLength) + "\r\n", "59 "},
+		{"non-utf8", "gemini://example.org/search?\xff\xfe\r\n", "59 "},
+
+		// these make it past the request line checks
+		{"max-length", "gemini://other.org/" + strings.Repeat("a", maxRequestLength-len("gemini://other.org/")) + "\r\n", "53 "},
+		{"no-crlf", "gemini://other.org/", "53 "},
+	}
+
+	for _, c := range cases {
+		var out bytes.Buffer
+		cgi(strings.NewReader(c.request), &out, params)
+		if !strings.HasPrefix(out.String(), c.expected) {
+			t.Errorf("%s: expected response starting with %q; got: %q", c.name, c.expected, out.String())
+		}
+	}
+}
+
+func TestPopularDisabled(t *testing.T) {
+	// the search daemon should not even be contacted
+	params := Params{SearchDaemonSocket: "/nonexistent", PopularDisabled: true}
+
+	var out bytes.Buffer
+	handlePopular(nil, nil, &out, params)
+	if !strings.HasPrefix(out.String(), "51 ") {
+		t.Fatalf("Expected a not found response; got: %q", out.String())
+	}
+}
+
+func TestReadRequestLine(t *testing.T) {
+	line, err := readRequestLine(strings.NewReader("gemini://example.org/\r\nextra"))
+	if err != nil || line != "gemini://example.org/" {
+		t.Fatalf("Unexpected result: %q, %v", line, err)
+	}
+
+	_, err = readRequestLine(strings.NewReader(strings.Repeat("a", 10*maxRequestLength)))
+	if err != ErrRequestTooLong {
+		t.Fatalf("Expected ErrRequestTooLong; got: %v", err)
+	}
+
+	_, err = readRequestLine(strings.NewReader("gemini://example.org/\x80\r\n"))
+	if err != ErrRequestNotUtf8 {
+		t.Fatalf("Expected ErrRequestNotUtf8; got: %v", err)
+	}
+
+	_, err = readRequestLine(strings.NewReader(""))
+	if err != ErrNoRequestLine {
+		t.Fatalf("Expected ErrNoRequestLine; got: %v", err)
+	}
+}
+
+func TestRenderSearchResultsCapped(t *testing.T) {
+	resp := gsearch.PageSearchResponse{
+		TotalResults: 1000,
+		TotalCapped:  true,
+		Results: []gsearch.PageSearchResult{
+			{Url: "gemini://example.org/", Title: "Example", ContentType: "text/gemini"},
+		},
+	}
+
+	out := string(renderSearchResults(resp, gsearch.PageSearchRequest{Query: "example", Page: 67}))
+	if !strings.Contains(out, "Found 1000+ result(s)") {
+		t.Fatalf("Expected a capped result count; got:\n%s", out)
+	}
+	if !strings.Contains(out, "Prev Page (66 of 67 pages)") || strings.Contains(out, "Next Page") {
+		t.Fatalf("Expected the last page to be the one containing the capped total; got:\n%s", out)
+	}
+}
+
+func TestRenderSearchResultsPaginationFilters(t *testing.T) {
+	resp := gsearch.PageSearchResponse{
+		TotalResults: 3 * gsearch.PageSize,
+		Results: []gsearch.PageSearchResult{
+			{Url: "gemini://example.org/", Title: "Example", ContentType: "text/gemini"},
+		},
+		ContentTypes: []gsearch.FacetCount{
+			{Term: "text/gemini", Count: 40},
+			{Term: "text/plain", Count: 5},
+		},
+	}
+
+	query := "foo lang:en site:example.org kind:gemlog"
+	u, _ := url.Parse("gemini://example.org/v/search/2?" + url.QueryEscape(query))
+	req, err := parseSearchRequest(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := string(renderSearchResults(resp, req))
+	for _, link := range []string{
+		"=> /v/search/1?" + url.QueryEscape(query) + " Prev Page",
+		"=> /v/search/3?" + url.QueryEscape(query) + " Next Page",
+		"=> /v/search?" + url.QueryEscape(query+" type:text/plain") + " text/plain",
+	} {
+		if !strings.Contains(out, link) {
+			t.Errorf("Expected link %q in the results; got:\n%s", link, out)
+		}
+	}
+
+	// the links should lead back to the same request
+	u, _ = url.Parse("gemini://example.org/v/search/3?" + searchQueryString(req))
+	next, err := parseSearchRequest(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Query != req.Query || !next.Verbose || next.Page != 3 || next.Collapse != req.Collapse {
+		t.Fatalf("Expected the next page to keep the request options; got: %+v", next)
+	}
+
+	// same with the plain text format
+	u, _ = url.Parse("gemini://example.org/search/2?q=" + url.QueryEscape(query) + "&fmt=plain")
+	req, err = parseSearchRequest(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out = string(renderSearchResults(resp, req))
+	expected := "/search/3?q=" + url.QueryEscape(query) + "&fmt=plain"
+	if !strings.Contains(out, expected) {
+		t.Fatalf("Expected next page link %q in the results; got:\n%s", expected, out)
+	}
+}
+
+func TestParseSearchRequestFormat(t *testing.T) {
+	cases := []struct {
+		rawQuery string
+		query    string
+		format   string
+	}{
+		{"q=foo&fmt=plain", "foo", "plain"},
+		{"q=foo&fmt=gemini", "foo", ""},
+		{"fmt=plain&q=foo", "foo", "plain"},
+		{"q=foo", "q=foo", ""},
+		{"q%3Dfoo", "q=foo", ""},
+		{"q=foo&fmt=bar", "q=foo&fmt=bar", ""},
+		{"q=foo&fmt=plain&x=1", "q=foo&fmt=plain&x=1", ""},
+	}
+
+	for _, c := range cases {
+		u, _ := url.Parse("gemini://example.org/search?" + c.rawQuery)
+		req, err := parseSearchRequest(u)
+		if err != nil {
+			t.Fatalf("%q: %s", c.rawQuery, err)
+		}
+		if req.Query != c.query || req.Format != c.format {
+			t.Errorf("%q: expected query %q and format %q; got %q and %q",
+				c.rawQuery, c.query, c.format, req.Query, req.Format)
+		}
+	}
+}
+
+func TestSearchDaemonErr(t *testing.T) {
+	cases := []struct {
+		daemonErr string
+		status    string
+	}{
+		{gsearch.ErrIndexNotReady.Error(), "41 "},
+		{gsearch.ErrPageBeyondLimit.Error(), "51 "},
+		{"something else", "42 "},
+	}
+
+	for _, c := range cases {
+		var w bytes.Buffer
+		searchDaemonErr(&w, c.daemonErr)
+		if !strings.HasPrefix(w.String(), c.status) {
+			t.Errorf("%q: expected status %q; got %q", c.daemonErr, c.status, w.String())
+		}
+	}
+}
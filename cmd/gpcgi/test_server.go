@@ -96,6 +96,11 @@ func handleConn(conn net.Conn, cfg *config.Config) {
 	log.Println("Accepted connection from:", conn.RemoteAddr())
 	params := Params{
 		SearchDaemonSocket: cfg.Search.UnixSocketPath,
+		MaxInlineImageSize: cfg.Search.MaxInlineImageSize,
+		CrawlerName:        cfg.Crawl.UserAgent,
+		CrawlerContact:     cfg.Crawl.Contact,
+		CollapseResults:    cfg.Search.CollapseResults,
+		PopularDisabled:    cfg.Search.PopularQueryHashKey != "",
 		ServerName:         "localhost",
 	}
 	cgi(conn, conn, params)
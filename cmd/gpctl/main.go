@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"crypto/md5"
 	"database/sql"
+	"encoding/csv"
 	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
 	"flag"
 	"fmt"
+	"io"
+	"math/rand"
+	"net"
 	"net/url"
 	"os"
 	"os/signal"
@@ -17,10 +24,13 @@ import (
 
 	"git.sr.ht/~elektito/gemplex/pkg/config"
 	"git.sr.ht/~elektito/gemplex/pkg/db"
+	"git.sr.ht/~elektito/gemplex/pkg/gcrawler"
 	"git.sr.ht/~elektito/gemplex/pkg/gparse"
 	"git.sr.ht/~elektito/gemplex/pkg/gsearch"
 	"git.sr.ht/~elektito/gemplex/pkg/pagerank"
 	"git.sr.ht/~elektito/gemplex/pkg/utils"
+	"github.com/a-h/gemini"
+	"github.com/blevesearch/bleve/v2"
 	"github.com/lib/pq"
 	"golang.org/x/exp/slices"
 )
@@ -36,8 +46,8 @@ var commands map[string]Command
 func init() {
 	commands = map[string]Command{
 		"addseed": {
-			Info:       "Add new seed url to the database",
-			ShortUsage: "<url> [<url> ...]",
+			Info:       "Add new seed url(s) to the database; pass - to read urls from stdin.",
+			ShortUsage: "[-file <file>] [<url> | - ...]",
 			Handler:    handleAddSeedCommand,
 		},
 		"delhost": {
@@ -47,6 +57,32 @@ func init() {
 			ShortUsage: "<host-name>",
 			Handler:    handleDelHostCommand,
 		},
+		"export-graph": {
+			Info:       "Export the link graph to a file (csv, graphml or edgelist).",
+			ShortUsage: "[-format csv|graphml|edgelist] [-text] <file>",
+			Handler:    handleExportGraphCommand,
+		},
+		"export-pages": {
+			Info:       "Export indexable pages to a file as JSON lines.",
+			ShortUsage: "[-filter kind=<kind>,lang=<lang>] <file>",
+			Handler:    handleExportPagesCommand,
+		},
+		"hide-host": {
+			Info: `Exclude a host (could be hostname:port) from search results, from
+   the next index build on. The host is still crawled.`,
+			ShortUsage: "<host-name>",
+			Handler:    handleHideHostCommand,
+		},
+		"hosts": {
+			Info:       "List the hosts with crawled pages, ordered by rank.",
+			ShortUsage: "[-page n] [-n count]",
+			Handler:    handleHostsCommand,
+		},
+		"import-seeds": {
+			Info:       "Fetch a gemtext page, and add all the gemini links in it as seed urls.",
+			ShortUsage: "<gemini-url>",
+			Handler:    handleImportSeedsCommand,
+		},
 		"index": {
 			Info:       "Index the contents of the database",
 			ShortUsage: "<index-dir>",
@@ -57,273 +93,1480 @@ func init() {
 			ShortUsage: "",
 			Handler:    handlePageRankCommand,
 		},
+		"prune-index": {
+			Info:       "Delete the pages no longer in the database from the given index.",
+			ShortUsage: "<index-dir>",
+			Handler:    handlePruneIndexCommand,
+		},
+		"recrawl": {
+			Info:       "Make the given urls due for crawling, ahead of other urls.",
+			ShortUsage: "<url> [<url> ...]",
+			Handler:    handleRecrawlCommand,
+		},
+		"refresh": {
+			Info: `Make all urls of a host (could be hostname:port) due for crawling, and
+   wait for the running crawler to revisit them (up to the given timeout;
+   zero means don't wait). Reports how many had their contents changed.`,
+			ShortUsage: "[-timeout duration] <host-name>",
+			Handler:    handleRefreshCommand,
+		},
+		"repin": {
+			Info: `Forget the certificate pinned for a host (could be hostname:port), so
+   that the one seen on the next visit is pinned instead. Only used if
+   tofuPin is set in the crawl config.`,
+			ShortUsage: "<host-name>",
+			Handler:    handleRepinCommand,
+		},
+		"rerank-hosts": {
+			Info:       "Update host ranks in the database, without updating url ranks.",
+			ShortUsage: "",
+			Handler:    handleRerankHostsCommand,
+		},
+		"rebuild-host-links": {
+			Info:       "Rebuild the host links table from the links table.",
+			ShortUsage: "",
+			Handler:    handleRebuildHostLinksCommand,
+		},
 		"reimg": {
 			Info:       "Update images (ascii art) table.",
 			ShortUsage: "",
 			Handler:    handleReImgCommand,
 		},
 		"reparse": {
-			Info:       "Re-parse all pages in db, re-calculate columns we get from parsing, and write the results back to db.",
-			ShortUsage: "",
+			Info:       "Re-parse all pages in db (or those matching the given filters), re-calculate columns we get from parsing, and write the results back to db.",
+			ShortUsage: "[-kind kind] [-lang lang] [-host hostname]",
 			Handler:    handleReparseCommand,
 		},
+		"search": {
+			Info:       "Search the index (through the search daemon, unless -index is given) and display the results.",
+			ShortUsage: "[-page n] [-n count] [-verbose] [-index path] <query>",
+			Handler:    handleSearchCommand,
+		},
+		"unhide-host": {
+			Info:       "Include a host hidden with hide-host in search results again, from the next index build on.",
+			ShortUsage: "<host-name>",
+			Handler:    handleUnhideHostCommand,
+		},
 		"url": {
 			Info:       "Display information about the given url",
 			ShortUsage: "[-substr] <url>",
 			Handler:    handleUrlInfoCommand,
 		},
+		"why": {
+			Info:       "Explain why the given url is (or isn't) being crawled.",
+			ShortUsage: "<url>",
+			Handler:    handleWhyCommand,
+		},
+		"verify-index": {
+			Info:       "Check a sample of pages in the given index against the database (and vice versa), and report drift.",
+			ShortUsage: "[-n sample-size] [-verbose] <index-dir>",
+			Handler:    handleVerifyIndexCommand,
+		},
 	}
 }
 
 func handleAddSeedCommand(cfg *config.Config, args []string) {
-	if len(args) == 0 {
+	fs := flag.NewFlagSet("addseed", flag.ExitOnError)
+
+	file := fs.String("file", "", "Read newline-separated urls from the given file.")
+
+	fs.Parse(args)
+
+	var urls []string
+	for _, arg := range fs.Args() {
+		if arg == "-" {
+			urls = append(urls, readSeedUrls(os.Stdin)...)
+		} else {
+			urls = append(urls, arg)
+		}
+	}
+
+	if *file != "" {
+		f, err := os.Open(*file)
+		if err != nil {
+			fmt.Printf("Cannot open file %s: %s\n", *file, err)
+			os.Exit(1)
+		}
+		urls = append(urls, readSeedUrls(f)...)
+		f.Close()
+	}
+
+	if len(urls) == 0 {
 		fmt.Println("No urls passed to add.")
 		return
 	}
 
-	db, err := sql.Open("postgres", cfg.GetDbConnStr())
+	conn, err := sql.Open("postgres", cfg.GetDbConnStr())
 	utils.PanicOnErr(err)
-	defer db.Close()
+	defer conn.Close()
 
-	for _, ustr := range args {
-		u, err := url.Parse(ustr)
-		if err != nil {
-			fmt.Printf("Invalid url %s: %s\n", ustr, err)
-			return
+	added, existing, invalid, err := addSeedUrls(conn, urls)
+	if err != nil {
+		fmt.Printf("Error inserting url into database: %s\n", err)
+		return
+	}
+
+	fmt.Printf("Added: %d  Already existed: %d  Invalid: %d\n", added, existing, invalid)
+}
+
+// add the given urls to the database as seeds, after validating and
+// normalizing them, reporting the outcome for each url.
+func addSeedUrls(conn *sql.DB, urls []string) (added, existing, invalid int, err error) {
+	for _, ustr := range urls {
+		u, parseErr := url.Parse(ustr)
+		if parseErr != nil {
+			fmt.Printf("Invalid url %s: %s\n", ustr, parseErr)
+			invalid++
+			continue
 		}
 
 		if u.Scheme != "gemini" {
-			fmt.Printf("Invalid url scheme '%s'. Expected 'gemini'.\n", u.Scheme)
-			return
+			fmt.Printf("Invalid url scheme '%s' (%s). Expected 'gemini'.\n", u.Scheme, ustr)
+			invalid++
+			continue
 		}
 
-		u, err = gparse.NormalizeUrl(u)
-		if err != nil {
-			fmt.Printf("Could not normalize url %s: %s\n", u, err)
-			return
+		u, parseErr = gparse.NormalizeUrl(u)
+		if parseErr != nil {
+			fmt.Printf("Could not normalize url %s: %s\n", ustr, parseErr)
+			invalid++
+			continue
 		}
 
-		r, err := db.Exec(`
-insert into urls (url, hostname, first_added)
-values ($1, $2, now())
+		var r sql.Result
+		r, err = conn.Exec(`
+insert into urls (url, hostname, first_added, depth, priority)
+values ($1, $2, now(), 0, $3)
 on conflict (url) do nothing
-`, ustr, u.Hostname())
+`, u.String(), u.Hostname(), db.SeedPriority)
 		if err != nil {
-			fmt.Printf("Error inserting url into database: %s\n", err)
 			return
 		}
 
 		affected, err := r.RowsAffected()
 		utils.PanicOnErr(err)
 		if affected == 0 {
-			fmt.Println("URL already exists:", ustr)
+			fmt.Println("URL already exists:", u)
+			existing++
 		} else {
 			fmt.Println("Added seed url:", u)
+			added++
 		}
 	}
+
+	return
 }
 
-func handleDelHostCommand(cfg *config.Config, args []string) {
-	type Link struct {
-		src int64
-		dst int64
+func handleHostsCommand(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("hosts", flag.ExitOnError)
+
+	page := fs.Int("page", 1, "The page of results to display.")
+	count := fs.Int("n", 50, "The number of hosts per page.")
+
+	fs.Parse(args)
+
+	if *page < 1 || *count < 1 {
+		usage()
+		os.Exit(1)
 	}
 
-	if len(args) == 0 {
-		fmt.Println("No hostname passed.")
+	conn, err := sql.Open("postgres", cfg.GetDbConnStr())
+	utils.PanicOnErr(err)
+	defer conn.Close()
+
+	hosts, total, err := db.QueryHosts(conn, (*page-1)**count, *count)
+	utils.PanicOnErr(err)
+
+	for _, h := range hosts {
+		fmt.Printf("%10.6f %7d  %s  %s\n", h.Rank, h.Pages, h.Hostname, h.TopUrl)
+	}
+
+	npages := (total + *count - 1) / *count
+	fmt.Printf("Page %d of %d (%d hosts)\n", *page, npages, total)
+}
+
+func handleImportSeedsCommand(cfg *config.Config, args []string) {
+	if len(args) != 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	u, err := url.Parse(args[0])
+	if err != nil || u.Scheme != "gemini" {
+		fmt.Println("Expected a gemini url:", args[0])
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	text, finalUrl, err := fetchGemtext(ctx, u)
+	if err != nil {
+		fmt.Printf("Could not fetch %s: %s\n", u, err)
+		os.Exit(1)
+	}
+
+	page := gparse.ParseGemtext(text, finalUrl)
+
+	// only gemini links are imported, each one once.
+	var urls []string
+	seen := map[string]bool{}
+	for _, link := range page.Links {
+		lu, err := url.Parse(link.Url)
+		if err != nil || lu.Scheme != "gemini" || seen[link.Url] {
+			continue
+		}
+		seen[link.Url] = true
+		urls = append(urls, link.Url)
+	}
+
+	if len(urls) == 0 {
+		fmt.Println("No gemini links found in:", finalUrl)
 		return
 	}
 
-	if len(args) > 1 {
-		fmt.Println("Only one hostname allowed.")
+	conn, err := sql.Open("postgres", cfg.GetDbConnStr())
+	utils.PanicOnErr(err)
+	defer conn.Close()
+
+	added, existing, invalid, err := addSeedUrls(conn, urls)
+	if err != nil {
+		fmt.Printf("Error inserting url into database: %s\n", err)
 		return
 	}
 
-	hostname := args[0]
+	fmt.Printf("Added: %d  Already existed: %d  Invalid: %d\n", added, existing, invalid)
+}
 
-	fmt.Println(cfg.GetDbConnStr())
-	db, err := sql.Open("postgres", cfg.GetDbConnStr())
+// fetch the given gemini url (following redirects) and return its contents,
+// if it's a gemtext page, along with the url it was fetched from.
+func fetchGemtext(ctx context.Context, u *url.URL) (text string, finalUrl *url.URL, err error) {
+	const maxRedirects = 5
+
+	client := gemini.NewClient()
+	for redirs := 0; ; redirs++ {
+		var resp *gemini.Response
+		var certs []string
+		var ok bool
+		resp, certs, _, ok, err = client.RequestURL(ctx, u)
+		if err != nil {
+			return
+		}
+		if !ok {
+			if len(certs) == 0 {
+				err = fmt.Errorf("No TLS certificates received")
+				return
+			}
+
+			// trust on first use, and retry
+			client.AddServerCertificate(u.Host, certs[0])
+			resp, _, _, ok, err = client.RequestURL(ctx, u)
+			if err != nil {
+				return
+			}
+			if !ok {
+				err = fmt.Errorf("Request error")
+				return
+			}
+		}
+
+		code := string(resp.Header.Code)
+		meta := resp.Header.Meta
+		switch {
+		case strings.HasPrefix(code, "2"):
+			defer resp.Body.Close()
+			if !strings.HasPrefix(meta, "text/gemini") {
+				err = fmt.Errorf("Not a gemtext page: %s", meta)
+				return
+			}
+
+			var body []byte
+			body, err = io.ReadAll(resp.Body)
+			text = string(body)
+			finalUrl = u
+			return
+		case strings.HasPrefix(code, "3"):
+			resp.Body.Close()
+			if redirs == maxRedirects {
+				err = fmt.Errorf("Too many redirects")
+				return
+			}
+
+			var target *url.URL
+			target, err = url.Parse(meta)
+			if err != nil {
+				err = fmt.Errorf("Invalid redirect url '%s': %w", meta, err)
+				return
+			}
+			u = u.ResolveReference(target)
+		default:
+			resp.Body.Close()
+			err = fmt.Errorf("Status %s: %s", code, meta)
+			return
+		}
+	}
+}
+
+func handleRecrawlCommand(cfg *config.Config, args []string) {
+	if len(args) == 0 {
+		usage()
+		os.Exit(1)
+	}
+
+	conn, err := sql.Open("postgres", cfg.GetDbConnStr())
 	utils.PanicOnErr(err)
-	defer db.Close()
+	defer conn.Close()
+
+	for _, ustr := range args {
+		u, err := url.Parse(ustr)
+		if err != nil {
+			fmt.Printf("Invalid url %s: %s\n", ustr, err)
+			continue
+		}
+
+		u, err = gparse.NormalizeUrl(u)
+		if err != nil {
+			fmt.Printf("Could not normalize url %s: %s\n", ustr, err)
+			continue
+		}
+
+		// setting last_visited to null makes the url due, without touching
+		// retry_time, which is used for calculating the next retry time.
+		r, err := conn.Exec(`
+update urls
+set last_visited = null, priority = greatest(priority, $2)
+where url = $1
+`, u.String(), db.RecrawlPriority)
+		utils.PanicOnErr(err)
+
+		affected, err := r.RowsAffected()
+		utils.PanicOnErr(err)
+		if affected == 0 {
+			fmt.Println("URL not in the database:", u)
+		} else {
+			fmt.Println("Scheduled for recrawl:", u)
+		}
+	}
+}
+
+func handleWhyCommand(cfg *config.Config, args []string) {
+	if len(args) != 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	parsed, err := url.Parse(args[0])
+	if err != nil {
+		fmt.Printf("Invalid url %s: %s\n", args[0], err)
+		os.Exit(1)
+	}
+
+	parsed, err = gparse.NormalizeUrl(parsed)
+	if err != nil {
+		fmt.Printf("Could not normalize url %s: %s\n", args[0], err)
+		os.Exit(1)
+	}
+
+	u := gcrawler.PreparedUrl{Parsed: parsed, NonParsed: parsed.String()}
+	fmt.Println("URL:", u)
+
+	err = gcrawler.ConfigureBlacklist(cfg)
+	utils.PanicOnErr(err)
+
+	conn, err := sql.Open("postgres", cfg.GetDbConnStr())
+	utils.PanicOnErr(err)
+	defer conn.Close()
+
+	// the reasons the url is not crawled; empty if it is
+	var reasons []string
+	check := func(ok bool, okMsg string, reason string) {
+		if ok {
+			fmt.Println(" - ok:", okMsg)
+		} else {
+			fmt.Println(" - NO:", reason)
+			reasons = append(reasons, reason)
+		}
+	}
+
+	var banned bool
+	var lastVisited, nextDue sql.NullTime
+	var statusCode sql.NullInt64
+	var errorMsg sql.NullString
+	var depth sql.NullInt64
+	err = conn.QueryRow(`
+select banned, last_visited, last_visited + retry_time * coalesce(retry_jitter, 1), status_code, error, depth
+from urls
+where url = $1
+`, u.String()).Scan(&banned, &lastVisited, &nextDue, &statusCode, &errorMsg, &depth)
+	inDb := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		panic(err)
+	}
+	check(inDb, "url is in the database",
+		"url is not in the database; it is added when a crawled page links to it, or using addseed")
+
+	rule := gcrawler.BlacklistRule(u)
+	check(rule == "", "url is not blacklisted", "url is blacklisted by "+rule)
+
+	err = gcrawler.CheckUrlLimits(u)
+	check(err == nil, "url is within url limits", fmt.Sprint("url exceeds url limits: ", err))
+
+	check(!gcrawler.IsSkippedQueryUrl(u), "url is not a skipped query url",
+		"url has a query string, and query urls are skipped on this host (Crawl.SkipQueryUrls)")
+
+	check(!gcrawler.IsDisallowedPort(u), "url is on an allowed port",
+		fmt.Sprintf("url is on port %s, which is not allowed (Crawl.AllowedPorts)", u.Parsed.Port()))
+
+	var slowdownUntil sql.NullTime
+	var robotsPrefixes sql.NullString
+	err = conn.QueryRow(`
+select slowdown_until, robots_prefixes from hosts where hostname = $1
+`, u.Parsed.Host).Scan(&slowdownUntil, &robotsPrefixes)
+	if err != nil && err != sql.ErrNoRows {
+		panic(err)
+	}
+
+	slowedDown := slowdownUntil.Valid && slowdownUntil.Time.After(time.Now())
+	check(!slowedDown, "host is not slowed down",
+		fmt.Sprintf("host asked us to slow down until %s", slowdownUntil.Time.Format(time.DateTime)))
+
+	if robotsPrefixes.Valid {
+		prefix, robotsBanned := gcrawler.RobotsBannedPrefix(u, strings.Split(robotsPrefixes.String, "\n"))
+		check(!robotsBanned, "url is allowed by robots.txt",
+			fmt.Sprintf("url is disallowed by robots.txt (prefix %q)", prefix))
+	} else {
+		fmt.Println(" - ok: robots.txt of the host has not been (successfully) fetched yet; it will be, before crawling")
+	}
+
+	if inDb {
+		// this is set by the crawler when it checked robots.txt itself
+		check(!banned, "url is not marked as banned", "url is marked as banned (by robots.txt, when last checked)")
+
+		if cfg.Crawl.MaxDepth > 0 && depth.Valid {
+			check(depth.Int64 <= int64(cfg.Crawl.MaxDepth),
+				fmt.Sprintf("url depth (%d) is within the maximum depth", depth.Int64),
+				fmt.Sprintf("url depth (%d) exceeds the maximum depth (%d)", depth.Int64, cfg.Crawl.MaxDepth))
+		}
+
+		if lastVisited.Valid {
+			fmt.Printf("   last visited at %s with status %d", lastVisited.Time.Format(time.DateTime), statusCode.Int64)
+			if errorMsg.String != "" {
+				fmt.Printf(" (%s)", errorMsg.String)
+			}
+			fmt.Print("\n")
+		}
+
+		switch {
+		case !lastVisited.Valid:
+			check(true, "url is due now (not visited yet, or scheduled for recrawl)", "")
+		case !nextDue.Valid || !nextDue.Time.After(time.Now()):
+			check(true, "url is due now", "")
+		default:
+			check(false, "", fmt.Sprintf("url is not due until %s (in %s)",
+				nextDue.Time.Format(time.DateTime), time.Until(nextDue.Time).Round(time.Minute)))
+		}
+	}
+
+	fmt.Println()
+	if len(reasons) == 0 {
+		fmt.Println("The url will be crawled when the crawler gets to it.")
+	} else {
+		fmt.Println("The url will not be crawled now, because:")
+		for _, reason := range reasons {
+			fmt.Println(" -", reason)
+		}
+	}
+}
+
+func handleRefreshCommand(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("refresh", flag.ExitOnError)
+
+	timeout := fs.Duration("timeout", 10*time.Minute, "How long to wait for the urls to be revisited.")
+
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	hostname := fs.Arg(0)
+
+	conn, err := sql.Open("postgres", cfg.GetDbConnStr())
+	utils.PanicOnErr(err)
+	defer conn.Close()
+
+	// the content hash of a url (null if never successfully visited), and
+	// when it was last visited.
+	type urlState struct {
+		hash        sql.NullString
+		lastVisited sql.NullTime
+	}
+	readStates := func() (states map[int64]urlState) {
+		rows, err := conn.Query(`
+select u.id, c.hash, u.last_visited
+from urls u
+left join contents c on c.id = u.content_id
+where u.hostname = $1
+`, hostname)
+		utils.PanicOnErr(err)
+		defer rows.Close()
+
+		states = map[int64]urlState{}
+		for rows.Next() {
+			var id int64
+			var state urlState
+			err = rows.Scan(&id, &state.hash, &state.lastVisited)
+			utils.PanicOnErr(err)
+			states[id] = state
+		}
+		utils.PanicOnErr(rows.Err())
+		return
+	}
+
+	before := readStates()
+	if len(before) == 0 {
+		fmt.Println("No urls for host in the database:", hostname)
+		os.Exit(1)
+	}
+
+	// setting last_visited to null makes the urls due (same as recrawl), and
+	// also lets us know when they have been revisited.
+	_, err = conn.Exec(`
+update urls
+set last_visited = null, priority = greatest(priority, $2)
+where hostname = $1
+`, hostname, db.RecrawlPriority)
+	utils.PanicOnErr(err)
+
+	fmt.Printf("Scheduled %d url(s) for recrawl.\n", len(before))
+	if *timeout <= 0 {
+		return
+	}
+
+	var visited, changed int
+	deadline := time.Now().Add(*timeout)
+	for {
+		visited, changed = 0, 0
+		for id, state := range readStates() {
+			prev, ok := before[id]
+			if !ok || !state.lastVisited.Valid {
+				// either added since we started, or not visited yet
+				continue
+			}
+
+			visited++
+			if state.hash.Valid && state.hash != prev.hash {
+				changed++
+			}
+		}
+
+		if visited == len(before) || time.Now().After(deadline) {
+			break
+		}
+
+		fmt.Printf("Visited %d of %d url(s)...\n", visited, len(before))
+		time.Sleep(5 * time.Second)
+	}
+
+	fmt.Printf("Visited: %d  Changed: %d  Unchanged: %d  Pending: %d\n",
+		visited, changed, visited-changed, len(before)-visited)
+}
+
+func handleHideHostCommand(cfg *config.Config, args []string) {
+	setHostSearchHidden(cfg, args, true)
+}
+
+func handleUnhideHostCommand(cfg *config.Config, args []string) {
+	setHostSearchHidden(cfg, args, false)
+}
+
+func setHostSearchHidden(cfg *config.Config, args []string, hidden bool) {
+	if len(args) != 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	hostname := args[0]
+
+	conn, err := sql.Open("postgres", cfg.GetDbConnStr())
+	utils.PanicOnErr(err)
+	defer conn.Close()
+
+	r, err := conn.Exec(`update hosts set search_hidden = $1 where hostname = $2`, hidden, hostname)
+	utils.PanicOnErr(err)
+
+	affected, err := r.RowsAffected()
+	utils.PanicOnErr(err)
+	if affected == 0 {
+		fmt.Println("Host not in the database:", hostname)
+		os.Exit(1)
+	}
+
+	if hidden {
+		fmt.Println("Host hidden from search (from the next index build on):", hostname)
+	} else {
+		fmt.Println("Host included in search again (from the next index build on):", hostname)
+	}
+}
+
+func handleRepinCommand(cfg *config.Config, args []string) {
+	if len(args) != 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	hostname := strings.ToLower(args[0])
+
+	conn, err := sql.Open("postgres", cfg.GetDbConnStr())
+	utils.PanicOnErr(err)
+	defer conn.Close()
+
+	var pin sql.NullString
+	err = conn.QueryRow(`select cert_pin from hosts where hostname = $1`, hostname).Scan(&pin)
+	if err == sql.ErrNoRows {
+		fmt.Println("Host not in the database:", hostname)
+		os.Exit(1)
+	}
+	utils.PanicOnErr(err)
+
+	if !pin.Valid {
+		fmt.Println("No certificate pinned for host:", hostname)
+		return
+	}
+
+	_, err = conn.Exec(`update hosts set cert_pin = null where hostname = $1`, hostname)
+	utils.PanicOnErr(err)
+
+	fmt.Println("Forgot pinned certificate:", pin.String)
+	fmt.Println("The certificate seen on the next visit will be pinned for host:", hostname)
+}
+
+// read newline-separated urls from the given reader, ignoring empty lines and
+// lines starting with a '#'.
+func readSeedUrls(r io.Reader) (urls []string) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	utils.PanicOnErr(scanner.Err())
+
+	return
+}
+
+func handleDelHostCommand(cfg *config.Config, args []string) {
+	type Link struct {
+		src int64
+		dst int64
+	}
+
+	if len(args) == 0 {
+		fmt.Println("No hostname passed.")
+		return
+	}
+
+	if len(args) > 1 {
+		fmt.Println("Only one hostname allowed.")
+		return
+	}
+
+	hostname := args[0]
+
+	fmt.Println(cfg.GetDbConnStr())
+	db, err := sql.Open("postgres", cfg.GetDbConnStr())
+	utils.PanicOnErr(err)
+	defer db.Close()
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	tx, err := db.BeginTx(ctx, nil)
+	utils.PanicOnErr(err)
+	defer tx.Rollback()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		signal.Stop(c)
+
+		// we do this to make sure we don't leave long-running queries left
+		// running in postgres when interrupted. postgres would eventually might
+		// realize the connection is closed, but that could take a long time,
+		// while the running operations could hold a lock stopping other quries
+		// in the future.
+		fmt.Println("Canceling...")
+		cancelFunc()
+		fmt.Println("Canceled.")
+
+		os.Exit(1)
+	}()
+
+	// check constraints on commit (not after each statement)
+	_, err = tx.Exec("set constraints all deferred")
+	utils.PanicOnErr(err)
+
+	urlIds := make([]int64, 0)
+
+	fmt.Println("Finding URLs...")
+	rows, err := tx.Query(`select id from urls where hostname=$1`, hostname)
+	utils.PanicOnErr(err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		utils.PanicOnErr(err)
+		urlIds = append(urlIds, id)
+	}
+
+	links := []Link{}
+	outboundLinks := []Link{}
+	inboundLinks := []Link{}
+	internalLinks := []Link{}
+
+	fmt.Println("Finding links...")
+	rows, err = tx.Query(`select src_url_id, dst_url_id from links join urls on src_url_id=id where hostname=$1`, hostname)
+	utils.PanicOnErr(err)
+	defer rows.Close()
+	for rows.Next() {
+		var src, dst int64
+		err = rows.Scan(&src, &dst)
+		utils.PanicOnErr(err)
+		links = append(links, Link{src: src, dst: dst})
+	}
+	fmt.Println("Links so far:", len(links))
+
+	fmt.Println("Finding more links...")
+	rows, err = tx.Query(`select src_url_id, dst_url_id from links join urls on dst_url_id=id where hostname=$1`, hostname)
+	utils.PanicOnErr(err)
+	defer rows.Close()
+	for rows.Next() {
+		var src, dst int64
+		err = rows.Scan(&src, &dst)
+		utils.PanicOnErr(err)
+		links = append(links, Link{src: src, dst: dst})
+	}
+	fmt.Println("Total links:", len(links))
+
+	fmt.Println("Categorizing links...")
+	for _, link := range links {
+		if slices.Index(urlIds, link.src) >= 0 && slices.Index(urlIds, link.dst) >= 0 {
+			internalLinks = append(internalLinks, link)
+		} else if slices.Index(urlIds, link.src) >= 0 {
+			outboundLinks = append(outboundLinks, link)
+		} else {
+			inboundLinks = append(inboundLinks, link)
+		}
+	}
+
+	fmt.Println("Finding not-externally-linked URLs...")
+	var notExternallyLinkedUrlIds []int64
+	for _, id := range urlIds {
+		externallyLinked := false
+		for _, link := range inboundLinks {
+			if link.dst == id {
+				externallyLinked = true
+				break
+			}
+		}
+
+		if !externallyLinked {
+			notExternallyLinkedUrlIds = append(notExternallyLinkedUrlIds, id)
+		}
+	}
+
+	fmt.Printf("Deleting %d internal links...\n", len(internalLinks))
+	//
+	var srcs, dsts []int64
+	for _, link := range internalLinks {
+		srcs = append(srcs, link.src)
+		dsts = append(dsts, link.dst)
+	}
+	q := `
+delete from links
+where row(src_url_id, dst_url_id) in
+    (select unnest($1::bigint[]), unnest($2::bigint[]))
+`
+	result, err := tx.Exec(q, pq.Array(srcs), pq.Array(dsts))
+	utils.PanicOnErr(err)
+	affected, err := result.RowsAffected()
+	utils.PanicOnErr(err)
+	fmt.Println("Affected:", affected)
+
+	fmt.Printf("Deleting %d outbound links...\n", len(outboundLinks))
+	srcs, dsts = nil, nil
+	for _, link := range outboundLinks {
+		srcs = append(srcs, link.src)
+		dsts = append(dsts, link.dst)
+	}
+	result, err = tx.Exec(q, pq.Array(srcs), pq.Array(dsts))
+	utils.PanicOnErr(err)
+	affected, err = result.RowsAffected()
+	utils.PanicOnErr(err)
+	fmt.Println("Affected:", affected)
+
+	fmt.Printf("Deleting %d urls with no external links...\n", len(notExternallyLinkedUrlIds))
+	q = `delete from urls where id = any($1::bigint[])`
+	result, err = tx.Exec(q, pq.Array(notExternallyLinkedUrlIds))
+	utils.PanicOnErr(err)
+	affected, err = result.RowsAffected()
+	utils.PanicOnErr(err)
+	fmt.Println("Affected:", affected)
+
+	// all host links going out of the host, or into it, are removed. inbound
+	// links are kept though, so the host links for them are added back with
+	// the remaining weights.
+	fmt.Println("Deleting host links...")
+	result, err = tx.Exec(`delete from host_links where src_host = $1 or dst_host = $1`, hostname)
+	utils.PanicOnErr(err)
+	affected, err = result.RowsAffected()
+	utils.PanicOnErr(err)
+	fmt.Println("Affected:", affected)
+
+	fmt.Println("Recreating inbound host links...")
+	result, err = tx.Exec(`
+insert into host_links (src_host, dst_host, weight)
+select s.hostname, d.hostname, count(*)
+from links l
+join urls s on s.id = l.src_url_id
+join urls d on d.id = l.dst_url_id
+where d.hostname = $1 and s.hostname <> $1
+group by s.hostname, d.hostname
+`, hostname)
+	utils.PanicOnErr(err)
+	affected, err = result.RowsAffected()
+	utils.PanicOnErr(err)
+	fmt.Println("Affected:", affected)
+
+	fmt.Println("Committing transaction...")
+	tx.Commit()
+
+	// make sure we won't try cancelling the transaction, now that we're done
+	tx = nil
+
+	fmt.Println("Done.")
+}
+
+func handleExportGraphCommand(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("export-graph", flag.ExitOnError)
+
+	format := fs.String("format", "csv", "Output format: csv, graphml or edgelist.")
+	withText := fs.Bool("text", false, "Include link texts in the output (ignored for edgelist).")
+
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	switch *format {
+	case "csv", "graphml", "edgelist":
+	default:
+		fmt.Println("Unknown format:", *format)
+		os.Exit(1)
+	}
+
+	db, err := sql.Open("postgres", cfg.GetDbConnStr())
+	utils.PanicOnErr(err)
+	defer db.Close()
+
+	f, err := os.Create(fs.Arg(0))
+	utils.PanicOnErr(err)
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	defer w.Flush()
+
+	var n int
+	if *format == "graphml" {
+		n = exportGraphMl(db, w, *withText)
+	} else {
+		n = exportEdges(db, w, *format, *withText)
+	}
+
+	fmt.Printf("Exported %d edges to: %s\n", n, fs.Arg(0))
+}
+
+// write edges with source and destination urls, one per line, either as csv or
+// as a space separated edge list. rows are streamed from the database, so the
+// whole graph is never loaded into memory.
+func exportEdges(db *sql.DB, w io.Writer, format string, withText bool) (n int) {
+	rows, err := db.Query(`
+select s.url, d.url, coalesce(l.text, '')
+from links l
+join urls s on s.id = l.src_url_id
+join urls d on d.id = l.dst_url_id
+`)
+	utils.PanicOnErr(err)
+	defer rows.Close()
+
+	var cw *csv.Writer
+	if format == "csv" {
+		cw = csv.NewWriter(w)
+		defer cw.Flush()
+
+		header := []string{"src_url", "dst_url"}
+		if withText {
+			header = append(header, "text")
+		}
+		err = cw.Write(header)
+		utils.PanicOnErr(err)
+	}
+
+	for rows.Next() {
+		var src, dst, text string
+		err = rows.Scan(&src, &dst, &text)
+		utils.PanicOnErr(err)
+
+		if cw != nil {
+			record := []string{src, dst}
+			if withText {
+				record = append(record, text)
+			}
+			err = cw.Write(record)
+		} else {
+			// urls cannot contain spaces, so no escaping needed here
+			_, err = fmt.Fprintf(w, "%s %s\n", src, dst)
+		}
+		utils.PanicOnErr(err)
+
+		n++
+		if n%100000 == 0 {
+			fmt.Println("Progress:", n)
+		}
+	}
+	utils.PanicOnErr(rows.Err())
+
+	return
+}
+
+// write the graph in graphml format. all linked urls are written as nodes
+// first (using their database ids as node ids), followed by the edges.
+func exportGraphMl(db *sql.DB, w io.Writer, withText bool) (n int) {
+	escape := func(s string) string {
+		var b strings.Builder
+		xml.EscapeText(&b, []byte(s))
+		return b.String()
+	}
+
+	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<graphml xmlns="http://graphml.graphdrawing.org/xmlns">
+  <key id="url" for="node" attr.name="url" attr.type="string"/>
+`)
+	if withText {
+		fmt.Fprint(w, `  <key id="text" for="edge" attr.name="text" attr.type="string"/>
+`)
+	}
+	fmt.Fprint(w, `  <graph id="links" edgedefault="directed">
+`)
+
+	rows, err := db.Query(`
+select id, url from urls u
+where exists (select 1 from links where src_url_id = u.id or dst_url_id = u.id)
+`)
+	utils.PanicOnErr(err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var ustr string
+		err = rows.Scan(&id, &ustr)
+		utils.PanicOnErr(err)
+
+		_, err = fmt.Fprintf(w, "    <node id=\"n%d\"><data key=\"url\">%s</data></node>\n", id, escape(ustr))
+		utils.PanicOnErr(err)
+	}
+	utils.PanicOnErr(rows.Err())
+
+	rows, err = db.Query(`select src_url_id, dst_url_id, coalesce(text, '') from links`)
+	utils.PanicOnErr(err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var src, dst int64
+		var text string
+		err = rows.Scan(&src, &dst, &text)
+		utils.PanicOnErr(err)
+
+		if withText && text != "" {
+			_, err = fmt.Fprintf(w, "    <edge source=\"n%d\" target=\"n%d\"><data key=\"text\">%s</data></edge>\n", src, dst, escape(text))
+		} else {
+			_, err = fmt.Fprintf(w, "    <edge source=\"n%d\" target=\"n%d\"/>\n", src, dst)
+		}
+		utils.PanicOnErr(err)
+
+		n++
+		if n%100000 == 0 {
+			fmt.Println("Progress:", n)
+		}
+	}
+	utils.PanicOnErr(rows.Err())
+
+	fmt.Fprint(w, `  </graph>
+</graphml>
+`)
+
+	return
+}
+
+func handleExportPagesCommand(cfg *config.Config, args []string) {
+	type ExportedPage struct {
+		Url         string  `json:"url"`
+		Title       string  `json:"title"`
+		Text        string  `json:"text"`
+		Lang        string  `json:"lang"`
+		Kind        string  `json:"kind"`
+		PageRank    float64 `json:"prank"`
+		HostRank    float64 `json:"hrank"`
+		ContentType string  `json:"content_type"`
+		ContentSize uint64  `json:"content_size"`
+	}
+
+	fs := flag.NewFlagSet("export-pages", flag.ExitOnError)
+
+	filter := fs.String("filter", "", "Only export pages matching the given comma-separated kind=<kind> and/or lang=<lang> filters.")
+
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	filters := map[string]string{}
+	if *filter != "" {
+		for _, part := range strings.Split(*filter, ",") {
+			key, value, ok := strings.Cut(part, "=")
+			key = strings.TrimSpace(key)
+			if !ok || (key != "kind" && key != "lang") {
+				fmt.Println("Invalid filter:", part)
+				os.Exit(1)
+			}
+			filters[key] = strings.TrimSpace(value)
+		}
+	}
+
+	// blacklisted pages are skipped, just like when indexing
+	err := gcrawler.ConfigureBlacklist(cfg)
+	utils.PanicOnErr(err)
+
+	db, err := sql.Open("postgres", cfg.GetDbConnStr())
+	utils.PanicOnErr(err)
+	defer db.Close()
+
+	f, err := os.Create(fs.Arg(0))
+	utils.PanicOnErr(err)
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	defer w.Flush()
+
+	enc := json.NewEncoder(w)
+	n := 0
+	err = gsearch.ForEachPage(context.Background(), db, func(urlStr string, doc gsearch.PageDoc) error {
+		if kind, ok := filters["kind"]; ok && doc.Kind != kind {
+			return nil
+		}
+
+		if lang, ok := filters["lang"]; ok && doc.Lang != lang {
+			return nil
+		}
+
+		n++
+		if n%10000 == 0 {
+			fmt.Println("Progress:", n)
+		}
+
+		return enc.Encode(ExportedPage{
+			Url:         urlStr,
+			Title:       doc.Title,
+			Text:        doc.Content,
+			Lang:        doc.Lang,
+			Kind:        doc.Kind,
+			PageRank:    doc.PageRank,
+			HostRank:    doc.HostRank,
+			ContentType: doc.ContentType,
+			ContentSize: doc.ContentSize,
+		})
+	})
+	utils.PanicOnErr(err)
+
+	fmt.Printf("Exported %d pages to: %s\n", n, fs.Arg(0))
+}
+
+func handleIndexCommand(cfg *config.Config, args []string) {
+	if len(args) != 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	indexDir := args[0]
+
+	var indexName string
+	_, filename := path.Split(indexDir)
+	if strings.HasSuffix(filename, ".idx") {
+		indexName = filename[:len(filename)-4]
+	} else {
+		indexName = filename
+	}
+
+	index, err := gsearch.NewShardedIndex(indexDir, indexName, cfg.Index.Shards)
+	utils.PanicOnErr(err)
+
+	start := time.Now()
+	rows, err := gsearch.IndexDb(context.Background(), index, cfg)
+	utils.PanicOnErr(err)
+
+	docs, err := index.DocCount()
+	utils.PanicOnErr(err)
+
+	err = gsearch.WriteIndexMeta(indexDir, gsearch.IndexMeta{
+		DocCount:    docs,
+		SourceRows:  rows,
+		BuildStart:  start,
+		BuildFinish: time.Now(),
+		Watermark:   start.Add(-gsearch.WatermarkMargin),
+	})
+	utils.PanicOnErr(err)
+}
+
+func handlePageRankCommand(cfg *config.Config, args []string) {
+	db, err := sql.Open("postgres", cfg.GetDbConnStr())
+	utils.PanicOnErr(err)
+	pagerank.PerformPageRankOnDb(db)
+	db.Close()
+}
+
+func handleRerankHostsCommand(cfg *config.Config, args []string) {
+	db, err := sql.Open("postgres", cfg.GetDbConnStr())
+	utils.PanicOnErr(err)
+	pagerank.PerformHostRankOnDb(db)
+	db.Close()
+}
+
+func handleRebuildHostLinksCommand(cfg *config.Config, args []string) {
+	conn, err := sql.Open("postgres", cfg.GetDbConnStr())
+	utils.PanicOnErr(err)
+	defer conn.Close()
+
+	fmt.Println("Rebuilding host links...")
+	count, err := db.RebuildHostLinks(conn)
+	utils.PanicOnErr(err)
+	fmt.Printf("Done. %d host links written.\n", count)
+}
+
+func handleSearchCommand(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+
+	page := fs.Int("page", 1, "The page of results to display.")
+	count := fs.Int("n", gsearch.PageSize, "The maximum number of results to display.")
+	verbose := fs.Bool("verbose", false, "Display scores, ranks and other details for each result.")
+	indexPath := fs.String("index", "", "Open the given index directly, instead of querying the search daemon.")
+
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	req := gsearch.PageSearchRequest{
+		Type:  "search",
+		Query: fs.Arg(0),
+		Page:  *page,
+	}
+
+	var resp gsearch.PageSearchResponse
+	var err error
+	if *indexPath != "" {
+		gsearch.SetSnippetSize(cfg.Search.SnippetSize)
+		gsearch.SetTitleBoost(cfg.Search.TitleBoost)
+		gsearch.SetLinksBoost(cfg.Search.LinksBoost)
+		gsearch.SetHeadingsBoost(cfg.Search.HeadingsBoost)
+		gsearch.SetLangBoost(cfg.Search.LangBoost)
+		gsearch.SetMaxReportedResults(cfg.Search.MaxReportedResults)
+		gsearch.SetSynonyms(cfg.Search.Synonyms)
+		gsearch.SetSynonymBoost(cfg.Search.SynonymBoost)
+
+		index, openErr := gsearch.OpenIndexReadOnly(*indexPath, "gpctl", 5*time.Second)
+		utils.PanicOnErr(openErr)
+		defer index.Close()
+
+		resp, err = gsearch.SearchPages(req, index)
+	} else {
+		resp, err = searchDaemon(cfg, req)
+	}
+	if err != nil {
+		fmt.Println("Search error:", err)
+		os.Exit(1)
+	}
+
+	capped := ""
+	if resp.TotalCapped {
+		capped = "+"
+	}
+	fmt.Printf("%d%s results (page %d) in %s\n", resp.TotalResults, capped, *page, resp.Duration.Round(time.Microsecond))
+	for i, r := range resp.Results {
+		if i >= *count {
+			break
+		}
+
+		fmt.Println()
+		fmt.Printf("%d. %s\n", (*page-1)*gsearch.PageSize+i+1, r.Title)
+		fmt.Printf("   %s\n", r.Url)
+		fmt.Printf("  %s\n", r.Snippet)
+		if *verbose {
+			fmt.Printf(
+				"   score: %f  prank: %f  hrank: %f  type: %s  size: %d  lang: %s\n",
+				r.Relevance, r.UrlRank, r.HostRank, r.ContentType, r.ContentSize, r.Lang)
+		}
+	}
+}
+
+// send a search request to the search daemon and return its response
+func searchDaemon(cfg *config.Config, req gsearch.PageSearchRequest) (resp gsearch.PageSearchResponse, err error) {
+	conn, err := net.Dial("unix", cfg.Search.UnixSocketPath)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		return
+	}
 
-	ctx, cancelFunc := context.WithCancel(context.Background())
-	tx, err := db.BeginTx(ctx, nil)
-	utils.PanicOnErr(err)
-	defer tx.Rollback()
+	err = json.NewDecoder(conn).Decode(&resp)
+	if err != nil {
+		return
+	}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		signal.Stop(c)
+	if resp.Err != "" {
+		err = fmt.Errorf("%s", resp.Err)
+	}
+	return
+}
 
-		// we do this to make sure we don't leave long-running queries left
-		// running in postgres when interrupted. postgres would eventually might
-		// realize the connection is closed, but that could take a long time,
-		// while the running operations could hold a lock stopping other quries
-		// in the future.
-		fmt.Println("Canceling...")
-		cancelFunc()
-		fmt.Println("Canceled.")
+func handleVerifyIndexCommand(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("verify-index", flag.ExitOnError)
 
+	sampleSize := fs.Int("n", 1000, "The number of pages to sample from each of the index and the database.")
+	showMissing := fs.Bool("verbose", false, "Display the urls missing from the index or the database.")
+
+	fs.Parse(args)
+	if fs.NArg() != 1 || *sampleSize <= 0 {
+		usage()
 		os.Exit(1)
-	}()
+	}
 
-	// check constraints on commit (not after each statement)
-	_, err = tx.Exec("set constraints all deferred")
-	utils.PanicOnErr(err)
+	indexDir := fs.Arg(0)
 
-	urlIds := make([]int64, 0)
+	// opened read-only, so that a running search daemon is not affected
+	index, err := gsearch.OpenIndexReadOnly(indexDir, "gpctl", 5*time.Second)
+	if err != nil {
+		fmt.Println("Cannot open index:", err)
+		os.Exit(1)
+	}
+	defer index.Close()
 
-	fmt.Println("Finding URLs...")
-	rows, err := tx.Query(`select id from urls where hostname=$1`, hostname)
+	conn, err := sql.Open("postgres", cfg.GetDbConnStr())
 	utils.PanicOnErr(err)
-	defer rows.Close()
+	defer conn.Close()
 
-	for rows.Next() {
-		var id int64
-		err = rows.Scan(&id)
-		utils.PanicOnErr(err)
-		urlIds = append(urlIds, id)
+	// pages added after the index was built are not expected to be in it.
+	// if the index metadata is not available, we can't tell which ones those
+	// are, and they will be reported as missing.
+	watermark := time.Now()
+	meta, err := gsearch.ReadIndexMeta(indexDir)
+	if err == nil && !meta.Watermark.IsZero() {
+		watermark = meta.Watermark
+	} else {
+		fmt.Println("Index watermark not known; recently fetched pages might be reported as missing.")
 	}
 
-	links := []Link{}
-	outboundLinks := []Link{}
-	inboundLinks := []Link{}
-	internalLinks := []Link{}
+	// we need to skip the same urls the indexer does
+	err = gcrawler.ConfigureBlacklist(cfg)
+	utils.PanicOnErr(err)
 
-	fmt.Println("Finding links...")
-	rows, err = tx.Query(`select src_url_id, dst_url_id from links join urls on src_url_id=id where hostname=$1`, hostname)
+	indexed, total, err := sampleIndexedPages(index, *sampleSize)
 	utils.PanicOnErr(err)
-	defer rows.Close()
-	for rows.Next() {
-		var src, dst int64
-		err = rows.Scan(&src, &dst)
+
+	notInDb := 0
+	for _, u := range indexed {
+		var exists bool
+		err = conn.QueryRow(
+			`select exists (select 1 from urls where url = $1 and content_id is not null)`,
+			u).Scan(&exists)
 		utils.PanicOnErr(err)
-		links = append(links, Link{src: src, dst: dst})
+		if !exists {
+			notInDb++
+			if *showMissing {
+				fmt.Println("Indexed, but not in database:", u)
+			}
+		}
 	}
-	fmt.Println("Links so far:", len(links))
 
-	fmt.Println("Finding more links...")
-	rows, err = tx.Query(`select src_url_id, dst_url_id from links join urls on dst_url_id=id where hostname=$1`, hostname)
+	indexable, err := sampleIndexableUrls(conn, *sampleSize, watermark)
 	utils.PanicOnErr(err)
-	defer rows.Close()
-	for rows.Next() {
-		var src, dst int64
-		err = rows.Scan(&src, &dst)
+
+	notInIndex := 0
+	for _, u := range indexable {
+		doc, err := index.Document(u)
 		utils.PanicOnErr(err)
-		links = append(links, Link{src: src, dst: dst})
+		if doc == nil {
+			notInIndex++
+			if *showMissing {
+				fmt.Println("In database, but not indexed:", u)
+			}
+		}
 	}
-	fmt.Println("Total links:", len(links))
 
-	fmt.Println("Categorizing links...")
-	for _, link := range links {
-		if slices.Index(urlIds, link.src) >= 0 && slices.Index(urlIds, link.dst) >= 0 {
-			internalLinks = append(internalLinks, link)
-		} else if slices.Index(urlIds, link.src) >= 0 {
-			outboundLinks = append(outboundLinks, link)
-		} else {
-			inboundLinks = append(inboundLinks, link)
+	fmt.Printf("Pages in index: %d\n", total)
+	fmt.Printf("Indexed pages missing from database: %d of %d sampled\n", notInDb, len(indexed))
+	fmt.Printf("Indexable pages missing from index: %d of %d sampled\n", notInIndex, len(indexable))
+
+	if notInDb > 0 || notInIndex > 0 {
+		os.Exit(1)
+	}
+}
+
+// return a random sample of (at most) n page urls from the given index, along
+// with the total number of pages in it.
+func sampleIndexedPages(index bleve.Index, n int) (urls []string, total int, err error) {
+	for _, shard := range gsearch.Shards(index) {
+		urls, total, err = sampleShardPages(shard, n, urls, total)
+		if err != nil {
+			return
 		}
 	}
 
-	fmt.Println("Finding not-externally-linked URLs...")
-	var notExternallyLinkedUrlIds []int64
-	for _, id := range urlIds {
-		externallyLinked := false
-		for _, link := range inboundLinks {
-			if link.dst == id {
-				externallyLinked = true
-				break
-			}
+	return
+}
+
+// continue sampling pages from a single (shard of an) index, given the sample
+// and the number of pages seen so far.
+func sampleShardPages(index bleve.Index, n int, urls []string, total int) ([]string, int, error) {
+	advanced, err := index.Advanced()
+	if err != nil {
+		return urls, total, err
+	}
+
+	reader, err := advanced.Reader()
+	if err != nil {
+		return urls, total, err
+	}
+	defer reader.Close()
+
+	idReader, err := reader.DocIDReaderAll()
+	if err != nil {
+		return urls, total, err
+	}
+	defer idReader.Close()
+
+	// reservoir sampling, so we don't need to keep all ids in memory
+	for {
+		internalId, err := idReader.Next()
+		if err != nil || internalId == nil {
+			return urls, total, err
 		}
 
-		if !externallyLinked {
-			notExternallyLinkedUrlIds = append(notExternallyLinkedUrlIds, id)
+		id, err := reader.ExternalID(internalId)
+		if err != nil {
+			return urls, total, err
 		}
-	}
 
-	fmt.Printf("Deleting %d internal links...\n", len(internalLinks))
-	//
-	var srcs, dsts []int64
-	for _, link := range internalLinks {
-		srcs = append(srcs, link.src)
-		dsts = append(dsts, link.dst)
+		// image documents are keyed by their hash, not a url
+		if !strings.Contains(id, "://") {
+			continue
+		}
+
+		total++
+		if len(urls) < n {
+			urls = append(urls, id)
+		} else if i := rand.Intn(total); i < n {
+			urls[i] = id
+		}
 	}
-	q := `
-delete from links
-where row(src_url_id, dst_url_id) in
-    (select unnest($1::bigint[]), unnest($2::bigint[]))
-`
-	result, err := tx.Exec(q, pq.Array(srcs), pq.Array(dsts))
-	utils.PanicOnErr(err)
-	affected, err := result.RowsAffected()
-	utils.PanicOnErr(err)
-	fmt.Println("Affected:", affected)
+}
 
-	fmt.Printf("Deleting %d outbound links...\n", len(outboundLinks))
-	srcs, dsts = nil, nil
-	for _, link := range outboundLinks {
-		srcs = append(srcs, link.src)
-		dsts = append(dsts, link.dst)
+// return a random sample of (at most) n urls from the database that should be
+// in an index built at the given time.
+func sampleIndexableUrls(conn *sql.DB, n int, before time.Time) (urls []string, err error) {
+	// this should match the conditions in gsearch.ForEachPageSince
+	rows, err := conn.Query(`
+select u.url
+from urls u
+join contents c on c.id = u.content_id
+join hosts h on h.hostname = u.hostname
+where u.rank is not null and h.rank is not null and u.input_prompt is null and not h.search_hidden
+      and c.insert_time <= $1 and (u.content_time is null or u.content_time <= $1)
+      and exists (select 1 from links l where l.dst_url_id = u.id)
+order by random()
+limit $2
+`, before, n)
+	if err != nil {
+		return
 	}
-	result, err = tx.Exec(q, pq.Array(srcs), pq.Array(dsts))
-	utils.PanicOnErr(err)
-	affected, err = result.RowsAffected()
-	utils.PanicOnErr(err)
-	fmt.Println("Affected:", affected)
+	defer rows.Close()
 
-	fmt.Printf("Deleting %d urls with no external links...\n", len(notExternallyLinkedUrlIds))
-	q = `delete from urls where id = any($1::bigint[])`
-	result, err = tx.Exec(q, pq.Array(notExternallyLinkedUrlIds))
-	utils.PanicOnErr(err)
-	affected, err = result.RowsAffected()
-	utils.PanicOnErr(err)
-	fmt.Println("Affected:", affected)
+	for rows.Next() {
+		var urlStr string
+		err = rows.Scan(&urlStr)
+		if err != nil {
+			return
+		}
 
-	fmt.Println("Committing transaction...")
-	tx.Commit()
+		u, parseErr := url.Parse(urlStr)
+		if parseErr == nil && gcrawler.IsBlacklisted(gcrawler.PreparedUrl{Parsed: u, NonParsed: urlStr}) {
+			continue
+		}
 
-	// make sure we won't try cancelling the transaction, now that we're done
-	tx = nil
+		urls = append(urls, urlStr)
+	}
 
-	fmt.Println("Done.")
+	err = rows.Err()
+	return
 }
 
-func handleIndexCommand(cfg *config.Config, args []string) {
-	if len(args) != 1 {
+func handlePruneIndexCommand(cfg *config.Config, args []string) {
+	fs := flag.NewFlagSet("prune-index", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
 		usage()
 		os.Exit(1)
 	}
 
-	indexDir := args[0]
+	indexDir := fs.Arg(0)
 
-	var indexName string
-	_, filename := path.Split(indexDir)
-	if strings.HasSuffix(filename, ".idx") {
-		indexName = filename[:len(filename)-4]
-	} else {
-		indexName = filename
+	// the index cannot be opened for writing while the index daemon is using
+	// it; the daemon can prune it itself instead (see Index.PruneInterval).
+	index, err := gsearch.OpenIndexTimeout(indexDir, "gpctl", 5*time.Second)
+	if err != nil {
+		fmt.Println("Cannot open index:", err)
+		os.Exit(1)
 	}
+	defer index.Close()
 
-	index, err := gsearch.NewIndex(indexDir, indexName)
+	conn, err := sql.Open("postgres", cfg.GetDbConnStr())
 	utils.PanicOnErr(err)
+	defer conn.Close()
 
-	err = gsearch.IndexDb(context.Background(), index, cfg)
-	utils.PanicOnErr(err)
-}
+	exist := func(ctx context.Context, urls []string) (map[string]bool, error) {
+		return gsearch.PagesWithContent(ctx, conn, urls)
+	}
 
-func handlePageRankCommand(cfg *config.Config, args []string) {
-	db, err := sql.Open("postgres", cfg.GetDbConnStr())
+	pruned, err := gsearch.PruneIndex(context.Background(), index, exist)
 	utils.PanicOnErr(err)
-	pagerank.PerformPageRankOnDb(db)
-	db.Close()
+
+	fmt.Printf("Pruned %d page(s) from the index.\n", pruned)
 }
 
 func handleUrlInfoCommand(cfg *config.Config, args []string) {
 	fs := flag.NewFlagSet("url", flag.ExitOnError)
 
 	substr := fs.Bool("substr", false, "Search for the given substring in urls; first will be picked.")
+	nVisits := fs.Int("visits", 10, "Maximum number of recent visits to display.")
 
 	fs.Parse(args)
 	if fs.NArg() != 1 {
@@ -349,19 +1592,32 @@ func handleUrlInfoCommand(cfg *config.Config, args []string) {
 	fmt.Println("URL:", info.Url)
 	fmt.Printf("uid: %d  urank: %f  hrank: %f\n", info.UrlId, info.UrlRank, info.HostRank)
 
+	if info.LastFetchMs >= 0 {
+		fmt.Printf("last fetch took: %dms\n", info.LastFetchMs)
+	}
+
+	if info.IsInput {
+		fmt.Printf("This is an input endpoint; prompt: %s\n", info.InputPrompt)
+	}
+
 	if info.ContentId >= 0 {
 		fmt.Printf("cid: %d  title: %s\n", info.ContentId, info.ContentTitle)
+		if info.ContentSummary != "" {
+			fmt.Printf("summary: %s\n", info.ContentSummary)
+		}
 		fmt.Printf("content-type: %s", info.ContentType)
 		if info.ContentTypeArgs != "" {
 			fmt.Printf("  args: %s", info.ContentTypeArgs)
 		}
 		fmt.Print("\n")
-		fmt.Printf("lang: %s  kind:  %s\n", info.ContentLang, info.ContentKind)
-		fmt.Printf("content-length: %d  text-length: %d\n", len(info.Contents), len(info.ContentsText))
+		fmt.Printf("lang: %s  script: %s  kind:  %s\n", info.ContentLang, info.ContentScript, info.ContentKind)
+		fmt.Printf("content-length: %d  text-length: %d\n", info.ContentsLength, info.TextLength)
 	} else {
 		fmt.Println("No content.")
 	}
 
+	fmt.Printf("outbound-links: %d  internal: %d  external: %d\n", info.OutboundLinks, len(info.InternalLinks), len(info.ExternalLinks))
+
 	fmt.Println()
 	if len(info.InternalLinks) == 0 {
 		fmt.Println("No internal links.")
@@ -417,6 +1673,23 @@ func handleUrlInfoCommand(cfg *config.Config, args []string) {
 			}
 		}
 	}
+
+	visits, err := db.QueryUrlVisits(conn, info.UrlId, *nVisits)
+	utils.PanicOnErr(err)
+
+	fmt.Println()
+	if len(visits) == 0 {
+		fmt.Println("No recorded visits.")
+	} else {
+		fmt.Printf("%d recent visits:\n", len(visits))
+		for _, visit := range visits {
+			fmt.Printf(" - %s  status: %d", visit.Time.Format(time.DateTime), visit.StatusCode)
+			if visit.Error != "" {
+				fmt.Printf("  error: %s", visit.Error)
+			}
+			fmt.Print("\n")
+		}
+	}
 }
 
 func handleReImgCommand(cfg *config.Config, args []string) {
@@ -494,21 +1767,63 @@ do nothing
 	fmt.Println("Done.")
 }
 
+// return the where clause (if any) selecting the contents to re-parse, along
+// with its arguments. empty filters match everything. a "none" kind or lang
+// matches contents without one.
+func reparseFilter(kind string, lang string, host string) (where string, args []any) {
+	var conds []string
+
+	addCond := func(column string, value string) {
+		if value == "" {
+			return
+		}
+
+		if value == "none" {
+			conds = append(conds, column+" is null")
+			return
+		}
+
+		args = append(args, value)
+		conds = append(conds, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+
+	addCond("c.kind", kind)
+	addCond("c.lang", lang)
+	addCond("u.hostname", strings.ToLower(host))
+
+	if len(conds) > 0 {
+		where = "where " + strings.Join(conds, " and ")
+	}
+
+	return
+}
+
 func handleReparseCommand(cfg *config.Config, args []string) {
 	// this sub-command re-parses all the contents in the database, checks if the
 	// title has changes, and if so, saves the new titles to the database again.
 	// This is useful, if our parsing algorithms change and we want to apply it
 	// to existing pages.
 
+	fs := flag.NewFlagSet("reparse", flag.ExitOnError)
+	kind := fs.String("kind", "", "Only re-parse contents of this kind (\"none\" for contents without a kind).")
+	lang := fs.String("lang", "", "Only re-parse contents in this language (\"none\" for contents without a language).")
+	host := fs.String("host", "", "Only re-parse contents of the urls on this host.")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		usage()
+		os.Exit(1)
+	}
+
 	db, err := sql.Open("postgres", cfg.GetDbConnStr())
 	utils.PanicOnErr(err)
 	defer db.Close()
 
+	where, whereArgs := reparseFilter(*kind, *lang, *host)
 	rows, err := db.Query(`
-select c.id, content, content_text, title, content_type, lang, kind, u.url
+select c.id, content, content_text, title, coalesce(summary, ''), coalesce(script, ''), content_type, lang, kind, u.url
 from contents c
 join urls u on u.content_id=c.id
-`)
+`+where, whereArgs...)
 	utils.PanicOnErr(err)
 	defer rows.Close()
 
@@ -516,11 +1831,15 @@ join urls u on u.content_id=c.id
 	changedKinds := map[int64]string{}
 	changedLangs := map[int64]string{}
 	changedTexts := map[int64]string{}
+	changedSummaries := map[int64]string{}
+	changedScripts := map[int64]string{}
 	i := 0
 	for rows.Next() {
 		var id int64
 		var blob []byte
 		var oldTitle string
+		var oldSummary string
+		var oldScript string
 		var oldKind string
 		var oldLang string
 		var oldKindNull sql.NullString
@@ -528,7 +1847,7 @@ join urls u on u.content_id=c.id
 		var oldText string
 		var us string
 		var contentType string
-		err = rows.Scan(&id, &blob, &oldText, &oldTitle, &contentType, &oldLangNull, &oldKindNull, &us)
+		err = rows.Scan(&id, &blob, &oldText, &oldTitle, &oldSummary, &oldScript, &contentType, &oldLangNull, &oldKindNull, &us)
 		utils.PanicOnErr(err)
 
 		if oldLangNull.Valid {
@@ -569,6 +1888,16 @@ join urls u on u.content_id=c.id
 			changedTexts[id] = rr.Text
 		}
 
+		if rr.Summary != oldSummary {
+			fmt.Printf("Summary change: url=%s  cid=%d\n", u.String(), id)
+			changedSummaries[id] = rr.Summary
+		}
+
+		if rr.Script != oldScript {
+			fmt.Printf("Script change: '%s' => '%s'  url=%s  cid=%d\n", oldScript, rr.Script, u.String(), id)
+			changedScripts[id] = rr.Script
+		}
+
 		i++
 		if i%1000 == 0 {
 			fmt.Println("Progress:", i)
@@ -626,6 +1955,40 @@ where contents.id = x.id
 	_, err = db.Exec(q, pq.Array(ids), pq.Array(values))
 	utils.PanicOnErr(err)
 
+	fmt.Printf("---- applying %d changed summaries ----\n", len(changedSummaries))
+	ids = make([]int64, 0)
+	values = make([]string, 0)
+	for id, value := range changedSummaries {
+		ids = append(ids, id)
+		values = append(values, value)
+	}
+	q = `
+update contents
+set summary = nullif(x.summary, '')
+from
+    (select unnest($1::bigint[]) id, unnest($2::text[]) summary) x
+where contents.id = x.id
+`
+	_, err = db.Exec(q, pq.Array(ids), pq.Array(values))
+	utils.PanicOnErr(err)
+
+	fmt.Printf("---- applying %d changed scripts ----\n", len(changedScripts))
+	ids = make([]int64, 0)
+	values = make([]string, 0)
+	for id, value := range changedScripts {
+		ids = append(ids, id)
+		values = append(values, value)
+	}
+	q = `
+update contents
+set script = nullif(x.script, '')
+from
+    (select unnest($1::bigint[]) id, unnest($2::text[]) script) x
+where contents.id = x.id
+`
+	_, err = db.Exec(q, pq.Array(ids), pq.Array(values))
+	utils.PanicOnErr(err)
+
 	fmt.Printf("---- applying %d changed texts ----\n", len(changedTexts))
 	ids = make([]int64, 0)
 	values = make([]string, 0)
@@ -680,6 +2043,18 @@ func main() {
 
 	cfg := config.LoadConfig(*configFile)
 
+	// needed by the commands that (re-)parse pages
+	gparse.SetListingLinkRatio(cfg.Crawl.ListingLinkRatio)
+	for prefix, parser := range cfg.Crawl.ContentTypeParsers {
+		err := gparse.AddContentTypeParser(prefix, parser)
+		utils.PanicOnErr(err)
+	}
+
+	// needed by the commands that normalize urls
+	for alias, canonical := range cfg.Crawl.HostAliases {
+		gparse.AddHostAlias(alias, canonical)
+	}
+
 	if len(flag.Args()) < 1 {
 		usage()
 		os.Exit(1)
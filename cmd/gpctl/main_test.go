@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+func TestReparseFilter(t *testing.T) {
+	cases := []struct {
+		kind, lang, host string
+		where            string
+		args             []any
+	}{
+		{"", "", "", "", nil},
+		{"rfc", "", "", "where c.kind = $1", []any{"rfc"}},
+		{"", "en", "Example.org", "where c.lang = $1 and u.hostname = $2", []any{"en", "example.org"}},
+		{"email", "none", "example.org", "where c.kind = $1 and c.lang is null and u.hostname = $2", []any{"email", "example.org"}},
+		{"none", "", "", "where c.kind is null", nil},
+	}
+
+	for _, c := range cases {
+		where, args := reparseFilter(c.kind, c.lang, c.host)
+		if where != c.where || !slices.Equal(args, c.args) {
+			t.Errorf("reparseFilter(%q, %q, %q): expected %q %v; got %q %v", c.kind, c.lang, c.host, c.where, c.args, where, args)
+		}
+	}
+}
@@ -0,0 +1,2 @@
+alter table urls
+      add column input_prompt text;
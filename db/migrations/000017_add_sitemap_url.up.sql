@@ -0,0 +1,2 @@
+alter table hosts
+      add column sitemap_url text;
@@ -0,0 +1,4 @@
+drop index urls_priority;
+
+alter table urls
+      drop column priority;
@@ -0,0 +1,4 @@
+alter table urls
+      add column priority int not null default 0;
+
+create index urls_priority on urls (priority desc, last_visited nulls first);
@@ -0,0 +1,4 @@
+alter table urls
+      drop column recent_hashes,
+      drop column recent_link_hashes,
+      drop column volatile;
@@ -0,0 +1,4 @@
+alter table urls
+      add column recent_hashes text[],
+      add column recent_link_hashes text[],
+      add column volatile boolean not null default false;
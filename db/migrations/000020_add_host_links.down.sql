@@ -0,0 +1 @@
+drop table host_links;
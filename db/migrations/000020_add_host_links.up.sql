@@ -0,0 +1,10 @@
+-- a denormalized view of the links table at the host level. weight is the
+-- number of url links from src_host to dst_host. this is kept up to date by the
+-- crawler, and can be rebuilt using "gpctl rebuild-host-links".
+create table host_links (
+       src_host text not null,
+       dst_host text not null,
+       weight bigint not null,
+
+       primary key (src_host, dst_host)
+);
@@ -0,0 +1,2 @@
+alter table urls
+      drop column last_fetch_ms;
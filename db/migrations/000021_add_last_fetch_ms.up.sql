@@ -0,0 +1,2 @@
+alter table urls
+      add column last_fetch_ms int;
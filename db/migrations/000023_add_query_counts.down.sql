@@ -0,0 +1 @@
+drop table query_counts;
@@ -0,0 +1,6 @@
+create table query_counts (
+       query text not null,
+       bucket date not null,
+       count int not null default 1,
+       primary key (query, bucket)
+);
@@ -0,0 +1,2 @@
+alter table contents
+      drop column code_langs;
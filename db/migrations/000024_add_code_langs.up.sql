@@ -0,0 +1,2 @@
+alter table contents
+      add column code_langs text[];
@@ -0,0 +1,2 @@
+alter table urls
+      drop column change_rate;
@@ -0,0 +1,2 @@
+alter table urls
+      add column change_rate real;
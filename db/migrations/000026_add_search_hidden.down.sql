@@ -0,0 +1,2 @@
+alter table hosts
+      drop column search_hidden;
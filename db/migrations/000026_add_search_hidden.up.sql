@@ -0,0 +1,2 @@
+alter table hosts
+      add column search_hidden boolean not null default false;
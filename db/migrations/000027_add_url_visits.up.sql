@@ -0,0 +1,8 @@
+create table url_visits (
+       url_id bigint not null references urls(id) on delete cascade,
+       visit_time timestamp not null default now(),
+       status_code int,
+       error text
+);
+
+create index url_visits_url_id_idx on url_visits (url_id, visit_time);
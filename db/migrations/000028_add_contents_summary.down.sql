@@ -0,0 +1,2 @@
+alter table contents
+      drop column summary;
@@ -0,0 +1,2 @@
+alter table hosts
+      add column cert_pin text;
@@ -0,0 +1,8 @@
+alter table contents
+      add column insert_time timestamptz;
+
+update contents set insert_time = fetch_time;
+
+alter table contents
+      alter column insert_time set default now(),
+      alter column insert_time set not null;
@@ -0,0 +1,2 @@
+alter table urls
+      add column retry_jitter real;
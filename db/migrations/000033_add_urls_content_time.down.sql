@@ -0,0 +1,2 @@
+alter table urls
+      drop column content_time;
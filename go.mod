@@ -8,6 +8,7 @@ require (
 	github.com/PuerkitoBio/purell v1.1.1
 	github.com/a-h/gemini v0.0.66
 	github.com/blevesearch/bleve/v2 v2.3.7
+	github.com/blevesearch/bleve_index_api v1.0.5
 	github.com/dustin/go-humanize v1.0.1
 	github.com/lib/pq v1.10.7
 	golang.org/x/exp v0.0.0-20230321023759-10a507213a29
@@ -19,7 +20,6 @@ require (
 	github.com/PuerkitoBio/urlesc v0.0.0-20170810143723-de5bf2ad4578 // indirect
 	github.com/RoaringBitmap/roaring v0.9.4 // indirect
 	github.com/bits-and-blooms/bitset v1.2.0 // indirect
-	github.com/blevesearch/bleve_index_api v1.0.5 // indirect
 	github.com/blevesearch/geo v0.1.17 // indirect
 	github.com/blevesearch/go-porterstemmer v1.0.3 // indirect
 	github.com/blevesearch/gtreap v0.1.1 // indirect
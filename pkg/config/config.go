@@ -4,13 +4,31 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"git.sr.ht/~elektito/gemplex/pkg/utils"
 )
 
 type Config struct {
+	// the number of seconds we wait for the daemons to stop after receiving a
+	// signal, before exiting anyway. zero or negative means wait forever.
+	ShutdownTimeout int
+
+	// the hostname of the capsule serving this gemplex instance (through
+	// gpcgi), if any. the crawler never crawls it, so that search results
+	// don't feed back into the index.
+	Capsule string
+
+	Log struct {
+		// the minimum level of logs written by the daemons; one of debug,
+		// info, warn or error.
+		Level string
+	}
+
 	Db struct {
 		Name     string
 		Host     string
@@ -18,6 +36,10 @@ type Config struct {
 		User     string
 		Password string
 		SslMode  string
+
+		// if set, the password is read from this file (with surrounding
+		// whitespace trimmed), instead of using Password.
+		PasswordFile string
 	}
 
 	Index struct {
@@ -27,21 +49,303 @@ type Config struct {
 		// batch size used when indexing; higher values increase indexing
 		// performance, but also increase memory consumption.
 		BatchSize int
+
+		// the number of images batched together in each step when indexing.
+		// images are much larger than pages, so this is usually smaller than
+		// BatchSize.
+		ImageBatchSize int
+
+		// a batch of images is also committed once the images in it add up to
+		// this many bytes, regardless of ImageBatchSize, so that a few large
+		// images don't blow up memory use. zero disables the limit.
+		ImageBatchMaxBytes int
+
+		// if set, lines that appear on a large fraction of the pages of a
+		// host (like shared footers and navigation) are removed from the
+		// indexed content of its pages, but not from the stored pages. this
+		// needs an extra pass over the pages, and only applies to full
+		// rebuilds.
+		StripBoilerplate bool
+
+		// if set, the original text of pages (before cleanup, like removing
+		// ascii-art pre-blocks) is also stored in the index, but not indexed.
+		// this makes the index considerably larger.
+		StoreRawText bool
+
+		// if set, images without alt text are also indexed, using the title
+		// of the page they were found in as searchable text.
+		IndexImagesWithoutAlt bool
+
+		// minutes between full index rebuilds
+		FullRebuildInterval int
+
+		// minutes between incremental index updates, which add pages fetched
+		// since the last update to the live index. zero disables incremental
+		// updates.
+		IncrementalInterval int
+
+		// the number of indexes (shards) documents are split across, by a
+		// hash of their ids. searches run on all shards. changes take effect
+		// on the next full rebuild.
+		Shards int
+
+		// minutes between compactions of the live index, which merge the
+		// segments accumulated by incremental updates. zero disables it.
+		CompactInterval int
+
+		// minutes between prunings of the live index, which delete the pages
+		// that no longer have any content in the database (for example after
+		// deleting a host), without waiting for the next full rebuild. zero
+		// disables it.
+		PruneInterval int
+
+		// a rebuilt index is not swapped in if it has fewer documents than
+		// this fraction of the ones in the current index, which usually means
+		// something went wrong while building it. zero disables the check.
+		MinDocRatio float64
+
+		// after this many rebuilt indices are refused in a row because of
+		// MinDocRatio, the next one is swapped in anyway, since the drop in
+		// the number of documents is probably legitimate. zero means always
+		// refusing them.
+		MaxRefusedRebuilds int
 	}
 
 	Search struct {
 		UnixSocketPath string
+
+		// if enabled, every search query is logged as a json line in the
+		// given file, along with the number of results and the time it took.
+		QueryLogEnabled bool
+		QueryLogPath    string
+
+		// the query log is rotated when it gets larger than this many bytes.
+		// up to QueryLogMaxFiles old log files are kept.
+		QueryLogMaxSize  int64
+		QueryLogMaxFiles int
+
+		// if enabled, the number of times each query is searched is counted
+		// (per day) in the database, so that the most popular queries can be
+		// listed. queries longer than PopularQueryMaxLength characters are
+		// not counted, and queries searched fewer than PopularQueryMinCount
+		// times in the last PopularQueryDays days are never listed.
+		PopularQueriesEnabled bool
+		PopularQueryMaxLength int
+		PopularQueryMinCount  int
+		PopularQueryDays      int
+
+		// if set, popular queries are stored as an HMAC (keyed with this
+		// value) of the query, instead of the query itself. the popular
+		// queries page is not available in this case, since the queries
+		// cannot be listed.
+		PopularQueryHashKey string
+
+		// the maximum length (in characters) of the snippets shown in search
+		// results.
+		SnippetSize int
+
+		// the maximum number of search responses cached in memory (zero
+		// disables the cache), and how long (in seconds) they are kept.
+		// the cache is cleared every time the index is rebuilt.
+		CacheSize int
+		CacheTTL  int
+
+		// the boost applied to title matches, relative to content matches.
+		TitleBoost float64
+
+		// the boost applied to matches in the texts of links pointing to a
+		// page. zero means link texts are not searched.
+		LinksBoost float64
+
+		// the boost applied to matches in the headings of a page. zero means
+		// headings are not searched separately (they're still part of the
+		// content).
+		HeadingsBoost float64
+
+		// the boost applied to pages in the same language as the query, when
+		// it can be reliably detected, so that results in less common
+		// languages aren't swamped by others. zero (the default) disables it.
+		LangBoost float64
+
+		// the maximum number of results reported (and paged through) for a
+		// search; broader queries are reported as having "N+" results.
+		// matching stops once the limit is reached, which makes broad
+		// searches faster, but then only the matches found until then are
+		// ranked. zero (the default) means no limit.
+		MaxReportedResults int
+
+		// if enabled, search results with the same host and title are shown
+		// as a single result, with a "+N more from this host" note.
+		CollapseResults bool
+
+		// groups of equivalent terms (words or phrases, like "gemlog" and
+		// "gem log"). when a query contains a term in a group, pages matching
+		// the others in the group are matched too, with SynonymBoost.
+		Synonyms     [][]string
+		SynonymBoost float64
+
+		// images (ascii art) larger than this many bytes are not shown inline
+		// in random image and image search pages; a link to the image
+		// permalink is shown instead. zero means no limit.
+		MaxInlineImageSize int
 	}
 
 	Crawl struct {
 		// the period (in seconds) in between "queue size" logs. if set to zero
 		// (default) those logs will be disabled.
 		QueueStatusLogPeriod int
+
+		// bounds (in seconds) applied to the value servers send us in a 44
+		// (slow down) response, so that a buggy or hostile server cannot park
+		// a host indefinitely, or ask for a delay too small to matter.
+		MinSlowdownSeconds int
+		MaxSlowdownSeconds int
+
+		// the slow down period (in seconds) used when the server does not send
+		// a valid integer in the meta field of a 44 response.
+		DefaultSlowdownSeconds int
+
+		// the maximum number of link hops from a seed url the crawler will
+		// follow. zero or negative values mean no limit.
+		MaxDepth int
+
+		// if set, spartan:// links are followed and fetched too, in addition
+		// to gemini links.
+		EnableSpartan bool
+
+		// if set, urls with a query string are not crawled, except on the
+		// hosts listed in QueryUrlHosts. many capsules generating endless
+		// urls do it through query strings.
+		SkipQueryUrls bool
+		QueryUrlHosts []string
+
+		// explicit ports links are followed on. urls without a port (that
+		// is, on the default port of their scheme) are always followed. an
+		// empty list allows all ports.
+		AllowedPorts []int
+
+		// the name the crawler identifies itself with in robots.txt files.
+		UserAgent string
+
+		// a url (or email address) where capsule owners can find out about
+		// the crawler, or reach its operator. gemini requests do not carry
+		// any identifying information, so this is only advertised on the
+		// search help page, along with UserAgent.
+		Contact string
+
+		// other robots.txt user-agent tokens the crawler obeys, in addition
+		// to UserAgent.
+		RobotsAgents []string
+
+		// if set, sitemap pages advertised in robots.txt files (using a
+		// "Sitemap:" directive) are visited as soon as they are found, so
+		// that the structure of new capsules is discovered quickly.
+		FollowSitemaps bool
+
+		// a url whose contents change on each of the last VolatileVisits
+		// visits, while its set of links changes at most
+		// VolatileMaxLinkChanges times, is marked as volatile and revisited
+		// rarely. zero disables detection.
+		VolatileVisits         int
+		VolatileMaxLinkChanges int
+
+		// address family to prefer when a host resolves to both ipv4 and ipv6
+		// addresses. the other family is used if the host has no address of
+		// the preferred family. if both are set, ipv4 is preferred.
+		PreferIPv4 bool
+		PreferIPv6 bool
+
+		// the time (in seconds) the address chosen for a host is kept before
+		// the host is resolved again.
+		HostResolveTTL int
+
+		// the time (in seconds) a failure to resolve a host is remembered;
+		// urls on the host are skipped until then.
+		HostResolveFailureTTL int
+
+		// the fraction of non-empty lines of a gemtext page that need to be
+		// links for the page to be classified as a (directory) listing, which
+		// is excluded from search results by default. zero disables the
+		// classification.
+		ListingLinkRatio float64
+
+		// the maximum time (in seconds) a single gemini request (including
+		// reading the response) can take before it's abandoned and treated
+		// as a temporary error. zero or negative values disable the timeout.
+		RequestTimeout int
+
+		// if set, the first certificate seen for each host is pinned (stored
+		// in the database), and a different certificate is refused and
+		// recorded as an error, until the host is re-pinned using "gpctl
+		// repin". otherwise, any certificate is trusted (tofu).
+		TofuPin bool
+
+		// the number of recent visits (with their status and error) kept for
+		// each url, for debugging. older visits are pruned whenever a new one
+		// is recorded. zero disables the history.
+		VisitHistorySize int
+
+		// maps host aliases to their canonical hosts (like "www.example.org"
+		// to "example.org"), so that urls on the aliases are treated as urls
+		// on the canonical host. hosts can include a port.
+		HostAliases map[string]string
+
+		// maps content type prefixes (like "text/x-rst") to the parser used
+		// for them; one of plain, gemtext or markdown. this is in addition to
+		// the built-in text/plain, text/gemini and text/markdown types. pages
+		// of other types are not parsed.
+		ContentTypeParsers map[string]string
+
+		// intervals used to schedule visits. these are postgres interval
+		// strings, like "2 days" or "1 month 12 hours".
+		Retry struct {
+			// how long we wait before retrying a url (or a host's
+			// robots.txt) after a permanent error.
+			PermanentError string
+
+			// the first retry interval after a temporary error; this is
+			// doubled after each consecutive failure, up to MaxRevisit.
+			TempErrorMin string
+
+			// added to the revisit interval of a url each time we find its
+			// contents unchanged, up to MaxRevisit.
+			RevisitIncrement string
+
+			// the revisit interval of a url after its contents change.
+			RevisitAfterChange string
+
+			// how quickly the tracked change rate of a url follows its
+			// latest visits, between 0 and 1. both revisit intervals above
+			// are scaled by up to 2x (or down to 0.5x) for urls that rarely
+			// (or often) change. zero treats all urls the same.
+			ChangeRateSmoothing float64
+
+			// the maximum revisit (or temporary error retry) interval.
+			MaxRevisit string
+
+			// how long robots.txt rules are used before fetching them again.
+			RobotsTxtValidity string
+
+			// the maximum fraction by which temporary error retry intervals
+			// are randomly shortened (and slow down intervals lengthened), so
+			// that urls failing together don't all come due together.
+			Jitter float64
+		}
 	}
 
 	Blacklist struct {
 		Domains  []string
 		Prefixes []string
+
+		// hostname patterns; either globs (like "*.onion") or regular
+		// expressions enclosed in slashes (like "/^foo[0-9]+\.org$/").
+		Patterns []string
+
+		// urls longer than this, or with more query parameters than this, are
+		// not crawled. these catch capsules generating endless urls. zero
+		// means no limit.
+		MaxUrlLength   int
+		MaxQueryParams int
 	}
 }
 
@@ -51,6 +355,10 @@ func LoadConfig(configFilename string) *Config {
 	c := new(Config)
 
 	// set default values
+	c.ShutdownTimeout = 60
+
+	c.Log.Level = "info"
+
 	c.Db.Name = "gemplex"
 	c.Db.Port = -1
 	c.Db.Host = "/var/run/postgresql"
@@ -58,8 +366,54 @@ func LoadConfig(configFilename string) *Config {
 
 	c.Index.Path = "."
 	c.Index.BatchSize = 200
+	c.Index.ImageBatchSize = 20
+	c.Index.ImageBatchMaxBytes = 32 * 1024 * 1024
+	c.Index.FullRebuildInterval = 60
+	c.Index.IncrementalInterval = 10
+	c.Index.Shards = 1
+	c.Index.MinDocRatio = 0.5
+	c.Index.MaxRefusedRebuilds = 3
 
 	c.Search.UnixSocketPath = "/tmp/gsearch.sock"
+	c.Search.QueryLogPath = "queries.log"
+	c.Search.QueryLogMaxSize = 100 * 1024 * 1024
+	c.Search.QueryLogMaxFiles = 5
+	c.Search.PopularQueryMaxLength = 50
+	c.Search.PopularQueryMinCount = 3
+	c.Search.PopularQueryDays = 7
+	c.Search.SnippetSize = 200
+	c.Search.CacheSize = 1000
+	c.Search.CacheTTL = 60
+	c.Search.TitleBoost = 2.0
+	c.Search.LinksBoost = 0.5
+	c.Search.HeadingsBoost = 1.5
+	c.Search.SynonymBoost = 0.5
+	c.Search.MaxInlineImageSize = 16 * 1024
+
+	c.Blacklist.MaxUrlLength = 1024
+	c.Blacklist.MaxQueryParams = 10
+
+	c.Crawl.MinSlowdownSeconds = 1
+	c.Crawl.MaxSlowdownSeconds = 24 * 60 * 60
+	c.Crawl.DefaultSlowdownSeconds = 60
+	c.Crawl.AllowedPorts = []int{1965}
+	c.Crawl.UserAgent = "elektito/gemplex"
+	c.Crawl.RobotsAgents = []string{"*", "crawler", "indexer", "researcher"}
+	c.Crawl.VolatileVisits = 5
+	c.Crawl.VolatileMaxLinkChanges = 1
+	c.Crawl.HostResolveTTL = 60 * 60
+	c.Crawl.HostResolveFailureTTL = 5 * 60
+	c.Crawl.ListingLinkRatio = 0.9
+	c.Crawl.RequestTimeout = 30
+	c.Crawl.VisitHistorySize = 10
+	c.Crawl.Retry.PermanentError = "1 month"
+	c.Crawl.Retry.TempErrorMin = "1 day"
+	c.Crawl.Retry.RevisitIncrement = "2 days"
+	c.Crawl.Retry.RevisitAfterChange = "2 days"
+	c.Crawl.Retry.MaxRevisit = "1 month"
+	c.Crawl.Retry.RobotsTxtValidity = "1 day"
+	c.Crawl.Retry.Jitter = 0.2
+	c.Crawl.Retry.ChangeRateSmoothing = 0.3
 
 	var f *os.File
 	var err error
@@ -91,9 +445,109 @@ func LoadConfig(configFilename string) *Config {
 	if err != nil {
 		utils.PanicOnErr(err)
 	}
+
+	err = c.validate()
+	if err != nil {
+		log.Fatalf("Invalid config file %s: %s", configFilename, err)
+	}
+
 	return c
 }
 
+var intervalRe = regexp.MustCompile(
+	`^\s*(\d+(\.\d+)?\s*(microseconds?|milliseconds?|seconds?|secs?|minutes?|mins?|hours?|days?|weeks?|months?|mons?|years?)\s*)+$`)
+
+// ValidateInterval returns an error if the given string is not a postgres
+// interval of the form "<quantity> <unit> [<quantity> <unit>...]".
+func ValidateInterval(s string) error {
+	if !intervalRe.MatchString(strings.ToLower(s)) {
+		return fmt.Errorf("Invalid interval: %q", s)
+	}
+
+	return nil
+}
+
+var intervalPartRe = regexp.MustCompile(`(\d+(?:\.\d+)?)\s*([a-z]+)`)
+
+// the length of interval units, as postgres counts them when converting
+// intervals to seconds.
+var intervalUnits = map[string]time.Duration{
+	"microsecond": time.Microsecond,
+	"millisecond": time.Millisecond,
+	"second":      time.Second,
+	"sec":         time.Second,
+	"minute":      time.Minute,
+	"min":         time.Minute,
+	"hour":        time.Hour,
+	"day":         24 * time.Hour,
+	"week":        7 * 24 * time.Hour,
+	"month":       30 * 24 * time.Hour,
+	"mon":         30 * 24 * time.Hour,
+	"year":        365*24*time.Hour + 6*time.Hour,
+}
+
+// ParseInterval converts a postgres interval of the form accepted by
+// ValidateInterval to a duration.
+func ParseInterval(s string) (d time.Duration, err error) {
+	err = ValidateInterval(s)
+	if err != nil {
+		return
+	}
+
+	for _, m := range intervalPartRe.FindAllStringSubmatch(strings.ToLower(s), -1) {
+		quantity, _ := strconv.ParseFloat(m[1], 64)
+		unit := intervalUnits[strings.TrimSuffix(m[2], "s")]
+		d += time.Duration(quantity * float64(unit))
+	}
+
+	return
+}
+
+func (c *Config) validate() (err error) {
+	intervals := map[string]string{
+		"crawl.retry.permanentError":     c.Crawl.Retry.PermanentError,
+		"crawl.retry.tempErrorMin":       c.Crawl.Retry.TempErrorMin,
+		"crawl.retry.revisitIncrement":   c.Crawl.Retry.RevisitIncrement,
+		"crawl.retry.revisitAfterChange": c.Crawl.Retry.RevisitAfterChange,
+		"crawl.retry.maxRevisit":         c.Crawl.Retry.MaxRevisit,
+		"crawl.retry.robotsTxtValidity":  c.Crawl.Retry.RobotsTxtValidity,
+	}
+	for name, value := range intervals {
+		err = ValidateInterval(value)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", name, err)
+			return
+		}
+	}
+
+	if c.Db.PasswordFile != "" {
+		_, err = c.GetDbPassword()
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// GetDbPassword returns the database password, reading it from the password
+// file if one is configured.
+func (c *Config) GetDbPassword() (password string, err error) {
+	if c.Db.PasswordFile == "" {
+		password = c.Db.Password
+		return
+	}
+
+	data, err := os.ReadFile(c.Db.PasswordFile)
+	if err != nil {
+		err = fmt.Errorf("Cannot read database password file: %w", err)
+		return
+	}
+
+	password = strings.TrimSpace(string(data))
+	return
+}
+
 func (c *Config) GetDbConnStr() string {
 	s := fmt.Sprintf(
 		"dbname=%s sslmode=%s host=%s",
@@ -108,8 +562,10 @@ func (c *Config) GetDbConnStr() string {
 		s += fmt.Sprintf(" user=%s", c.Db.User)
 	}
 
-	if c.Db.Password != "" {
-		s += fmt.Sprintf(" password=%s", c.Db.Password)
+	password, err := c.GetDbPassword()
+	utils.PanicOnErr(err)
+	if password != "" {
+		s += fmt.Sprintf(" password=%s", password)
 	}
 
 	return s
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateInterval(t *testing.T) {
+	valid := []string{
+		"1 month",
+		"2 days",
+		"1 day 12 hours",
+		"30 minutes",
+		"1.5 hours",
+		"1 Week",
+	}
+	for _, s := range valid {
+		if err := ValidateInterval(s); err != nil {
+			t.Errorf("Expected %q to be valid; got: %s", s, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"month",
+		"2 fortnights",
+		"1 day; drop table urls",
+		"-1 day",
+	}
+	for _, s := range invalid {
+		if err := ValidateInterval(s); err == nil {
+			t.Errorf("Expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestParseInterval(t *testing.T) {
+	cases := []struct {
+		s        string
+		expected time.Duration
+	}{
+		{"2 days", 48 * time.Hour},
+		{"1 day 12 hours", 36 * time.Hour},
+		{"1.5 hours", 90 * time.Minute},
+		{"30 mins", 30 * time.Minute},
+		{"1 Month", 30 * 24 * time.Hour},
+		{"10 secs", 10 * time.Second},
+	}
+	for _, c := range cases {
+		d, err := ParseInterval(c.s)
+		if err != nil || d != c.expected {
+			t.Errorf("ParseInterval(%q): expected %s; got %s (err: %v)", c.s, c.expected, d, err)
+		}
+	}
+
+	if _, err := ParseInterval("2 fortnights"); err == nil {
+		t.Error("Expected an error for an invalid interval")
+	}
+}
+
+func TestValidateDefaults(t *testing.T) {
+	c := LoadConfig("")
+	if err := c.validate(); err != nil {
+		t.Fatalf("Default config is invalid: %s", err)
+	}
+}
+
+func TestDbPasswordFile(t *testing.T) {
+	c := LoadConfig("")
+	c.Db.Password = "fromconfig"
+
+	password, err := c.GetDbPassword()
+	if err != nil || password != "fromconfig" {
+		t.Fatalf("Expected the configured password; got %q, %v", password, err)
+	}
+
+	filename := t.TempDir() + "/password"
+	err = os.WriteFile(filename, []byte("  s3cret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Db.PasswordFile = filename
+	if err = c.validate(); err != nil {
+		t.Fatalf("Unexpected validation error: %s", err)
+	}
+
+	password, err = c.GetDbPassword()
+	if err != nil || password != "s3cret" {
+		t.Fatalf("Expected the password from the file; got %q, %v", password, err)
+	}
+
+	if !strings.Contains(c.GetDbConnStr(), " password=s3cret") {
+		t.Fatalf("Expected the password in the connection string; got %q", c.GetDbConnStr())
+	}
+
+	c.Db.PasswordFile = filename + ".missing"
+	if err = c.validate(); err == nil {
+		t.Fatal("Expected an error for a missing password file")
+	}
+}
@@ -3,10 +3,24 @@ package db
 import (
 	"database/sql"
 	"net/url"
+	"time"
 
 	"git.sr.ht/~elektito/gemplex/pkg/gparse"
 )
 
+// crawl priorities stored in the urls table. due urls with higher priorities
+// are crawled first. priorities are a one-off bump; once a url is visited, its
+// priority goes back to the default.
+const (
+	DefaultPriority = 0
+	SeedPriority    = 100
+	RecrawlPriority = 50
+
+	// the first url found on a host we haven't seen before, so that new
+	// capsules are crawled before the backlog of revisits.
+	NewHostPriority = 25
+)
+
 type UrlInfo struct {
 	Url               string
 	UrlId             int64
@@ -14,16 +28,31 @@ type UrlInfo struct {
 	HostRank          float64
 	ContentId         int64
 	ContentTitle      string
+	ContentSummary    string
 	Contents          []byte
 	ContentsText      string
 	ContentType       string
 	ContentTypeArgs   string
 	ContentLang       string
+	ContentScript     string
 	ContentKind       string
+	InputPrompt       string
+	IsInput           bool
 	InternalLinks     []gparse.Link
 	ExternalLinks     []gparse.Link
 	InternalBacklinks []gparse.Link
 	ExternalBacklinks []gparse.Link
+	OutboundLinks     int
+
+	// the lengths of Contents and ContentsText, which are still available
+	// when the contents themselves are left out (like in the search daemon
+	// responses).
+	ContentsLength int
+	TextLength     int
+
+	// the time the last fetch of the url took, in milliseconds; -1 if
+	// unknown.
+	LastFetchMs int64
 }
 
 func QueryUrl(db *sql.DB, urlStr string, substr bool) (info UrlInfo, err error) {
@@ -35,34 +64,64 @@ func QueryUrl(db *sql.DB, urlStr string, substr bool) (info UrlInfo, err error)
 	}
 
 	q := `
-select u.url, u.id, u.rank, h.rank, c.id, c.title, c.content_type, c.content_type_args, c.content, c.content_text, c.lang, c.kind
+select u.url, u.id, u.rank, h.rank, c.id, c.title, c.summary, c.content_type, c.content_type_args, c.content, c.content_text, c.lang, c.script, c.kind, u.input_prompt, u.last_fetch_ms
 from urls u
 join hosts h on h.hostname = u.hostname
-join contents c on u.content_id = c.id
+left join contents c on u.content_id = c.id
 where ` + whereClause
 
 	row := db.QueryRow(q, urlStr)
 
 	var cid sql.NullInt64
+	var title sql.NullString
+	var summary sql.NullString
+	var contentType sql.NullString
+	var contentTypeArgs sql.NullString
+	var contentsText sql.NullString
 	var lang sql.NullString
+	var script sql.NullString
 	var kind sql.NullString
+	var inputPrompt sql.NullString
+	var lastFetchMs sql.NullInt64
 	err = row.Scan(
 		&info.Url,
 		&info.UrlId,
 		&info.UrlRank,
 		&info.HostRank,
 		&cid,
-		&info.ContentTitle,
-		&info.ContentType,
-		&info.ContentTypeArgs,
+		&title,
+		&summary,
+		&contentType,
+		&contentTypeArgs,
 		&info.Contents,
-		&info.ContentsText,
+		&contentsText,
 		&lang,
-		&kind)
+		&script,
+		&kind,
+		&inputPrompt,
+		&lastFetchMs)
 	if err != nil {
 		return
 	}
 
+	info.LastFetchMs = -1
+	if lastFetchMs.Valid {
+		info.LastFetchMs = lastFetchMs.Int64
+	}
+
+	info.ContentTitle = title.String
+	info.ContentSummary = summary.String
+	info.ContentType = contentType.String
+	info.ContentTypeArgs = contentTypeArgs.String
+	info.ContentsText = contentsText.String
+	info.ContentsLength = len(info.Contents)
+	info.TextLength = len(info.ContentsText)
+
+	// urls requiring input (status 10/11) are classified as "input" endpoints,
+	// even if they had content before.
+	info.IsInput = inputPrompt.Valid
+	info.InputPrompt = inputPrompt.String
+
 	if cid.Valid {
 		info.ContentId = cid.Int64
 	} else {
@@ -70,7 +129,11 @@ where ` + whereClause
 	}
 
 	info.ContentLang = lang.String
+	info.ContentScript = script.String
 	info.ContentKind = kind.String
+	if info.IsInput {
+		info.ContentKind = "input"
+	}
 
 	u, err := url.Parse(info.Url)
 	if err != nil {
@@ -110,6 +173,8 @@ where src_url_id = $1
 		}
 	}
 
+	info.OutboundLinks = len(info.InternalLinks) + len(info.ExternalLinks)
+
 	// backlinks
 
 	rows, err = db.Query(`
@@ -145,3 +210,203 @@ where dst_url_id = $1
 
 	return
 }
+
+// QueryBacklinks returns a page of links pointing to the given url, along with
+// the total number of such links. Links from other hosts come first.
+func QueryBacklinks(db *sql.DB, urlStr string, offset int, limit int) (links []gparse.Link, total int, err error) {
+	rows, err := db.Query(`
+select s.url, l.text, count(*) over ()
+from links l
+join urls s on s.id = l.src_url_id
+join urls d on d.id = l.dst_url_id
+where d.url = $1 and s.id != d.id
+order by s.hostname = d.hostname, s.url
+offset $2 limit $3
+`, urlStr, offset, limit)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var link gparse.Link
+		err = rows.Scan(&link.Url, &link.Text, &total)
+		if err != nil {
+			return
+		}
+
+		links = append(links, link)
+	}
+
+	err = rows.Err()
+	return
+}
+
+// UrlVisit is an entry in the visit history of a url.
+type UrlVisit struct {
+	Time       time.Time
+	StatusCode int
+
+	// empty if the visit was successful
+	Error string
+}
+
+// QueryUrlVisits returns the latest visits of the given url (at most limit),
+// newest first.
+func QueryUrlVisits(db *sql.DB, urlId int64, limit int) (visits []UrlVisit, err error) {
+	rows, err := db.Query(`
+select visit_time, coalesce(status_code, 0), coalesce(error, '')
+from url_visits
+where url_id = $1
+order by visit_time desc
+limit $2
+`, urlId, limit)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var visit UrlVisit
+		err = rows.Scan(&visit.Time, &visit.StatusCode, &visit.Error)
+		if err != nil {
+			return
+		}
+
+		visits = append(visits, visit)
+	}
+
+	err = rows.Err()
+	return
+}
+
+// HostInfo summarizes a host (capsule) with crawled pages.
+type HostInfo struct {
+	Hostname string  `json:"hostname"`
+	Rank     float64 `json:"rank"`
+	Pages    int     `json:"pages"`
+
+	// the highest ranked page of the host
+	TopUrl string `json:"top_url"`
+}
+
+// QueryHosts returns a page of the hosts with crawled pages (except those
+// hidden from search), ordered by rank, along with the total number of such
+// hosts.
+func QueryHosts(db *sql.DB, offset int, limit int) (hosts []HostInfo, total int, err error) {
+	rows, err := db.Query(`
+with pages as
+    (select hostname, count(*) n, (array_agg(url order by rank desc nulls last, url))[1] top_url
+     from urls
+     where content_id is not null
+     group by hostname)
+select h.hostname, coalesce(h.rank, 0), p.n, p.top_url, count(*) over ()
+from hosts h
+join pages p on p.hostname = h.hostname
+where not h.search_hidden
+order by h.rank desc nulls last, h.hostname
+offset $1 limit $2
+`, offset, limit)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var host HostInfo
+		err = rows.Scan(&host.Hostname, &host.Rank, &host.Pages, &host.TopUrl, &total)
+		if err != nil {
+			return
+		}
+
+		hosts = append(hosts, host)
+	}
+
+	err = rows.Err()
+	return
+}
+
+// RebuildHostLinks recreates the contents of the host_links table from the
+// links table, and returns the number of host links written.
+func RebuildHostLinks(db *sql.DB) (count int64, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`delete from host_links`)
+	if err != nil {
+		return
+	}
+
+	result, err := tx.Exec(`
+insert into host_links (src_host, dst_host, weight)
+select s.hostname, d.hostname, count(*)
+from links l
+join urls s on s.id = l.src_url_id
+join urls d on d.id = l.dst_url_id
+group by s.hostname, d.hostname
+`)
+	if err != nil {
+		return
+	}
+
+	count, err = result.RowsAffected()
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
+
+// QueryCount is the number of times a search query was performed.
+type QueryCount struct {
+	Query string `json:"query"`
+	Count int    `json:"count"`
+}
+
+// RecordQuery adds one to the count of the given search query, in the daily
+// bucket containing the given time.
+func RecordQuery(db *sql.DB, query string, t time.Time) (err error) {
+	_, err = db.Exec(`
+insert into query_counts (query, bucket)
+values ($1, $2)
+on conflict (query, bucket)
+do update set count = query_counts.count + 1
+`, query, t.UTC().Format("2006-01-02"))
+	return
+}
+
+// TopQueries returns up to limit of the most common search queries since the
+// given time, leaving out those performed fewer than minCount times.
+func TopQueries(db *sql.DB, since time.Time, minCount int, limit int) (queries []QueryCount, err error) {
+	rows, err := db.Query(`
+select query, sum(count) total
+from query_counts
+where bucket >= $1
+group by query
+having sum(count) >= $2
+order by total desc, query
+limit $3
+`, since.UTC().Format("2006-01-02"), minCount, limit)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	queries = []QueryCount{}
+	for rows.Next() {
+		var qc QueryCount
+		err = rows.Scan(&qc.Query, &qc.Count)
+		if err != nil {
+			return
+		}
+
+		queries = append(queries, qc)
+	}
+
+	err = rows.Err()
+	return
+}
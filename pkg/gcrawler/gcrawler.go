@@ -2,8 +2,15 @@ package gcrawler
 
 import (
 	"fmt"
+	"net"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+
+	"golang.org/x/exp/slices"
+
+	"git.sr.ht/~elektito/gemplex/pkg/config"
 )
 
 var blacklistedDomains = map[string]bool{
@@ -48,6 +55,22 @@ var blacklistedPrefixes = []string{
 	"gemini://gemlog.stargrave.org/?",
 }
 
+// limits on urls, used to filter out urls produced by generator traps (like
+// endlessly growing query strings); see SetUrlLimits. zero means no limit.
+var maxUrlLength = 0
+var maxQueryParams = 0
+
+// whether urls with a query string are skipped, except on the listed hosts;
+// see SetQueryUrlPolicy.
+var skipQueryUrls = false
+var queryUrlHosts = []string{}
+
+// explicit ports urls are allowed on; see SetAllowedPorts. empty means all.
+var allowedPorts = []int{}
+
+// hostname patterns; see AddPatternToBlacklist.
+var blacklistedPatterns = []*regexp.Regexp{}
+
 // since we frequently need both the parsed and non-parsed form of the url,
 // we'll be passing this url around so we only need to parse once, and not have
 // to reassemble the parsed url either.
@@ -56,6 +79,17 @@ type PreparedUrl struct {
 	NonParsed string
 }
 
+// NewPreparedUrl parses the given url string and returns a PreparedUrl.
+func NewPreparedUrl(s string) (u PreparedUrl, err error) {
+	parsed, err := url.Parse(s)
+	if err != nil {
+		return
+	}
+
+	u = PreparedUrl{Parsed: parsed, NonParsed: s}
+	return
+}
+
 func (u PreparedUrl) String() string {
 	return u.NonParsed
 }
@@ -63,23 +97,212 @@ func (u PreparedUrl) String() string {
 var _ fmt.Stringer = (*PreparedUrl)(nil)
 
 func IsBlacklisted(u PreparedUrl) bool {
+	return BlacklistRule(u) != ""
+}
+
+// BlacklistRule returns a description of the blacklist rule matching the given
+// url, or an empty string if the url is not blacklisted.
+func BlacklistRule(u PreparedUrl) string {
 	if _, ok := blacklistedDomains[u.Parsed.Hostname()]; ok {
-		return true
+		return "domain " + u.Parsed.Hostname()
 	}
 
 	for _, prefix := range blacklistedPrefixes {
 		if strings.HasPrefix(u.String(), prefix) {
-			return true
+			return "prefix " + prefix
+		}
+	}
+
+	for _, re := range blacklistedPatterns {
+		if re.MatchString(u.Parsed.Hostname()) {
+			return "pattern " + re.String()
+		}
+	}
+
+	return ""
+}
+
+// ConfigureBlacklist adds the blacklist rules and url limits in the given
+// config to the built-in ones, along with our own capsule. The query url and
+// port policies of the crawler are set from the config too.
+func ConfigureBlacklist(cfg *config.Config) (err error) {
+	if cfg.Capsule != "" {
+		AddSelfToBlacklist(cfg.Capsule)
+	}
+
+	for _, domain := range cfg.Blacklist.Domains {
+		AddDomainToBlacklist(domain)
+	}
+
+	for _, prefix := range cfg.Blacklist.Prefixes {
+		AddPrefixToBlacklist(prefix)
+	}
+
+	for _, pattern := range cfg.Blacklist.Patterns {
+		err = AddPatternToBlacklist(pattern)
+		if err != nil {
+			return
+		}
+	}
+
+	SetUrlLimits(cfg.Blacklist.MaxUrlLength, cfg.Blacklist.MaxQueryParams)
+	SetQueryUrlPolicy(cfg.Crawl.SkipQueryUrls, cfg.Crawl.QueryUrlHosts)
+	SetAllowedPorts(cfg.Crawl.AllowedPorts)
+	return
+}
+
+// RobotsBannedPrefix returns the first of the given robots.txt disallowed path
+// prefixes matching the url, if any.
+func RobotsBannedPrefix(u PreparedUrl, robotsPrefixes []string) (prefix string, banned bool) {
+	for _, prefix = range robotsPrefixes {
+		if strings.HasPrefix(u.Parsed.Path, prefix) {
+			banned = true
+			return
+		}
+	}
+
+	prefix = ""
+	return
+}
+
+// SetUrlLimits sets the maximum length of urls, and the maximum number of
+// query parameters in them, checked by CheckUrlLimits. Zero means no limit.
+func SetUrlLimits(maxLength int, maxParams int) {
+	maxUrlLength = maxLength
+	maxQueryParams = maxParams
+}
+
+// CheckUrlLimits returns an error describing the problem, if the url is longer
+// than the maximum length, or has more query parameters than allowed.
+func CheckUrlLimits(u PreparedUrl) (err error) {
+	if maxUrlLength > 0 && len(u.String()) > maxUrlLength {
+		err = fmt.Errorf("Url length %d exceeds the limit of %d", len(u.String()), maxUrlLength)
+		return
+	}
+
+	if maxQueryParams > 0 {
+		n := countQueryParams(u.Parsed.RawQuery)
+		if n > maxQueryParams {
+			err = fmt.Errorf("Url has %d query parameters; the limit is %d", n, maxQueryParams)
+			return
+		}
+	}
+
+	return
+}
+
+// SetQueryUrlPolicy sets whether urls with a query string are skipped (see
+// IsSkippedQueryUrl), and the hosts on which they are crawled anyway.
+func SetQueryUrlPolicy(skip bool, hosts []string) {
+	skipQueryUrls = skip
+	queryUrlHosts = hosts
+}
+
+// IsSkippedQueryUrl returns true if the url has a query string, and query urls
+// are configured to be skipped on its host.
+func IsSkippedQueryUrl(u PreparedUrl) bool {
+	if !skipQueryUrls || u.Parsed.RawQuery == "" {
+		return false
+	}
+
+	for _, host := range queryUrlHosts {
+		if host == u.Parsed.Host || host == u.Parsed.Hostname() {
+			return false
 		}
 	}
 
-	return false
+	return true
+}
+
+// SetAllowedPorts sets the explicit ports urls are allowed on (see
+// IsDisallowedPort). An empty list allows all ports.
+func SetAllowedPorts(ports []int) {
+	allowedPorts = ports
+}
+
+// IsDisallowedPort returns true if the url is on an explicit port not listed in
+// the allowed ports. Urls without a port (that is, on the default port of their
+// scheme) are always allowed, as are all urls if no allowed ports are set.
+func IsDisallowedPort(u PreparedUrl) bool {
+	port := u.Parsed.Port()
+	if port == "" || len(allowedPorts) == 0 {
+		return false
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return true
+	}
+
+	return !slices.Contains(allowedPorts, n)
+}
+
+// return the number of (non-empty) &- or ;-separated parameters in a raw
+// query string. a query that is not in the key=value form (as is common in
+// gemini) counts as a single parameter.
+func countQueryParams(rawQuery string) int {
+	params := strings.FieldsFunc(rawQuery, func(r rune) bool {
+		return r == '&' || r == ';'
+	})
+	return len(params)
 }
 
 func AddDomainToBlacklist(domain string) {
 	blacklistedDomains[domain] = true
 }
 
+// AddSelfToBlacklist blacklists the host of our own capsule, so that we never
+// crawl our own search results. The hostname can include a port, which is
+// ignored.
+func AddSelfToBlacklist(hostname string) {
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = host
+	}
+
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	if hostname == "" {
+		return
+	}
+
+	blacklistedDomains[hostname] = true
+}
+
 func AddPrefixToBlacklist(prefix string) {
 	blacklistedPrefixes = append(blacklistedPrefixes, prefix)
 }
+
+// AddPatternToBlacklist adds a hostname pattern to the blacklist. By default
+// the pattern is a glob in which "*" matches any number of characters and "?"
+// matches a single character (e.g. "*.onion"). If the pattern is enclosed in
+// slashes (e.g. "/^gemini[0-9]+\.example\.org$/") it's treated as a regular
+// expression instead. Either way, the pattern is matched against the hostname.
+func AddPatternToBlacklist(pattern string) (err error) {
+	re, err := compileHostnamePattern(pattern)
+	if err != nil {
+		return
+	}
+
+	blacklistedPatterns = append(blacklistedPatterns, re)
+	return
+}
+
+func compileHostnamePattern(pattern string) (re *regexp.Regexp, err error) {
+	if pattern == "" {
+		err = fmt.Errorf("Empty blacklist pattern")
+		return
+	}
+
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err = regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			err = fmt.Errorf("Invalid blacklist pattern '%s': %w", pattern, err)
+		}
+		return
+	}
+
+	expr := regexp.QuoteMeta(strings.ToLower(pattern))
+	expr = strings.ReplaceAll(expr, `\*`, ".*")
+	expr = strings.ReplaceAll(expr, `\?`, ".")
+	re, err = regexp.Compile("^" + expr + "$")
+	return
+}
@@ -0,0 +1,211 @@
+package gcrawler
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func prepareUrl(t *testing.T, s string) PreparedUrl {
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatalf("Cannot parse url %s: %s", s, err)
+	}
+	return PreparedUrl{Parsed: u, NonParsed: s}
+}
+
+func TestCompileHostnamePattern(t *testing.T) {
+	cases := []struct {
+		pattern  string
+		hostname string
+		expected bool
+	}{
+		{"*.onion", "foo.onion", true},
+		{"*.onion", "foo.onion.example.org", false},
+		{"*.onion", "onion", false},
+		{"gemini?.example.org", "gemini1.example.org", true},
+		{"gemini?.example.org", "geminiXX.example.org", false},
+		{"*.example.*", "a.example.net", true},
+		{"/^gemini[0-9]+\\.example\\.org$/", "gemini42.example.org", true},
+		{"/^gemini[0-9]+\\.example\\.org$/", "geminiX.example.org", false},
+		{"/\\.xyz$/", "foo.bar.xyz", true},
+	}
+
+	for _, c := range cases {
+		re, err := compileHostnamePattern(c.pattern)
+		if err != nil {
+			t.Fatalf("compileHostnamePattern(%q) returned an error: %s", c.pattern, err)
+		}
+
+		if re.MatchString(c.hostname) != c.expected {
+			t.Fatalf("Pattern %q matching %q: expected %t", c.pattern, c.hostname, c.expected)
+		}
+	}
+}
+
+func TestAddPatternToBlacklistInvalid(t *testing.T) {
+	for _, pattern := range []string{"", "/[a-z/", "/(foo/"} {
+		err := AddPatternToBlacklist(pattern)
+		if err == nil {
+			t.Fatalf("Expected an error for invalid pattern %q", pattern)
+		}
+	}
+}
+
+func TestIsBlacklistedPattern(t *testing.T) {
+	err := AddPatternToBlacklist("*.blacklisted-tld")
+	if err != nil {
+		t.Fatal("AddPatternToBlacklist returned an error:", err)
+	}
+
+	if !IsBlacklisted(prepareUrl(t, "gemini://foo.blacklisted-tld/bar")) {
+		t.Fatal("Expected url matching a blacklist pattern to be blacklisted")
+	}
+
+	if IsBlacklisted(prepareUrl(t, "gemini://example.org/foo.blacklisted-tld")) {
+		t.Fatal("Expected patterns to only be matched against the hostname")
+	}
+}
+
+func TestAddSelfToBlacklist(t *testing.T) {
+	AddSelfToBlacklist("Search.Example.org:1965")
+	defer delete(blacklistedDomains, "search.example.org")
+
+	if !IsBlacklisted(prepareUrl(t, "gemini://search.example.org/search?foo")) {
+		t.Fatal("Expected urls on our own capsule to be blacklisted")
+	}
+
+	if IsBlacklisted(prepareUrl(t, "gemini://example.org/")) {
+		t.Fatal("Expected other hosts not to be blacklisted")
+	}
+
+	// an empty hostname (no capsule configured) should not blacklist anything
+	AddSelfToBlacklist("")
+	if blacklistedDomains[""] {
+		t.Fatal("Expected an empty hostname not to be added to the blacklist")
+	}
+}
+
+func TestCheckUrlLimits(t *testing.T) {
+	SetUrlLimits(40, 3)
+	t.Cleanup(func() { SetUrlLimits(0, 0) })
+
+	cases := []struct {
+		url      string
+		rejected bool
+	}{
+		{"gemini://example.org/", false},
+		{"gemini://example.org/" + strings.Repeat("a", 19), false}, // exactly 40
+		{"gemini://example.org/" + strings.Repeat("a", 20), true},
+		{"gemini://example.org/?a=1&b=2&c=3", false},
+		{"gemini://example.org/?a=1&b=2&c=3&d=4", true},
+		{"gemini://example.org/?a=1;b=2;c=3;d=4", true},
+		{"gemini://example.org/?hello%20world", false},
+		{"gemini://example.org/?a=1&&&b=2", false},
+	}
+
+	for _, c := range cases {
+		err := CheckUrlLimits(prepareUrl(t, c.url))
+		if (err != nil) != c.rejected {
+			t.Errorf("CheckUrlLimits(%s): expected rejected=%t; got err=%v", c.url, c.rejected, err)
+		}
+	}
+}
+
+func TestCheckUrlLimitsDisabled(t *testing.T) {
+	SetUrlLimits(0, 0)
+
+	u := prepareUrl(t, "gemini://example.org/"+strings.Repeat("a", 5000)+"?"+strings.Repeat("x=1&", 100))
+	if err := CheckUrlLimits(u); err != nil {
+		t.Fatalf("Expected no limits to be applied; got: %s", err)
+	}
+}
+
+func TestBlacklistRule(t *testing.T) {
+	AddDomainToBlacklist("rule.example.org")
+	defer delete(blacklistedDomains, "rule.example.org")
+
+	cases := []struct {
+		url  string
+		rule string
+	}{
+		{"gemini://rule.example.org/foo", "domain rule.example.org"},
+		{"gemini://tlgs.one/search?foo", "prefix gemini://tlgs.one/search"},
+		{"gemini://example.org/", ""},
+	}
+
+	for _, c := range cases {
+		if rule := BlacklistRule(prepareUrl(t, c.url)); rule != c.rule {
+			t.Errorf("BlacklistRule(%s): expected %q; got %q", c.url, c.rule, rule)
+		}
+	}
+}
+
+func TestRobotsBannedPrefix(t *testing.T) {
+	prefixes := []string{"/private/", "/cgi-bin/"}
+
+	prefix, banned := RobotsBannedPrefix(prepareUrl(t, "gemini://example.org/cgi-bin/search"), prefixes)
+	if !banned || prefix != "/cgi-bin/" {
+		t.Fatalf("Expected url to be banned by /cgi-bin/; got %v %q", banned, prefix)
+	}
+
+	prefix, banned = RobotsBannedPrefix(prepareUrl(t, "gemini://example.org/public/"), prefixes)
+	if banned || prefix != "" {
+		t.Fatalf("Expected url not to be banned; got %v %q", banned, prefix)
+	}
+}
+
+func TestIsSkippedQueryUrl(t *testing.T) {
+	hosts := []string{"search.example.org", "other.example.org:1966"}
+	t.Cleanup(func() { SetQueryUrlPolicy(false, nil) })
+
+	cases := []struct {
+		url      string
+		skipped  bool
+		disabled bool
+	}{
+		{"gemini://example.org/search?foo", true, false},
+		{"gemini://example.org/search", false, false},
+		{"gemini://example.org/search?", false, false},
+		{"gemini://search.example.org/?foo", false, false},
+		{"gemini://search.example.org:1966/?foo", false, false},
+		{"gemini://other.example.org:1966/?foo", false, false},
+		{"gemini://other.example.org/?foo", true, false},
+		{"gemini://example.org/search?foo", false, true},
+	}
+
+	for _, c := range cases {
+		SetQueryUrlPolicy(!c.disabled, hosts)
+		if IsSkippedQueryUrl(prepareUrl(t, c.url)) != c.skipped {
+			t.Errorf("Expected skipped=%v for %s (enabled: %v)", c.skipped, c.url, !c.disabled)
+		}
+	}
+}
+
+func TestIsDisallowedPort(t *testing.T) {
+	t.Cleanup(func() { SetAllowedPorts(nil) })
+
+	cases := []struct {
+		url        string
+		allowed    []int
+		disallowed bool
+	}{
+		{"gemini://example.org/", []int{1965}, false},
+		{"gemini://example.org:1965/", []int{1965}, false},
+		{"gemini://example.org:1966/", []int{1965}, true},
+		{"gemini://example.org:22/", []int{1965}, true},
+		{"gemini://example.org:1966/", []int{1965, 1966}, false},
+		{"spartan://example.org/", []int{1965}, false},
+		{"spartan://example.org:3000/", []int{1965}, true},
+
+		// an empty list allows everything
+		{"gemini://example.org:22/", nil, false},
+	}
+
+	for _, c := range cases {
+		SetAllowedPorts(c.allowed)
+		if IsDisallowedPort(prepareUrl(t, c.url)) != c.disallowed {
+			t.Errorf("Expected disallowed=%v for %s (allowed ports: %v)", c.disallowed, c.url, c.allowed)
+		}
+	}
+}
@@ -6,14 +6,17 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/mail"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"unicode"
 
 	"git.sr.ht/~elektito/whatlanggo"
 	"github.com/PuerkitoBio/purell"
+	"golang.org/x/exp/slices"
 	"golang.org/x/net/html/charset"
 	"golang.org/x/text/transform"
 )
@@ -22,8 +25,33 @@ const (
 	maxTitleLength   = 72
 	minAsciiArtSize  = 64
 	minAsciiArtLines = 3
+
+	// pages with fewer links than this are never considered listings.
+	minListingLinks = 10
+
+	// bounds on the length of page summaries. shorter paragraphs (like
+	// bylines and dates) are not considered substantial enough, and longer
+	// ones are cut.
+	minSummaryLength = 50
+	maxSummaryLength = 300
 )
 
+// DefaultListingLinkRatio is the default fraction of non-empty lines of a
+// gemtext page that need to be links for it to be classified as a listing.
+const DefaultListingLinkRatio = 0.9
+
+var listingLinkRatio = DefaultListingLinkRatio
+
+// url schemes for which links are kept. gemini is always accepted; others
+// (like spartan) can be added using AddLinkScheme.
+var linkSchemes = map[string]bool{
+	"gemini": true,
+}
+
+// host aliases mapped to their canonical hosts, applied by NormalizeUrl. Both
+// are lowercase and may include a (non-default) port.
+var hostAliases = map[string]string{}
+
 type Link struct {
 	Url  string
 	Text string
@@ -47,10 +75,25 @@ type Page struct {
 	Lang     string
 	Kind     string
 	Images   []Image
+
+	// programming languages of the preformatted blocks in the page, as hinted
+	// by their alt texts; in order of appearance, without duplicates.
+	CodeLangs []string
+
+	// links to image files. these are also included in Links, so that they
+	// are still part of the link graph.
+	ImageLinks []Link
+
+	// a short summary of the page; the first substantial paragraph of text.
+	Summary string
+
+	// the dominant unicode script of the text, like "latin" or "cjk".
+	Script string
 }
 
 var (
 	headingRe        = regexp.MustCompile("^(#+) *(?P<heading>.+) *$")
+	paragraphRe      = regexp.MustCompile(`\n[ \t\r]*\n`)
 	linkRe           = regexp.MustCompile("^=> *(?P<linkurl>.*?)(?: +(?P<linktext>.+))? *$")
 	preRe            = regexp.MustCompile("^``` *(?P<prealt>.*)? *$")
 	rfcRe            = regexp.MustCompile(`(?s)Request for Comments: (?P<rfc>\d+)(?P<rest>.+)(?:Status of this Memo|Abstract)`)
@@ -60,6 +103,91 @@ var (
 	allWhitespaceRe  = regexp.MustCompile(`^\s+$`)
 	ansiSeqRe        = regexp.MustCompile("[\u001B\u009B][[\\]()#;?]*(?:(?:(?:[a-zA-Z\\d]*(?:;[a-zA-Z\\d]*)*)?\u0007)|(?:(?:\\d{1,4}(?:;\\d{0,4})*)?[\\dA-PRZcf-ntqry=><~]))") // from: https://github.com/acarl005/stripansi/blob/master/stripansi.go
 	gitSummaryRe     = regexp.MustCompile(`\s*[MAD]\s+(.+)\s+\|\s+\d+\s+(\++-+|-+|\++)\s*`)
+	mdLinkRe         = regexp.MustCompile(`(!?)\[([^\]]*)\]\(\s*<?([^\s)>]*)>?(?:\s+"[^"]*")?\s*\)`)
+	mdStrongRe       = regexp.MustCompile(`(\*\*|__)([^\s*_](?:.*?[^\s*_])?)(\*\*|__)`)
+	mdEmStarRe       = regexp.MustCompile(`\*([^\s*](?:[^*]*?[^\s*])?)\*`)
+	mdEmUnderscoreRe = regexp.MustCompile(`(^|[^\w])_([^\s_](?:[^_]*?[^\s_])?)_([^\w]|$)`)
+	mdStrikeRe       = regexp.MustCompile(`~~([^~]+)~~`)
+	mdCodeRe         = regexp.MustCompile("`([^`]+)`")
+	mdCodeSpanRe     = regexp.MustCompile("\x00(\\d+)\x00")
+	mdHeadingTailRe  = regexp.MustCompile(` +#+$`)
+)
+
+// programming language hints recognized as the first word of the alt text of
+// preformatted blocks (as in "```go"), mapped to a canonical name.
+var codeLangs = map[string]string{
+	"asm":        "asm",
+	"assembly":   "asm",
+	"awk":        "awk",
+	"bash":       "shell",
+	"c":          "c",
+	"c++":        "cpp",
+	"clojure":    "clojure",
+	"cpp":        "cpp",
+	"csharp":     "csharp",
+	"c#":         "csharp",
+	"css":        "css",
+	"diff":       "diff",
+	"elisp":      "elisp",
+	"elixir":     "elixir",
+	"erlang":     "erlang",
+	"fennel":     "fennel",
+	"forth":      "forth",
+	"fortran":    "fortran",
+	"go":         "go",
+	"golang":     "go",
+	"haskell":    "haskell",
+	"hs":         "haskell",
+	"html":       "html",
+	"java":       "java",
+	"javascript": "javascript",
+	"js":         "javascript",
+	"json":       "json",
+	"kotlin":     "kotlin",
+	"lisp":       "lisp",
+	"lua":        "lua",
+	"makefile":   "make",
+	"nim":        "nim",
+	"ocaml":      "ocaml",
+	"pascal":     "pascal",
+	"perl":       "perl",
+	"php":        "php",
+	"py":         "python",
+	"python":     "python",
+	"racket":     "racket",
+	"rb":         "ruby",
+	"ruby":       "ruby",
+	"rs":         "rust",
+	"rust":       "rust",
+	"scheme":     "scheme",
+	"sh":         "shell",
+	"shell":      "shell",
+	"sql":        "sql",
+	"swift":      "swift",
+	"tcl":        "tcl",
+	"toml":       "toml",
+	"ts":         "typescript",
+	"typescript": "typescript",
+	"xml":        "xml",
+	"yaml":       "yaml",
+	"yml":        "yaml",
+	"zig":        "zig",
+	"zsh":        "shell",
+}
+
+var imageExtensions = []string{
+	".png", ".jpg", ".jpeg", ".gif", ".webp", ".svg", ".bmp", ".ico", ".tif", ".tiff", ".avif",
+}
+
+// invisible characters that can split words in the middle (and so break
+// search term matching), without being visible to the reader.
+var invisibleCharsReplacer = strings.NewReplacer(
+	"\u00ad", "", // soft hyphen
+	"\u200b", "", // zero width space
+	"\u200c", "", // zero width non-joiner
+	"\u200d", "", // zero width joiner
+	"\u2060", "", // word joiner
+	"\ufeff", "", // zero width no-break space (byte order mark)
 )
 
 func ParsePlain(text string) (result Page) {
@@ -69,10 +197,12 @@ func ParsePlain(text string) (result Page) {
 	r := strings.NewReader(text)
 	msg, err := mail.ReadMessage(r)
 	if err == nil {
-		result.Kind = "email"
-
+		// text without any headers (like text starting with an empty line)
+		// still parses as a message, so we only treat it as an email if it
+		// has a subject.
 		result.Title = msg.Header.Get("Subject")
 		if result.Title != "" {
+			result.Kind = "email"
 			ct := msg.Header.Get("Content-Type")
 
 			// yes, I've seen upper case content-type headers! :)
@@ -84,6 +214,7 @@ func ParsePlain(text string) (result Page) {
 				body, err := io.ReadAll(msg.Body)
 				if err == nil {
 					result.Text = result.Title + "\n\n" + string(body)
+					result.Summary = plainSummary(string(body))
 				}
 			}
 
@@ -108,10 +239,58 @@ func ParsePlain(text string) (result Page) {
 		}
 	}
 
+	result.Summary = plainSummary(text)
+
 	return
 }
 
+// return the first substantial paragraph of a plain text document (paragraphs
+// being separated by empty lines), as a single shortened line.
+func plainSummary(text string) string {
+	for _, para := range paragraphRe.Split(text, -1) {
+		para = strings.Join(strings.Fields(para), " ")
+		if isSummary(para) {
+			return shortenSummaryIfNeeded(para)
+		}
+	}
+
+	return ""
+}
+
+// return true if the given paragraph is substantial enough to be used as a
+// summary.
+func isSummary(para string) bool {
+	return len(para) >= minSummaryLength && isMostlyAlphanumeric(para)
+}
+
+func shortenSummaryIfNeeded(summary string) string {
+	if len(summary) <= maxSummaryLength {
+		return summary
+	}
+
+	summary = summary[:maxSummaryLength]
+	if idx := strings.LastIndex(summary, " "); idx > 0 {
+		summary = summary[:idx]
+	}
+
+	// in case we've cut in the middle of a multi-byte character
+	summary = strings.ToValidUTF8(summary, "")
+
+	return strings.TrimRight(summary, " ,;:") + "..."
+}
+
 func ParseGemtext(text string, base *url.URL) (result Page) {
+	return parseGemtext(text, base, false)
+}
+
+// ParseMarkdown parses a markdown document. Apart from what ParseGemtext
+// handles, inline links of the form [text](url) are extracted, and emphasis
+// markers are removed from headings and text.
+func ParseMarkdown(text string, base *url.URL) (result Page) {
+	return parseGemtext(text, base, true)
+}
+
+func parseGemtext(text string, base *url.URL, markdown bool) (result Page) {
 	var s strings.Builder
 
 	firstLine := ""
@@ -120,6 +299,8 @@ func ParseGemtext(text string, base *url.URL) (result Page) {
 	preAll := ""
 	preLineCount := 0
 	altText := ""
+	linkLines := 0
+	textLines := 0
 	lines := strings.Split(text, "\n")
 	for _, line := range lines {
 		line = strings.TrimRight(line, " ")
@@ -133,6 +314,11 @@ func ParseGemtext(text string, base *url.URL) (result Page) {
 					s.WriteString(altText + "\n")
 				}
 
+				lang := codeLangFromAltText(altText)
+				if lang != "" && !slices.Contains(result.CodeLangs, lang) {
+					result.CodeLangs = append(result.CodeLangs, lang)
+				}
+
 				preAll = ""
 				preText = ""
 				preLineCount = 0
@@ -172,12 +358,20 @@ func ParseGemtext(text string, base *url.URL) (result Page) {
 			continue
 		}
 
+		if markdown {
+			line = parseMarkdownInline(line, base, &result)
+		}
+
 		matches = headingRe.FindStringSubmatch(line)
 		if len(matches) > 0 {
 			heading := Heading{
 				Level: len(matches[1]),
 				Text:  matches[2],
 			}
+			if markdown {
+				// markdown allows closing hashes, as in "## foo ##"
+				heading.Text = mdHeadingTailRe.ReplaceAllLiteralString(heading.Text, "")
+			}
 			result.Headings = append(result.Headings, heading)
 			s.WriteString(heading.Text + "\n")
 			continue
@@ -185,33 +379,22 @@ func ParseGemtext(text string, base *url.URL) (result Page) {
 
 		matches = linkRe.FindStringSubmatch(line)
 		if len(matches) > 0 {
+			linkLines++
 			link := Link{
 				Url:  matches[1],
 				Text: matches[2],
 			}
 
-			// a quick hacky fix for a mistake I've seen in some capsules.
-			// clients usually handle //foo to mean the same thing as /foo, so
-			// we do that too.
-			if strings.HasPrefix(link.Url, "//") {
-				link.Url = link.Url[1:]
-			}
-
-			u, err := url.Parse(link.Url)
-			if err != nil {
-				continue
-			}
-			u = base.ResolveReference(u)
-			u, err = NormalizeUrl(u)
-			if err != nil {
-				continue
-			}
-			if u.Scheme != "gemini" {
+			var ok bool
+			link.Url, ok = resolveLinkUrl(link.Url, base)
+			if !ok {
 				continue
 			}
-			link.Url = u.String()
 
 			result.Links = append(result.Links, link)
+			if looksLikeImageUrl(link.Url) {
+				result.ImageLinks = append(result.ImageLinks, link)
+			}
 
 			if link.Text != "" {
 				s.WriteString(link.Text + "\n")
@@ -221,39 +404,71 @@ func ParseGemtext(text string, base *url.URL) (result Page) {
 		}
 
 		if line != "" {
+			textLines++
 			if firstLine == "" && isMostlyAlphanumeric(line) {
 				firstLine = line
 			}
+
+			// gemtext lines are paragraphs
+			if result.Summary == "" && isSummary(strings.TrimSpace(line)) {
+				result.Summary = shortenSummaryIfNeeded(strings.TrimSpace(line))
+			}
 			s.WriteString(line + "\n")
 		}
 	}
 
 	result.Text = s.String()
 
-	for _, heading := range result.Headings {
-		result.Title = heading.Text
+	result.Title = selectTitle(result.Headings, firstLine, result.Links)
+	result.Title = strings.TrimSpace(result.Title)
+	result.Title = shortenTitleIfNeeded(result.Title)
+
+	if isListing(linkLines, textLines, listingLinkRatio) {
+		result.Kind = "listing"
+	}
+
+	return
+}
+
+// return the canonical name of the programming language hinted by the alt text
+// of a preformatted block, or an empty string if there's no such hint.
+func codeLangFromAltText(altText string) string {
+	words := strings.Fields(strings.ToLower(altText))
+	if len(words) == 0 {
+		return ""
+	}
+
+	return codeLangs[strings.TrimRight(words[0], ".,:;")]
+}
+
+// selectTitle picks a page title, in order of preference, from: the first
+// mostly alphanumeric level 1 heading, the first mostly alphanumeric heading of
+// any level, the first content line, and the first mostly alphanumeric link
+// text.
+func selectTitle(headings []Heading, firstLine string, links []Link) string {
+	for _, heading := range headings {
 		if heading.Level == 1 && isMostlyAlphanumeric(heading.Text) {
-			break
+			return heading.Text
 		}
 	}
 
-	if result.Title == "" {
-		result.Title = firstLine
+	for _, heading := range headings {
+		if isMostlyAlphanumeric(heading.Text) {
+			return heading.Text
+		}
 	}
 
-	if result.Title == "" {
-		for _, link := range result.Links {
-			if isMostlyAlphanumeric(link.Text) {
-				result.Title = link.Text
-				break
-			}
-		}
+	if firstLine != "" {
+		return firstLine
 	}
 
-	result.Title = strings.TrimSpace(result.Title)
-	result.Title = shortenTitleIfNeeded(result.Title)
+	for _, link := range links {
+		if isMostlyAlphanumeric(link.Text) {
+			return link.Text
+		}
+	}
 
-	return
+	return ""
 }
 
 func ParsePage(body []byte, base *url.URL, contentType string) (result Page, err error) {
@@ -263,17 +478,14 @@ func ParsePage(body []byte, base *url.URL, contentType string) (result Page, err
 		return
 	}
 
-	switch {
-	case strings.HasPrefix(contentType, "text/plain"):
-		result = ParsePlain(text)
-	case strings.HasPrefix(contentType, "text/gemini"):
-		fallthrough
-	case strings.HasPrefix(contentType, "text/markdown"):
-		result = ParseGemtext(text, base)
-	default:
+	text = removeInvisibleChars(text)
+
+	parser := parserForContentType(contentType)
+	if parser == "" {
 		err = fmt.Errorf("Cannot process text type: %s", contentType)
 		return
 	}
+	result = parsers[parser](text, base)
 
 	// cleanup the text a little
 	result.Text = ansiSeqRe.ReplaceAllLiteralString(result.Text, "")
@@ -305,12 +517,249 @@ func ParsePage(body []byte, base *url.URL, contentType string) (result Page, err
 
 	result.Title = strings.ToValidUTF8(result.Title, "")
 
+	result.Summary = ansiSeqRe.ReplaceAllLiteralString(result.Summary, "")
+	result.Summary = strings.ToValidUTF8(result.Summary, "")
+
 	// detect text language
 	result.Lang = detectLang(result.Text)
+	result.Script = detectScript(result.Text)
 
 	return
 }
 
+// SetListingLinkRatio sets the fraction of non-empty lines of a gemtext page
+// that need to be links for the page to be classified as a (directory) listing.
+// A value of zero disables the classification.
+func SetListingLinkRatio(ratio float64) {
+	listingLinkRatio = ratio
+}
+
+// return true if a page with the given number of link lines and other
+// (non-empty) text lines looks like a listing, given a link ratio threshold.
+func isListing(linkLines, textLines int, ratio float64) bool {
+	if ratio <= 0 || linkLines < minListingLinks {
+		return false
+	}
+
+	return float64(linkLines)/float64(linkLines+textLines) >= ratio
+}
+
+// parsers that content types can be mapped to, using AddContentTypeParser.
+var parsers = map[string]func(text string, base *url.URL) Page{
+	"plain":    func(text string, base *url.URL) Page { return ParsePlain(text) },
+	"gemtext":  ParseGemtext,
+	"markdown": ParseMarkdown,
+}
+
+// content type prefixes mapped to parser names, in addition to the built-in
+// ones (text/plain, text/gemini and text/markdown).
+var contentTypeParsers = map[string]string{}
+
+// AddContentTypeParser makes ParsePage use the given parser (one of plain,
+// gemtext or markdown) for content types starting with the given prefix. This
+// takes precedence over the built-in mappings.
+func AddContentTypeParser(prefix string, parser string) (err error) {
+	if _, ok := parsers[parser]; !ok {
+		err = fmt.Errorf("Unknown parser for content type %s: %s", prefix, parser)
+		return
+	}
+
+	contentTypeParsers[strings.ToLower(prefix)] = parser
+	return
+}
+
+// return the name of the parser used for the given content type, or an empty
+// string if the content type is not supported.
+func parserForContentType(contentType string) (parser string) {
+	contentType = strings.ToLower(contentType)
+
+	// the longest matching prefix wins
+	longest := -1
+	for prefix, name := range contentTypeParsers {
+		if strings.HasPrefix(contentType, prefix) && len(prefix) > longest {
+			parser = name
+			longest = len(prefix)
+		}
+	}
+	if parser != "" {
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(contentType, "text/plain"):
+		parser = "plain"
+	case strings.HasPrefix(contentType, "text/gemini"):
+		parser = "gemtext"
+	case strings.HasPrefix(contentType, "text/markdown"):
+		parser = "markdown"
+	}
+
+	return
+}
+
+// AddLinkScheme makes parsers keep links with the given url scheme, in addition
+// to gemini links.
+func AddLinkScheme(scheme string) {
+	linkSchemes[strings.ToLower(scheme)] = true
+}
+
+// resolve the given link url against the base url and normalize it. ok is
+// false if the url cannot be parsed, or its scheme is not accepted (see
+// AddLinkScheme).
+func resolveLinkUrl(link string, base *url.URL) (result string, ok bool) {
+	if strings.HasPrefix(link, "//") && !isSchemeRelativeLink(link, base) {
+		// a quick hacky fix for a mistake I've seen in some capsules. clients
+		// usually handle //foo to mean the same thing as /foo, so we do that
+		// too.
+		link = link[1:]
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		return
+	}
+	u = base.ResolveReference(u)
+	u, err = NormalizeUrl(u)
+	if err != nil {
+		return
+	}
+	if !linkSchemes[u.Scheme] {
+		return
+	}
+
+	result = u.String()
+	ok = true
+	return
+}
+
+// file extensions commonly seen at the end of the first path segment of
+// mistaken double-slash links (like //foo.gmi), which look like hostnames.
+var fileExtensions = map[string]bool{
+	"gmi": true, "gemini": true, "txt": true, "md": true, "html": true,
+	"htm": true, "xml": true, "atom": true, "rss": true, "json": true,
+	"csv": true, "pdf": true, "zip": true, "gz": true, "tar": true,
+}
+
+var hostLabelRe = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// return true if the given link, which starts with a double slash, should be
+// treated as a scheme-relative url (//host/path) rather than a mistaken
+// absolute path. this is the case if it names the same host as the base url,
+// or something that clearly looks like a hostname.
+func isSchemeRelativeLink(link string, base *url.URL) bool {
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if base != nil && host == strings.ToLower(base.Hostname()) {
+		return true
+	}
+
+	if u.Port() != "" || net.ParseIP(host) != nil {
+		return true
+	}
+
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+	if len(labels) < 2 {
+		return false
+	}
+
+	for _, label := range labels {
+		if !hostLabelRe.MatchString(label) {
+			return false
+		}
+	}
+
+	tld := labels[len(labels)-1]
+	if fileExtensions[tld] || slices.Contains(imageExtensions, "."+tld) {
+		return false
+	}
+
+	return true
+}
+
+// return true if the url path has the extension of a known image format.
+func looksLikeImageUrl(urlStr string) bool {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return false
+	}
+
+	p := strings.ToLower(u.Path)
+	for _, ext := range imageExtensions {
+		if strings.HasSuffix(p, ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// extract inline markdown links from the given line (adding them to the page),
+// and return the line with links replaced by their text and emphasis markers
+// removed. link urls and code spans are left alone.
+func parseMarkdownInline(line string, base *url.URL, page *Page) string {
+	// gemtext link lines are recognized in markdown files too (see
+	// parseGemtext), so only the link text is processed.
+	if m := linkRe.FindStringSubmatch(line); m != nil {
+		if m[2] == "" {
+			return line
+		}
+		return "=> " + m[1] + " " + parseMarkdownInline(m[2], base, page)
+	}
+
+	// code spans are taken out first (and replaced with their index between
+	// two nul characters), so that nothing inside them is taken for links or
+	// emphasis. they are put back (without the backticks) at the end.
+	var spans []string
+	line = mdCodeRe.ReplaceAllStringFunc(line, func(m string) string {
+		spans = append(spans, mdCodeRe.FindStringSubmatch(m)[1])
+		return fmt.Sprintf("\x00%d\x00", len(spans)-1)
+	})
+	restoreSpans := func(s string) string {
+		if len(spans) == 0 {
+			return s
+		}
+		return mdCodeSpanRe.ReplaceAllStringFunc(s, func(m string) string {
+			i, err := strconv.Atoi(mdCodeSpanRe.FindStringSubmatch(m)[1])
+			if err != nil || i >= len(spans) {
+				return m
+			}
+			return spans[i]
+		})
+	}
+
+	line = mdLinkRe.ReplaceAllStringFunc(line, func(m string) string {
+		parts := mdLinkRe.FindStringSubmatch(m)
+		isImage := parts[1] != ""
+		text := restoreSpans(stripMarkdownEmphasis(parts[2]))
+		if linkUrl, ok := resolveLinkUrl(parts[3], base); ok {
+			link := Link{
+				Url:  linkUrl,
+				Text: text,
+			}
+			page.Links = append(page.Links, link)
+			if isImage || looksLikeImageUrl(linkUrl) {
+				page.ImageLinks = append(page.ImageLinks, link)
+			}
+		}
+		return text
+	})
+
+	return restoreSpans(stripMarkdownEmphasis(line))
+}
+
+func stripMarkdownEmphasis(s string) string {
+	s = mdCodeRe.ReplaceAllString(s, "$1")
+	s = mdStrongRe.ReplaceAllString(s, "$2")
+	s = mdEmStarRe.ReplaceAllString(s, "$1")
+	s = mdEmUnderscoreRe.ReplaceAllString(s, "$1$2$3")
+	s = mdStrikeRe.ReplaceAllString(s, "$1")
+	return s
+}
+
 func shortenTitleIfNeeded(title string) string {
 	if len(title) <= maxTitleLength {
 		return title
@@ -335,6 +784,58 @@ func detectLang(text string) string {
 	return info.Lang.Iso6391()
 }
 
+// unicode scripts reported by detectScript, in order of precedence for ties.
+// han, kana and hangul are all reported as "cjk", since they're usually mixed
+// (and handled) together.
+var scriptTables = []struct {
+	name   string
+	tables []*unicode.RangeTable
+}{
+	{"latin", []*unicode.RangeTable{unicode.Latin}},
+	{"cyrillic", []*unicode.RangeTable{unicode.Cyrillic}},
+	{"greek", []*unicode.RangeTable{unicode.Greek}},
+	{"cjk", []*unicode.RangeTable{unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul}},
+	{"arabic", []*unicode.RangeTable{unicode.Arabic}},
+	{"hebrew", []*unicode.RangeTable{unicode.Hebrew}},
+	{"devanagari", []*unicode.RangeTable{unicode.Devanagari}},
+	{"thai", []*unicode.RangeTable{unicode.Thai}},
+	{"armenian", []*unicode.RangeTable{unicode.Armenian}},
+	{"georgian", []*unicode.RangeTable{unicode.Georgian}},
+}
+
+// return the script most of the letters in the given text are written in (one
+// of the names in scriptTables), or an empty string if there are no letters in
+// a known script. unlike language detection, this is reliable even for short
+// texts.
+func detectScript(text string) string {
+	counts := make([]int, len(scriptTables))
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+
+		for i, script := range scriptTables {
+			if unicode.In(r, script.tables...) {
+				counts[i]++
+				break
+			}
+		}
+	}
+
+	best := -1
+	for i, n := range counts {
+		if n > 0 && (best < 0 || n > counts[best]) {
+			best = i
+		}
+	}
+
+	if best < 0 {
+		return ""
+	}
+
+	return scriptTables[best].name
+}
+
 func parseRfc(text string) (title string) {
 	m := rfcRe.FindStringSubmatch(text)
 	if m == nil {
@@ -463,6 +964,12 @@ func isAsciiArt(s string) bool {
 	return true
 }
 
+// remove soft hyphens, zero-width spaces and similar invisible characters from
+// the given string.
+func removeInvisibleChars(s string) string {
+	return invisibleCharsReplacer.Replace(s)
+}
+
 func convertToString(body []byte, contentType string) (s string, err error) {
 	encoding, _, _ := charset.DetermineEncoding(body, contentType)
 
@@ -484,12 +991,23 @@ func convertToString(body []byte, contentType string) (s string, err error) {
 	return
 }
 
+// AddHostAlias makes NormalizeUrl replace the given host with the canonical one
+// (for example www.example.org with example.org), so that urls on both collapse
+// to the same url. Hosts can include a port, in which case only urls with that
+// port are affected.
+func AddHostAlias(alias string, canonical string) {
+	hostAliases[strings.ToLower(alias)] = strings.ToLower(canonical)
+}
+
 func NormalizeUrl(u *url.URL) (outputUrl *url.URL, err error) {
-	// remove default gemini port, since purell only supports doing this with
-	// http and https.
+	// remove default gemini and spartan ports, since purell only supports
+	// doing this with http and https.
 	if u.Scheme == "gemini" && u.Port() == "1965" {
 		u.Host = strings.ReplaceAll(u.Host, ":1965", "")
 	}
+	if u.Scheme == "spartan" && u.Port() == "300" {
+		u.Host = strings.ReplaceAll(u.Host, ":300", "")
+	}
 
 	flags := purell.FlagLowercaseScheme |
 		purell.FlagLowercaseHost |
@@ -504,6 +1022,9 @@ func NormalizeUrl(u *url.URL) (outputUrl *url.URL, err error) {
 	urlStr := purell.NormalizeURL(u, flags)
 
 	outputUrl, err = url.Parse(urlStr)
+	if err != nil {
+		return
+	}
 
 	// make sure the root pages have a single slash as path (this seems more
 	// frequently seen in the wild, and so there's less chance we'll have to
@@ -512,5 +1033,9 @@ func NormalizeUrl(u *url.URL) (outputUrl *url.URL, err error) {
 		outputUrl.Path = "/"
 	}
 
+	if canonical, ok := hostAliases[outputUrl.Host]; ok {
+		outputUrl.Host = canonical
+	}
+
 	return
 }
@@ -1,6 +1,7 @@
 package gparse
 
 import (
+	"fmt"
 	"net/url"
 	"strings"
 	"testing"
@@ -18,7 +19,11 @@ Message body
 	result := ParsePlain(text)
 	expectedTitle := "Spam & Eggs"
 	if result.Title != expectedTitle {
-		t.Fatalf("ParsePlain(.): expected %q for title, <nil>; got %q", expectedTitle, result.Title)
+		t.Fatalf("ParsePlain(.): expected %q for title; got %q", expectedTitle, result.Title)
+	}
+
+	if result.Kind != "email" {
+		t.Fatalf("ParsePlain(.): expected kind %q; got %q", "email", result.Kind)
 	}
 
 	expectedText := `Spam & Eggs
@@ -26,7 +31,7 @@ Message body
 Message body
 `
 	if result.Text != expectedText {
-		t.Fatalf("ParsePlain(.): expected %q for text, <nil>; got %q", expectedText, result.Text)
+		t.Fatalf("ParsePlain(.): expected %q for text; got %q", expectedText, result.Text)
 	}
 }
 
@@ -39,13 +44,14 @@ hello there!
 	result := ParsePlain(text)
 	expected := "subject matter"
 	if result.Title != expected {
-		t.Fatalf("ParsePlain(.): expected %q, <nil>; got %q", expected, result.Title)
+		t.Fatalf("ParsePlain(.): expected %q; got %q", expected, result.Title)
+	}
+
+	if result.Kind != "" {
+		t.Fatalf("ParsePlain(.): expected no kind; got %q", result.Kind)
 	}
 }
 
-/*
-// this doesn't work correctly at the moment, and there's no easy way to fix
-// it. i'm just leaving it here for now
 func TestParseEmail2(t *testing.T) {
 	text := `X-Google-Language: POLISH,Latin2
 X-Google-Thread: 1045ba,c8575288f3977aed
@@ -63,13 +69,47 @@ Newsgroups: pl.rec.ascii-art
 
 > foobar
 `
-	title, err := ParsePlain(text)
+	result := ParsePlain(text)
 	expected := "Re: no subject -- a raczej no comment :)"
-	if err != nil || title != expected {
-		t.Fatalf("ParsePlain(.): expected %q, <nil>; got %q, %v", expected, title, err)
+	if result.Title != expected {
+		t.Fatalf("ParsePlain(.): expected %q; got %q", expected, result.Title)
+	}
+}
+
+func TestParsePlainRfc(t *testing.T) {
+	text := `Network Working Group                                         S. Deering
+Request for Comments: 2460                                         Cisco
+Obsoletes: 1883                                                R. Hinden
+Category: Standards Track                                          Nokia
+                                                           December 1998
+
+
+                  Internet Protocol, Version 6 (IPv6)
+                             Specification
+
+Status of this Memo
+
+   This document specifies an Internet standards track protocol for the
+   Internet community, and requests discussion and suggestions for
+   improvements.
+`
+	// only long enough documents are checked for rfc headers
+	text += strings.Repeat("   More text.\n", 100)
+
+	result := ParsePlain(text)
+	expected := "RFC 2460 - Internet Protocol, Version 6 (IPv6) Specification"
+	if result.Title != expected {
+		t.Fatalf("ParsePlain(.): expected %q; got %q", expected, result.Title)
+	}
+
+	if result.Kind != "rfc" {
+		t.Fatalf("ParsePlain(.): expected kind %q; got %q", "rfc", result.Kind)
+	}
+
+	if result.Text != text {
+		t.Fatal("ParsePlain(.): expected text to be left unchanged")
 	}
 }
-*/
 
 func TestParsePage(t *testing.T) {
 	inputText := `
@@ -395,3 +435,664 @@ spam
 		t.Fatalf("Expected text %q, got %q", expected, result.Text)
 	}
 }
+
+func TestParseMarkdown(t *testing.T) {
+	text := `# The **Bold** _Title_ #
+
+Some text with an [inline link](foo/bar.md) and another
+[external one](gemini://example.org/spam "Spam") in it.
+
+![an image](/img.png) and a [web link](https://example.com/).
+
+## A *second* heading
+`
+	base, _ := url.Parse("gemini://example.net/docs/index.md")
+	result, err := ParsePage([]byte(text), base, "text/markdown")
+	if err != nil {
+		t.Fatal("ParsePage(.) returned an error:", err)
+	}
+
+	expectedTitle := "The Bold Title"
+	if result.Title != expectedTitle {
+		t.Fatalf("Expected title %q; got %q", expectedTitle, result.Title)
+	}
+
+	expectedHeadings := []Heading{
+		{Level: 1, Text: "The Bold Title"},
+		{Level: 2, Text: "A second heading"},
+	}
+	if len(result.Headings) != len(expectedHeadings) {
+		t.Fatalf("Expected %d headings; got %d.", len(expectedHeadings), len(result.Headings))
+	}
+	for i := range expectedHeadings {
+		if result.Headings[i] != expectedHeadings[i] {
+			t.Fatalf("Heading %d mismatch: expected=%v got=%v", i, expectedHeadings[i], result.Headings[i])
+		}
+	}
+
+	expectedLinks := []Link{
+		{
+			Url:  "gemini://example.net/docs/foo/bar.md",
+			Text: "inline link",
+		},
+		{
+			Url:  "gemini://example.org/spam",
+			Text: "external one",
+		},
+		{
+			Url:  "gemini://example.net/img.png",
+			Text: "an image",
+		},
+	}
+	if len(result.Links) != len(expectedLinks) {
+		t.Fatalf("Expected %d links; got %d: %v", len(expectedLinks), len(result.Links), result.Links)
+	}
+	for i := range expectedLinks {
+		if result.Links[i] != expectedLinks[i] {
+			t.Fatalf("Link %d mismatch: expected=%v got=%v", i, expectedLinks[i], result.Links[i])
+		}
+	}
+
+	expectedText := `The Bold Title
+Some text with an inline link and another
+external one in it.
+an image and a web link.
+A second heading
+`
+	if result.Text != expectedText {
+		t.Fatalf("Markdown output text:\nexpected=%q\n     got=%q", expectedText, result.Text)
+	}
+}
+
+func TestParseMarkdownUrlsAndCode(t *testing.T) {
+	text := "=> /_drafts_/x The _drafts_ page\n" +
+		"A [private one](/_private_/y) and `a_b_c` with `*stars*` in it.\n" +
+		"Not a link: `[foo](bar.md)`\n"
+	base, _ := url.Parse("gemini://example.net/docs/index.md")
+	result, err := ParsePage([]byte(text), base, "text/markdown")
+	if err != nil {
+		t.Fatal("ParsePage(.) returned an error:", err)
+	}
+
+	expectedLinks := []Link{
+		{Url: "gemini://example.net/_drafts_/x", Text: "The drafts page"},
+		{Url: "gemini://example.net/_private_/y", Text: "private one"},
+	}
+	if len(result.Links) != len(expectedLinks) {
+		t.Fatalf("Expected %d links; got %d: %v", len(expectedLinks), len(result.Links), result.Links)
+	}
+	for i := range expectedLinks {
+		if result.Links[i] != expectedLinks[i] {
+			t.Fatalf("Link %d mismatch: expected=%v got=%v", i, expectedLinks[i], result.Links[i])
+		}
+	}
+
+	expectedText := `The drafts page
+A private one and a_b_c with *stars* in it.
+Not a link: [foo](bar.md)
+`
+	if result.Text != expectedText {
+		t.Fatalf("Markdown output text:\nexpected=%q\n     got=%q", expectedText, result.Text)
+	}
+}
+
+func TestStripMarkdownEmphasis(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{"**bold** and __bold__", "bold and bold"},
+		{"*em* and _em_", "em and em"},
+		{"snake_case_name stays", "snake_case_name stays"},
+		{"`code` and ~~gone~~", "code and gone"},
+		{"2 * 3 * 4", "2 * 3 * 4"},
+	}
+
+	for _, c := range cases {
+		result := stripMarkdownEmphasis(c.input)
+		if result != c.expected {
+			t.Fatalf("stripMarkdownEmphasis(%q): expected %q; got %q", c.input, c.expected, result)
+		}
+	}
+}
+
+func TestRemoveInvisibleChars(t *testing.T) {
+	input := "soft\u00adhyphen zero\u200bwidth \ufeffbom join\u200dner"
+	expected := "softhyphen zerowidth bom joinner"
+	result := removeInvisibleChars(input)
+	if result != expected {
+		t.Fatalf("removeInvisibleChars(%q): expected %q; got %q", input, expected, result)
+	}
+}
+
+func TestParsePageSoftHyphen(t *testing.T) {
+	text := "# Sear\u00adchable\n\nA long in\u00adcom\u00adpre\u00adhen\u00adsi\u00adble word.\n"
+	u, _ := url.Parse("gemini://example.org/")
+	result, err := ParsePage([]byte(text), u, "text/gemini")
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	if result.Title != "Searchable" {
+		t.Fatalf("Expected title 'Searchable'; got %q", result.Title)
+	}
+
+	if !strings.Contains(result.Text, "incomprehensible") {
+		t.Fatalf("Expected the hyphenated word to be joined; got text %q", result.Text)
+	}
+}
+
+func TestParseGemtextImageLinks(t *testing.T) {
+	text := `# Gallery
+=> /photos/cat.JPG A sleepy cat
+=> gemini://example.org/art/sunset.png?size=large Sunset
+=> /photos/ More photos
+=> https://example.com/dog.gif A web dog
+`
+	base, _ := url.Parse("gemini://example.net/gallery.gmi")
+	result := ParseGemtext(text, base)
+
+	expectedImageLinks := []Link{
+		{
+			Url:  "gemini://example.net/photos/cat.JPG",
+			Text: "A sleepy cat",
+		},
+		{
+			Url:  "gemini://example.org/art/sunset.png?size=large",
+			Text: "Sunset",
+		},
+	}
+	if len(result.ImageLinks) != len(expectedImageLinks) {
+		t.Fatalf("Expected %d image links; got %d: %v", len(expectedImageLinks), len(result.ImageLinks), result.ImageLinks)
+	}
+	for i := range expectedImageLinks {
+		if result.ImageLinks[i] != expectedImageLinks[i] {
+			t.Fatalf("Image link %d mismatch: expected=%v got=%v", i, expectedImageLinks[i], result.ImageLinks[i])
+		}
+	}
+
+	// image links are still regular links too
+	expectedLinks := []Link{
+		expectedImageLinks[0],
+		expectedImageLinks[1],
+		{
+			Url:  "gemini://example.net/photos/",
+			Text: "More photos",
+		},
+	}
+	if len(result.Links) != len(expectedLinks) {
+		t.Fatalf("Expected links %v; got %v", expectedLinks, result.Links)
+	}
+	for i := range expectedLinks {
+		if result.Links[i] != expectedLinks[i] {
+			t.Fatalf("Link %d mismatch: expected=%v got=%v", i, expectedLinks[i], result.Links[i])
+		}
+	}
+}
+
+func TestParseGemtextTitleSelection(t *testing.T) {
+	base, _ := url.Parse("gemini://example.org/")
+	cases := []struct {
+		name     string
+		text     string
+		expected string
+	}{
+		{"h2 before h1", "## Section\n# Main Title\nsome text\n", "Main Title"},
+		{"no h1", "some text\n### Third\n## Second\n", "Third"},
+		{"multiple h1s", "# First\n# Second\n", "First"},
+		{"non-alphanumeric h1", "# ~~~***~~~\n## Real Title\n", "Real Title"},
+		{"trailing non-h1", "# ***\n## ---\n### Last\n", "Last"},
+		{"no headings", "\nfirst line\nsecond line\n", "first line"},
+		{"links only", "=> /foo ***\n=> /bar Bar Page\n", "Bar Page"},
+		{"empty", "", ""},
+	}
+
+	for _, c := range cases {
+		result := ParseGemtext(c.text, base)
+		if result.Title != c.expected {
+			t.Errorf("%s: expected title %q; got %q", c.name, c.expected, result.Title)
+		}
+	}
+}
+
+func TestAddLinkScheme(t *testing.T) {
+	base, _ := url.Parse("gemini://example.org/")
+	text := "=> spartan://example.net:300/ Spartan\n=> gemini://example.com/ Gemini\n"
+
+	result := ParseGemtext(text, base)
+	if len(result.Links) != 1 {
+		t.Fatalf("Expected spartan links to be dropped by default; got %v", result.Links)
+	}
+
+	AddLinkScheme("spartan")
+	defer delete(linkSchemes, "spartan")
+
+	result = ParseGemtext(text, base)
+	if len(result.Links) != 2 {
+		t.Fatalf("Expected two links; got %v", result.Links)
+	}
+	if result.Links[0].Url != "spartan://example.net/" {
+		t.Fatalf("Expected default spartan port to be removed; got %s", result.Links[0].Url)
+	}
+}
+
+func TestParseGemtextListing(t *testing.T) {
+	base, _ := url.Parse("gemini://example.org/files/")
+
+	var listing strings.Builder
+	listing.WriteString("# Index of /files/\n\n")
+	for i := 0; i < 30; i++ {
+		fmt.Fprintf(&listing, "=> file%d.txt file%d.txt\n", i, i)
+	}
+	listing.WriteString("\nGenerated by some server.\n")
+
+	result := ParseGemtext(listing.String(), base)
+	if result.Kind != "listing" {
+		t.Fatalf("Expected a listing; got kind %q", result.Kind)
+	}
+
+	article := `# On Gardening
+
+Gardening is a slow hobby. You plant something, and then you wait.
+Sometimes for weeks, sometimes for years.
+
+=> /seeds.gmi Where I buy seeds
+=> /tools.gmi My tools
+
+The soil matters more than anything else. I spent the first year
+doing little more than adding compost, and it paid off the year after.
+
+## Tomatoes
+
+Tomatoes are the easiest to start with.
+`
+	result = ParseGemtext(article, base)
+	if result.Kind != "" {
+		t.Fatalf("Expected an article not to be a listing; got kind %q", result.Kind)
+	}
+}
+
+func TestIsListing(t *testing.T) {
+	cases := []struct {
+		linkLines int
+		textLines int
+		ratio     float64
+		expected  bool
+	}{
+		{30, 1, 0.9, true},
+		{30, 10, 0.9, false},
+		{30, 10, 0.7, true},
+		{5, 0, 0.9, false}, // too few links
+		{30, 0, 0, false},  // disabled
+	}
+
+	for _, c := range cases {
+		result := isListing(c.linkLines, c.textLines, c.ratio)
+		if result != c.expected {
+			t.Errorf("isListing(%d, %d, %f): expected %t; got %t",
+				c.linkLines, c.textLines, c.ratio, c.expected, result)
+		}
+	}
+}
+
+func TestNormalizeUrl(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		// default port stripping
+		{"gemini://example.org:1965/foo", "gemini://example.org/foo"},
+		{"gemini://example.org:1966/foo", "gemini://example.org:1966/foo"},
+		{"spartan://example.org:300/foo", "spartan://example.org/foo"},
+		{"gemini://example.org:300/foo", "gemini://example.org:300/foo"},
+		{"gemini://example.org:/foo", "gemini://example.org/foo"},
+
+		// case
+		{"gemini://EXAMPLE.org/Foo", "gemini://example.org/Foo"},
+		{"GEMINI://example.org/", "gemini://example.org/"},
+
+		// dot segments and duplicate slashes
+		{"gemini://example.org/a/./b/../c", "gemini://example.org/a/c"},
+		{"gemini://example.org/a//b", "gemini://example.org/a/b"},
+		{"gemini://example.org.//a", "gemini://example.org/a"},
+
+		// queries are kept as they are (gemini queries are usually not
+		// key/value pairs, so the order matters)
+		{"gemini://example.org/search?b=1&a=2", "gemini://example.org/search?b=1&a=2"},
+		{"gemini://example.org/search?hello%20world", "gemini://example.org/search?hello%20world"},
+		{"gemini://example.org/foo?", "gemini://example.org/foo"},
+
+		// escapes
+		{"gemini://example.org/%7efoo", "gemini://example.org/~foo"},
+
+		// empty path
+		{"gemini://example.org", "gemini://example.org/"},
+		{"gemini://example.org:1965", "gemini://example.org/"},
+	}
+
+	for _, c := range cases {
+		u, err := url.Parse(c.input)
+		if err != nil {
+			t.Fatalf("Cannot parse test url %q: %s", c.input, err)
+		}
+
+		result, err := NormalizeUrl(u)
+		if err != nil {
+			t.Errorf("NormalizeUrl(%q): unexpected error: %s", c.input, err)
+			continue
+		}
+
+		if result.String() != c.expected {
+			t.Errorf("NormalizeUrl(%q): expected %q; got %q", c.input, c.expected, result.String())
+		}
+	}
+}
+
+func TestNormalizeUrlHostAliases(t *testing.T) {
+	AddHostAlias("www.example.org", "example.org")
+	AddHostAlias("Mirror.example.org:1966", "example.org")
+	defer delete(hostAliases, "www.example.org")
+	defer delete(hostAliases, "mirror.example.org:1966")
+
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		// aliases collapse to the canonical host
+		{"gemini://www.example.org/foo", "gemini://example.org/foo"},
+		{"gemini://WWW.example.org:1965", "gemini://example.org/"},
+		{"gemini://mirror.example.org:1966/foo?q", "gemini://example.org/foo?q"},
+
+		// other hosts (and ports) are left untouched
+		{"gemini://example.org/foo", "gemini://example.org/foo"},
+		{"gemini://www.example.com/foo", "gemini://www.example.com/foo"},
+		{"gemini://www.example.org:1966/foo", "gemini://www.example.org:1966/foo"},
+		{"gemini://mirror.example.org/foo", "gemini://mirror.example.org/foo"},
+	}
+
+	for _, c := range cases {
+		u, err := url.Parse(c.input)
+		if err != nil {
+			t.Fatalf("Cannot parse test url %q: %s", c.input, err)
+		}
+
+		result, err := NormalizeUrl(u)
+		if err != nil {
+			t.Errorf("NormalizeUrl(%q): unexpected error: %s", c.input, err)
+			continue
+		}
+
+		if result.String() != c.expected {
+			t.Errorf("NormalizeUrl(%q): expected %q; got %q", c.input, c.expected, result.String())
+		}
+	}
+}
+
+func FuzzNormalizeUrl(f *testing.F) {
+	seeds := []string{
+		"gemini://example.org:1965/foo",
+		"gemini://EXAMPLE.org/a/./b/../c?x",
+		"spartan://example.org:300",
+		"//foo/bar",
+		"gemini://[::1]:1965/",
+		"gemini://user@example.org/%7e",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		u, err := url.Parse(s)
+		if err != nil {
+			return
+		}
+
+		result, err := NormalizeUrl(u)
+		if err != nil {
+			return
+		}
+
+		_, err = url.Parse(result.String())
+		if err != nil {
+			t.Fatalf("NormalizeUrl(%q) returned unparseable url %q: %s", s, result.String(), err)
+		}
+	})
+}
+
+func TestDoubleSlashLinks(t *testing.T) {
+	base, _ := url.Parse("gemini://example.org/dir/page.gmi")
+
+	cases := []struct {
+		link     string
+		expected string
+	}{
+		// mistaken double-slash paths
+		{"//foo.gmi", "gemini://example.org/foo.gmi"},
+		{"//docs/index.gmi", "gemini://example.org/docs/index.gmi"},
+		{"//pics/cat.png", "gemini://example.org/pics/cat.png"},
+		{"//", "gemini://example.org/"},
+
+		// scheme-relative urls
+		{"//other.example.net/foo.gmi", "gemini://other.example.net/foo.gmi"},
+		{"//example.org/foo.gmi", "gemini://example.org/foo.gmi"},
+		{"//localhost:1966/", "gemini://localhost:1966/"},
+		{"//192.0.2.1/foo", "gemini://192.0.2.1/foo"},
+	}
+
+	for _, c := range cases {
+		result, ok := resolveLinkUrl(c.link, base)
+		if !ok {
+			t.Errorf("resolveLinkUrl(%q): unexpected failure", c.link)
+			continue
+		}
+
+		if result != c.expected {
+			t.Errorf("resolveLinkUrl(%q): expected %q; got %q", c.link, c.expected, result)
+		}
+	}
+}
+
+func TestContentTypeParsers(t *testing.T) {
+	base, _ := url.Parse("gemini://example.org/doc.foo")
+	body := []byte("\nSome Title\n\n=> /link.gmi a link\n")
+
+	_, err := ParsePage(body, base, "text/x-foo")
+	if err == nil {
+		t.Fatal("Expected an error for an unknown content type")
+	}
+
+	err = AddContentTypeParser("text/x-foo", "plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { delete(contentTypeParsers, "text/x-foo") })
+
+	result, err := ParsePage(body, base, "text/x-foo; charset=utf-8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Title != "Some Title" {
+		t.Fatalf("Expected title %q; got %q", "Some Title", result.Title)
+	}
+
+	// the plain parser does not extract links
+	if len(result.Links) != 0 {
+		t.Fatalf("Expected no links from the plain parser; got %d", len(result.Links))
+	}
+
+	_, err = ParsePage(body, base, "text/x-bar")
+	if err == nil {
+		t.Fatal("Expected an error for an unmapped content type")
+	}
+
+	err = AddContentTypeParser("text/x-bar", "nonexistent")
+	if err == nil {
+		t.Fatal("Expected an error for an unknown parser")
+	}
+}
+
+func TestParseGemtextCodeLangs(t *testing.T) {
+	text := "# Some Code\n" +
+		"```go\n" +
+		"func main() {\n" +
+		"    fmt.Println(\"hello\")\n" +
+		"}\n" +
+		"```\n" +
+		"```Python example\n" +
+		"This block explains what the script does\n" +
+		"```\n" +
+		"```golang\n" +
+		"package main\n" +
+		"```\n" +
+		"```A drawing of a cat\n" +
+		"  /\\_/\\\n" +
+		"```\n"
+
+	result := ParseGemtext(text, nil)
+
+	expected := []string{"go", "python"}
+	if len(result.CodeLangs) != len(expected) {
+		t.Fatalf("Expected code languages %v; got %v", expected, result.CodeLangs)
+	}
+	for i := range expected {
+		if result.CodeLangs[i] != expected[i] {
+			t.Fatalf("Expected code languages %v; got %v", expected, result.CodeLangs)
+		}
+	}
+
+	// prose inside a code block (and the alt text itself) is still indexed
+	if !strings.Contains(result.Text, "This block explains what the script does") {
+		t.Fatalf("Expected text in preformatted block to be kept; got: %q", result.Text)
+	}
+	if !strings.Contains(result.Text, "Python example") {
+		t.Fatalf("Expected alt text to be kept; got: %q", result.Text)
+	}
+}
+
+func TestCodeLangFromAltText(t *testing.T) {
+	cases := []struct {
+		alt      string
+		expected string
+	}{
+		{"go", "go"},
+		{"Go", "go"},
+		{"py", "python"},
+		{"sh: install script", "shell"},
+		{"c++ example", "cpp"},
+		{"", ""},
+		{"ASCII art", ""},
+		{"good morning", ""},
+	}
+
+	for _, c := range cases {
+		result := codeLangFromAltText(c.alt)
+		if result != c.expected {
+			t.Fatalf("codeLangFromAltText(%q): expected %q; got %q", c.alt, c.expected, result)
+		}
+	}
+}
+
+func TestParseGemtextSummary(t *testing.T) {
+	base, _ := url.Parse("gemini://example.org/")
+	text := `# My Gemlog
+2023-04-01
+
+=> /posts/ All posts
+This first real paragraph is long enough to be used as the summary of the page.
+This second paragraph is also long, but it comes after the first one, so it's not used.
+`
+	result := ParseGemtext(text, base)
+	expected := "This first real paragraph is long enough to be used as the summary of the page."
+	if result.Summary != expected {
+		t.Fatalf("Expected summary %q; got %q", expected, result.Summary)
+	}
+
+	// long paragraphs are cut at a word boundary
+	text = "# Title\n\n" + strings.Repeat("lorem ipsum ", 100) + "\n"
+	result = ParseGemtext(text, base)
+	if len(result.Summary) > maxSummaryLength+3 || !strings.HasSuffix(result.Summary, "ipsum...") {
+		t.Fatalf("Expected a shortened summary; got %q", result.Summary)
+	}
+
+	// no substantial paragraphs
+	text = "# Title\n\nshort line\n=> /foo A link text that is long enough to be a summary but isn't\n"
+	result = ParseGemtext(text, base)
+	if result.Summary != "" {
+		t.Fatalf("Expected no summary; got %q", result.Summary)
+	}
+}
+
+func TestParsePlainSummary(t *testing.T) {
+	text := `Some Title
+by someone
+
+This is the first paragraph of the document, and it spans
+more than a single line, which should be joined together.
+
+Another paragraph.
+`
+	result := ParsePlain(text)
+	expected := "This is the first paragraph of the document, and it spans more than a single line, which should be joined together."
+	if result.Summary != expected {
+		t.Fatalf("Expected summary %q; got %q", expected, result.Summary)
+	}
+
+	// emails use the first paragraph of the body
+	text = `From: Gopher <from@example.com>
+Subject: Spam & Eggs
+
+Hi,
+
+This is an email with a body that is long enough to have a summary.
+`
+	result = ParsePlain(text)
+	expected = "This is an email with a body that is long enough to have a summary."
+	if result.Summary != expected {
+		t.Fatalf("Expected email summary %q; got %q", expected, result.Summary)
+	}
+}
+
+func TestDetectScript(t *testing.T) {
+	cases := []struct {
+		text     string
+		expected string
+	}{
+		{"Hello, world!", "latin"},
+		{"Привет, мир", "cyrillic"},
+		{"Γειά σου κόσμε", "greek"},
+		{"你好，世界", "cjk"},
+		{"こんにちは世界", "cjk"},
+		{"안녕하세요", "cjk"},
+		{"مرحبا بالعالم", "arabic"},
+		{"שלום עולם", "hebrew"},
+		{"नमस्ते दुनिया", "devanagari"},
+
+		// mixed scripts; the one with the most letters wins
+		{"Go 言語のチュートリアルとサンプル", "cjk"},
+		{"Статья about gemini and the smallnet", "latin"},
+		{"Новости дня: Gemini", "cyrillic"},
+
+		// no letters
+		{"1234 ---- !!!", ""},
+		{"", ""},
+	}
+
+	for _, c := range cases {
+		if script := detectScript(c.text); script != c.expected {
+			t.Errorf("detectScript(%q): expected %q; got %q", c.text, c.expected, script)
+		}
+	}
+}
+
+func TestParsePageScript(t *testing.T) {
+	base, _ := url.Parse("gemini://example.org/")
+	page, err := ParsePage([]byte("# Заголовок\n\nЭто страница на русском языке.\n=> /en English version\n"), base, "text/gemini")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if page.Script != "cyrillic" {
+		t.Fatalf("Expected cyrillic script; got %q", page.Script)
+	}
+}
@@ -0,0 +1,145 @@
+package gsearch
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+	"net/url"
+	"strings"
+)
+
+const (
+	// hosts with fewer pages than this are never checked for boilerplate,
+	// since a line shared by a few pages is not necessarily boilerplate.
+	boilerplateMinPages = 5
+
+	// lines appearing on at least this fraction of the pages of a host are
+	// considered boilerplate (like a shared footer or navigation).
+	boilerplateRatio = 0.5
+)
+
+// boilerplateDetector finds lines repeated across the pages of each host. Only
+// hashes of the lines are kept, so memory use is proportional to the number of
+// distinct lines, not their size.
+type boilerplateDetector struct {
+	pages map[string]int
+	lines map[string]map[uint64]int
+}
+
+func newBoilerplateDetector() *boilerplateDetector {
+	return &boilerplateDetector{
+		pages: map[string]int{},
+		lines: map[string]map[uint64]int{},
+	}
+}
+
+func hashLine(line string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(line))
+	return h.Sum64()
+}
+
+func rowHost(row pageRow) string {
+	u, err := url.Parse(row.url)
+	if err != nil {
+		return ""
+	}
+
+	return u.Host
+}
+
+// count the lines of the given page. each line is counted once per page.
+func (b *boilerplateDetector) add(row pageRow) {
+	host := rowHost(row)
+	b.pages[host]++
+
+	counts, ok := b.lines[host]
+	if !ok {
+		counts = map[uint64]int{}
+		b.lines[host] = counts
+	}
+
+	seen := map[uint64]bool{}
+	for _, line := range strings.Split(row.doc.Content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		h := hashLine(line)
+		if !seen[h] {
+			seen[h] = true
+			counts[h]++
+		}
+	}
+}
+
+// drop the counts of lines that are not boilerplate, so that only the
+// boilerplate lines of each host remain. this should be called after all pages
+// are added.
+func (b *boilerplateDetector) finish() {
+	for host, counts := range b.lines {
+		n := b.pages[host]
+		if n < boilerplateMinPages {
+			delete(b.lines, host)
+			continue
+		}
+
+		for h, count := range counts {
+			if float64(count) < boilerplateRatio*float64(n) {
+				delete(counts, h)
+			}
+		}
+	}
+}
+
+// remove the boilerplate lines of the page's host from its content.
+func (b *boilerplateDetector) strip(row pageRow) pageRow {
+	boilerplate := b.lines[rowHost(row)]
+	if len(boilerplate) == 0 {
+		return row
+	}
+
+	var s strings.Builder
+	for _, line := range strings.Split(row.doc.Content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" {
+			if _, ok := boilerplate[hashLine(trimmed)]; ok {
+				continue
+			}
+		}
+
+		s.WriteString(line)
+		s.WriteString("\n")
+	}
+
+	row.doc.Content = strings.TrimSuffix(s.String(), "\n")
+	return row
+}
+
+// wrap the given page row producer so that boilerplate lines are removed from
+// the content of the rows. this runs the producer twice; once to find the
+// boilerplate lines of each host, and once to pass on the stripped rows.
+func withoutBoilerplate(produce func(ctx context.Context, f func(row pageRow) error) error) func(ctx context.Context, f func(row pageRow) error) error {
+	return func(ctx context.Context, f func(row pageRow) error) (err error) {
+		b := newBoilerplateDetector()
+		err = produce(ctx, func(row pageRow) error {
+			b.add(row)
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		b.finish()
+
+		nlines := 0
+		for _, counts := range b.lines {
+			nlines += len(counts)
+		}
+		log.Printf("Found %d boilerplate lines in %d hosts.\n", nlines, len(b.lines))
+
+		return produce(ctx, func(row pageRow) error {
+			return f(b.strip(row))
+		})
+	}
+}
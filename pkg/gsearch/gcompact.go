@@ -0,0 +1,63 @@
+package gsearch
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/index/scorch"
+)
+
+// return the scorch index underlying the given (non-sharded) index.
+func scorchIndex(idx bleve.Index) (s *scorch.Scorch, err error) {
+	advanced, err := idx.Advanced()
+	if err != nil {
+		return
+	}
+
+	s, ok := advanced.(*scorch.Scorch)
+	if !ok {
+		err = fmt.Errorf("Index %s is not a scorch index", idx.Name())
+	}
+
+	return
+}
+
+// return the number of segments (both in memory and on disk) of the given
+// scorch index.
+func segmentCount(s *scorch.Scorch) (n uint64) {
+	stats := s.StatsMap()
+	for _, key := range []string{"TotFileSegmentsAtRoot", "TotMemorySegmentsAtRoot"} {
+		if v, ok := stats[key].(uint64); ok {
+			n += v
+		}
+	}
+
+	return
+}
+
+// CompactIndex merges the segments of each shard of the given index into a
+// single one, and returns the total number of segments before and after. The
+// merge happens online; searches keep using the existing segments until it's
+// done.
+func CompactIndex(ctx context.Context, idx bleve.Index) (before uint64, after uint64, err error) {
+	for _, shard := range Shards(idx) {
+		var s *scorch.Scorch
+		s, err = scorchIndex(shard)
+		if err != nil {
+			return
+		}
+
+		before += segmentCount(s)
+
+		// a nil plan means merging everything into a single segment
+		err = s.ForceMerge(ctx, nil)
+		if err != nil {
+			return
+		}
+
+		after += segmentCount(s)
+	}
+
+	return
+}
@@ -2,6 +2,9 @@ package gsearch
 
 import (
 	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/blevesearch/bleve/v2/registry"
 	"github.com/blevesearch/bleve/v2/search/highlight"
@@ -11,14 +14,55 @@ import (
 
 const formatName = "gem"
 
-func formatConstructor(config map[string]interface{}, cache *registry.Cache) (highlight.Highlighter, error) {
+// the default maximum snippet length (in characters), same as bleve's default
+// fragment size.
+const DefaultSnippetSize = 200
 
-	fragmenter, err := cache.FragmenterNamed(simpleFragmenter.Name)
-	if err != nil {
-		return nil, fmt.Errorf("error building fragmenter: %v", err)
+var snippetSize = DefaultSnippetSize
+
+// SetSnippetSize sets the maximum length (in characters) of the snippets
+// returned in search results. Highlighters are cached per index once built, so
+// this should be called before any searches are performed.
+func SetSnippetSize(size int) {
+	if size <= 0 {
+		size = DefaultSnippetSize
+	}
+	snippetSize = size
+}
+
+// the maximum length of custom highlight delimiters.
+const maxHighlightDelimiterLen = 16
+
+// the name of a highlighter like the "gem" one, which marks matched terms with
+// the characters below instead. custom delimiters replace these marks in the
+// results of each request, so that we don't need a highlighter for every pair
+// of delimiters we are sent. the marks are unicode noncharacters, reserved for
+// internal use, so they should not appear in any indexed text.
+const markedStyle = "gem-marked"
+const markBefore = "\uFDD0"
+const markAfter = "\uFDD1"
+
+func formatConstructor(config map[string]interface{}, cache *registry.Cache) (highlight.Highlighter, error) {
+	formatterName := formatName
+	if name, ok := config["fragment_formatter"].(string); ok {
+		formatterName = name
 	}
 
-	formatter, err := cache.FragmentFormatterNamed(formatName)
+	return newHighlighter(formatterName, cache)
+}
+
+func markedConstructor(config map[string]interface{}, cache *registry.Cache) (highlight.Highlighter, error) {
+	return newHighlighter(markedStyle, cache)
+}
+
+func markedFormatterConstructor(config map[string]interface{}, cache *registry.Cache) (highlight.FragmentFormatter, error) {
+	return NewFragmentFormatter(markBefore, markAfter), nil
+}
+
+func newHighlighter(formatterName string, cache *registry.Cache) (highlight.Highlighter, error) {
+	fragmenter := simpleFragmenter.NewFragmenter(snippetSize)
+
+	formatter, err := cache.FragmentFormatterNamed(formatterName)
 	if err != nil {
 		return nil, fmt.Errorf("error building fragment formatter: %v", err)
 	}
@@ -30,6 +74,58 @@ func formatConstructor(config map[string]interface{}, cache *registry.Cache) (hi
 		nil
 }
 
+// return the name of a highlighter for marking matched terms with the given
+// delimiters. empty delimiters are replaced with the defaults. for custom
+// delimiters, the returned replacer needs to be applied to the highlighted
+// text to get the final result; it's nil otherwise. delimiters should be
+// short, printable, and on a single line, since they end up in gemtext.
+func gemHighlightStyle(before, after string) (style string, marks *strings.Replacer, err error) {
+	if before == "" {
+		before = DefaultGemHighlightBefore
+	}
+	if after == "" {
+		after = DefaultGemHighlightAfter
+	}
+	if before == DefaultGemHighlightBefore && after == DefaultGemHighlightAfter {
+		style = formatName
+		return
+	}
+
+	for _, delim := range []string{before, after} {
+		if len(delim) > maxHighlightDelimiterLen {
+			err = fmt.Errorf("Highlight delimiters cannot be longer than %d bytes", maxHighlightDelimiterLen)
+			return
+		}
+
+		if !isPrintable(delim) {
+			err = fmt.Errorf("Highlight delimiters can only contain printable characters")
+			return
+		}
+	}
+
+	style = markedStyle
+	marks = strings.NewReplacer(markBefore, before, markAfter, after)
+	return
+}
+
+// return true if the given string is valid utf-8, and only contains printable
+// characters (which means no line breaks or other control characters).
+func isPrintable(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func init() {
 	registry.RegisterHighlighter(formatName, formatConstructor)
+	registry.RegisterHighlighter(markedStyle, markedConstructor)
+	registry.RegisterFragmentFormatter(markedStyle, markedFormatterConstructor)
 }
@@ -0,0 +1,141 @@
+package gsearch
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/lib/pq"
+)
+
+// the number of page ids checked against the database at a time when pruning.
+const pruneChunkSize = 1000
+
+// PagesWithContent returns the subset of the given urls that are stored in the
+// database with some content.
+func PagesWithContent(ctx context.Context, db *sql.DB, urls []string) (exist map[string]bool, err error) {
+	rows, err := db.QueryContext(
+		ctx,
+		`select url from urls where url = any($1) and content_id is not null`,
+		pq.Array(urls))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	exist = map[string]bool{}
+	for rows.Next() {
+		var u string
+		err = rows.Scan(&u)
+		if err != nil {
+			return
+		}
+
+		exist[u] = true
+	}
+
+	err = rows.Err()
+	return
+}
+
+// PruneIndex deletes the pages from the given index for which exist does not
+// report the url as existing, and returns the number of pages deleted. exist
+// is called with chunks of the page urls in the index (usually
+// PagesWithContent). Image documents are left alone.
+func PruneIndex(ctx context.Context, idx bleve.Index, exist func(ctx context.Context, urls []string) (map[string]bool, error)) (pruned uint64, err error) {
+	var stale []string
+	for _, shard := range Shards(idx) {
+		stale, err = staleShardPages(ctx, shard, exist, stale)
+		if err != nil {
+			return
+		}
+	}
+
+	for _, u := range stale {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			return
+		}
+
+		err = idx.Delete(u)
+		if err != nil {
+			return
+		}
+		pruned++
+	}
+
+	return
+}
+
+// append the pages in the given (shard of an) index that don't exist any more
+// to stale.
+func staleShardPages(ctx context.Context, index bleve.Index, exist func(ctx context.Context, urls []string) (map[string]bool, error), stale []string) ([]string, error) {
+	advanced, err := index.Advanced()
+	if err != nil {
+		return stale, err
+	}
+
+	reader, err := advanced.Reader()
+	if err != nil {
+		return stale, err
+	}
+	defer reader.Close()
+
+	idReader, err := reader.DocIDReaderAll()
+	if err != nil {
+		return stale, err
+	}
+	defer idReader.Close()
+
+	var chunk []string
+	check := func() error {
+		existing, err := exist(ctx, chunk)
+		if err != nil {
+			return err
+		}
+
+		for _, u := range chunk {
+			if !existing[u] {
+				stale = append(stale, u)
+			}
+		}
+
+		chunk = chunk[:0]
+		return nil
+	}
+
+	for {
+		internalId, err := idReader.Next()
+		if err != nil {
+			return stale, err
+		}
+		if internalId == nil {
+			break
+		}
+
+		id, err := reader.ExternalID(internalId)
+		if err != nil {
+			return stale, err
+		}
+
+		// image documents are keyed by their hash, not a url
+		if !strings.Contains(id, "://") {
+			continue
+		}
+
+		chunk = append(chunk, id)
+		if len(chunk) >= pruneChunkSize {
+			err = check()
+			if err != nil {
+				return stale, err
+			}
+		}
+	}
+
+	if len(chunk) > 0 {
+		err = check()
+	}
+
+	return stale, err
+}
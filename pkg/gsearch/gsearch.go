@@ -3,40 +3,226 @@ package gsearch
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"math"
 	"net/url"
+	"os"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/blevesearch/bleve/v2"
 	"github.com/blevesearch/bleve/v2/numeric"
 	"github.com/blevesearch/bleve/v2/search"
+	"github.com/blevesearch/bleve/v2/search/collector"
 	_ "github.com/blevesearch/bleve/v2/search/highlight/highlighter/ansi"
+	"github.com/blevesearch/bleve/v2/search/query"
+	index "github.com/blevesearch/bleve_index_api"
 	"github.com/lib/pq"
+	"golang.org/x/exp/slices"
 
 	"git.sr.ht/~elektito/gemplex/pkg/config"
 	"git.sr.ht/~elektito/gemplex/pkg/gcrawler"
 	"git.sr.ht/~elektito/gemplex/pkg/utils"
+	"git.sr.ht/~elektito/whatlanggo"
 )
 
 const PageSize = 15
 
+// ErrIndexNotReady is returned by the search functions when there is no index
+// to search yet, e.g. because the first one is still being built.
+var ErrIndexNotReady = errors.New("index not ready")
+
+// ErrPageBeyondLimit is returned by SearchPages when the requested page is past
+// the maximum number of reported results (see SetMaxReportedResults).
+var ErrPageBeyondLimit = errors.New("page beyond the viewable results")
+
+// when collapsing search results, this many times the results up to the end of
+// the requested page are fetched, so there's enough left after collapsing.
+const collapseWindowFactor = 3
+
+// the maximum number of suggestions returned by SuggestTerms, and the maximum
+// number of dictionary entries scanned per field to find them (which bounds
+// latency for short prefixes).
+const (
+	MaxSuggestions       = 20
+	maxSuggestScanLength = 10000
+)
+
+// DefaultTitleBoost is the default boost applied to title matches in page
+// searches, relative to content matches.
+const DefaultTitleBoost = 2.0
+
+var titleBoost = DefaultTitleBoost
+
+// DefaultLinksBoost is the default boost applied to matches in the texts of
+// links pointing to a page. The words others use to describe a page are a good
+// signal of what it is about, but are weighed lower than the page's own text.
+const DefaultLinksBoost = 0.5
+
+var linksBoost = DefaultLinksBoost
+
+// SetTitleBoost sets the boost applied to title matches in page searches,
+// relative to content matches. Zero or negative values restore the default.
+func SetTitleBoost(boost float64) {
+	if boost <= 0 {
+		boost = DefaultTitleBoost
+	}
+	titleBoost = boost
+}
+
+// SetLinksBoost sets the boost applied to matches in the texts of links
+// pointing to a page. Zero or negative values disable searching link texts.
+func SetLinksBoost(boost float64) {
+	if boost < 0 {
+		boost = 0
+	}
+	linksBoost = boost
+}
+
+// DefaultHeadingsBoost is the default boost applied to matches in the headings
+// of a page. Headings are a strong hint of what a page (or a section of it) is
+// about, so they're weighed between the title and the rest of the content.
+const DefaultHeadingsBoost = 1.5
+
+var headingsBoost = DefaultHeadingsBoost
+
+// SetHeadingsBoost sets the boost applied to matches in page headings. Zero or
+// negative values disable searching headings separately.
+func SetHeadingsBoost(boost float64) {
+	if boost < 0 {
+		boost = 0
+	}
+	headingsBoost = boost
+}
+
+// the boost applied to pages in the same language as the query; zero (the
+// default) disables detecting the language of queries.
+var langBoost float64
+
+// SetLangBoost sets the boost applied to pages in the same language as the
+// query, when it can be reliably detected. Zero or negative values disable it.
+func SetLangBoost(boost float64) {
+	if boost < 0 {
+		boost = 0
+	}
+	langBoost = boost
+}
+
+// the maximum number of results reported for page searches, and so the
+// maximum number of results that can be paged through; zero means no limit.
+var maxReportedResults uint64
+
+// SetMaxReportedResults caps the total number of results reported for page
+// searches. Pages beyond the cap cannot be requested. Matching stops early once
+// the cap is reached, which makes broad queries faster, but also means only the
+// matches found until then (in index order) are ranked. Zero or negative
+// values remove the cap.
+func SetMaxReportedResults(n int) {
+	if n < 0 {
+		n = 0
+	}
+	maxReportedResults = uint64(n)
+}
+
+// DefaultSynonymBoost is the default boost applied to matches of the synonyms
+// of query terms. Synonyms widen the search, but the words actually used in the
+// query should still count for more.
+const DefaultSynonymBoost = 0.5
+
+var synonymBoost = DefaultSynonymBoost
+
+// groups of terms considered equivalent in page searches. each term is a list
+// of words, as split by synonymWords.
+var synonymGroups [][][]string
+
+// SetSynonymBoost sets the boost applied to matches of the synonyms of query
+// terms. Zero or negative values restore the default.
+func SetSynonymBoost(boost float64) {
+	if boost <= 0 {
+		boost = DefaultSynonymBoost
+	}
+	synonymBoost = boost
+}
+
+// SetSynonyms sets the groups of terms (words or phrases, like "gemlog" and
+// "gem log") considered equivalent in page searches. When a query contains one
+// of the terms in a group, pages matching the other terms in the group are also
+// matched, with a lower boost. Matching is case-insensitive.
+func SetSynonyms(groups [][]string) {
+	synonymGroups = nil
+	for _, group := range groups {
+		var terms [][]string
+		for _, term := range group {
+			words := synonymWords(term)
+			if len(words) > 0 {
+				terms = append(terms, words)
+			}
+		}
+
+		if len(terms) > 1 {
+			synonymGroups = append(synonymGroups, terms)
+		}
+	}
+}
+
+// PageCount returns the number of result pages needed for the given number of
+// results.
+func PageCount(total uint64) uint64 {
+	return (total + PageSize - 1) / PageSize
+}
+
+// the maximum number of content types reported in page search responses
+const maxContentTypeFacets = 5
+
+// kinds of documents excluded from search results, unless explicitly asked for
+// using a "kind:" filter.
+var DefaultExcludedKinds = []string{"email", "rfc", "irc", "listing"}
+
 type PageDoc struct {
 	Title       string
 	Content     string
 	Lang        string
 	Links       string
+	Headings    string
 	PageRank    float64
 	HostRank    float64
 	Kind        string
 	ContentType string
 	ContentSize uint64
+
+	// programming languages of the code blocks in the page
+	CodeLangs []string
+
+	// number of links going out of the page
+	OutboundLinks uint64
+
+	// a short summary of the page; stored for display, but not indexed.
+	Summary string
+
+	// the original text of the page, before cleanup (like removing ascii-art
+	// pre-blocks); stored, but not indexed. only set if Index.StoreRawText is
+	// set.
+	RawText string
 }
 
 type ImageDoc struct {
-	AltText   string
+	AltText string
+
+	// for images without alt text, this is set to the title of the page the
+	// image was found in, so that they can still be searched (only if
+	// Index.IndexImagesWithoutAlt is set).
+	SurrogateText string
+
 	Image     string
 	SourceUrl string
 	FetchTime time.Time
@@ -56,6 +242,18 @@ type PageSearchRequest struct {
 	Page           int    `json:"page,omitempty"`
 	HighlightStyle string `json:"-"`
 	Verbose        bool   `json:"-"`
+
+	// if set, used instead of the default delimiters around matched terms
+	// in snippets and titles. only used with the default highlight style.
+	HighlightBefore string `json:"hl_before,omitempty"`
+	HighlightAfter  string `json:"hl_after,omitempty"`
+
+	// output format used by the cgi; either "plain" or empty (for gemtext).
+	Format string `json:"-"`
+
+	// if set, results from the same host with the same title are collapsed
+	// into a single result.
+	Collapse bool `json:"collapse,omitempty"`
 }
 
 type ImageSearchRequest struct {
@@ -67,15 +265,45 @@ type ImageSearchRequest struct {
 	HighlightStyle string `json:"-"`
 }
 
+type SuggestRequest struct {
+	// this should be set to "suggest"
+	Type string `json:"t"`
+
+	Query string `json:"q"`
+	Count int    `json:"n,omitempty"`
+}
+
+type SuggestResponse struct {
+	Query       string   `json:"q"`
+	Suggestions []string `json:"suggestions"`
+
+	// used by the search daemon and cgi
+	Err string `json:"err,omitempty"`
+}
+
 type PageSearchResult struct {
-	Url         string  `json:"url"`
-	Title       string  `json:"title"`
-	Snippet     string  `json:"snippet"`
+	Url     string `json:"url"`
+	Title   string `json:"title"`
+	Snippet string `json:"snippet"`
+
+	// the title, with the terms matching the query highlighted; same as
+	// Title if there are none.
+	HighlightedTitle string `json:"highlighted_title,omitempty"`
+
 	UrlRank     float64 `json:"prank"`
 	HostRank    float64 `json:"hrank"`
 	Relevance   float64 `json:"score"`
 	ContentType string  `json:"content_type"`
 	ContentSize uint64  `json:"content_size"`
+	Lang        string  `json:"lang,omitempty"`
+	Kind        string  `json:"kind,omitempty"`
+
+	// a short, query-independent summary of the page, if one was found.
+	Summary string `json:"summary,omitempty"`
+
+	// when collapsing is enabled, the number of other results from the same
+	// host with the same title, collapsed into this one.
+	Collapsed int `json:"collapsed,omitempty"`
 
 	// used by templates; this is _not_ set by the Search function.
 	Hostname string `json:"-"`
@@ -90,11 +318,28 @@ type ImageSearchResult struct {
 	Relevance float64   `json:"score"`
 }
 
+type FacetCount struct {
+	Term  string `json:"term"`
+	Count int    `json:"count"`
+}
+
 type PageSearchResponse struct {
 	TotalResults uint64             `json:"n"`
 	Results      []PageSearchResult `json:"results"`
 	Duration     time.Duration      `json:"duration"`
 
+	// the time the index in use finished building; zero if not known. this is
+	// set by the search daemon, not the SearchPages function.
+	IndexBuilt time.Time `json:"index_built"`
+
+	// the most common content types among all results (not just the current
+	// page), along with the number of results of each type.
+	ContentTypes []FacetCount `json:"content_types,omitempty"`
+
+	// set if there are more results than TotalResults, which is capped at
+	// the configured maximum.
+	TotalCapped bool `json:"capped,omitempty"`
+
 	// used by the search daemon and cgi
 	Err string `json:"err,omitempty"`
 }
@@ -176,59 +421,63 @@ func (so *RankedSort) Copy() search.SearchSort {
 func NewIndex(path string, name string) (idx bleve.Index, err error) {
 	idxMapping := bleve.NewIndexMapping()
 
-	pageMapping := bleve.NewDocumentMapping()
-
-	titleFieldMapping := bleve.NewTextFieldMapping()
-	pageMapping.AddFieldMappingsAt("Title", titleFieldMapping)
-
-	contentFieldMapping := bleve.NewTextFieldMapping()
-	pageMapping.AddFieldMappingsAt("Content", contentFieldMapping)
-
-	langFieldMapping := bleve.NewKeywordFieldMapping()
-	langFieldMapping.IncludeInAll = false
-	langFieldMapping.IncludeTermVectors = false
-	pageMapping.AddFieldMappingsAt("Lang", langFieldMapping)
+	// page documents don't declare their type, so they are indexed using the
+	// default mapping. fields not mapped here (like the title, content, and
+	// ranks) are mapped dynamically.
 
+	// link texts are searched explicitly (see buildPageQuery), and are never
+	// displayed or highlighted.
 	linksFieldMapping := bleve.NewTextFieldMapping()
-	pageMapping.AddFieldMappingsAt("Links", linksFieldMapping)
-
-	pageRankFieldMapping := bleve.NewNumericFieldMapping()
-	pageRankFieldMapping.Index = false
-	pageRankFieldMapping.IncludeInAll = false
-	pageRankFieldMapping.IncludeTermVectors = false
-	pageMapping.AddFieldMappingsAt("PageRank", pageRankFieldMapping)
-
-	hostRankFieldMapping := bleve.NewNumericFieldMapping()
-	hostRankFieldMapping.Index = false
-	pageRankFieldMapping.IncludeInAll = false
-	pageRankFieldMapping.IncludeTermVectors = false
-	pageMapping.AddFieldMappingsAt("HostRank", hostRankFieldMapping)
-
-	kindFieldMapping := bleve.NewTextFieldMapping()
-	kindFieldMapping.Index = true
-	kindFieldMapping.IncludeInAll = false
-	kindFieldMapping.IncludeTermVectors = false
-	pageMapping.AddFieldMappingsAt("Kind", kindFieldMapping)
-
+	linksFieldMapping.Store = false
+	linksFieldMapping.IncludeInAll = false
+	linksFieldMapping.IncludeTermVectors = false
+	idxMapping.DefaultMapping.AddFieldMappingsAt("Links", linksFieldMapping)
+
+	// headings are also part of the content, so they're only searched
+	// explicitly (with a boost) and never displayed.
+	headingsFieldMapping := bleve.NewTextFieldMapping()
+	headingsFieldMapping.Store = false
+	headingsFieldMapping.IncludeInAll = false
+	headingsFieldMapping.IncludeTermVectors = false
+	idxMapping.DefaultMapping.AddFieldMappingsAt("Headings", headingsFieldMapping)
+
+	// content types and code languages are indexed as keywords, for filtering
+	// and faceting to work.
 	contentTypeFieldMapping := bleve.NewKeywordFieldMapping()
 	contentTypeFieldMapping.Index = true
 	contentTypeFieldMapping.IncludeInAll = false
 	contentTypeFieldMapping.IncludeTermVectors = false
-	pageMapping.AddFieldMappingsAt("ContentType", contentTypeFieldMapping)
-
-	contentSizeFieldMapping := bleve.NewNumericFieldMapping()
-	contentSizeFieldMapping.Index = true
-	contentSizeFieldMapping.IncludeInAll = false
-	contentSizeFieldMapping.IncludeTermVectors = false
-	pageMapping.AddFieldMappingsAt("ContentSize", contentSizeFieldMapping)
-
-	idxMapping.AddDocumentMapping("Page", pageMapping)
+	idxMapping.DefaultMapping.AddFieldMappingsAt("ContentType", contentTypeFieldMapping)
+
+	codeLangsFieldMapping := bleve.NewKeywordFieldMapping()
+	codeLangsFieldMapping.Store = false
+	codeLangsFieldMapping.IncludeInAll = false
+	codeLangsFieldMapping.IncludeTermVectors = false
+	idxMapping.DefaultMapping.AddFieldMappingsAt("CodeLangs", codeLangsFieldMapping)
+
+	// the summary and raw text are only stored for display, and not indexed.
+	summaryFieldMapping := bleve.NewTextFieldMapping()
+	summaryFieldMapping.Index = false
+	summaryFieldMapping.IncludeInAll = false
+	summaryFieldMapping.IncludeTermVectors = false
+	idxMapping.DefaultMapping.AddFieldMappingsAt("Summary", summaryFieldMapping)
+
+	rawTextFieldMapping := bleve.NewTextFieldMapping()
+	rawTextFieldMapping.Index = false
+	rawTextFieldMapping.IncludeInAll = false
+	rawTextFieldMapping.IncludeTermVectors = false
+	idxMapping.DefaultMapping.AddFieldMappingsAt("RawText", rawTextFieldMapping)
 
 	imgMapping := bleve.NewDocumentMapping()
 
 	altFieldMapping := bleve.NewTextFieldMapping()
 	imgMapping.AddFieldMappingsAt("AltText", altFieldMapping)
 
+	surrogateTextFieldMapping := bleve.NewTextFieldMapping()
+	surrogateTextFieldMapping.Store = false
+	surrogateTextFieldMapping.IncludeInAll = false
+	imgMapping.AddFieldMappingsAt("SurrogateText", surrogateTextFieldMapping)
+
 	imageFieldMapping := bleve.NewTextFieldMapping()
 	imageFieldMapping.Store = true
 	imageFieldMapping.Index = false
@@ -252,7 +501,12 @@ func NewIndex(path string, name string) (idx bleve.Index, err error) {
 	return
 }
 
+// OpenIndex opens an existing index, which can be a sharded one.
 func OpenIndex(path string, name string) (idx bleve.Index, err error) {
+	if isShardedIndex(path) {
+		return openShardedIndex(path, name, OpenIndex)
+	}
+
 	idx, err = bleve.Open(path)
 	if err != nil {
 		return
@@ -262,118 +516,412 @@ func OpenIndex(path string, name string) (idx bleve.Index, err error) {
 	return
 }
 
-func IndexDb(ctx context.Context, index bleve.Index, cfg *config.Config) (err error) {
-	IndexPages(ctx, index, cfg)
+// OpenIndexReadOnly opens an existing (possibly sharded) index in read-only
+// mode. If the index is locked by another process, an error is returned after
+// the given timeout.
+func OpenIndexReadOnly(path string, name string, timeout time.Duration) (idx bleve.Index, err error) {
+	return openIndexUsing(path, name, map[string]interface{}{
+		"read_only":    true,
+		"bolt_timeout": timeout.String(),
+	})
+}
+
+// OpenIndexTimeout is like OpenIndex, but if the index is locked by another
+// process (like a running index daemon), an error is returned after the given
+// timeout.
+func OpenIndexTimeout(path string, name string, timeout time.Duration) (idx bleve.Index, err error) {
+	return openIndexUsing(path, name, map[string]interface{}{
+		"bolt_timeout": timeout.String(),
+	})
+}
+
+// open an existing (possibly sharded) index, passing the given runtime config
+// to each of its shards.
+func openIndexUsing(path string, name string, runtimeConfig map[string]interface{}) (idx bleve.Index, err error) {
+	if isShardedIndex(path) {
+		return openShardedIndex(path, name, func(path string, name string) (bleve.Index, error) {
+			return openIndexUsing(path, name, runtimeConfig)
+		})
+	}
+
+	idx, err = bleve.OpenUsing(path, runtimeConfig)
+	if err != nil {
+		return
+	}
+
+	idx.SetName(name)
+	return
+}
+
+// IndexDb indexes all pages and images in the database, and returns the
+// number of database rows read.
+func IndexDb(ctx context.Context, index bleve.Index, cfg *config.Config) (rows uint64, err error) {
+	pages, err := IndexPages(ctx, index, cfg)
 	if ctx.Err() == context.Canceled {
 		err = ctx.Err()
 		return
 	}
+	if err != nil {
+		err = fmt.Errorf("Error indexing pages: %w", err)
+		return
+	}
 
-	IndexImages(ctx, index, cfg)
+	images, err := IndexImages(ctx, index, cfg)
 	if ctx.Err() == context.Canceled {
 		err = ctx.Err()
 		return
 	}
+	if err != nil {
+		err = fmt.Errorf("Error indexing images: %w", err)
+		return
+	}
 
+	rows = pages + images
 	return
 }
 
-func IndexPages(ctx context.Context, index bleve.Index, cfg *config.Config) (err error) {
-	log.Println("Indexing pages...")
+// IndexMeta is metadata about an index build, stored in a sidecar file next
+// to the index.
+type IndexMeta struct {
+	DocCount    uint64    `json:"docs"`
+	SourceRows  uint64    `json:"source_rows"`
+	BuildStart  time.Time `json:"build_start"`
+	BuildFinish time.Time `json:"build_finish"`
+
+	// contents added to the database after this time are not in the index
+	// yet. incremental index updates start from here, and move it forward.
+	Watermark time.Time `json:"watermark"`
+}
 
-	db, err := sql.Open("postgres", cfg.GetDbConnStr())
+// WatermarkMargin is subtracted from the start time of an index update to get
+// the new watermark. The insert time of contents is set when their database
+// transaction starts, so rows committed while the index was being updated can
+// have an insert time slightly before the update started. Re-indexing a few
+// pages is harmless; missing them is not.
+const WatermarkMargin = time.Minute
+
+type IndexStatsResponse struct {
+	IndexMeta
+
+	// used by the search daemon and cgi
+	Err string `json:"err,omitempty"`
+}
+
+// return the path of the metadata sidecar file for the index at the given path.
+func indexMetaPath(indexPath string) string {
+	return indexPath + ".meta"
+}
+
+// WriteIndexMeta writes the metadata sidecar file for the index at the given
+// path. The file is written atomically, so readers never see a partial file.
+func WriteIndexMeta(indexPath string, meta IndexMeta) (err error) {
+	data, err := json.Marshal(meta)
 	if err != nil {
 		return
 	}
-	defer db.Close()
+
+	tmpPath := indexMetaPath(indexPath) + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(tmpPath, indexMetaPath(indexPath))
+	return
+}
+
+// ReadIndexMeta reads the metadata sidecar file for the index at the given
+// path. If the file does not exist (e.g. for indexes built before sidecar files
+// were added), an error satisfying errors.Is(err, fs.ErrNotExist) is returned.
+func ReadIndexMeta(indexPath string) (meta IndexMeta, err error) {
+	data, err := os.ReadFile(indexMetaPath(indexPath))
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &meta)
+	return
+}
+
+// RemoveIndexMeta removes the metadata sidecar file for the index at the given
+// path, if it exists.
+func RemoveIndexMeta(indexPath string) (err error) {
+	err = os.Remove(indexMetaPath(indexPath))
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	return
+}
+
+// ForEachPage calls the given function for each indexable page stored in the
+// database, stopping at the first error returned by it. Rows are streamed from
+// the database, so memory use stays bounded regardless of the number of pages.
+func ForEachPage(ctx context.Context, db *sql.DB, f func(urlStr string, doc PageDoc) error) (err error) {
+	return ForEachPageSince(ctx, db, time.Time{}, f)
+}
+
+// ForEachPageSince is like ForEachPage, but only visits pages whose contents
+// were added to the database, or changed, after the given time. A zero time
+// visits all pages.
+func ForEachPageSince(ctx context.Context, db *sql.DB, since time.Time, f func(urlStr string, doc PageDoc) error) (err error) {
+	return forEachPageRow(ctx, db, since, false, func(row pageRow) error {
+		urlStr, doc, ok := row.toDoc()
+		if !ok {
+			return nil
+		}
+
+		return f(urlStr, doc)
+	})
+}
+
+// a page as read from the database, before being turned into a document.
+type pageRow struct {
+	url       string
+	doc       PageDoc
+	links     pq.StringArray
+	codeLangs pq.StringArray
+	lang      sql.NullString
+	kind      sql.NullString
+}
+
+// call the given function for each row of indexable pages in the database,
+// with contents added or changed after the given time (or all, for a zero
+// time). if rawText is set, the original text of text pages is also read.
+func forEachPageRow(ctx context.Context, db *sql.DB, since time.Time, rawText bool, f func(row pageRow) error) (err error) {
+	rawCol := "null::bytea"
+	if rawText {
+		rawCol = "c.content"
+	}
 
 	q := `
 with x as
     (select dst_url_id uid, array_agg(text) links
      from links
      group by dst_url_id)
-select u.url, c.title, c.content_text, length(c.content), c.content_type, c.lang, c.kind, x.links, u.rank, h.rank
+select u.url, c.title, coalesce(c.summary, ''), c.content_text, coalesce(c.headings, ''), c.code_langs, length(c.content), c.content_type, c.lang, c.kind, x.links, u.rank, h.rank,
+       (select count(*) from links l where l.src_url_id = u.id), ` + rawCol + `
 from x
 join urls u on u.id = uid
 join contents c on c.id = u.content_id
 join hosts h on h.hostname = u.hostname
-where u.rank is not null and h.rank is not null
+where u.rank is not null and h.rank is not null and u.input_prompt is null and not h.search_hidden
 `
+	var args []any
+	if !since.IsZero() {
+		// a url can also switch to contents that were already in the
+		// database (like when it's changed back to an older version), so the
+		// time the url's contents changed is checked too.
+		q += "and (c.insert_time > $1 or u.content_time > $1)\n"
+		args = append(args, since)
+	}
 
-	rows, err := db.Query(q)
+	rows, err := db.QueryContext(ctx, q, args...)
 	if err != nil {
 		return
 	}
 	defer rows.Close()
 
-	n := 1
-	batch := index.NewBatch()
 loop:
 	for rows.Next() {
-		var doc PageDoc
-		var links pq.StringArray
-		var urlStr string
-		var lang sql.NullString
-		var kind sql.NullString
-		err = rows.Scan(&urlStr, &doc.Title, &doc.Content, &doc.ContentSize, &doc.ContentType, &lang, &kind, &links, &doc.PageRank, &doc.HostRank)
+		var row pageRow
+		var raw []byte
+		doc := &row.doc
+		err = rows.Scan(&row.url, &doc.Title, &doc.Summary, &doc.Content, &doc.Headings, &row.codeLangs, &doc.ContentSize, &doc.ContentType, &row.lang, &row.kind, &row.links, &doc.PageRank, &doc.HostRank, &doc.OutboundLinks, &raw)
 		if err != nil {
 			return
 		}
 
-		// in case there are pages we've fetched before adding blacklist rules
-		var urlParsed *url.URL
-		urlParsed, err = url.Parse(urlStr)
-		if err != nil {
-			log.Printf("WARNING: URL stored in db cannot be parsed: url=%s error=%s\n", urlStr, err)
-		} else if gcrawler.IsBlacklisted(gcrawler.PreparedUrl{Parsed: urlParsed, NonParsed: urlStr}) {
-			continue
+		// there's no point in storing the raw contents of binary documents
+		// (like pdf files), since only their extracted text is of any use.
+		if raw != nil && strings.HasPrefix(doc.ContentType, "text/") {
+			doc.RawText = strings.ToValidUTF8(string(raw), "")
 		}
 
-		doc.Lang = ""
-		if lang.Valid {
-			doc.Lang = lang.String
+		err = f(row)
+		if err != nil {
+			return
 		}
 
-		doc.Kind = ""
-		if kind.Valid {
-			doc.Kind = kind.String
+		select {
+		case <-ctx.Done():
+			break loop
+		default:
 		}
+	}
+
+	if ctx.Err() == nil {
+		err = rows.Err()
+	}
 
-		doc.Links = strings.Join(links, "\n")
+	return
+}
 
-		doc.Title = strings.ToValidUTF8(doc.Title, "")
+// turn a page row into a document to be indexed. ok is false if the page
+// should not be indexed.
+func (row pageRow) toDoc() (urlStr string, doc PageDoc, ok bool) {
+	urlStr = row.url
+	doc = row.doc
 
-		batch.Index(urlStr, doc)
-		if batch.Size() >= cfg.Index.BatchSize {
-			err = index.Batch(batch)
-			if err != nil {
-				return
+	// in case there are pages we've fetched before adding blacklist rules
+	urlParsed, err := url.Parse(urlStr)
+	if err != nil {
+		log.Printf("WARNING: URL stored in db cannot be parsed: url=%s error=%s\n", urlStr, err)
+	} else if gcrawler.IsBlacklisted(gcrawler.PreparedUrl{Parsed: urlParsed, NonParsed: urlStr}) {
+		return
+	}
+
+	doc.Lang = ""
+	if row.lang.Valid {
+		doc.Lang = row.lang.String
+	}
+
+	doc.Kind = ""
+	if row.kind.Valid {
+		doc.Kind = row.kind.String
+	}
+
+	doc.Links = strings.Join(row.links, "\n")
+	doc.CodeLangs = row.codeLangs
+
+	doc.Title = strings.ToValidUTF8(doc.Title, "")
+	doc.Summary = strings.ToValidUTF8(doc.Summary, "")
+
+	ok = true
+	return
+}
+
+// IndexPages indexes all pages in the database, and returns the number of
+// pages indexed.
+func IndexPages(ctx context.Context, index bleve.Index, cfg *config.Config) (count uint64, err error) {
+	log.Println("Indexing pages...")
+	return indexPages(ctx, index, cfg, time.Time{})
+}
+
+// IndexPagesSince adds (or updates) the pages whose contents were added to the
+// database, or changed, after the given time to an existing index. This is much
+// cheaper than rebuilding the index, but rank changes and removed pages are
+// only picked up by a full rebuild.
+func IndexPagesSince(ctx context.Context, index bleve.Index, cfg *config.Config, since time.Time) (count uint64, err error) {
+	log.Println("Indexing pages added since:", since.Format(time.RFC3339))
+	return indexPages(ctx, index, cfg, since)
+}
+
+func indexPages(ctx context.Context, index bleve.Index, cfg *config.Config, since time.Time) (count uint64, err error) {
+	db, err := sql.Open("postgres", cfg.GetDbConnStr())
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	produce := func(ctx context.Context, f func(row pageRow) error) error {
+		return forEachPageRow(ctx, db, since, cfg.Index.StoreRawText, f)
+	}
+
+	// boilerplate is detected across all pages of a host, so it's only done
+	// on full rebuilds.
+	if cfg.Index.StripBoilerplate && since.IsZero() {
+		produce = withoutBoilerplate(produce)
+	}
+
+	count, err = indexPageRows(ctx, index, cfg.Index.BatchSize, runtime.GOMAXPROCS(0), produce)
+	if err != nil {
+		return
+	}
+
+	log.Printf("Finished indexing: %d pages indexed.\n", count)
+	return
+}
+
+// index the page rows passed by the given producer function to its callback.
+// rows are read sequentially, but turned into documents and indexed by the
+// given number of workers in parallel, each with its own batch of (up to)
+// batchSize documents. returns the number of pages indexed.
+func indexPageRows(ctx context.Context, index bleve.Index, batchSize int, workers int, produce func(ctx context.Context, f func(row pageRow) error) error) (count uint64, err error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	rows := make(chan pageRow, workers)
+	var indexed atomic.Uint64
+	var wg sync.WaitGroup
+	workerErrs := make([]error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			workerErrs[i] = indexPageWorker(index, batchSize, rows, &indexed)
+			if workerErrs[i] != nil {
+				// stop reading more rows
+				cancel()
 			}
-			batch.Reset()
-			log.Printf("Indexing progress: %d pages indexed so far.\n", n)
-		}
+		}(i)
+	}
 
+	err = produce(ctx, func(row pageRow) error {
 		select {
+		case rows <- row:
+			return nil
 		case <-ctx.Done():
-			break loop
-		default:
+			return ctx.Err()
 		}
+	})
+	close(rows)
+	wg.Wait()
 
-		n++
+	// an error from a worker is what caused the producer to stop (if it did)
+	if workerErr := errors.Join(workerErrs...); workerErr != nil {
+		err = workerErr
 	}
 
-	if batch.Size() > 0 {
-		err = index.Batch(batch)
+	count = indexed.Load()
+	return
+}
+
+func indexPageWorker(index bleve.Index, batchSize int, rows <-chan pageRow, indexed *atomic.Uint64) (err error) {
+	batch := newShardedBatch(index)
+	commit := func() error {
+		n := batch.Size()
+		err := batch.Commit()
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Indexing progress: %d pages indexed so far.\n", indexed.Add(uint64(n)))
+		return nil
+	}
+
+	for row := range rows {
+		urlStr, doc, ok := row.toDoc()
+		if !ok {
+			continue
+		}
+
+		err = batch.Index(urlStr, doc)
 		if err != nil {
 			return
 		}
+
+		if batch.Size() >= batchSize {
+			err = commit()
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	if batch.Size() > 0 {
+		err = commit()
 	}
 
-	log.Printf("Finished indexing: %d pages indexed.\n", n)
 	return
 }
 
-func IndexImages(ctx context.Context, index bleve.Index, cfg *config.Config) (err error) {
+// IndexImages indexes all images in the database, and returns the number of
+// database rows read.
+func IndexImages(ctx context.Context, index bleve.Index, cfg *config.Config) (count uint64, err error) {
 	log.Println("Indexing images...")
 
 	db, err := sql.Open("postgres", cfg.GetDbConnStr())
@@ -382,32 +930,55 @@ func IndexImages(ctx context.Context, index bleve.Index, cfg *config.Config) (er
 	}
 	defer db.Close()
 
-	q := `select url, image_hash, alt, image, fetch_time from images where alt != ''`
-	rows, err := db.Query(q)
+	produce := func(ctx context.Context, f func(row imageRow) error) error {
+		return forEachImageRow(ctx, db, cfg.Index.IndexImagesWithoutAlt, f)
+	}
+	count, err = indexImageRows(ctx, index, cfg.Index.ImageBatchSize, cfg.Index.ImageBatchMaxBytes, produce)
+	if err != nil {
+		return
+	}
+
+	log.Printf("Finished indexing: %d images indexed.\n", count)
+	return
+}
+
+// an image as read from the database
+type imageRow struct {
+	hash string
+	doc  ImageDoc
+}
+
+// call the given function for each row of indexable images in the database.
+// images without alt text are only included if withoutAlt is set.
+func forEachImageRow(ctx context.Context, db *sql.DB, withoutAlt bool, f func(row imageRow) error) (err error) {
+	q := `
+select i.url, i.image_hash, i.alt, i.image, i.fetch_time, coalesce(c.title, '')
+from images i
+left join contents c on c.hash = i.content_hash
+where i.alt != '' or $1`
+	rows, err := db.QueryContext(ctx, q, withoutAlt)
 	if err != nil {
 		return
 	}
 	defer rows.Close()
 
-	n := 1
-	batch := index.NewBatch()
 loop:
 	for rows.Next() {
-		var doc ImageDoc
-		var imageHash string
-		err = rows.Scan(&doc.SourceUrl, &imageHash, &doc.AltText, &doc.Image, &doc.FetchTime)
+		var row imageRow
+		var pageTitle string
+		doc := &row.doc
+		err = rows.Scan(&doc.SourceUrl, &row.hash, &doc.AltText, &doc.Image, &doc.FetchTime, &pageTitle)
 		if err != nil {
 			return
 		}
 
-		batch.Index(imageHash, doc)
-		if batch.Size() >= cfg.Index.BatchSize {
-			err = index.Batch(batch)
-			if err != nil {
-				return
-			}
-			batch.Reset()
-			log.Printf("Indexing progress: %d pages indexed so far.\n", n)
+		if doc.AltText == "" {
+			doc.SurrogateText = strings.ToValidUTF8(pageTitle, "")
+		}
+
+		err = f(row)
+		if err != nil {
+			return
 		}
 
 		select {
@@ -415,63 +986,370 @@ loop:
 			break loop
 		default:
 		}
+	}
 
-		n++
+	if ctx.Err() == nil {
+		err = rows.Err()
 	}
 
-	if batch.Size() > 0 {
-		err = index.Batch(batch)
+	return
+}
+
+// index the image rows passed by the given producer function to its callback.
+// images are much larger than pages, so the batch is committed when it reaches
+// either batchSize images, or maxBytes bytes of image data (if non-zero),
+// whichever comes first. returns the number of images indexed.
+func indexImageRows(ctx context.Context, index bleve.Index, batchSize int, maxBytes int, produce func(ctx context.Context, f func(row imageRow) error) error) (count uint64, err error) {
+	batch := newShardedBatch(index)
+	batchBytes := 0
+	err = produce(ctx, func(row imageRow) error {
+		err := batch.Index(row.hash, row.doc)
 		if err != nil {
-			return
+			return err
+		}
+		batchBytes += len(row.doc.Image)
+		count++
+
+		if batch.Size() >= batchSize || (maxBytes > 0 && batchBytes >= maxBytes) {
+			err = batch.Commit()
+			if err != nil {
+				return err
+			}
+			batchBytes = 0
+			log.Printf("Indexing progress: %d images indexed so far.\n", count)
 		}
+
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	if batch.Size() > 0 {
+		err = batch.Commit()
 	}
 
-	log.Printf("Finished indexing: %d images indexed.\n", n)
 	return
 }
 
-func SearchPages(req PageSearchRequest, idx bleve.Index) (resp PageSearchResponse, err error) {
-	// sanity check, in case someone sends a zero-based page index
-	if req.Page < 1 {
-		err = fmt.Errorf("Invalid page number (needs to be greater than or equal to 1)")
-		return
-	}
+// extract a "kind:<kind>" token from the query (if any), and return the kind
+// along with the rest of the query.
+func parseKindFilter(query string) (rest string, kind string) {
+	return parseFilter(query, "kind:")
+}
 
-	shouldContent := bleve.NewMatchQuery(req.Query)
-	shouldContent.SetField("Content")
+// extract a "type:<content-type>" token from the query (if any), and return the
+// content type along with the rest of the query.
+func parseTypeFilter(query string) (rest string, contentType string) {
+	return parseFilter(query, "type:")
+}
 
-	shouldTitle := bleve.NewMatchQuery(req.Query)
-	shouldTitle.SetField("Title")
-	shouldTitle.SetBoost(2.0)
+// extract a "code:<language>" token from the query (if any), and return the
+// programming language along with the rest of the query.
+func parseCodeFilter(query string) (rest string, codeLang string) {
+	return parseFilter(query, "code:")
+}
+
+// extract a filter token with the given prefix (like "kind:") from the query,
+// and return its (lower-cased) value along with the rest of the query.
+func parseFilter(query string, prefix string) (rest string, value string) {
+	words := strings.Fields(query)
+	restWords := make([]string, 0, len(words))
+	for _, word := range words {
+		if strings.HasPrefix(strings.ToLower(word), prefix) && len(word) > len(prefix) {
+			value = strings.ToLower(word[len(prefix):])
+			continue
+		}
+		restWords = append(restWords, word)
+	}
+
+	rest = strings.Join(restWords, " ")
+	return
+}
 
-	mustNotEmail := bleve.NewTermQuery("email")
-	mustNotEmail.SetField("Kind")
+func buildPageQuery(queryStr string) *query.BooleanQuery {
+	queryStr, kind := parseKindFilter(queryStr)
+	queryStr, contentType := parseTypeFilter(queryStr)
+	queryStr, codeLang := parseCodeFilter(queryStr)
 
-	mustNotRfc := bleve.NewTermQuery("rfc")
-	mustNotRfc.SetField("Kind")
+	shouldContent := bleve.NewMatchQuery(queryStr)
+	shouldContent.SetField("Content")
 
-	mustNotIrc := bleve.NewTermQuery("irc")
-	mustNotIrc.SetField("Kind")
+	shouldTitle := bleve.NewMatchQuery(queryStr)
+	shouldTitle.SetField("Title")
+	shouldTitle.SetBoost(titleBoost)
 
 	q := bleve.NewBooleanQuery()
 	q.AddShould(shouldContent)
 	q.AddShould(shouldTitle)
-	q.AddMustNot(mustNotEmail)
-	q.AddMustNot(mustNotRfc)
-	q.AddMustNot(mustNotIrc)
+
+	if linksBoost > 0 {
+		shouldLinks := bleve.NewMatchQuery(queryStr)
+		shouldLinks.SetField("Links")
+		shouldLinks.SetBoost(linksBoost)
+		q.AddShould(shouldLinks)
+	}
+
+	if headingsBoost > 0 {
+		shouldHeadings := bleve.NewMatchQuery(queryStr)
+		shouldHeadings.SetField("Headings")
+		shouldHeadings.SetBoost(headingsBoost)
+		q.AddShould(shouldHeadings)
+	}
+
+	for _, synonym := range querySynonyms(queryStr) {
+		shouldContent := bleve.NewMatchPhraseQuery(synonym)
+		shouldContent.SetField("Content")
+		shouldContent.SetBoost(synonymBoost)
+		q.AddShould(shouldContent)
+
+		shouldTitle := bleve.NewMatchPhraseQuery(synonym)
+		shouldTitle.SetField("Title")
+		shouldTitle.SetBoost(synonymBoost * titleBoost)
+		q.AddShould(shouldTitle)
+	}
+
+	if contentType != "" {
+		mustType := bleve.NewTermQuery(contentType)
+		mustType.SetField("ContentType")
+		q.AddMust(mustType)
+
+		// when there's a must clause, should clauses become optional, but we
+		// still want the query terms to match.
+		q.SetMinShould(1)
+	}
+
+	if codeLang != "" {
+		mustCode := bleve.NewTermQuery(codeLang)
+		mustCode.SetField("CodeLangs")
+		q.AddMust(mustCode)
+		q.SetMinShould(1)
+	}
+
+	if kind != "" {
+		// the user explicitly asked for this kind of document, so we won't
+		// exclude anything by default.
+		mustKind := bleve.NewTermQuery(kind)
+		mustKind.SetField("Kind")
+		q.AddMust(mustKind)
+		q.SetMinShould(1)
+	} else {
+		for _, excluded := range DefaultExcludedKinds {
+			mustNotKind := bleve.NewTermQuery(excluded)
+			mustNotKind.SetField("Kind")
+			q.AddMustNot(mustNotKind)
+		}
+	}
+
+	// an explicit "lang:" token means the user already knows what language
+	// they're after, so we won't guess.
+	_, explicitLang := parseFilter(queryStr, "lang:")
+	if langBoost > 0 && explicitLang == "" {
+		if lang := detectQueryLang(queryStr); lang != "" {
+			shouldLang := bleve.NewTermQuery(lang)
+			shouldLang.SetField("Lang")
+			shouldLang.SetBoost(langBoost)
+
+			// the language only affects the ranking of the pages matching the
+			// rest of the query.
+			outer := bleve.NewBooleanQuery()
+			outer.AddMust(q)
+			outer.AddShould(shouldLang)
+			q = outer
+		}
+	}
+
+	return q
+}
+
+// split a query (or a synonym) into lower-cased words, ignoring punctuation, so
+// that they can be compared.
+func synonymWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// return true if the given words contain the given term (a sequence of words).
+func containsTerm(words []string, term []string) bool {
+	for i := 0; i+len(term) <= len(words); i++ {
+		if slices.Equal(words[i:i+len(term)], term) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// return the synonyms (as phrases) of the terms in the given query, excluding
+// the ones already in the query.
+func querySynonyms(queryStr string) (synonyms []string) {
+	words := synonymWords(queryStr)
+	seen := map[string]bool{}
+	for _, group := range synonymGroups {
+		matched := false
+		for _, term := range group {
+			if containsTerm(words, term) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		for _, term := range group {
+			phrase := strings.Join(term, " ")
+			if !containsTerm(words, term) && !seen[phrase] {
+				seen[phrase] = true
+				synonyms = append(synonyms, phrase)
+			}
+		}
+	}
+
+	return
+}
+
+// return true if the given query word looks like a filter (like "site:foo" or
+// "lang:en"), whether or not it is one we support.
+func isFilterToken(word string) bool {
+	i := strings.IndexByte(word, ':')
+	if i <= 0 {
+		return false
+	}
+
+	for _, r := range word[:i] {
+		if !unicode.IsLetter(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// return the language of the given query (in the same format as the Lang field
+// of pages), or an empty string if it cannot be reliably detected. filter
+// tokens are not natural language, so they are left out of the detection.
+func detectQueryLang(queryStr string) string {
+	words := strings.Fields(queryStr)
+	textWords := make([]string, 0, len(words))
+	for _, word := range words {
+		if !isFilterToken(word) {
+			textWords = append(textWords, word)
+		}
+	}
+
+	info := whatlanggo.Detect(strings.Join(textWords, " "))
+	if !info.IsReliable() {
+		return ""
+	}
+
+	return info.Lang.Iso6391()
+}
+
+// returned by the handlers made by cappedMatchHandler to stop collecting
+var errResultCapReached = errors.New("result cap reached")
+
+// return a document match handler maker (to be passed in the search context,
+// under search.MakeDocumentMatchHandlerKey) which stops collecting matches after
+// the first n+1, so that the total number of results is at most n+1 (for each
+// shard), which is enough to tell it's over n. bleve stops going through the
+// matches as soon as the handler returns an error, and still finalizes the ones
+// collected so far.
+func cappedMatchHandler(n uint64) search.MakeDocumentMatchHandler {
+	return func(ctx *search.SearchContext) (search.DocumentMatchHandler, bool, error) {
+		handler, loadID, err := collector.MakeTopNDocumentMatchHandler(ctx)
+		if err != nil {
+			return nil, false, err
+		}
+
+		var seen uint64
+		return func(d *search.DocumentMatch) error {
+			if d == nil {
+				return handler(nil)
+			}
+
+			err := handler(d)
+			if err != nil {
+				return err
+			}
+
+			seen++
+			if seen > n {
+				return errResultCapReached
+			}
+
+			return nil
+		}, loadID, nil
+	}
+}
+
+// run the given search request, reporting a missing or empty index (alias) as
+// ErrIndexNotReady.
+func searchIndex(idx bleve.Index, s *bleve.SearchRequest) (results *bleve.SearchResult, err error) {
+	return searchIndexContext(context.Background(), idx, s)
+}
+
+// like searchIndex, but with a context.
+func searchIndexContext(ctx context.Context, idx bleve.Index, s *bleve.SearchRequest) (results *bleve.SearchResult, err error) {
+	if idx == nil {
+		err = ErrIndexNotReady
+		return
+	}
+
+	results, err = idx.SearchInContext(ctx, s)
+	if err == bleve.ErrorAliasEmpty {
+		err = ErrIndexNotReady
+	}
+	return
+}
+
+// PageRawText returns the original (pre-cleanup) text of the given page as
+// stored in the index. The text is empty if the page is not in the index, or
+// the index was built without Index.StoreRawText.
+func PageRawText(idx bleve.Index, urlStr string) (text string, err error) {
+	s := bleve.NewSearchRequest(bleve.NewDocIDQuery([]string{urlStr}))
+	s.Fields = []string{"RawText"}
+
+	results, err := searchIndex(idx, s)
+	if err != nil || len(results.Hits) == 0 {
+		return
+	}
+
+	text, _ = results.Hits[0].Fields["RawText"].(string)
+	return
+}
+
+func SearchPages(req PageSearchRequest, idx bleve.Index) (resp PageSearchResponse, err error) {
+	// sanity check, in case someone sends a zero-based page index
+	if req.Page < 1 {
+		err = fmt.Errorf("Invalid page number (needs to be greater than or equal to 1)")
+		return
+	}
+
+	q := buildPageQuery(req.Query)
 
 	highlightStyle := req.HighlightStyle
+	var marks *strings.Replacer
 	if highlightStyle == "" {
-		highlightStyle = "gem"
+		highlightStyle, marks, err = gemHighlightStyle(req.HighlightBefore, req.HighlightAfter)
+		if err != nil {
+			return
+		}
 	}
 
 	s := bleve.NewSearchRequest(q)
 	s.Highlight = bleve.NewHighlightWithStyle(highlightStyle)
-	s.Fields = []string{"Title", "Content", "PageRank", "HostRank", "ContentType", "ContentSize"}
+	s.Highlight.AddField("Title")
+	s.Highlight.AddField("Content")
+	s.Fields = []string{"Title", "Content", "PageRank", "HostRank", "ContentType", "ContentSize", "Lang", "Kind", "Summary"}
 
 	langFacet := bleve.NewFacetRequest("Lang", 3)
 	s.AddFacet("lang", langFacet)
 
+	contentTypeFacet := bleve.NewFacetRequest("ContentType", maxContentTypeFacets)
+	s.AddFacet("content_type", contentTypeFacet)
+
 	rs := &RankedSort{
 		desc:          true,
 		pageRankBytes: make([]byte, 0),
@@ -482,33 +1360,183 @@ func SearchPages(req PageSearchRequest, idx bleve.Index) (resp PageSearchRespons
 
 	s.Size = PageSize
 	s.From = (req.Page - 1) * s.Size
+	from := s.From
 
-	results, err := idx.Search(s)
-	if err != nil {
-		return
+	ctx := context.Background()
+	if maxReportedResults > 0 {
+		if uint64(s.From) >= maxReportedResults {
+			err = ErrPageBeyondLimit
+			return
+		}
+
+		// the last page might only be partially covered by the cap
+		if uint64(s.From+s.Size) > maxReportedResults {
+			s.Size = int(maxReportedResults) - s.From
+		}
+
+		ctx = context.WithValue(ctx, search.MakeDocumentMatchHandlerKey, cappedMatchHandler(maxReportedResults))
+	}
+
+	if req.Collapse {
+		// collapsing is done over a window of results starting from the
+		// first one, so that every page is collapsed the same way and no
+		// result shows up on more than one page. the requested page is then
+		// sliced out of the collapsed results.
+		s.From = 0
+		s.Size = req.Page * PageSize * collapseWindowFactor
+	}
+
+	var results *bleve.SearchResult
+	var pageResults []PageSearchResult
+	for {
+		results, err = searchIndexContext(ctx, idx, s)
+		if err != nil {
+			return
+		}
+
+		pageResults = nil
+		for _, r := range results.Hits {
+			pageResults = append(pageResults, pageSearchResult(r, marks))
+		}
+
+		if !req.Collapse {
+			break
+		}
+
+		// if there's not enough left after collapsing to fill the requested
+		// page, try again with a larger window, unless we already have all
+		// the results.
+		collapsed := collapseResults(pageResults, 0)
+		if len(collapsed) >= req.Page*PageSize || uint64(len(results.Hits)) >= results.Total {
+			// the results collapsed into others are not counted. the total
+			// is exact if the window covers all results, and an estimate
+			// otherwise.
+			results.Total -= uint64(len(pageResults) - len(collapsed))
+			pageResults = pagedResults(collapsed, req.Page)
+			if maxReportedResults > 0 && uint64(from+len(pageResults)) > maxReportedResults {
+				pageResults = pageResults[:int(maxReportedResults)-from]
+			}
+			break
+		}
+
+		s.Size *= 2
 	}
 
 	resp.TotalResults = results.Total
+	if maxReportedResults > 0 && resp.TotalResults > maxReportedResults {
+		resp.TotalResults = maxReportedResults
+		resp.TotalCapped = true
+	}
 	resp.Duration = results.Took
 
-	for _, r := range results.Hits {
-		snippet := strings.Join(r.Fragments["Content"], "…")
-
-		// this make sure snippets don't expand on many lines, and also
-		// cruicially, formatted lines are not rendered in clients that do that.
-		snippet = " " + strings.Replace(snippet, "\n", " ", -1)
-
-		result := PageSearchResult{
-			Url:         r.ID,
-			Title:       r.Fields["Title"].(string),
-			Snippet:     snippet,
-			UrlRank:     r.Fields["PageRank"].(float64),
-			HostRank:    r.Fields["HostRank"].(float64),
-			Relevance:   r.Score,
-			ContentType: r.Fields["ContentType"].(string),
-			ContentSize: uint64(r.Fields["ContentSize"].(float64)),
+	if facet, ok := results.Facets["content_type"]; ok && facet.Terms != nil {
+		for _, term := range facet.Terms.Terms() {
+			resp.ContentTypes = append(resp.ContentTypes, FacetCount{
+				Term:  term.Term,
+				Count: term.Count,
+			})
 		}
-		resp.Results = append(resp.Results, result)
+	}
+
+	resp.Results = pageResults
+	return
+}
+
+// convert a search hit to a page search result. if marks is not nil, it is
+// used to replace the highlight marks (see gemHighlightStyle).
+func pageSearchResult(r *search.DocumentMatch, marks *strings.Replacer) PageSearchResult {
+	snippet := strings.Join(r.Fragments["Content"], "…")
+
+	// this make sure snippets don't expand on many lines, and also
+	// cruicially, formatted lines are not rendered in clients that do that.
+	snippet = " " + strings.Replace(snippet, "\n", " ", -1)
+
+	title := r.Fields["Title"].(string)
+	hlTitle := highlightedTitle(title, r.Fragments["Title"])
+	if marks != nil {
+		snippet = marks.Replace(snippet)
+		hlTitle = marks.Replace(hlTitle)
+	}
+
+	result := PageSearchResult{
+		Url:              r.ID,
+		Title:            title,
+		HighlightedTitle: hlTitle,
+		Snippet:          snippet,
+		UrlRank:          r.Fields["PageRank"].(float64),
+		HostRank:         r.Fields["HostRank"].(float64),
+		Relevance:        r.Score,
+		ContentType:      r.Fields["ContentType"].(string),
+		ContentSize:      uint64(r.Fields["ContentSize"].(float64)),
+	}
+
+	// older indices, or documents with no detected language, might not have
+	// this field.
+	if lang, ok := r.Fields["Lang"].(string); ok {
+		result.Lang = lang
+	}
+	if kind, ok := r.Fields["Kind"].(string); ok {
+		result.Kind = kind
+	}
+	if summary, ok := r.Fields["Summary"].(string); ok {
+		result.Summary = summary
+	}
+
+	return result
+}
+
+// return the given (1-based) page of the results.
+func pagedResults(results []PageSearchResult, page int) []PageSearchResult {
+	start := (page - 1) * PageSize
+	if start > len(results) {
+		start = len(results)
+	}
+	end := start + PageSize
+	if end > len(results) {
+		end = len(results)
+	}
+
+	return results[start:end]
+}
+
+// return the title highlighted using the given fragments, or the plain title if
+// it wasn't matched, or is too long to fit in a single fragment.
+func highlightedTitle(title string, fragments []string) string {
+	if len(fragments) != 1 || utf8.RuneCountInString(title) > snippetSize {
+		return title
+	}
+
+	return strings.Replace(fragments[0], "\n", " ", -1)
+}
+
+// collapse results with the same hostname and title into the first (highest
+// ranking) one, and return up to n results (or all of them if n is not
+// positive).
+func collapseResults(results []PageSearchResult, n int) (collapsed []PageSearchResult) {
+	type key struct {
+		host  string
+		title string
+	}
+
+	seen := map[key]int{}
+	for _, r := range results {
+		host := ""
+		if u, err := url.Parse(r.Url); err == nil {
+			host = u.Host
+		}
+
+		k := key{host: host, title: strings.TrimSpace(r.Title)}
+		if i, ok := seen[k]; ok {
+			collapsed[i].Collapsed++
+			continue
+		}
+
+		if n > 0 && len(collapsed) == n {
+			continue
+		}
+
+		seen[k] = len(collapsed)
+		collapsed = append(collapsed, r)
 	}
 
 	return
@@ -521,8 +1549,15 @@ func SearchImages(req ImageSearchRequest, idx bleve.Index) (resp ImageSearchResp
 		return
 	}
 
-	q := bleve.NewMatchQuery(req.Query)
-	q.SetField("AltText")
+	altQuery := bleve.NewMatchQuery(req.Query)
+	altQuery.SetField("AltText")
+
+	// only set for images without alt text (if at all)
+	surrogateQuery := bleve.NewMatchQuery(req.Query)
+	surrogateQuery.SetField("SurrogateText")
+	surrogateQuery.SetBoost(0.5)
+
+	q := bleve.NewDisjunctionQuery(altQuery, surrogateQuery)
 
 	highlightStyle := req.HighlightStyle
 	if highlightStyle == "" {
@@ -536,7 +1571,7 @@ func SearchImages(req ImageSearchRequest, idx bleve.Index) (resp ImageSearchResp
 	s.Size = PageSize
 	s.From = (req.Page - 1) * s.Size
 
-	results, err := idx.Search(s)
+	results, err := searchIndex(idx, s)
 	if err != nil {
 		return
 	}
@@ -551,12 +1586,15 @@ func SearchImages(req ImageSearchRequest, idx bleve.Index) (resp ImageSearchResp
 			log.Println("WARNING: Could not parse datetime value stored in index.")
 		}
 
+		// images without alt text do not have this field
+		altText, _ := r.Fields["AltText"].(string)
+
 		result := ImageSearchResult{
 			ImageHash: r.ID,
 			SourceUrl: r.Fields["SourceUrl"].(string),
 			Image:     r.Fields["Image"].(string),
 			FetchTime: fetchTime,
-			AltText:   r.Fields["AltText"].(string),
+			AltText:   altText,
 			Relevance: r.Score,
 		}
 		resp.Results = append(resp.Results, result)
@@ -566,3 +1604,94 @@ func SearchImages(req ImageSearchRequest, idx bleve.Index) (resp ImageSearchResp
 }
 
 var _ search.SearchSort = (*RankedSort)(nil)
+
+// SuggestTerms returns up to n terms from the Title and Content fields of the
+// index starting with the given prefix, most frequent first.
+func SuggestTerms(prefix string, idx bleve.Index, n int) (terms []string, err error) {
+	prefix = strings.ToLower(strings.TrimSpace(prefix))
+	if prefix == "" {
+		return
+	}
+
+	if n <= 0 || n > MaxSuggestions {
+		n = MaxSuggestions
+	}
+
+	if idx == nil {
+		err = ErrIndexNotReady
+		return
+	}
+
+	counts := map[string]uint64{}
+	for _, field := range []string{"Title", "Content"} {
+		var dict index.FieldDict
+		dict, err = idx.FieldDictPrefix(field, []byte(prefix))
+		if err == bleve.ErrorAliasEmpty {
+			err = ErrIndexNotReady
+			return
+		} else if err != nil {
+			return
+		}
+
+		var entry *index.DictEntry
+		for i := 0; i < maxSuggestScanLength; i++ {
+			entry, err = dict.Next()
+			if err != nil || entry == nil {
+				break
+			}
+
+			counts[entry.Term] += entry.Count
+		}
+
+		dict.Close()
+		if err != nil {
+			return
+		}
+	}
+
+	for term := range counts {
+		terms = append(terms, term)
+	}
+
+	sort.Slice(terms, func(i, j int) bool {
+		if counts[terms[i]] != counts[terms[j]] {
+			return counts[terms[i]] > counts[terms[j]]
+		}
+		return terms[i] < terms[j]
+	})
+
+	if len(terms) > n {
+		terms = terms[:n]
+	}
+
+	return
+}
+
+// Suggest returns completions for a partial query, by completing its last word
+// using SuggestTerms.
+func Suggest(req SuggestRequest, idx bleve.Index) (resp SuggestResponse, err error) {
+	resp.Query = req.Query
+	resp.Suggestions = []string{}
+
+	words := strings.Fields(req.Query)
+	if len(words) == 0 {
+		return
+	}
+
+	last := words[len(words)-1]
+	head := strings.Join(words[:len(words)-1], " ")
+	if head != "" {
+		head += " "
+	}
+
+	terms, err := SuggestTerms(last, idx, req.Count)
+	if err != nil {
+		return
+	}
+
+	for _, term := range terms {
+		resp.Suggestions = append(resp.Suggestions, head+term)
+	}
+
+	return
+}
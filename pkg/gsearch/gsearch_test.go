@@ -0,0 +1,1455 @@
+package gsearch
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search"
+	"github.com/blevesearch/bleve/v2/search/query"
+
+	"git.sr.ht/~elektito/gemplex/pkg/gcrawler"
+)
+
+func TestParseKindFilter(t *testing.T) {
+	rest, kind := parseKindFilter("kind:RFC  tcp congestion")
+	if kind != "rfc" {
+		t.Fatalf("Expected kind 'rfc'; got %q", kind)
+	}
+	if rest != "tcp congestion" {
+		t.Fatalf("Expected rest of the query to be 'tcp congestion'; got %q", rest)
+	}
+
+	rest, kind = parseKindFilter("foo kind: bar")
+	if kind != "" || rest != "foo kind: bar" {
+		t.Fatalf("Expected an empty kind filter to be ignored; got kind=%q rest=%q", kind, rest)
+	}
+}
+
+func TestBuildPageQueryKindFilter(t *testing.T) {
+	q := buildPageQuery("kind:rfc foo")
+
+	if q.MustNot != nil {
+		t.Fatal("Expected no must-not clauses when a kind filter is used")
+	}
+
+	must, ok := q.Must.(*query.ConjunctionQuery)
+	if !ok || len(must.Conjuncts) != 1 {
+		t.Fatalf("Expected a single must clause; got %#v", q.Must)
+	}
+
+	term, ok := must.Conjuncts[0].(*query.TermQuery)
+	if !ok {
+		t.Fatalf("Expected a term query; got %#v", must.Conjuncts[0])
+	}
+
+	if term.Term != "rfc" || term.Field() != "Kind" {
+		t.Fatalf("Expected term query for rfc on Kind; got term=%q field=%q", term.Term, term.Field())
+	}
+
+	should := q.Should.(*query.DisjunctionQuery)
+	if should.Min != 1 {
+		t.Fatalf("Expected the query terms to be required; got min=%f", should.Min)
+	}
+
+	for _, d := range should.Disjuncts {
+		mq := d.(*query.MatchQuery)
+		if mq.Match != "foo" {
+			t.Fatalf("Expected the kind filter to be removed from the query; got %q", mq.Match)
+		}
+	}
+}
+
+func TestBuildPageQueryDefaultExclusions(t *testing.T) {
+	q := buildPageQuery("foo")
+
+	if q.Must != nil {
+		t.Fatal("Expected no must clauses without a kind filter")
+	}
+
+	mustNot := q.MustNot.(*query.DisjunctionQuery)
+	if len(mustNot.Disjuncts) != len(DefaultExcludedKinds) {
+		t.Fatalf("Expected %d excluded kinds; got %d", len(DefaultExcludedKinds), len(mustNot.Disjuncts))
+	}
+}
+
+func TestCollapseResults(t *testing.T) {
+	results := []PageSearchResult{
+		{Url: "gemini://example.org/log/", Title: "My Log"},
+		{Url: "gemini://example.org/log/page/2", Title: "My Log"},
+		{Url: "gemini://example.net/", Title: "My Log"},
+		{Url: "gemini://example.org/log", Title: "My Log"},
+		{Url: "gemini://example.org/about", Title: "About"},
+		{Url: "gemini://example.com/", Title: "Other"},
+	}
+
+	collapsed := collapseResults(results, 3)
+	if len(collapsed) != 3 {
+		t.Fatalf("Expected 3 results; got %d", len(collapsed))
+	}
+
+	expected := []struct {
+		url       string
+		collapsed int
+	}{
+		{"gemini://example.org/log/", 2},
+		{"gemini://example.net/", 0},
+		{"gemini://example.org/about", 0},
+	}
+	for i, e := range expected {
+		if collapsed[i].Url != e.url || collapsed[i].Collapsed != e.collapsed {
+			t.Fatalf("Result %d: expected url=%s collapsed=%d; got url=%s collapsed=%d",
+				i, e.url, e.collapsed, collapsed[i].Url, collapsed[i].Collapsed)
+		}
+	}
+}
+
+func TestOutboundLinksIndexed(t *testing.T) {
+	idx, err := NewIndex(t.TempDir()+"/idx", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	err = idx.Index("gemini://example.org/", PageDoc{Title: "Hub", OutboundLinks: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Index("gemini://example.org/leaf", PageDoc{Title: "Leaf", OutboundLinks: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	min := 10.0
+	q := bleve.NewNumericRangeQuery(&min, nil)
+	q.SetField("OutboundLinks")
+	s := bleve.NewSearchRequest(q)
+	s.Fields = []string{"OutboundLinks"}
+	results, err := idx.Search(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results.Hits) != 1 || results.Hits[0].ID != "gemini://example.org/" {
+		t.Fatalf("Expected only the hub page to match; got %v", results.Hits)
+	}
+
+	if n, _ := results.Hits[0].Fields["OutboundLinks"].(float64); n != 42 {
+		t.Fatalf("Expected stored OutboundLinks to be 42; got %v", results.Hits[0].Fields["OutboundLinks"])
+	}
+}
+
+func TestLinksAndHeadingsNotStored(t *testing.T) {
+	idx, err := NewIndex(t.TempDir()+"/idx", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	err = idx.Index("gemini://example.org/", PageDoc{
+		Title:    "Home",
+		Content:  "Welcome to my capsule.",
+		Links:    "zymurgy notes",
+		Headings: "Quokka Sightings",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// neither field is part of the composite field...
+	for _, term := range []string{"zymurgy", "quokka"} {
+		results, err := idx.Search(bleve.NewSearchRequest(bleve.NewMatchQuery(term)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results.Total != 0 {
+			t.Fatalf("Expected %q not to be in the composite field; got %d hit(s)", term, results.Total)
+		}
+	}
+
+	// ...but they are still searchable explicitly, and not stored.
+	for field, term := range map[string]string{"Links": "zymurgy", "Headings": "quokka"} {
+		q := bleve.NewMatchQuery(term)
+		q.SetField(field)
+		s := bleve.NewSearchRequest(q)
+		s.Fields = []string{"*"}
+		results, err := idx.Search(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results.Hits) != 1 {
+			t.Fatalf("Expected %q to be found in %s; got %d hit(s)", term, field, len(results.Hits))
+		}
+		if _, ok := results.Hits[0].Fields[field]; ok {
+			t.Fatalf("Expected %s not to be stored; got fields: %v", field, results.Hits[0].Fields)
+		}
+	}
+}
+
+func TestIndexMeta(t *testing.T) {
+	indexPath := t.TempDir() + "/ping.idx"
+
+	_, err := ReadIndexMeta(indexPath)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected a not-exist error for a missing sidecar file; got %v", err)
+	}
+
+	meta := IndexMeta{
+		DocCount:    10,
+		SourceRows:  12,
+		BuildStart:  time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC),
+		BuildFinish: time.Date(2023, 1, 1, 11, 0, 0, 0, time.UTC),
+		Watermark:   time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC),
+	}
+	err = WriteIndexMeta(indexPath, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := ReadIndexMeta(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != meta {
+		t.Fatalf("Expected %+v; got %+v", meta, read)
+	}
+
+	err = RemoveIndexMeta(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RemoveIndexMeta(indexPath)
+	if err != nil {
+		t.Fatalf("Expected removing a missing sidecar file to succeed; got %v", err)
+	}
+}
+
+func TestSnippetSize(t *testing.T) {
+	defer SetSnippetSize(DefaultSnippetSize)
+	SetSnippetSize(40)
+
+	idx, err := NewIndex(t.TempDir()+"/idx", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	content := strings.Repeat("lorem ipsum dolor sit amet ", 20) + "needle " + strings.Repeat("consectetur adipiscing elit ", 20)
+	err = idx.Index("gemini://example.org/", PageDoc{Title: "Test", Content: content, PageRank: 1, HostRank: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := SearchPages(PageSearchRequest{Query: "needle", Page: 1}, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != 1 {
+		t.Fatalf("Expected one result; got %d", len(resp.Results))
+	}
+
+	snippet := resp.Results[0].Snippet
+	snippet = strings.ReplaceAll(snippet, DefaultGemHighlightBefore, "")
+	snippet = strings.ReplaceAll(snippet, DefaultGemHighlightAfter, "")
+	snippet = strings.Trim(snippet, " …")
+	if !strings.Contains(snippet, "needle") {
+		t.Fatalf("Expected snippet to contain the search term; got %q", snippet)
+	}
+	if len([]rune(snippet)) > 40 {
+		t.Fatalf("Expected snippet to be at most 40 characters; got %d: %q", len([]rune(snippet)), snippet)
+	}
+}
+
+func TestBuildPageQueryBoosts(t *testing.T) {
+	SetTitleBoost(3.5)
+	SetLinksBoost(0.5)
+	t.Cleanup(func() {
+		SetTitleBoost(DefaultTitleBoost)
+		SetLinksBoost(DefaultLinksBoost)
+	})
+
+	q := buildPageQuery("foo")
+
+	boosts := map[string]float64{}
+	should := q.Should.(*query.DisjunctionQuery)
+	for _, d := range should.Disjuncts {
+		mq := d.(*query.MatchQuery)
+		boosts[mq.Field()] = mq.Boost()
+	}
+
+	if boosts["Title"] != 3.5 {
+		t.Fatalf("Expected title boost 3.5; got %f", boosts["Title"])
+	}
+
+	if boosts["Links"] != 0.5 {
+		t.Fatalf("Expected links boost 0.5; got %f", boosts["Links"])
+	}
+
+	if boosts["Headings"] != DefaultHeadingsBoost {
+		t.Fatalf("Expected headings boost %f; got %f", DefaultHeadingsBoost, boosts["Headings"])
+	}
+
+	SetLinksBoost(0)
+	q = buildPageQuery("foo")
+	should = q.Should.(*query.DisjunctionQuery)
+	for _, d := range should.Disjuncts {
+		if d.(*query.MatchQuery).Field() == "Links" {
+			t.Fatal("Expected links not to be searched with a zero boost")
+		}
+	}
+}
+
+func TestSearchPagesAnchorText(t *testing.T) {
+	idx, err := NewIndex(t.TempDir()+"/idx", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	// the only mention of "zymurgy" is in the text of links pointing to the
+	// page
+	err = idx.Index("gemini://example.org/brewing.gmi", PageDoc{
+		Title:       "My Hobby",
+		Content:     "Notes on making beer at home.",
+		Links:       "zymurgy notes\nhome brewing",
+		PageRank:    1,
+		HostRank:    1,
+		ContentType: "text/gemini",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := PageSearchRequest{Query: "zymurgy", Page: 1}
+
+	SetLinksBoost(0)
+	t.Cleanup(func() { SetLinksBoost(DefaultLinksBoost) })
+
+	resp, err := SearchPages(req, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.TotalResults != 0 {
+		t.Fatalf("Expected no results with link texts disabled; got %d", resp.TotalResults)
+	}
+
+	SetLinksBoost(DefaultLinksBoost)
+	resp, err = SearchPages(req, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.TotalResults != 1 || resp.Results[0].Url != "gemini://example.org/brewing.gmi" {
+		t.Fatalf("Expected the page to be found by its anchor text; got %+v", resp.Results)
+	}
+}
+
+func TestBuildPageQueryTypeFilter(t *testing.T) {
+	q := buildPageQuery("Type:text/gemini foo")
+
+	must, ok := q.Must.(*query.ConjunctionQuery)
+	if !ok || len(must.Conjuncts) != 1 {
+		t.Fatalf("Expected a single must clause; got %#v", q.Must)
+	}
+
+	term, ok := must.Conjuncts[0].(*query.TermQuery)
+	if !ok || term.Term != "text/gemini" || term.Field() != "ContentType" {
+		t.Fatalf("Expected term query for text/gemini on ContentType; got %#v", must.Conjuncts[0])
+	}
+
+	// default exclusions still apply without a kind filter
+	if q.MustNot == nil {
+		t.Fatal("Expected default kind exclusions with only a type filter")
+	}
+
+	should := q.Should.(*query.DisjunctionQuery)
+	for _, d := range should.Disjuncts {
+		mq := d.(*query.MatchQuery)
+		if mq.Match != "foo" {
+			t.Fatalf("Expected the type filter to be removed from the query; got %q", mq.Match)
+		}
+	}
+}
+
+func TestSearchPagesContentTypes(t *testing.T) {
+	idx, err := NewIndex(t.TempDir()+"/idx", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	docs := map[string]string{
+		"gemini://example.org/a.gmi": "text/gemini",
+		"gemini://example.org/b.gmi": "text/gemini",
+		"gemini://example.org/c.txt": "text/plain",
+	}
+	for u, ct := range docs {
+		err = idx.Index(u, PageDoc{
+			Title:       "Gardening",
+			Content:     "all about gardening",
+			PageRank:    1,
+			HostRank:    1,
+			ContentType: ct,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := SearchPages(PageSearchRequest{Query: "gardening", Page: 1}, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []FacetCount{
+		{Term: "text/gemini", Count: 2},
+		{Term: "text/plain", Count: 1},
+	}
+	if len(resp.ContentTypes) != len(expected) {
+		t.Fatalf("Expected content types %v; got %v", expected, resp.ContentTypes)
+	}
+	for i := range expected {
+		if resp.ContentTypes[i] != expected[i] {
+			t.Fatalf("Expected content types %v; got %v", expected, resp.ContentTypes)
+		}
+	}
+
+	resp, err = SearchPages(PageSearchRequest{Query: "gardening type:text/plain", Page: 1}, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.TotalResults != 1 || resp.Results[0].Url != "gemini://example.org/c.txt" {
+		t.Fatalf("Expected only the plain text page; got %+v", resp.Results)
+	}
+}
+
+func TestSearchIndexNotReady(t *testing.T) {
+	alias := bleve.NewIndexAlias()
+	defer alias.Close()
+
+	_, err := SearchPages(PageSearchRequest{Query: "foo", Page: 1}, alias)
+	if !errors.Is(err, ErrIndexNotReady) {
+		t.Fatalf("Expected ErrIndexNotReady from empty alias; got: %v", err)
+	}
+
+	_, err = SearchPages(PageSearchRequest{Query: "foo", Page: 1}, nil)
+	if !errors.Is(err, ErrIndexNotReady) {
+		t.Fatalf("Expected ErrIndexNotReady from nil index; got: %v", err)
+	}
+
+	_, err = SearchImages(ImageSearchRequest{Query: "foo", Page: 1}, alias)
+	if !errors.Is(err, ErrIndexNotReady) {
+		t.Fatalf("Expected ErrIndexNotReady from image search; got: %v", err)
+	}
+
+	_, err = SuggestTerms("foo", alias, 5)
+	if !errors.Is(err, ErrIndexNotReady) {
+		t.Fatalf("Expected ErrIndexNotReady from suggestions; got: %v", err)
+	}
+}
+
+func TestSearchPagesHeadings(t *testing.T) {
+	idx, err := NewIndex(t.TempDir()+"/idx", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	// both pages mention the word the same number of times, but only one of
+	// them has a section about it.
+	docs := map[string]PageDoc{
+		"gemini://example.org/heading.gmi": {
+			Title:    "My garden",
+			Content:  "Composting\nI started a pile last year.",
+			Headings: "Composting",
+		},
+		"gemini://example.org/body.gmi": {
+			Title:   "My garden",
+			Content: "Composting is something I started last year.",
+		},
+	}
+	for u, doc := range docs {
+		doc.PageRank = 1
+		doc.HostRank = 1
+		err = idx.Index(u, doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q := buildPageQuery("composting")
+	s := bleve.NewSearchRequest(q)
+	results, err := idx.Search(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results.Hits) != 2 {
+		t.Fatalf("Expected 2 hits; got %d", len(results.Hits))
+	}
+	if results.Hits[0].ID != "gemini://example.org/heading.gmi" {
+		t.Fatalf("Expected page with a matching heading to rank first; got %s", results.Hits[0].ID)
+	}
+
+	hq := bleve.NewMatchQuery("composting")
+	hq.SetField("Headings")
+	results, err = idx.Search(bleve.NewSearchRequest(hq))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.Total != 1 || results.Hits[0].ID != "gemini://example.org/heading.gmi" {
+		t.Fatalf("Expected heading text to be searchable; got %v", results.Hits)
+	}
+}
+
+func TestSearchPagesCodeFilter(t *testing.T) {
+	idx, err := NewIndex(t.TempDir()+"/idx", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	docs := map[string][]string{
+		"gemini://example.org/go.gmi":     {"go"},
+		"gemini://example.org/both.gmi":   {"python", "go"},
+		"gemini://example.org/python.gmi": {"python"},
+		"gemini://example.org/none.gmi":   nil,
+	}
+	for u, langs := range docs {
+		err = idx.Index(u, PageDoc{
+			Title:     "Web Servers",
+			Content:   "writing a web server",
+			PageRank:  1,
+			HostRank:  1,
+			CodeLangs: langs,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := SearchPages(PageSearchRequest{Query: "server Code:Go", Page: 1}, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := map[string]bool{}
+	for _, r := range resp.Results {
+		found[r.Url] = true
+	}
+	if resp.TotalResults != 2 || !found["gemini://example.org/go.gmi"] || !found["gemini://example.org/both.gmi"] {
+		t.Fatalf("Expected only the pages with go code; got %+v", resp.Results)
+	}
+}
+
+func TestSearchPagesHighlightedTitle(t *testing.T) {
+	idx, err := NewIndex(t.TempDir()+"/idx", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	docs := map[string]string{
+		"gemini://example.org/garden.gmi": "My Gardening Notes",
+		"gemini://example.org/other.gmi":  "Miscellany",
+	}
+	for u, title := range docs {
+		err = idx.Index(u, PageDoc{
+			Title:    title,
+			Content:  "notes about gardening and other things",
+			PageRank: 1,
+			HostRank: 1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := SearchPages(PageSearchRequest{Query: "gardening", Page: 1}, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	titles := map[string]string{}
+	for _, r := range resp.Results {
+		titles[r.Url] = r.HighlightedTitle
+	}
+
+	expected := "My " + DefaultGemHighlightBefore + "Gardening" + DefaultGemHighlightAfter + " Notes"
+	if titles["gemini://example.org/garden.gmi"] != expected {
+		t.Fatalf("Expected highlighted title %q; got %q", expected, titles["gemini://example.org/garden.gmi"])
+	}
+
+	// no title match; the plain title is used
+	if titles["gemini://example.org/other.gmi"] != "Miscellany" {
+		t.Fatalf("Expected the plain title; got %q", titles["gemini://example.org/other.gmi"])
+	}
+}
+
+func TestSearchPagesHighlightDelimiters(t *testing.T) {
+	idx, err := NewIndex(t.TempDir()+"/idx", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	err = idx.Index("gemini://example.org/", PageDoc{
+		Title:    "Notes",
+		Content:  "notes about gardening",
+		PageRank: 1,
+		HostRank: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		before, after string
+		expected      string
+	}{
+		{"*", "*", "*gardening*"},
+		{"<b>", "</b>", "<b>gardening</b>"},
+		{"", "", DefaultGemHighlightBefore + "gardening" + DefaultGemHighlightAfter},
+		{"*", "*", "*gardening*"}, // again, after the highlighter is defined
+	}
+	for _, c := range cases {
+		resp, err := SearchPages(PageSearchRequest{
+			Query:           "gardening",
+			Page:            1,
+			HighlightBefore: c.before,
+			HighlightAfter:  c.after,
+		}, idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(resp.Results) != 1 || !strings.Contains(resp.Results[0].Snippet, c.expected) {
+			t.Fatalf("Expected %q in the snippet; got %+v", c.expected, resp.Results)
+		}
+	}
+
+	_, err = SearchPages(PageSearchRequest{
+		Query:           "gardening",
+		Page:            1,
+		HighlightBefore: strings.Repeat("*", maxHighlightDelimiterLen+1),
+	}, idx)
+	if err == nil {
+		t.Fatal("Expected an error for a too long delimiter")
+	}
+
+	// delimiters must not be able to add lines to the gemtext output
+	for _, delim := range []string{"\n=> gemini://evil.example/ ", "*\r*", "\t", "\x00"} {
+		_, err = SearchPages(PageSearchRequest{
+			Query:           "gardening",
+			Page:            1,
+			HighlightBefore: delim,
+		}, idx)
+		if err == nil {
+			t.Fatalf("Expected an error for delimiter %q", delim)
+		}
+	}
+}
+
+func TestCompactIndex(t *testing.T) {
+	idx, err := NewShardedIndex(t.TempDir()+"/idx", "test", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	// each batch creates new segments
+	for i := 0; i < 10; i++ {
+		b := newShardedBatch(idx)
+		for j := 0; j < 10; j++ {
+			err = b.Index(fmt.Sprintf("gemini://example.org/%d/%d", i, j), PageDoc{
+				Title:   "Page",
+				Content: "some content",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = b.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before, after, err := CompactIndex(context.Background(), idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if after > 2 || after > before {
+		t.Fatalf("Expected at most one segment per shard after compaction; got %d (from %d)", after, before)
+	}
+
+	n, err := idx.DocCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 100 {
+		t.Fatalf("Expected all documents to survive compaction; got %d", n)
+	}
+}
+
+func TestSearchPagesLangBoost(t *testing.T) {
+	defer SetLangBoost(0)
+
+	idx, err := NewIndex(t.TempDir()+"/idx", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	// the english page has a higher rank, so it comes first without a boost
+	content := "comment faire du pain à la maison, sans machine"
+	docs := map[string]PageDoc{
+		"gemini://example.org/en.gmi": {Title: "Pain", Content: content, Lang: "en", PageRank: 0.2, HostRank: 1},
+		"gemini://example.org/fr.gmi": {Title: "Pain", Content: content, Lang: "fr", PageRank: 0.1, HostRank: 1},
+	}
+	for u, doc := range docs {
+		err = idx.Index(u, doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	search := func() []string {
+		resp, err := SearchPages(PageSearchRequest{Query: "comment faire du pain à la maison", Page: 1}, idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var urls []string
+		for _, r := range resp.Results {
+			urls = append(urls, r.Url)
+		}
+		return urls
+	}
+
+	SetLangBoost(0)
+	urls := search()
+	if len(urls) != 2 || urls[0] != "gemini://example.org/en.gmi" {
+		t.Fatalf("Expected the higher ranked page first without a language boost; got %v", urls)
+	}
+
+	SetLangBoost(2)
+	urls = search()
+	if len(urls) != 2 || urls[0] != "gemini://example.org/fr.gmi" {
+		t.Fatalf("Expected the page in the query language first with a language boost; got %v", urls)
+	}
+}
+
+func TestDetectQueryLang(t *testing.T) {
+	if lang := detectQueryLang("comment faire du pain à la maison"); lang != "fr" {
+		t.Fatalf("Expected french to be detected; got %q", lang)
+	}
+
+	if lang := detectQueryLang("go"); lang != "" {
+		t.Fatalf("Expected no language for a single short word; got %q", lang)
+	}
+
+	if lang := detectQueryLang("go site:example.org lang:fr kind:listing"); lang != "" {
+		t.Fatalf("Expected filter tokens to be ignored; got %q", lang)
+	}
+
+	lang := detectQueryLang("comment faire du pain à la maison site:example.org")
+	if lang != "fr" {
+		t.Fatalf("Expected french to be detected next to a filter token; got %q", lang)
+	}
+}
+
+func TestExplicitLangSkipsBoost(t *testing.T) {
+	defer SetLangBoost(0)
+	SetLangBoost(2)
+
+	// the boosted query wraps the original one in a must clause
+	q := buildPageQuery("comment faire du pain à la maison")
+	if q.Must == nil {
+		t.Fatal("Expected a language boost for a french query")
+	}
+
+	q = buildPageQuery("comment faire du pain à la maison lang:en")
+	if q.Must != nil {
+		t.Fatal("Expected no language boost with an explicit lang: token")
+	}
+}
+
+func TestShardedIndex(t *testing.T) {
+	path := t.TempDir() + "/idx"
+	idx, err := NewShardedIndex(path, "test", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := newShardedBatch(idx)
+	for i := 0; i < 30; i++ {
+		u := fmt.Sprintf("gemini://example.org/%d.gmi", i)
+		err = batch.Index(u, PageDoc{
+			Title:    "Gardening",
+			Content:  "all about gardening",
+			PageRank: 1,
+			HostRank: 1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if batch.Size() != 30 {
+		t.Fatalf("Expected batch size 30; got %d", batch.Size())
+	}
+	err = batch.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shards := Shards(idx)
+	if len(shards) != 3 {
+		t.Fatalf("Expected 3 shards; got %d", len(shards))
+	}
+	for i, shard := range shards {
+		n, err := shard.DocCount()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			t.Fatalf("Expected documents in shard %d", i)
+		}
+	}
+
+	n, err := idx.DocCount()
+	if err != nil || n != 30 {
+		t.Fatalf("Expected 30 documents; got %d (err: %v)", n, err)
+	}
+
+	doc, err := idx.Document("gemini://example.org/7.gmi")
+	if err != nil || doc == nil {
+		t.Fatalf("Expected document to be found; got %v (err: %v)", doc, err)
+	}
+
+	resp, err := SearchPages(PageSearchRequest{Query: "gardening", Page: 1}, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.TotalResults != 30 {
+		t.Fatalf("Expected results from all shards; got %d", resp.TotalResults)
+	}
+
+	// term counts are added up across shards
+	dict, err := idx.FieldDictPrefix("Content", []byte("garden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := dict.Next()
+	if err != nil || entry == nil || entry.Term != "gardening" || entry.Count != 30 {
+		t.Fatalf("Expected 'gardening' with a count of 30; got %+v (err: %v)", entry, err)
+	}
+	entry, err = dict.Next()
+	if err != nil || entry != nil {
+		t.Fatalf("Expected a single term; got %+v (err: %v)", entry, err)
+	}
+	dict.Close()
+
+	err = idx.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err = OpenIndex(path, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	if len(Shards(idx)) != 3 {
+		t.Fatalf("Expected 3 shards after reopening; got %d", len(Shards(idx)))
+	}
+	n, err = idx.DocCount()
+	if err != nil || n != 30 {
+		t.Fatalf("Expected 30 documents after reopening; got %d (err: %v)", n, err)
+	}
+
+	// the search daemon adds the index to an alias of its own
+	alias := bleve.NewIndexAlias(idx)
+	resp, err = SearchPages(PageSearchRequest{Query: "gardening", Page: 1}, alias)
+	if err != nil || resp.TotalResults != 30 {
+		t.Fatalf("Expected 30 results through an alias; got %d (err: %v)", resp.TotalResults, err)
+	}
+	terms, err := SuggestTerms("gard", alias, 5)
+	if err != nil || len(terms) != 1 || terms[0] != "gardening" {
+		t.Fatalf("Expected suggestions through an alias; got %v (err: %v)", terms, err)
+	}
+}
+
+func TestNewShardedIndexSingleShard(t *testing.T) {
+	idx, err := NewShardedIndex(t.TempDir()+"/idx", "test", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	if _, ok := idx.(*ShardedIndex); ok {
+		t.Fatal("Expected a plain index for a single shard")
+	}
+}
+
+func TestIndexPageRows(t *testing.T) {
+	idx, err := NewShardedIndex(t.TempDir()+"/idx", "test", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	gcrawler.AddDomainToBlacklist("blacklisted.example.org")
+
+	produce := func(ctx context.Context, f func(row pageRow) error) error {
+		for i := 0; i < 500; i++ {
+			row := pageRow{
+				url: fmt.Sprintf("gemini://example.org/%d.gmi", i),
+				doc: PageDoc{
+					Title:    "Gardening \xff",
+					Content:  "all about gardening",
+					PageRank: 1,
+					HostRank: 1,
+				},
+				kind: sql.NullString{String: "listing", Valid: i%2 == 0},
+			}
+			if i%100 == 0 {
+				row.url = fmt.Sprintf("gemini://blacklisted.example.org/%d.gmi", i)
+			}
+
+			err := f(row)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	count, err := indexPageRows(context.Background(), idx, 7, 4, produce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 495 {
+		t.Fatalf("Expected 495 pages indexed; got %d", count)
+	}
+
+	n, err := idx.DocCount()
+	if err != nil || n != 495 {
+		t.Fatalf("Expected 495 documents in the index; got %d (err: %v)", n, err)
+	}
+
+	doc, err := idx.Document("gemini://blacklisted.example.org/100.gmi")
+	if err != nil || doc != nil {
+		t.Fatalf("Expected blacklisted page not to be indexed; got %v (err: %v)", doc, err)
+	}
+
+	resp, err := SearchPages(PageSearchRequest{Query: "gardening kind:listing", Page: 1}, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.TotalResults != 245 {
+		t.Fatalf("Expected 245 listings; got %d", resp.TotalResults)
+	}
+	if resp.Results[0].Title != "Gardening " {
+		t.Fatalf("Expected invalid utf-8 to be removed from the title; got %q", resp.Results[0].Title)
+	}
+}
+
+func TestPageCount(t *testing.T) {
+	cases := []struct {
+		total    uint64
+		expected uint64
+	}{
+		{0, 0},
+		{1, 1},
+		{PageSize, 1},
+		{PageSize + 1, 2},
+		{10 * PageSize, 10},
+	}
+
+	for _, c := range cases {
+		if n := PageCount(c.total); n != c.expected {
+			t.Errorf("PageCount(%d): expected %d; got %d", c.total, c.expected, n)
+		}
+	}
+}
+
+func TestSearchPagesMaxReportedResults(t *testing.T) {
+	defer SetMaxReportedResults(0)
+
+	idx, err := NewIndex(t.TempDir()+"/idx", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	for i := 0; i < 3*PageSize; i++ {
+		u := fmt.Sprintf("gemini://example.org/%d.gmi", i)
+		err = idx.Index(u, PageDoc{Title: fmt.Sprintf("Page %d", i), Content: "some foobar content", PageRank: 0.1, HostRank: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the cap is not a multiple of the page size, so the last viewable page
+	// is only partially covered by it.
+	SetMaxReportedResults(PageSize + 5)
+
+	resp, err := SearchPages(PageSearchRequest{Query: "foobar", Page: 1}, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.TotalResults != PageSize+5 || !resp.TotalCapped {
+		t.Fatalf("Expected a capped total of %d; got %d (capped: %v)", PageSize+5, resp.TotalResults, resp.TotalCapped)
+	}
+	if n := PageCount(resp.TotalResults); n != 2 {
+		t.Fatalf("Expected 2 pages for the capped total; got %d", n)
+	}
+
+	// the last page only shows the results within the cap, with or without
+	// collapsing.
+	for _, collapse := range []bool{false, true} {
+		resp, err = SearchPages(PageSearchRequest{Query: "foobar", Page: 2, Collapse: collapse}, idx)
+		if err != nil {
+			t.Fatal("Expected the last page within the cap to be viewable; got:", err)
+		}
+		if len(resp.Results) != 5 {
+			t.Fatalf("Expected 5 results on the last page (collapse: %v); got %d", collapse, len(resp.Results))
+		}
+	}
+
+	_, err = SearchPages(PageSearchRequest{Query: "foobar", Page: 3}, idx)
+	if !errors.Is(err, ErrPageBeyondLimit) {
+		t.Fatal("Expected ErrPageBeyondLimit for a page beyond the cap; got:", err)
+	}
+
+	// matching actually stops after the cap
+	sr := bleve.NewSearchRequest(buildPageQuery("foobar"))
+	ctx := context.WithValue(context.Background(), search.MakeDocumentMatchHandlerKey, cappedMatchHandler(10))
+	results, err := searchIndexContext(ctx, idx, sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.Total != 11 {
+		t.Fatalf("Expected matching to stop after 11 results; got %d", results.Total)
+	}
+
+	// no cap
+	SetMaxReportedResults(0)
+	resp, err = SearchPages(PageSearchRequest{Query: "foobar", Page: 3}, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.TotalResults != 3*PageSize || resp.TotalCapped {
+		t.Fatalf("Expected an uncapped total of %d; got %d (capped: %v)", 3*PageSize, resp.TotalResults, resp.TotalCapped)
+	}
+}
+
+func TestWithoutBoilerplate(t *testing.T) {
+	footer := "=> /index.gmi Home\nCopyright 2023 Example Capsule"
+	produce := func(ctx context.Context, f func(row pageRow) error) error {
+		for i := 0; i < 10; i++ {
+			row := pageRow{
+				url: fmt.Sprintf("gemini://example.org/%d.gmi", i),
+				doc: PageDoc{
+					Content: fmt.Sprintf("post number %d about gardening\n\n%s", i, footer),
+				},
+			}
+			if err := f(row); err != nil {
+				return err
+			}
+		}
+
+		// too few pages on this host to detect boilerplate
+		for i := 0; i < 2; i++ {
+			row := pageRow{
+				url: fmt.Sprintf("gemini://small.example.org/%d.gmi", i),
+				doc: PageDoc{
+					Content: fmt.Sprintf("page %d\n%s", i, footer),
+				},
+			}
+			if err := f(row); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	contents := map[string]string{}
+	err := withoutBoilerplate(produce)(context.Background(), func(row pageRow) error {
+		contents[row.url] = row.doc.Content
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(contents) != 12 {
+		t.Fatalf("Expected 12 pages; got %d", len(contents))
+	}
+
+	for i := 0; i < 10; i++ {
+		content := contents[fmt.Sprintf("gemini://example.org/%d.gmi", i)]
+		if strings.Contains(content, "Copyright") || strings.Contains(content, "Home") {
+			t.Fatalf("Expected footer to be stripped; got %q", content)
+		}
+		if !strings.Contains(content, fmt.Sprintf("post number %d about gardening", i)) {
+			t.Fatalf("Expected unique content to be kept; got %q", content)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		content := contents[fmt.Sprintf("gemini://small.example.org/%d.gmi", i)]
+		expected := fmt.Sprintf("page %d\n%s", i, footer)
+		if content != expected {
+			t.Fatalf("Expected small host to be left alone; got %q", content)
+		}
+	}
+}
+
+func TestPageRawText(t *testing.T) {
+	idx, err := NewIndex(t.TempDir()+"/idx", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	raw := "# My program\n```\n  _____\n |_   _|\n```\nfunc main() {}\n"
+	docs := map[string]PageDoc{
+		"gemini://example.org/raw.gmi": {
+			Title:   "My program",
+			Content: "My program\nfunc main() {}",
+			RawText: raw,
+		},
+		"gemini://example.org/noraw.gmi": {
+			Title:   "My other program",
+			Content: "func main() {}",
+		},
+	}
+	for u, doc := range docs {
+		doc.PageRank = 1
+		doc.HostRank = 1
+		err = idx.Index(u, doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	text, err := PageRawText(idx, "gemini://example.org/raw.gmi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != raw {
+		t.Fatalf("Expected raw text to be stored; got %q", text)
+	}
+
+	for _, u := range []string{"gemini://example.org/noraw.gmi", "gemini://example.org/missing.gmi"} {
+		text, err = PageRawText(idx, u)
+		if err != nil || text != "" {
+			t.Fatalf("Expected no raw text for %s; got %q (err: %v)", u, text, err)
+		}
+	}
+
+	// the raw text should not be searchable
+	q := bleve.NewMatchQuery("program")
+	q.SetField("RawText")
+	results, err := idx.Search(bleve.NewSearchRequest(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.Total != 0 {
+		t.Fatalf("Expected raw text not to be indexed; got %d hits", results.Total)
+	}
+}
+
+func TestPruneIndex(t *testing.T) {
+	idx, err := NewShardedIndex(t.TempDir()+"/idx", "test", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	for i := 0; i < 20; i++ {
+		doc := PageDoc{
+			Title:    "Gardening",
+			Content:  "all about gardening",
+			PageRank: 1,
+			HostRank: 1,
+		}
+		err = idx.Index(fmt.Sprintf("gemini://example.org/%d.gmi", i), doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// images are keyed by their hash, and should never be pruned
+	err = idx.Index("0123456789abcdef", ImageDoc{AltText: "a garden"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the even pages are still in the "database"
+	var checked []string
+	exist := func(ctx context.Context, urls []string) (map[string]bool, error) {
+		checked = append(checked, urls...)
+		existing := map[string]bool{}
+		for i := 0; i < 20; i += 2 {
+			existing[fmt.Sprintf("gemini://example.org/%d.gmi", i)] = true
+		}
+		return existing, nil
+	}
+
+	pruned, err := PruneIndex(context.Background(), idx, exist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 10 {
+		t.Fatalf("Expected 10 pages to be pruned; got %d", pruned)
+	}
+	if len(checked) != 20 {
+		t.Fatalf("Expected all 20 pages to be checked; got %d", len(checked))
+	}
+
+	n, err := idx.DocCount()
+	if err != nil || n != 11 {
+		t.Fatalf("Expected 11 documents left in the index; got %d (err: %v)", n, err)
+	}
+
+	for i := 0; i < 20; i++ {
+		doc, err := idx.Document(fmt.Sprintf("gemini://example.org/%d.gmi", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (doc != nil) != (i%2 == 0) {
+			t.Fatalf("Unexpected state for page %d after pruning: %v", i, doc)
+		}
+	}
+
+	// nothing left to prune
+	pruned, err = PruneIndex(context.Background(), idx, exist)
+	if err != nil || pruned != 0 {
+		t.Fatalf("Expected nothing to be pruned again; got %d (err: %v)", pruned, err)
+	}
+}
+
+func TestIndexImageRowsMaxBytes(t *testing.T) {
+	idx, err := NewShardedIndex(t.TempDir()+"/idx", "test", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	// the batch size is never reached, but every second image reaches the
+	// byte limit
+	var counts []uint64
+	produce := func(ctx context.Context, f func(row imageRow) error) error {
+		for i := 0; i < 5; i++ {
+			row := imageRow{
+				hash: fmt.Sprintf("%016x", i),
+				doc: ImageDoc{
+					AltText: "a garden",
+					Image:   strings.Repeat("x", 600),
+				},
+			}
+			err := f(row)
+			if err != nil {
+				return err
+			}
+
+			n, err := idx.DocCount()
+			if err != nil {
+				return err
+			}
+			counts = append(counts, n)
+		}
+		return nil
+	}
+
+	count, err := indexImageRows(context.Background(), idx, 100, 1000, produce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Fatalf("Expected 5 images indexed; got %d", count)
+	}
+
+	expected := []uint64{0, 2, 2, 4, 4}
+	for i := range expected {
+		if counts[i] != expected[i] {
+			t.Fatalf("Expected batches to be committed when the byte limit is reached; documents in index after each image: %v", counts)
+		}
+	}
+
+	n, err := idx.DocCount()
+	if err != nil || n != 5 {
+		t.Fatalf("Expected the last batch to be committed; got %d documents (err: %v)", n, err)
+	}
+}
+
+func TestBuildPageQuerySynonyms(t *testing.T) {
+	SetSynonyms([][]string{
+		{"gemlog", "gem log", "Gemini Log"},
+		{"smallnet", "smolnet"},
+		{"lonely"},
+	})
+	t.Cleanup(func() { SetSynonyms(nil) })
+
+	// return the synonym clauses of the query, as field:phrase => boost
+	synonymClauses := func(q *query.BooleanQuery) map[string]float64 {
+		clauses := map[string]float64{}
+		should := q.Should.(*query.DisjunctionQuery)
+		for _, d := range should.Disjuncts {
+			if phrase, ok := d.(*query.MatchPhraseQuery); ok {
+				clauses[phrase.Field()+":"+phrase.MatchPhrase] = phrase.Boost()
+			}
+		}
+		return clauses
+	}
+
+	baseline := buildPageQuery("gardening").Should.(*query.DisjunctionQuery)
+
+	q := buildPageQuery("my Gem-Log")
+	should := q.Should.(*query.DisjunctionQuery)
+	if len(should.Disjuncts) != len(baseline.Disjuncts)+4 {
+		t.Fatalf("Expected 4 additional should clauses; got %d", len(should.Disjuncts)-len(baseline.Disjuncts))
+	}
+
+	clauses := synonymClauses(q)
+	expected := map[string]float64{
+		"Content:gemlog":     DefaultSynonymBoost,
+		"Title:gemlog":       DefaultSynonymBoost * DefaultTitleBoost,
+		"Content:gemini log": DefaultSynonymBoost,
+		"Title:gemini log":   DefaultSynonymBoost * DefaultTitleBoost,
+	}
+	if len(clauses) != len(expected) {
+		t.Fatalf("Expected synonym clauses %v; got %v", expected, clauses)
+	}
+	for k, v := range expected {
+		if clauses[k] != v {
+			t.Fatalf("Expected synonym clauses %v; got %v", expected, clauses)
+		}
+	}
+
+	// multi-word terms only match as a whole
+	if clauses := synonymClauses(buildPageQuery("gem stones")); len(clauses) != 0 {
+		t.Fatalf("Expected no synonyms for a partial match; got %v", clauses)
+	}
+
+	if clauses := synonymClauses(buildPageQuery("gardening")); len(clauses) != 0 {
+		t.Fatalf("Expected no synonyms; got %v", clauses)
+	}
+
+	SetSynonymBoost(0.2)
+	t.Cleanup(func() { SetSynonymBoost(DefaultSynonymBoost) })
+	clauses = synonymClauses(buildPageQuery("smolnet kind:listing"))
+	if len(clauses) != 2 || clauses["Content:smallnet"] != 0.2 {
+		t.Fatalf("Unexpected synonym clauses: %v", clauses)
+	}
+}
+
+func TestSearchPagesSynonyms(t *testing.T) {
+	SetSynonyms([][]string{{"gemlog", "gem log"}})
+	t.Cleanup(func() { SetSynonyms(nil) })
+
+	idx, err := NewIndex(t.TempDir()+"/idx", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	docs := map[string]PageDoc{
+		"gemini://example.org/gemlog.gmi": {
+			Title:   "My gemlog",
+			Content: "Welcome to my gemlog.",
+		},
+		"gemini://example.org/other.gmi": {
+			Title:   "Gardening",
+			Content: "All about gardening.",
+		},
+	}
+	for u, doc := range docs {
+		doc.PageRank = 1
+		doc.HostRank = 1
+		err = idx.Index(u, doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := SearchPages(PageSearchRequest{Query: "gem log", Page: 1}, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.TotalResults != 1 || resp.Results[0].Url != "gemini://example.org/gemlog.gmi" {
+		t.Fatalf("Expected \"gem log\" to match the gemlog page; got %+v", resp.Results)
+	}
+}
+
+func TestSearchPagesCollapsePaging(t *testing.T) {
+	idx, err := NewIndex(t.TempDir()+"/idx", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	// ten pages with the same title on one host, which collapse into one,
+	// and thirty distinct pages.
+	for i := 0; i < 10; i++ {
+		u := fmt.Sprintf("gemini://dup.example/%d.gmi", i)
+		err = idx.Index(u, PageDoc{Title: "Same", Content: "foobar", PageRank: 0.5, HostRank: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 30; i++ {
+		u := fmt.Sprintf("gemini://example%d.org/", i)
+		doc := PageDoc{Title: fmt.Sprintf("Page %d", i), Content: "foobar", PageRank: float64(i) / 30, HostRank: 1}
+		err = idx.Index(u, doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := map[string]bool{}
+	for page := 1; page <= 3; page++ {
+		resp, err := SearchPages(PageSearchRequest{Query: "foobar", Page: page, Collapse: true}, idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.TotalResults != 31 {
+			t.Fatalf("Page %d: expected a collapsed total of 31; got %d", page, resp.TotalResults)
+		}
+
+		expected := PageSize
+		if page == 3 {
+			expected = 31 - 2*PageSize
+		}
+		if len(resp.Results) != expected {
+			t.Fatalf("Page %d: expected %d results; got %d", page, expected, len(resp.Results))
+		}
+
+		for _, r := range resp.Results {
+			if seen[r.Url] {
+				t.Fatalf("Page %d: result %s already shown on a previous page", page, r.Url)
+			}
+			seen[r.Url] = true
+
+			if strings.HasPrefix(r.Url, "gemini://dup.example/") && r.Collapsed != 9 {
+				t.Fatalf("Expected 9 results collapsed into %s; got %d", r.Url, r.Collapsed)
+			}
+		}
+	}
+
+	if PageCount(31) != 3 || len(seen) != 31 {
+		t.Fatalf("Expected 31 distinct results over 3 pages; got %d", len(seen))
+	}
+}
@@ -0,0 +1,301 @@
+package gsearch
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/mapping"
+	index "github.com/blevesearch/bleve_index_api"
+)
+
+// ShardedIndex is a set of indexes (shards) used as a single one. Documents
+// are assigned to shards by a hash of their id, and searches are run on all
+// shards (and their results merged) through an index alias.
+//
+// Batches are specific to a single shard, so documents should be indexed in
+// batches using the IndexPages/IndexImages functions, which split them across
+// the shards.
+type ShardedIndex struct {
+	bleve.IndexAlias
+	shards []bleve.Index
+}
+
+// return the path of the i'th shard of the sharded index at the given path.
+func shardPath(indexPath string, i int) string {
+	return path.Join(indexPath, fmt.Sprintf("shard-%d.idx", i))
+}
+
+func newShardedIndex(name string, shards []bleve.Index) *ShardedIndex {
+	alias := bleve.NewIndexAlias(shards...)
+	alias.SetName(name)
+	return &ShardedIndex{
+		IndexAlias: alias,
+		shards:     shards,
+	}
+}
+
+// NewShardedIndex creates a new index at the given path, with documents split
+// across the given number of shards. With less than two shards, this is the
+// same as NewIndex.
+func NewShardedIndex(indexPath string, name string, nshards int) (idx bleve.Index, err error) {
+	if nshards <= 1 {
+		return NewIndex(indexPath, name)
+	}
+
+	err = os.Mkdir(indexPath, 0755)
+	if err != nil {
+		return
+	}
+
+	shards := make([]bleve.Index, 0, nshards)
+	for i := 0; i < nshards; i++ {
+		var shard bleve.Index
+		shard, err = NewIndex(shardPath(indexPath, i), fmt.Sprintf("%s-%d", name, i))
+		if err != nil {
+			closeShards(shards)
+			return
+		}
+		shards = append(shards, shard)
+	}
+
+	idx = newShardedIndex(name, shards)
+	return
+}
+
+// return true if the index at the given path is a sharded one.
+func isShardedIndex(indexPath string) bool {
+	_, err := os.Stat(shardPath(indexPath, 0))
+	return err == nil
+}
+
+// open all the shards of the sharded index at the given path, using the given
+// function to open each one.
+func openShardedIndex(indexPath string, name string, open func(path string, name string) (bleve.Index, error)) (idx bleve.Index, err error) {
+	var shards []bleve.Index
+	for i := 0; ; i++ {
+		p := shardPath(indexPath, i)
+		if _, statErr := os.Stat(p); statErr != nil {
+			break
+		}
+
+		var shard bleve.Index
+		shard, err = open(p, fmt.Sprintf("%s-%d", name, i))
+		if err != nil {
+			closeShards(shards)
+			return
+		}
+		shards = append(shards, shard)
+	}
+
+	idx = newShardedIndex(name, shards)
+	return
+}
+
+func closeShards(shards []bleve.Index) {
+	for _, shard := range shards {
+		shard.Close()
+	}
+}
+
+// Shards returns the shards of the given index, or the index itself if it's
+// not a sharded index.
+func Shards(idx bleve.Index) []bleve.Index {
+	if sharded, ok := idx.(*ShardedIndex); ok {
+		return sharded.shards
+	}
+
+	return []bleve.Index{idx}
+}
+
+// return the number of the shard a document with the given id belongs to.
+func shardOf(id string, nshards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(nshards))
+}
+
+func (s *ShardedIndex) shardFor(id string) bleve.Index {
+	return s.shards[shardOf(id, len(s.shards))]
+}
+
+func (s *ShardedIndex) Index(id string, data interface{}) error {
+	return s.shardFor(id).Index(id, data)
+}
+
+func (s *ShardedIndex) Delete(id string) error {
+	return s.shardFor(id).Delete(id)
+}
+
+func (s *ShardedIndex) Document(id string) (index.Document, error) {
+	return s.shardFor(id).Document(id)
+}
+
+// Mapping returns the mapping of the shards, which is the same for all of them.
+func (s *ShardedIndex) Mapping() mapping.IndexMapping {
+	return s.shards[0].Mapping()
+}
+
+func (s *ShardedIndex) FieldDict(field string) (index.FieldDict, error) {
+	return s.mergeFieldDicts(func(shard bleve.Index) (index.FieldDict, error) {
+		return shard.FieldDict(field)
+	})
+}
+
+func (s *ShardedIndex) FieldDictRange(field string, startTerm []byte, endTerm []byte) (index.FieldDict, error) {
+	return s.mergeFieldDicts(func(shard bleve.Index) (index.FieldDict, error) {
+		return shard.FieldDictRange(field, startTerm, endTerm)
+	})
+}
+
+func (s *ShardedIndex) FieldDictPrefix(field string, termPrefix []byte) (index.FieldDict, error) {
+	return s.mergeFieldDicts(func(shard bleve.Index) (index.FieldDict, error) {
+		return shard.FieldDictPrefix(field, termPrefix)
+	})
+}
+
+func (s *ShardedIndex) mergeFieldDicts(get func(shard bleve.Index) (index.FieldDict, error)) (dict index.FieldDict, err error) {
+	merged := &mergedFieldDict{}
+	for _, shard := range s.shards {
+		var d index.FieldDict
+		d, err = get(shard)
+		if err != nil {
+			merged.Close()
+			return
+		}
+
+		var entry *index.DictEntry
+		entry, err = d.Next()
+		if err != nil {
+			d.Close()
+			merged.Close()
+			return
+		}
+
+		merged.dicts = append(merged.dicts, d)
+		merged.heads = append(merged.heads, entry)
+	}
+
+	dict = merged
+	return
+}
+
+// Close closes all the shards.
+func (s *ShardedIndex) Close() (err error) {
+	for _, shard := range s.shards {
+		err = errors.Join(err, shard.Close())
+	}
+
+	return errors.Join(err, s.IndexAlias.Close())
+}
+
+// a field dictionary merging the (sorted) dictionaries of all shards, adding up
+// the counts of terms present in more than one.
+type mergedFieldDict struct {
+	dicts []index.FieldDict
+
+	// the next entry of each dictionary; nil if exhausted.
+	heads []*index.DictEntry
+}
+
+func (d *mergedFieldDict) Next() (entry *index.DictEntry, err error) {
+	var term []byte
+	for _, head := range d.heads {
+		if head != nil && (term == nil || bytes.Compare([]byte(head.Term), term) < 0) {
+			term = []byte(head.Term)
+		}
+	}
+	if term == nil {
+		return
+	}
+
+	entry = &index.DictEntry{Term: string(term)}
+	for i, head := range d.heads {
+		if head == nil || head.Term != entry.Term {
+			continue
+		}
+
+		entry.Count += head.Count
+		d.heads[i], err = d.dicts[i].Next()
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (d *mergedFieldDict) Close() (err error) {
+	for _, dict := range d.dicts {
+		err = errors.Join(err, dict.Close())
+	}
+	return
+}
+
+func (d *mergedFieldDict) BytesRead() (n uint64) {
+	for _, dict := range d.dicts {
+		n += dict.BytesRead()
+	}
+	return
+}
+
+// a batch of documents for an index, split across its shards (if any).
+type shardedBatch struct {
+	shards  []bleve.Index
+	batches []*bleve.Batch
+	size    int
+}
+
+func newShardedBatch(idx bleve.Index) *shardedBatch {
+	shards := Shards(idx)
+	b := &shardedBatch{
+		shards:  shards,
+		batches: make([]*bleve.Batch, len(shards)),
+	}
+	for i, shard := range shards {
+		b.batches[i] = shard.NewBatch()
+	}
+
+	return b
+}
+
+func (b *shardedBatch) Index(id string, data interface{}) error {
+	err := b.batches[shardOf(id, len(b.shards))].Index(id, data)
+	if err != nil {
+		return err
+	}
+
+	b.size++
+	return nil
+}
+
+func (b *shardedBatch) Size() int {
+	return b.size
+}
+
+// write the batch to the shards (in parallel), and reset it.
+func (b *shardedBatch) Commit() error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(b.shards))
+	for i := range b.shards {
+		if b.batches[i].Size() == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = b.shards[i].Batch(b.batches[i])
+			b.batches[i].Reset()
+		}(i)
+	}
+	wg.Wait()
+
+	b.size = 0
+	return errors.Join(errs...)
+}
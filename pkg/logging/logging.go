@@ -0,0 +1,72 @@
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[string]Level{
+	"debug": LevelDebug,
+	"info":  LevelInfo,
+	"warn":  LevelWarn,
+	"error": LevelError,
+}
+
+var currentLevel = LevelInfo
+
+// ParseLevel converts a level name (debug, info, warn or error) to a Level.
+func ParseLevel(name string) (level Level, err error) {
+	level, ok := levelNames[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		err = fmt.Errorf("Invalid log level: %s", name)
+	}
+	return
+}
+
+// SetLevel sets the minimum level of messages that are logged. Messages with a
+// lower level are discarded.
+func SetLevel(level Level) {
+	currentLevel = level
+}
+
+// Enabled returns true if messages with the given level are logged. This can be
+// used to avoid building expensive log messages that would be discarded anyway.
+func Enabled(level Level) bool {
+	return level >= currentLevel
+}
+
+func logf(level Level, format string, args ...any) {
+	if !Enabled(level) {
+		return
+	}
+
+	// calldepth 3 so that Lshortfile (if set) reports the caller of the
+	// exported function, not this one.
+	log.Output(3, fmt.Sprintf(format, args...))
+}
+
+func Debugf(format string, args ...any) {
+	logf(LevelDebug, format, args...)
+}
+
+func Infof(format string, args ...any) {
+	logf(LevelInfo, format, args...)
+}
+
+func Warnf(format string, args ...any) {
+	logf(LevelWarn, format, args...)
+}
+
+func Errorf(format string, args ...any) {
+	logf(LevelError, format, args...)
+}
@@ -0,0 +1,27 @@
+package logging
+
+import "testing"
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel(" Warn ")
+	if err != nil || level != LevelWarn {
+		t.Fatalf("Expected LevelWarn, <nil>; got %v, %v", level, err)
+	}
+
+	_, err = ParseLevel("verbose")
+	if err == nil {
+		t.Fatal("Expected an error for an invalid level")
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	defer SetLevel(currentLevel)
+
+	SetLevel(LevelInfo)
+	if Enabled(LevelDebug) {
+		t.Fatal("Expected debug logs to be disabled at info level")
+	}
+	if !Enabled(LevelInfo) || !Enabled(LevelError) {
+		t.Fatal("Expected info and error logs to be enabled at info level")
+	}
+}
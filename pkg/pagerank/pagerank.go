@@ -19,6 +19,19 @@ type Link struct {
 	dst int64
 }
 
+// a link that counts as weight links from src to dst
+type weightedLink struct {
+	src    int64
+	dst    int64
+	weight float64
+}
+
+// a link between two hosts
+type hostLink struct {
+	src string
+	dst string
+}
+
 // Calculate pagerank given a set of links. The input "links" map, maps a node
 // id to another node id. As an example if links[1] == 2, then node 1 links to
 // node 2.
@@ -27,6 +40,17 @@ type Link struct {
 // range. The ranks are normalized so that the highest ranking node always has
 // the rank 1.0.
 func PageRank(links []Link) (ranks map[int64]float64) {
+	weighted := make([]weightedLink, len(links))
+	for i, link := range links {
+		weighted[i] = weightedLink{link.src, link.dst, 1}
+	}
+
+	return weightedPageRank(weighted)
+}
+
+// like PageRank, but each link counts as a number of links given by its
+// weight.
+func weightedPageRank(links []weightedLink) (ranks map[int64]float64) {
 	if len(links) == 0 {
 		return map[int64]float64{}
 	}
@@ -39,7 +63,7 @@ func PageRank(links []Link) (ranks map[int64]float64) {
 	nodes := map[int64]bool{}
 
 	for _, link := range links {
-		outDegree[link.src] += 1
+		outDegree[link.src] += link.weight
 
 		nodes[link.src] = true
 		nodes[link.dst] = true
@@ -62,7 +86,7 @@ func PageRank(links []Link) (ranks map[int64]float64) {
 			if link.src == link.dst { // ignore self-links
 				continue
 			}
-			newRanks[link.dst] += beta * (ranks[link.src] / outDegree[link.src])
+			newRanks[link.dst] += beta * link.weight * (ranks[link.src] / outDegree[link.src])
 		}
 
 		// We distributed 1.0 unit worth of ranks between all nodes, but some
@@ -111,33 +135,12 @@ func PageRank(links []Link) (ranks map[int64]float64) {
 func PerformPageRankOnDb(db *sql.DB) {
 	log.Println("Starting PageRank Calculation...")
 
-	links := make([]Link, 0)
-
-	log.Println("Reading links...")
-	rows, err := db.Query("select src_url_id, dst_url_id from links")
-	utils.PanicOnErr(err)
-	for rows.Next() {
-		var link Link
-		err = rows.Scan(&link.src, &link.dst)
-		utils.PanicOnErr(err)
-
-		links = append(links, link)
-	}
-
+	links := readLinks(db)
 	urlRanks := PageRank(links)
 
 	// Now we'll normalize url ranks based on the domain ranks. To do that, we
 	// first need a mapping between url ids and hostnames.
-	log.Println("Reading hostnames...")
-	rows, err = db.Query("select id, hostname from urls")
-	url2host := map[int64]string{}
-	for rows.Next() {
-		var id int64
-		var host string
-		err = rows.Scan(&id, &host)
-		utils.PanicOnErr(err)
-		url2host[id] = host
-	}
+	url2host := readUrlHosts(db)
 
 	log.Println("Calculating hostname ranks...")
 	hostRanks := getHostRanks(links, url2host)
@@ -174,60 +177,143 @@ func PerformPageRankOnDb(db *sql.DB) {
           from
              (select unnest($1::bigint[]) id, unnest($2::real[]) rank) x
           where urls.id = x.id`
-	_, err = db.Exec(q, pq.Array(ids), pq.Array(rs))
+	_, err := db.Exec(q, pq.Array(ids), pq.Array(rs))
 	utils.PanicOnErr(err)
 
+	writeHostRanks(db, hostRanks)
+
+	log.Println("Done PageRank Calculation.")
+}
+
+// Perform PageRank on the host graph only, and write host ranks to the
+// database. The host graph is read from the host_links table, which makes this
+// much faster than PerformPageRankOnDb. It can be used to refresh host ranks
+// after bulk deletions.
+func PerformHostRankOnDb(db *sql.DB) {
+	log.Println("Starting host rank calculation...")
+
+	hostLinks := readHostLinks(db)
+
+	log.Println("Calculating hostname ranks...")
+	hostRanks := rankHosts(hostLinks)
+
+	writeHostRanks(db, hostRanks)
+
+	log.Println("Done host rank calculation.")
+}
+
+func readLinks(db *sql.DB) (links []Link) {
+	links = make([]Link, 0)
+
+	log.Println("Reading links...")
+	rows, err := db.Query("select src_url_id, dst_url_id from links")
+	utils.PanicOnErr(err)
+	defer rows.Close()
+	for rows.Next() {
+		var link Link
+		err = rows.Scan(&link.src, &link.dst)
+		utils.PanicOnErr(err)
+
+		links = append(links, link)
+	}
+	utils.PanicOnErr(rows.Err())
+
+	return
+}
+
+// return a mapping between host links and their weights
+func readHostLinks(db *sql.DB) (hostLinks map[hostLink]float64) {
+	log.Println("Reading host links...")
+	rows, err := db.Query("select src_host, dst_host, weight from host_links")
+	utils.PanicOnErr(err)
+	defer rows.Close()
+	hostLinks = map[hostLink]float64{}
+	for rows.Next() {
+		var link hostLink
+		var weight float64
+		err = rows.Scan(&link.src, &link.dst, &weight)
+		utils.PanicOnErr(err)
+		hostLinks[link] = weight
+	}
+	utils.PanicOnErr(rows.Err())
+
+	return
+}
+
+// return a mapping between url ids and hostnames
+func readUrlHosts(db *sql.DB) (url2host map[int64]string) {
+	log.Println("Reading hostnames...")
+	rows, err := db.Query("select id, hostname from urls")
+	utils.PanicOnErr(err)
+	defer rows.Close()
+	url2host = map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var host string
+		err = rows.Scan(&id, &host)
+		utils.PanicOnErr(err)
+		url2host[id] = host
+	}
+	utils.PanicOnErr(rows.Err())
+
+	return
+}
+
+func writeHostRanks(db *sql.DB, hostRanks map[string]float64) {
 	log.Println("Writing host ranks to database...")
 	hostnames := make([]string, len(hostRanks))
-	rs = make([]float64, len(hostRanks))
-	i = 0
+	rs := make([]float64, len(hostRanks))
+	i := 0
 	for hostname, rank := range hostRanks {
 		hostnames[i] = hostname
 		rs[i] = rank
 		i++
 	}
-	q = `with hostranks as
+	q := `with hostranks as
              (select unnest($1::text[]) hostname, unnest($2::real[]) rank)
          insert into hosts (hostname, rank)
          select * from hostranks
          on conflict (hostname) do update
          set rank = excluded.rank`
-	_, err = db.Exec(q, pq.Array(hostnames), pq.Array(rs))
+	_, err := db.Exec(q, pq.Array(hostnames), pq.Array(rs))
 	utils.PanicOnErr(err)
-
-	log.Println("Done PageRank Calculation.")
 }
 
 func getHostRanks(urlLinks []Link, url2host map[int64]string) (hostRanks map[string]float64) {
+	// count the url links between each pair of hosts
+	hostLinks := map[hostLink]float64{}
+	for _, link := range urlLinks {
+		hostLinks[hostLink{url2host[link.src], url2host[link.dst]}]++
+	}
+
+	return rankHosts(hostLinks)
+}
+
+// calculate host ranks, given the (weighted) links between hosts.
+func rankHosts(hostLinks map[hostLink]float64) (hostRanks map[string]float64) {
 	hostRanks = map[string]float64{}
 
 	// we need to assign a node id to each hostname in order to be able to call
 	// pagerank
 	host2id := map[string]int64{}
 	id2host := map[int64]string{}
-	i := int64(0)
-	for _, host := range url2host {
-		if _, ok := host2id[host]; ok {
-			// already assigned
-			continue
+	hostId := func(host string) int64 {
+		id, ok := host2id[host]
+		if !ok {
+			id = int64(len(host2id))
+			host2id[host] = id
+			id2host[id] = host
 		}
-		host2id[host] = i
-		id2host[i] = host
-		i++
+		return id
 	}
 
-	// now create a map of host links (a host linking to another host)
-	hostLinks := make([]Link, 0)
-	for _, link := range urlLinks {
-		srcHost := url2host[link.src]
-		dstHost := url2host[link.dst]
-		srcHostId := host2id[srcHost]
-		dstHostId := host2id[dstHost]
-		hostLinks = append(hostLinks, Link{srcHostId, dstHostId})
+	links := make([]weightedLink, 0, len(hostLinks))
+	for link, weight := range hostLinks {
+		links = append(links, weightedLink{hostId(link.src), hostId(link.dst), weight})
 	}
 
 	// map the ranks back to hostnames
-	ranks := PageRank(hostLinks)
+	ranks := weightedPageRank(links)
 	for id, rank := range ranks {
 		hostname := id2host[id]
 		hostRanks[hostname] = rank